@@ -0,0 +1,193 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package hlc
+
+// Hybrid logical clock timestamps
+// A timestamp is the physical time of a write plus a logical counter ordering writes within the same nanosecond or
+// behind a clock that was seen ahead, plus the ID of the node that assigned it.  Two timestamps from any nodes always
+// compare the same way so copies of a key are resolved deterministically.
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp is a hybrid logical clock timestamp
+type Timestamp struct {
+	Wall    int64  // Physical time in unix nanoseconds
+	Logical uint32 // Counter ordering timestamps with the same physical time
+	Node    uint32 // ID of the node that assigned the timestamp, breaks ties
+}
+
+// FromTime returns the timestamp of a physical time, without logical counter or node
+func FromTime(t time.Time) Timestamp {
+	return Timestamp{Wall: t.UnixNano()}
+}
+
+// Parse parses a timestamp as formatted by String
+// A plain RFC3339 time is parsed as a timestamp without logical counter or node, like one journaled before hybrid
+// logical clocks
+func Parse(s string) (Timestamp, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 1 && len(parts) != 3 {
+		return Timestamp{}, errors.New("invalid timestamp")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return Timestamp{}, errors.New("invalid timestamp")
+	}
+
+	ts := FromTime(t)
+	if len(parts) == 1 {
+		return ts, nil
+	}
+
+	logical, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return Timestamp{}, errors.New("invalid timestamp")
+	}
+
+	node, err := strconv.ParseUint(parts[2], 16, 32)
+	if err != nil {
+		return Timestamp{}, errors.New("invalid timestamp")
+	}
+
+	ts.Logical, ts.Node = uint32(logical), uint32(node)
+	return ts, nil
+}
+
+// String formats the timestamp as <RFC3339 time with nanoseconds>/<logical>/<node in hex>
+// 2025-03-01T10:00:00.123456789Z/0/1a2b3c4d
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%s/%d/%08x", t.Time().Format(time.RFC3339Nano), t.Logical, t.Node)
+}
+
+// Time returns the physical time of the timestamp
+func (t Timestamp) Time() time.Time {
+	return time.Unix(0, t.Wall).UTC()
+}
+
+// IsZero returns true for the zero timestamp
+func (t Timestamp) IsZero() bool {
+	return t == Timestamp{}
+}
+
+// Compare returns -1 if t is before o, 1 if t is after o and 0 if they are equal
+// Physical time is compared first, then the logical counter and then the node ID
+func (t Timestamp) Compare(o Timestamp) int {
+	switch {
+	case t.Wall != o.Wall:
+		return compare(t.Wall < o.Wall)
+	case t.Logical != o.Logical:
+		return compare(t.Logical < o.Logical)
+	case t.Node != o.Node:
+		return compare(t.Node < o.Node)
+	}
+	return 0
+}
+
+// compare returns -1 if less, 1 otherwise
+func compare(less bool) int {
+	if less {
+		return -1
+	}
+	return 1
+}
+
+// Before returns true if t is before o
+func (t Timestamp) Before(o Timestamp) bool {
+	return t.Compare(o) < 0
+}
+
+// After returns true if t is after o
+func (t Timestamp) After(o Timestamp) bool {
+	return t.Compare(o) > 0
+}
+
+// NodeID returns the node ID of a node from its address
+func NodeID(address string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(address))
+	return h.Sum32()
+}
+
+// Clock assigns hybrid logical clock timestamps, each one after every timestamp it assigned or was updated with
+type Clock struct {
+	Node uint32           // ID of the node the clock assigns timestamps for
+	last Timestamp        // The last timestamp assigned
+	now  func() time.Time // Physical clock
+	lock sync.Mutex       // Guards last
+}
+
+// NewClock creates a clock assigning timestamps for a node
+func NewClock(node uint32) *Clock {
+	return &Clock{Node: node, now: time.Now}
+}
+
+// Now returns a timestamp for a local write
+func (c *Clock) Now() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if wall := c.now().UnixNano(); wall > c.last.Wall {
+		c.last = Timestamp{Wall: wall}
+	} else {
+		c.last.Logical++
+	}
+
+	c.last.Node = c.Node
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from another node and returns a timestamp after both
+func (c *Clock) Update(remote Timestamp) Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	wall := c.now().UnixNano()
+	switch {
+	case wall > c.last.Wall && wall > remote.Wall:
+		c.last = Timestamp{Wall: wall}
+	case remote.Wall > c.last.Wall:
+		c.last = Timestamp{Wall: remote.Wall, Logical: remote.Logical + 1}
+	case c.last.Wall > remote.Wall:
+		c.last.Logical++
+	default:
+		c.last.Logical = max(c.last.Logical, remote.Logical) + 1
+	}
+
+	c.last.Node = c.Node
+	return c.last
+}
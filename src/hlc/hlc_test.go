@@ -0,0 +1,130 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package hlc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompare(t *testing.T) {
+	a := Timestamp{Wall: 10, Logical: 1, Node: 2}
+
+	tests := []struct {
+		b    Timestamp
+		want int
+	}{
+		{Timestamp{Wall: 11}, -1},
+		{Timestamp{Wall: 9, Logical: 5, Node: 9}, 1},
+		{Timestamp{Wall: 10, Logical: 2}, -1},
+		{Timestamp{Wall: 10, Logical: 1, Node: 1}, 1},
+		{Timestamp{Wall: 10, Logical: 1, Node: 3}, -1},
+		{a, 0},
+	}
+
+	for _, test := range tests {
+		if got := a.Compare(test.b); got != test.want {
+			t.Errorf("Compare(%v) = %d, expected %d", test.b, got, test.want)
+		}
+	}
+
+	if !a.Before(Timestamp{Wall: 11}) || !a.After(Timestamp{Wall: 9}) || a.After(a) {
+		t.Error("Unexpected Before or After")
+	}
+}
+
+func TestStringParse(t *testing.T) {
+	ts := Timestamp{Wall: time.Date(2025, 3, 1, 10, 0, 0, 123456789, time.UTC).UnixNano(), Logical: 7, Node: 0x1a2b3c4d}
+
+	if s := ts.String(); s != "2025-03-01T10:00:00.123456789Z/7/1a2b3c4d" {
+		t.Fatalf("Unexpected string %s", s)
+	}
+
+	parsed, err := Parse(ts.String())
+	if err != nil || parsed != ts {
+		t.Fatalf("Expected %v, got %v %v", ts, parsed, err)
+	}
+
+	// Plain times have no logical counter or node
+	parsed, err = Parse("2025-03-01T10:00:00Z")
+	if err != nil || parsed != FromTime(time.Date(2025, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected plain time %v %v", parsed, err)
+	}
+
+	for _, invalid := range []string{"", "yesterday", "2025-03-01T10:00:00Z/1", "2025-03-01T10:00:00Z/x/1", "2025-03-01T10:00:00Z/1/zz"} {
+		if _, err := Parse(invalid); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	wall := time.Unix(100, 0)
+	c := NewClock(1)
+	c.now = func() time.Time { return wall }
+
+	first := c.Now()
+	if first != (Timestamp{Wall: wall.UnixNano(), Node: 1}) {
+		t.Fatalf("Unexpected first timestamp %v", first)
+	}
+
+	// The physical clock did not move, the logical counter does
+	second := c.Now()
+	if !second.After(first) || second.Logical != 1 {
+		t.Fatalf("Expected logical counter 1, got %v", second)
+	}
+
+	// A clock seen ahead moves this one ahead
+	remote := Timestamp{Wall: wall.Add(time.Second).UnixNano(), Logical: 4, Node: 2}
+	updated := c.Update(remote)
+	if updated.Wall != remote.Wall || updated.Logical != 5 || updated.Node != 1 {
+		t.Fatalf("Unexpected updated timestamp %v", updated)
+	}
+
+	if next := c.Now(); !next.After(remote) {
+		t.Fatalf("Expected %v after %v", next, remote)
+	}
+
+	// Once the physical clock passes, the counter resets
+	wall = wall.Add(2 * time.Second)
+	if next := c.Now(); next != (Timestamp{Wall: wall.UnixNano(), Node: 1}) {
+		t.Fatalf("Unexpected timestamp %v", next)
+	}
+
+	// A remote timestamp behind leaves physical time alone
+	if next := c.Update(Timestamp{Wall: 1}); next.Wall != wall.UnixNano() || next.Logical != 1 {
+		t.Fatalf("Unexpected timestamp %v", next)
+	}
+}
+
+func TestNodeID(t *testing.T) {
+	if NodeID("localhost:4001") != NodeID("localhost:4001") || NodeID("localhost:4001") == NodeID("localhost:4002") {
+		t.Error("Expected node IDs to be stable and distinct")
+	}
+}
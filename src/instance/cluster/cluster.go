@@ -35,13 +35,26 @@ import (
 	"encoding/base64"
 	"fmt"
 	"gopkg.in/yaml.v3"
-	"log"
 	"log/slog"
+	"math"
 	"net"
 	"os"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"supermassive/hlc"
 	"supermassive/network/client"
 	"supermassive/network/server"
+	"supermassive/query"
+	"supermassive/slots"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/fulltext"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/vector"
+	"supermassive/storage/versions"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -50,19 +63,42 @@ import (
 // ConfigFile is cluster config name
 const ConfigFile = ".cluster"
 
+// MigrateBatchSize is how many keys MIGRATE moves off a shard at a time
+const MigrateBatchSize = 1000
+
+// QueuePollInterval is how often primary nodes are polled for ready jobs on a blocking reserve
+const QueuePollInterval = 100 * time.Millisecond
+
+// CatchUpTimeout is how long FAILOVER waits for a read replica to apply the last write journaled by its primary node
+const CatchUpTimeout = 10 * time.Second
+
 // The cluster runs a server and has many client connections to nodes and their read replicas.
 
 // Config is the cluster configurations
 type Config struct {
-	HealthCheckInterval int            `yaml:"health-check-interval"` // Health check interval
-	ServerConfig        *server.Config `yaml:"server-config"`         // Cluster server configs
-	NodeConfigs         []*NodeConfig  `yaml:"node-configs"`          // Node configurations
+	HealthCheckInterval int               `yaml:"health-check-interval"` // Health check interval
+	ServerConfig        *server.Config    `yaml:"server-config"`         // Cluster server configs
+	NodeConfigs         []*NodeConfig     `yaml:"node-configs"`          // Node configurations
+	PlacementWeights    *PlacementWeights `yaml:"placement-weights"`     // How much the load of a node counts when placing new keys and jobs
+	FailoverAfter       int               `yaml:"failover-after"`        // Failed health checks of a primary node before a read replica is promoted, 0 never fails over
+	MaxReplicaLag       int               `yaml:"max-replica-lag"`       // Milliseconds a read replica can lag behind its primary node and still serve reads, 0 for no limit
+}
+
+// PlacementWeights are the weights of the load of a node when placing new keys and jobs, 0 ignores a measure
+type PlacementWeights struct {
+	Memory  float64 `yaml:"memory"`  // Weight of the memory used as a fraction of the node's max memory threshold
+	Keys    float64 `yaml:"keys"`    // Weight of the key count relative to the node with the most keys
+	Latency float64 `yaml:"latency"` // Weight of the health check latency relative to the slowest node
 }
 
+// DefaultPlacementWeights are used when the config has no placement weights, only memory counts
+var DefaultPlacementWeights = &PlacementWeights{Memory: 1}
+
 // NodeConfig is the configuration for a node within cluster
 type NodeConfig struct {
 	Node     *client.Config   // Node server configs
 	Replicas []*client.Config // Read replica configs
+	Slots    string           // Hash slots owned by the node, like 0-8191
 }
 
 // Cluster is the main struct for the cluster
@@ -74,7 +110,12 @@ type Cluster struct {
 	NodeConnectionsLock *sync.RWMutex     // Is the node connections lock
 	Logger              *slog.Logger      // Is the logger for the cluster
 	SharedKey           string            // Is the shared key for the cluster
-	Sequence            atomic.Int32      // Is the sequence for writes to primary nodes
+	Slots               *slots.Table      // Is the owner of each hash slot
+	Rebalance           *Rebalance        // Is the last slot rebalance, nil if there was none
+	Decommissioning     atomic.Bool       // Is true while the keys of a decommissioned primary node are moved
+	Sequence            atomic.Int32      // Is the sequence of the primary node after the last one placed a write
+	ReserveSequence     atomic.Int32      // Is the sequence for the first primary node tried when reserving jobs
+	MaxReplicaLag       atomic.Int64      // Is the max replica lag of the config, set with the config so reads holding connection locks need not take the config lock
 	Username            string            // Is the cluster user username to access through client
 	Password            string            // Is the cluster user password to access through client
 	Wd                  string            // Is the working directory
@@ -89,6 +130,27 @@ type NodeConnection struct {
 	Context  context.Context      // Is the context for the node
 	Config   *NodeConfig          // Is the node configuration
 	Lock     *sync.Mutex          // Is the lock for the node connection
+	Load     NodeLoad             // Is the load of the node, guarded by the cluster lock
+	Failures int                  // Is the number of health checks failed in a row
+}
+
+// NodeLoad is the load of a primary node gathered by health checks and its share of new keys and jobs
+type NodeLoad struct {
+	Memory   float64       // Is the memory used as a percentage of the node's max memory threshold
+	Keys     int64         // Is the number of keys on the node
+	Latency  time.Duration // Is the round trip time of the last health check
+	Measured bool          // Is true once the load was gathered
+	Weight   float64       // Is the placement weight of the node
+	Current  float64       // Is the smooth weighted round-robin counter of the node
+	Placed   int64         // Is the number of writes placed on the node
+}
+
+// weight returns the placement weight of the node, 1 until its load is measured
+func (l *NodeLoad) weight() float64 {
+	if !l.Measured {
+		return 1
+	}
+	return l.Weight
 }
 
 // ReplicaConnection is a connection to a nodes read replica
@@ -98,6 +160,42 @@ type ReplicaConnection struct {
 	Context context.Context // Is the context for the read replica
 	Config  *client.Config  // Is the read replica configuration
 	Lock    *sync.Mutex     // Is the lock for the read replica connection
+	Lag     ReplicaLag      // Is the lag of the read replica behind its primary node, guarded by the replica connection lock
+}
+
+// ReplicaLag is how far a read replica is behind its primary node as reported to the last health check
+type ReplicaLag struct {
+	Applied  uint64        // Is the sequence number of the last write of the primary node the replica applied
+	Entries  uint64        // Is the number of writes the replica is behind
+	Behind   time.Duration // Is how long ago the oldest write the replica is missing was relayed
+	At       time.Time     // Is when the lag was measured
+	Measured bool          // Is true once the lag was gathered
+}
+
+// current returns how far behind the read replica is now, a replica missing writes or out of contact with its primary
+// node falls further behind after it was measured
+func (l *ReplicaLag) current() time.Duration {
+	if l.Entries == 0 && l.Behind == 0 {
+		return 0
+	}
+	return l.Behind + time.Since(l.At)
+}
+
+// Rebalance is the move of slots between primary nodes after their owners changed
+// Keys are routed to the new owners as soon as the move starts.  A key still on its old owner is pulled to its new
+// owner before a command on the key runs, the rest are streamed in the background
+type Rebalance struct {
+	Moves []*SlotMove // Are the slots moving by source and target
+}
+
+// SlotMove is a set of slots moving from one primary node to another
+type SlotMove struct {
+	Source *NodeConnection // Is the connection to the node the slots move from
+	Target string          // Is the address of the node the slots move to
+	Ranges slots.Ranges    // Are the slots moving
+	Keys   atomic.Int64    // Is the number of keys moved
+	Done   atomic.Bool     // Is true once the move ended
+	Failed atomic.Bool     // Is true if keys were left on the source
 }
 
 // ServerConnectionHandler is the handler for the server connections
@@ -125,7 +223,7 @@ func New(logger *slog.Logger, sharedKey, username, password string) (*Cluster, e
 		return nil, fmt.Errorf("logger is required")
 	}
 
-	return &Cluster{Logger: logger, SharedKey: sharedKey, Username: username, Password: password, Sequence: atomic.Int32{}, ConfigLock: &sync.RWMutex{}, NodeConnectionsLock: &sync.RWMutex{}, Lock: &sync.RWMutex{}}, nil
+	return &Cluster{Logger: logger, SharedKey: sharedKey, Username: username, Password: password, ConfigLock: &sync.RWMutex{}, NodeConnectionsLock: &sync.RWMutex{}, Lock: &sync.RWMutex{}}, nil
 }
 
 // Open opens a new cluster instance
@@ -156,8 +254,24 @@ func (c *Cluster) Open() error {
 
 	}
 
+	// Every slot must have an owner, the slots of a config without any are split evenly between its nodes
+	table, assigned, err := assignSlots(conf)
+	if err != nil {
+		return err
+	}
+
+	if assigned {
+		err = saveConfigFile(wd, conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Slots = table
+
 	// Set the cluster configuration
 	c.Config = conf
+	c.MaxReplicaLag.Store(int64(conf.MaxReplicaLag))
 
 	c.Wd = wd
 
@@ -207,46 +321,25 @@ func (c *Cluster) backgroundHealthChecks() {
 	for {
 		select {
 		case <-ticker.C:
+			// Primary nodes failing their health checks too many times in a row, failed over once the checks are done
+			var failing []*NodeConnection
+
 			for _, nodeConn := range c.NodeConnections {
 				// We read lock the node connection
 				nodeConn.Lock.Lock()
 
 				if !nodeConn.Health {
 					c.Logger.Warn("node is unhealthy", "node", nodeConn.Config.Node.ServerAddress)
-					if nodeConn.Context == nil {
-						nodeConn.Context = context.Background()
-					}
-					if nodeConn.Client == nil {
-						nodeConn.Client = client.New(nodeConn.Config.Node, c.Logger)
-					}
-
-					if err := nodeConn.Client.Connect(nodeConn.Context); err != nil {
-						c.Logger.Warn("node connection error", "error", err)
-					} else {
-
-						sharedKeyHash := sha256.Sum256([]byte(c.SharedKey))
-
-						err := nodeConn.Client.Send(nodeConn.Context, []byte(fmt.Sprintf("NAUTH %x\r\n", sharedKeyHash)))
-						if err != nil {
-							c.Logger.Warn("authentication error", "error", err)
-						} else {
-							response, err := nodeConn.Client.Receive(nodeConn.Context)
-							log.Println(string(response))
-							if err != nil || string(response) != "OK authenticated\r\n" {
-								c.Logger.Warn("authentication error", "error", err)
-							} else {
-								nodeConn.Health = true
-								c.Logger.Info("node is reconnected and healthy", "node", nodeConn.Config.Node.ServerAddress)
-							}
-						}
-					}
+					c.connectNode(nodeConn)
 				} else {
 					// We create a temp connection to the replica using a new client
 					tempClient := client.New(nodeConn.Client.Config, c.Logger)
 					if err := tempClient.Connect(nodeConn.Context); err != nil {
 						c.Logger.Warn("node connection error", "error", err)
+						nodeConn.Health = false
 					} else {
 
+						start := time.Now()
 						err := tempClient.Send(nodeConn.Context, []byte("PING\r\n"))
 						if err != nil {
 							nodeConn.Health = false
@@ -266,12 +359,32 @@ func (c *Cluster) backgroundHealthChecks() {
 							}
 
 							tempClient.Close()
+
+							if nodeConn.Health {
+								c.gatherLoad(nodeConn, time.Since(start))
+							}
 						}
 					}
 
 				}
 
-				for _, replicaConn := range nodeConn.Replicas {
+				if nodeConn.Health {
+					nodeConn.Failures = 0
+				} else {
+					nodeConn.Failures++
+					if c.Config.FailoverAfter > 0 && nodeConn.Failures >= c.Config.FailoverAfter {
+						failing = append(failing, nodeConn)
+					}
+				}
+
+				// Replicas are checked without holding the node connection, reads and writes to a healthy
+				// primary node don't wait on reconnecting to a down replica such as a failed over node
+				replicas := append([]*ReplicaConnection(nil), nodeConn.Replicas...)
+
+				// Unlock the node connection
+				nodeConn.Lock.Unlock()
+
+				for _, replicaConn := range replicas {
 					// We acquire the lock for the replica connection
 					replicaConn.Lock.Lock()
 
@@ -304,6 +417,13 @@ func (c *Cluster) backgroundHealthChecks() {
 							}
 							replicaConn.Health = true
 							c.Logger.Info("replica is reconnected and healthy", "replica", replicaConn.Config.ServerAddress)
+
+							// A failed primary node coming back is still a node until it rejoins as a read replica
+							c.rejoin(replicaConn)
+
+							if replicaConn.Health {
+								c.gatherLag(replicaConn)
+							}
 						}
 
 						// Unlock the replica connection
@@ -342,1440 +462,4629 @@ func (c *Cluster) backgroundHealthChecks() {
 
 						tempClient.Close()
 
+						if replicaConn.Health {
+							c.gatherLag(replicaConn)
+						}
+
 						replicaConn.Lock.Unlock()
 
 					}
 				}
+			}
 
-				// Unlock the node connection
-				nodeConn.Lock.Unlock()
+			for _, nodeConn := range failing {
+				c.failover(nodeConn)
+			}
+
+			c.updateWeights()
+			c.rebalanceByLoad()
+		}
+	}
+}
+
+// connectNode connects to a primary node and authenticates, the node is healthy once it did
+// The caller holds the node connection lock
+func (c *Cluster) connectNode(nodeConn *NodeConnection) {
+	if nodeConn.Context == nil {
+		nodeConn.Context = context.Background()
+	}
+	if nodeConn.Client == nil {
+		nodeConn.Client = client.New(nodeConn.Config.Node, c.Logger)
+	}
+
+	if err := nodeConn.Client.Connect(nodeConn.Context); err != nil {
+		c.Logger.Warn("node connection error", "error", err)
+	} else {
+
+		sharedKeyHash := sha256.Sum256([]byte(c.SharedKey))
+
+		err := nodeConn.Client.Send(nodeConn.Context, []byte(fmt.Sprintf("NAUTH %x\r\n", sharedKeyHash)))
+		if err != nil {
+			c.Logger.Warn("authentication error", "error", err)
+		} else {
+			response, err := nodeConn.Client.Receive(nodeConn.Context)
+			if err != nil || string(response) != "OK authenticated\r\n" {
+				c.Logger.Warn("authentication error", "error", err)
+			} else {
+				nodeConn.Health = true
+				c.Logger.Info("node is reconnected and healthy", "node", nodeConn.Config.Node.ServerAddress)
 			}
 		}
 	}
 }
 
-// Close closes the cluster instance gracefully
-func (c *Cluster) Close() error {
-	// We close the server
-	err := c.Server.Shutdown()
+// rejoin demotes a read replica that answers as a primary node, such as a primary node coming back after a failover
+// The node restarts as a read replica and is synced from the new primary, it is reconnected by the next health check.
+// The caller holds the replica connection lock
+func (c *Cluster) rejoin(replicaConn *ReplicaConnection) {
+	err := replicaConn.Client.Send(replicaConn.Context, []byte("ROLE\r\n"))
 	if err != nil {
-		return err
+		c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
+		return
 	}
 
-	// Close all the node connections
-	for _, nodeConn := range c.NodeConnections {
-		if nodeConn.Client != nil {
-			if nodeConn.Health {
-				err = nodeConn.Client.Close()
-				if err != nil {
-					return err
-				}
+	rec, err := replicaConn.Client.ReceiveLine(replicaConn.Context)
+	if err != nil || string(rec) != "OK primary\r\n" {
+		return
+	}
 
-				// Check for read replicas
-				for _, replica := range nodeConn.Replicas {
-					if replica.Client != nil {
-						if replica.Health {
-							err = replica.Client.Close()
-							if err != nil {
-								return err
-							}
-						}
-					}
+	err = replicaConn.Client.Send(replicaConn.Context, []byte("DEMOTE\r\n"))
+	if err != nil {
+		c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
+		return
+	}
 
-				}
+	rec, err = replicaConn.Client.ReceiveLine(replicaConn.Context)
+	if err != nil || string(rec) != "OK demoted\r\n" {
+		c.Logger.Warn("demote error", "error", err, "response", string(rec), "replica", replicaConn.Config.ServerAddress)
+	} else {
+		c.Logger.Info("node demoted to read replica", "replica", replicaConn.Config.ServerAddress)
+	}
+
+	// Reads are not served by the node while it is not a read replica
+	replicaConn.Health = false
+	replicaConn.Client.Close()
+}
+
+// failover promotes the healthy read replica furthest along in its journal in place of a primary node failing its
+// health checks.  The failed node rejoins as a read replica when it comes back, the next health check connects to the
+// promoted node once it is open
+func (c *Cluster) failover(nodeConn *NodeConnection) {
+	c.ConfigLock.Lock()
+	defer c.ConfigLock.Unlock()
+
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
+
+	nodeConn.Lock.Lock()
+	defer nodeConn.Lock.Unlock()
+
+	// The node came back or was removed while we waited for the locks
+	if nodeConn.Health || !slices.Contains(c.NodeConnections, nodeConn) {
+		return
+	}
+
+	address := nodeConn.Config.Node.ServerAddress
+
+	promoted, seq := c.furthestReplica(nodeConn)
+	if promoted == nil {
+		c.Logger.Warn("no healthy read replica to promote", "node", address)
+		return
+	}
+
+	err := c.promote(nodeConn, promoted)
+	if err != nil {
+		c.Logger.Warn("promote error", "error", err, "node", address, "replica", promoted.Config.ServerAddress)
+		return
+	}
+
+	c.Logger.Info("primary node failed over", "node", address, "promoted", promoted.Config.ServerAddress, "journal_seq", seq)
+}
+
+// furthestReplica returns the healthy read replica of a primary node furthest along in its journal with the sequence
+// number of the last write it applied, nil if no replica is healthy
+// The caller holds the node connection lock
+func (c *Cluster) furthestReplica(nodeConn *NodeConnection) (*ReplicaConnection, uint64) {
+	var furthest *ReplicaConnection
+	var furthestSeq uint64
+	for _, replicaConn := range nodeConn.Replicas {
+		replicaConn.Lock.Lock()
+		if replicaConn.Health {
+			if seq, err := c.journalPosition(replicaConn); err == nil && (furthest == nil || seq > furthestSeq) {
+				furthest, furthestSeq = replicaConn, seq
 			}
+		}
+		replicaConn.Lock.Unlock()
+	}
+
+	return furthest, furthestSeq
+}
+
+// journalPosition returns the sequence number of the last write of its primary node a read replica applied
+// The caller holds the replica connection lock
+func (c *Cluster) journalPosition(replicaConn *ReplicaConnection) (uint64, error) {
+	// OK <sequence number>
+	rec := c.sendReplica(replicaConn, []byte("JOURNALPOS\r\n"))
+
+	var seq uint64
+	if _, err := fmt.Sscanf(string(rec), "OK %d", &seq); err != nil {
+		return 0, fmt.Errorf("invalid journal position %q", strings.TrimSpace(string(rec)))
+	}
+
+	return seq, nil
+}
 
+// promote sends PROMOTE to a read replica of a primary node with the configs of the other read replicas and of the
+// node, which is kept as a read replica.  The replica owns the slots of the node from then on and the config is saved,
+// the connection is left unhealthy until it is connected to the promoted node.
+// The caller holds the config, node connections and node connection locks
+func (c *Cluster) promote(nodeConn *NodeConnection, promoted *ReplicaConnection) error {
+	address := nodeConn.Config.Node.ServerAddress
+
+	err := c.handOver(nodeConn, promoted, c.Config.HealthCheckInterval)
+	if err != nil {
+		return err
+	}
+
+	return c.reassign(nodeConn, address)
+}
+
+// handOver sends PROMOTE to a read replica of a primary node with the configs of the other read replicas and of the
+// node, which is kept as a read replica, and the health check interval.  The connection is pointed at the promoted
+// node and left unhealthy until it is connected, the config is left to reassign
+// The caller holds the node connection lock
+func (c *Cluster) handOver(nodeConn *NodeConnection, promoted *ReplicaConnection, interval int) error {
+	// The promoted node writes to the other read replicas and to the failed node once it rejoined
+	var replicas []*ReplicaConnection
+	var replicaConfigs []*client.Config
+	for _, replicaConn := range nodeConn.Replicas {
+		if replicaConn != promoted {
+			replicas = append(replicas, replicaConn)
+			replicaConfigs = append(replicaConfigs, replicaConn.Config)
 		}
 	}
+	replicas = append(replicas, &ReplicaConnection{Config: nodeConn.Config.Node, Lock: &sync.Mutex{}})
+	replicaConfigs = append(replicaConfigs, nodeConn.Config.Node)
+
+	// The replica configs go as they are in the cluster config so the promoted node keeps their TLS and timeouts
+	data, err := yaml.Marshal(replicaConfigs)
+	if err != nil {
+		return err
+	}
+
+	promoted.Lock.Lock()
+	rec := c.sendReplica(promoted, []byte(fmt.Sprintf("PROMOTE %d %s\r\n", interval, base64.StdEncoding.EncodeToString(data))))
+	promoted.Health = false
+	promoted.Client.Close()
+	promoted.Lock.Unlock()
+
+	if string(rec) != "OK promoted\r\n" {
+		return fmt.Errorf("unexpected response %q", strings.TrimSpace(string(rec)))
+	}
+
+	if nodeConn.Client != nil {
+		nodeConn.Client.Close()
+	}
+	nodeConn.Client = client.New(promoted.Config, c.Logger)
+	nodeConn.Replicas = replicas
+	nodeConn.Health = false
+	nodeConn.Failures = 0
+
+	c.Lock.Lock()
+	nodeConn.Load = NodeLoad{}
+	c.Lock.Unlock()
 
 	return nil
 }
 
-// openExistingConfigFile opens an existing cluster config file
-func openExistingConfigFile(wd string) (*Config, error) {
+// reassign gives the slots of the primary node with the address to the node its connection was handed over to and
+// saves the config
+// The caller holds the config, node connections and node connection locks
+func (c *Cluster) reassign(nodeConn *NodeConnection, address string) error {
+	promoted := nodeConn.Client.Config
 
-	// If it exists, we read the config file
-	f, err := os.Open(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), ConfigFile))
-	if err != nil {
-		return nil, err
+	replicaConfigs := make([]*client.Config, 0, len(nodeConn.Replicas))
+	for _, replicaConn := range nodeConn.Replicas {
+		replicaConfigs = append(replicaConfigs, replicaConn.Config)
 	}
 
-	defer f.Close()
+	// The promoted node owns the slots of the failed node
+	owned := make(map[string]slots.Ranges)
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		owned[nodeConfig.Node.ServerAddress] = c.Slots.Ranges(nodeConfig.Node.ServerAddress)
+	}
+	owned[promoted.ServerAddress] = owned[address]
+	delete(owned, address)
 
-	// We decode the config file
-	decoder := yaml.NewDecoder(f)
-	config := &Config{}
-	err = decoder.Decode(config)
+	table, err := slots.NewTable(owned)
+	if err != nil {
+		return err
+	}
+
+	nodeConfig := &NodeConfig{Node: promoted, Replicas: replicaConfigs, Slots: owned[promoted.ServerAddress].String()}
+	for i := range c.Config.NodeConfigs {
+		if c.Config.NodeConfigs[i].Node.ServerAddress == address {
+			c.Config.NodeConfigs[i] = nodeConfig
+		}
+	}
+	c.Slots = table
+	nodeConn.Config = nodeConfig
 
+	err = saveConfigFile(c.Wd, c.Config)
 	if err != nil {
-		return nil, err
+		c.Logger.Warn("error saving config", "error", err)
 	}
 
-	return config, nil
+	return nil
 }
 
-// createDefaultConfigFile creates a default cluster config file
-func createDefaultConfigFile(wd string) (*Config, error) {
-	// We create the default cluster config file
-	f, err := os.Create(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), ConfigFile))
+// Failover runs a FAILOVER <node> [TO <replica>] command, switching a healthy primary node over to one of its read
+// replicas for maintenance.  Writes to the node wait while the replica, the one given or the one furthest along in its
+// journal, catches up to the last write journaled by the node.  The node is then demoted to a read replica and the replica
+// promoted in its place, the writes waiting go to the promoted node once it is connected
+func (c *Cluster) Failover(command []byte) ([]byte, error) {
+	fields := strings.Fields(string(command))
+	if (len(fields) != 2 && len(fields) != 4) || (len(fields) == 4 && fields[2] != "TO") {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	nodeConn, err := c.failoverNode(fields[1])
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	config := &Config{
-		HealthCheckInterval: 2,
-		ServerConfig: &server.Config{
-			Address:     "localhost:4000",
-			UseTLS:      false,
-			CertFile:    "/",
-			KeyFile:     "/",
-			ReadTimeout: 10,
-			BufferSize:  1024,
-		},
-		NodeConfigs: []*NodeConfig{
-			{
-				Node: &client.Config{
+	c.ConfigLock.RLock()
+	interval := c.Config.HealthCheckInterval
+	c.ConfigLock.RUnlock()
 
-					ServerAddress:  "localhost:4001",
-					UseTLS:         false,
-					ConnectTimeout: 5,
-					WriteTimeout:   5,
-					ReadTimeout:    5,
-					MaxRetries:     3,
-					RetryWaitTime:  1,
-					BufferSize:     1024,
-				},
-				Replicas: []*client.Config{
-					{
-						ServerAddress:  "localhost:4002",
-						UseTLS:         false,
-						ConnectTimeout: 5,
-						WriteTimeout:   5,
-						ReadTimeout:    5,
-						MaxRetries:     3,
-						RetryWaitTime:  1,
-						BufferSize:     1024,
-					},
-				},
-			},
-		},
+	// Writes to the node wait on its connection until the promoted node is connected, only the connection is locked
+	// while the replica catches up so other nodes keep serving
+	nodeConn.Lock.Lock()
+	replicaConn, position, err := c.catchUp(nodeConn, fields)
+	if err != nil {
+		nodeConn.Lock.Unlock()
+		return nil, err
 	}
 
-	// We marshal the config to yaml
-	data, err := yaml.Marshal(config)
+	rec, err := c.sendToNode(nodeConn, []byte("DEMOTE\r\n"))
+	if err == nil && string(rec) != "OK demoted\r\n" {
+		err = fmt.Errorf("unexpected response %q", strings.TrimSpace(string(rec)))
+	}
 	if err != nil {
+		nodeConn.Lock.Unlock()
 		return nil, err
 	}
 
-	// We write the config to the file
-	_, err = f.Write(data)
+	// A node demoted without a promoted replica is failed over by the health checks
+	err = c.handOver(nodeConn, replicaConn, interval)
 	if err != nil {
+		nodeConn.Health = false
+		nodeConn.Lock.Unlock()
 		return nil, err
 	}
 
-	return config, nil
-}
+	c.connectPromoted(nodeConn)
+	nodeConn.Lock.Unlock()
 
-// HandleConnection handles the server connections
-func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
-	// Create a buffer for receiving data
-	buffer := make([]byte, h.BufferSize)
-	var tempBuffer []byte // Temporary buffer to store data (larger than buffer)
+	c.ConfigLock.Lock()
+	defer c.ConfigLock.Unlock()
+
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
+
+	nodeConn.Lock.Lock()
+	defer nodeConn.Lock.Unlock()
+
+	// The slots of a node removed while it was handed over are not given to the promoted node
+	if !slices.Contains(c.NodeConnections, nodeConn) || nodeConn.Config.Node.ServerAddress != fields[1] {
+		return nil, fmt.Errorf("node changed during switchover")
+	}
 
-	authenticated := false // Whether client is authenticated to the cluster
+	err = c.reassign(nodeConn, fields[1])
+	if err != nil {
+		return nil, err
+	}
+
+	c.Logger.Info("primary node switched over", "node", fields[1], "promoted", replicaConn.Config.ServerAddress, "journal_seq", position)
 
+	return []byte(fmt.Sprintf("OK switched over to %s\r\n", replicaConn.Config.ServerAddress)), nil
+}
+
+// connectPromoted connects to a promoted node once it restarted as a primary node, giving up after CatchUpTimeout when
+// the health checks connect to it
+// The caller holds the node connection lock
+func (c *Cluster) connectPromoted(nodeConn *NodeConnection) {
+	deadline := time.Now().Add(CatchUpTimeout)
 	for {
-		_ = conn.SetReadDeadline(time.Time{}) // Disable read deadline
-		n, err := conn.Read(buffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				h.Cluster.Logger.Warn("connection timeout", "remote_addr", conn.RemoteAddr())
-			} else {
-				h.Cluster.Logger.Warn("read error", "error", err, "remote_addr", conn.RemoteAddr())
-			}
+		c.connectNode(nodeConn)
+		if nodeConn.Health || time.Now().After(deadline) {
 			return
 		}
 
-		// Append the read data to the temporary buffer
-		tempBuffer = append(tempBuffer, buffer[:n]...)
+		time.Sleep(QueuePollInterval)
+	}
+}
+
+// failoverNode returns the connection to the primary node with the address for a switchover
+func (c *Cluster) failoverNode(address string) (*NodeConnection, error) {
+	c.NodeConnectionsLock.RLock()
+	defer c.NodeConnectionsLock.RUnlock()
+
+	i := slices.IndexFunc(c.NodeConnections, func(nodeConn *NodeConnection) bool {
+		return nodeConn.Config.Node.ServerAddress == address
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("node not found")
+	}
+
+	if c.Rebalance.Active() {
+		return nil, fmt.Errorf("rebalance in progress")
+	}
+
+	return c.NodeConnections[i], nil
+}
+
+// catchUp waits until the read replica of a FAILOVER command applied every write the primary node journaled
+// Returns the replica and the journal sequence number it caught up to, the caller holds the node connection lock
+func (c *Cluster) catchUp(nodeConn *NodeConnection, fields []string) (*ReplicaConnection, uint64, error) {
+	if !nodeConn.Health {
+		return nil, 0, fmt.Errorf("node is down")
+	}
+
+	var replicaConn *ReplicaConnection
+	if len(fields) == 4 {
+		j := slices.IndexFunc(nodeConn.Replicas, func(replicaConn *ReplicaConnection) bool {
+			return replicaConn.Config.ServerAddress == fields[3]
+		})
+		if j < 0 {
+			return nil, 0, fmt.Errorf("replica not found")
+		}
+		replicaConn = nodeConn.Replicas[j]
+	} else {
+		replicaConn, _ = c.furthestReplica(nodeConn)
+		if replicaConn == nil {
+			return nil, 0, fmt.Errorf("no healthy read replica")
+		}
+	}
+
+	// OK <sequence number>
+	rec, err := c.sendToNode(nodeConn, []byte("JOURNALPOS\r\n"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var position uint64
+	if _, err := fmt.Sscanf(string(rec), "OK %d", &position); err != nil {
+		return nil, 0, fmt.Errorf("invalid journal position %q", strings.TrimSpace(string(rec)))
+	}
+
+	// No write reaches the node from here, the replica is caught up once it applied every write the node journaled
+	deadline := time.Now().Add(CatchUpTimeout)
+	for {
+		replicaConn.Lock.Lock()
+		if !replicaConn.Health {
+			replicaConn.Lock.Unlock()
+			return nil, 0, fmt.Errorf("replica is down")
+		}
+		seq, err := c.journalPosition(replicaConn)
+		replicaConn.Lock.Unlock()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if seq >= position {
+			return replicaConn, position, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, 0, fmt.Errorf("replica did not catch up, at sequence number %d of %d", seq, position)
+		}
+
+		time.Sleep(QueuePollInterval)
+	}
+}
+
+// sendReplica sends a command to a read replica and returns the first line of the response, nil on error
+// The caller holds the replica connection lock
+func (c *Cluster) sendReplica(replicaConn *ReplicaConnection, command []byte) []byte {
+	err := replicaConn.Client.Send(replicaConn.Context, command)
+	if err != nil {
+		c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
+		return nil
+	}
+
+	rec, err := replicaConn.Client.ReceiveLine(replicaConn.Context)
+	if err != nil {
+		c.Logger.Warn("read error", "error", err, "replica", replicaConn.Config.ServerAddress)
+		return nil
+	}
+
+	return rec
+}
+
+// gatherLoad reads the memory and key count of a healthy primary node with the latency of its health check
+// The caller holds the node connection lock
+func (c *Cluster) gatherLoad(nodeConn *NodeConnection, latency time.Duration) {
+	err := nodeConn.Client.Send(nodeConn.Context, []byte("LOAD\r\n"))
+	if err != nil {
+		c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+		return
+	}
+
+	rec, err := nodeConn.Client.ReceiveLine(nodeConn.Context)
+	if err != nil {
+		c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+		return
+	}
+
+	// OK <memory> <keys>
+	var memory float64
+	var keys int64
+	if _, err = fmt.Sscanf(string(rec), "OK %f %d", &memory, &keys); err != nil {
+		c.Logger.Warn("invalid load response", "response", string(rec), "node", nodeConn.Config.Node.ServerAddress)
+		return
+	}
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	nodeConn.Load.Memory = memory
+	nodeConn.Load.Keys = keys
+	nodeConn.Load.Latency = latency
+	nodeConn.Load.Measured = true
+}
+
+// gatherLag reads how far a healthy read replica is behind its primary node
+// The caller holds the replica connection lock
+func (c *Cluster) gatherLag(replicaConn *ReplicaConnection) {
+	rec := c.sendReplica(replicaConn, []byte("LAG\r\n"))
+	if rec == nil {
+		return
+	}
+
+	// OK <applied> <entries> <milliseconds>
+	var applied, entries uint64
+	var behind int64
+	if _, err := fmt.Sscanf(string(rec), "OK %d %d %d", &applied, &entries, &behind); err != nil {
+		c.Logger.Warn("invalid lag response", "response", string(rec), "replica", replicaConn.Config.ServerAddress)
+		return
+	}
+
+	lagging := replicaConn.Lag.Measured && c.lagging(replicaConn, 0)
+
+	replicaConn.Lag = ReplicaLag{Applied: applied, Entries: entries, Behind: time.Duration(behind) * time.Millisecond, At: time.Now(), Measured: true}
+
+	if !lagging && c.lagging(replicaConn, 0) {
+		c.Logger.Warn("replica lags behind its primary node, not serving reads", "replica", replicaConn.Config.ServerAddress, "lag_entries", entries, "lag", replicaConn.Lag.Behind)
+	} else if lagging && !c.lagging(replicaConn, 0) {
+		c.Logger.Info("replica caught up with its primary node, serving reads", "replica", replicaConn.Config.ServerAddress)
+	}
+}
+
+// lagging returns true if a read replica is further behind its primary node than the lag limit of the cluster or the
+// given limit, 0 for none.  A replica whose lag is not known yet only serves reads without a limit
+// The caller holds the replica connection lock
+func (c *Cluster) lagging(replicaConn *ReplicaConnection, maxLag time.Duration) bool {
+	limit := time.Duration(c.MaxReplicaLag.Load()) * time.Millisecond
+	if maxLag > 0 && (limit == 0 || maxLag < limit) {
+		limit = maxLag
+	}
+
+	if limit == 0 {
+		return false
+	}
+
+	return !replicaConn.Lag.Measured || replicaConn.Lag.current() > limit
+}
+
+// updateWeights sets the placement weight of each primary node from its load and the configured placement weights
+// A node weighs 1 / (1 + penalty), the penalty adds the memory used as a fraction of the node's threshold, the keys
+// and the latency relative to the busiest node, each times its configured weight.  A node at its memory threshold
+// weighs 0
+func (c *Cluster) updateWeights() {
+	c.ConfigLock.RLock()
+	weights := c.Config.PlacementWeights
+	c.ConfigLock.RUnlock()
+
+	if weights == nil {
+		weights = DefaultPlacementWeights
+	}
+
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	var maxKeys int64
+	var maxLatency time.Duration
+	for _, nodeConn := range c.NodeConnections {
+		maxKeys = max(maxKeys, nodeConn.Load.Keys)
+		maxLatency = max(maxLatency, nodeConn.Load.Latency)
+	}
+
+	for _, nodeConn := range c.NodeConnections {
+		load := &nodeConn.Load
+		if !load.Measured {
+			load.Weight = 1
+			continue
+		}
+
+		if load.Memory >= 100 {
+			load.Weight = 0
+			continue
+		}
+
+		penalty := weights.Memory * load.Memory / 100
+		if maxKeys > 0 {
+			penalty += weights.Keys * float64(load.Keys) / float64(maxKeys)
+		}
+		if maxLatency > 0 {
+			penalty += weights.Latency * float64(load.Latency) / float64(maxLatency)
+		}
+
+		load.Weight = 1 / (1 + penalty)
+	}
+}
+
+// Close closes the cluster instance gracefully
+func (c *Cluster) Close() error {
+	// We close the server
+	err := c.Server.Shutdown()
+	if err != nil {
+		return err
+	}
+
+	// Close all the node connections
+	for _, nodeConn := range c.NodeConnections {
+		if nodeConn.Client != nil {
+			if nodeConn.Health {
+				err = nodeConn.Client.Close()
+				if err != nil {
+					return err
+				}
+
+				// Check for read replicas
+				for _, replica := range nodeConn.Replicas {
+					if replica.Client != nil {
+						if replica.Health {
+							err = replica.Client.Close()
+							if err != nil {
+								return err
+							}
+						}
+					}
+
+				}
+			}
+
+		}
+	}
+
+	return nil
+}
+
+// openExistingConfigFile opens an existing cluster config file
+func openExistingConfigFile(wd string) (*Config, error) {
+
+	// If it exists, we read the config file
+	f, err := os.Open(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	// We decode the config file
+	decoder := yaml.NewDecoder(f)
+	config := &Config{}
+	err = decoder.Decode(config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// createDefaultConfigFile creates a default cluster config file
+func createDefaultConfigFile(wd string) (*Config, error) {
+	// We create the default cluster config file
+	f, err := os.Create(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := &Config{
+		HealthCheckInterval: 2,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4000",
+			UseTLS:      false,
+			CertFile:    "/",
+			KeyFile:     "/",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		NodeConfigs: []*NodeConfig{
+			{
+				Node: &client.Config{
+
+					ServerAddress:  "localhost:4001",
+					UseTLS:         false,
+					ConnectTimeout: 5,
+					WriteTimeout:   5,
+					ReadTimeout:    5,
+					MaxRetries:     3,
+					RetryWaitTime:  1,
+					BufferSize:     1024,
+				},
+				Replicas: []*client.Config{
+					{
+						ServerAddress:  "localhost:4002",
+						UseTLS:         false,
+						ConnectTimeout: 5,
+						WriteTimeout:   5,
+						ReadTimeout:    5,
+						MaxRetries:     3,
+						RetryWaitTime:  1,
+						BufferSize:     1024,
+					},
+				},
+				Slots: fmt.Sprintf("0-%d", slots.Count-1),
+			},
+		},
+		PlacementWeights: &PlacementWeights{Memory: 1},
+		FailoverAfter:    3,
+	}
+
+	// We marshal the config to yaml
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// We write the config to the file
+	_, err = f.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// saveConfigFile writes the cluster config file
+func saveConfigFile(wd string, config *Config) error {
+	// We marshal the config to yaml
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), ConfigFile), data, 0644)
+}
+
+// assignSlots returns the slot table of a config
+// Slots without an owner, such as those of a removed node, and nodes without slots are balanced between the nodes and
+// true is returned so the config can be saved
+func assignSlots(config *Config) (*slots.Table, bool, error) {
+	if len(config.NodeConfigs) == 0 {
+		return nil, false, nil
+	}
+
+	owned := make(map[string]slots.Ranges)
+	nodes := make([]string, 0, len(config.NodeConfigs))
+	balanced := true
+	for _, nodeConfig := range config.NodeConfigs {
+		ranges, err := slots.ParseRanges(nodeConfig.Slots)
+		if err != nil {
+			return nil, false, fmt.Errorf("node %s: %w", nodeConfig.Node.ServerAddress, err)
+		}
+
+		if ranges.Len() == 0 {
+			balanced = false
+		}
+
+		owned[nodeConfig.Node.ServerAddress] = ranges
+		nodes = append(nodes, nodeConfig.Node.ServerAddress)
+	}
+
+	table, err := slots.NewTable(owned)
+	if err == nil && balanced {
+		return table, false, nil
+	}
+
+	owned, err = slots.Balance(owned, nodes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, nodeConfig := range config.NodeConfigs {
+		nodeConfig.Slots = owned[nodeConfig.Node.ServerAddress].String()
+	}
+
+	table, err = slots.NewTable(owned)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return table, true, nil
+}
+
+// HandleConnection handles the server connections
+func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
+	// Create a buffer for receiving data
+	buffer := make([]byte, h.BufferSize)
+	var tempBuffer []byte // Temporary buffer to store data (larger than buffer)
+
+	authenticated := false                    // Whether client is authenticated to the cluster
+	written := make(map[*NodeConnection]bool) // Are the primary nodes the client wrote to, WAIT waits for their read replicas
+
+	for {
+		_ = conn.SetReadDeadline(time.Time{}) // Disable read deadline
+		n, err := conn.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				h.Cluster.Logger.Warn("connection timeout", "remote_addr", conn.RemoteAddr())
+			} else {
+				h.Cluster.Logger.Warn("read error", "error", err, "remote_addr", conn.RemoteAddr())
+			}
+			return
+		}
+
+		// Append the read data to the temporary buffer
+		tempBuffer = append(tempBuffer, buffer[:n]...)
+
+		// Check if the command is complete (ends with \r\n)
+		if !bytes.HasSuffix(tempBuffer, []byte("\r\n")) {
+			continue
+		}
+
+		// Process the complete command
+		command := tempBuffer
+		tempBuffer = nil // Reset the temporary buffer for the next command
+
+		if authenticated {
+			h.Cluster.wrote(written, strings.Fields(string(command)))
+		}
+
+		switch {
+		case strings.HasPrefix(string(command), "AUTH"):
+			// We check if the client is already authenticated
+			if authenticated {
+				_, err = conn.Write([]byte("ERR already authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get base64 encoded "username\0password"
+			credentials := bytes.TrimSuffix(bytes.Split(command, []byte(" "))[1], []byte("\r\n"))
+
+			decoded, err := base64.StdEncoding.DecodeString(string(credentials))
+			if err != nil {
+				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We split the decoded credentials into username and password
+			creds := bytes.Split(decoded, []byte("\\0"))
+			if len(creds) != 2 {
+				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if the username and password match
+			if string(creds[0]) != h.Cluster.Username || string(creds[1]) != h.Cluster.Password {
+				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We authenticate the client
+			authenticated = true
+			_, err = conn.Write([]byte("OK authenticated\r\n"))
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+			continue
+		case strings.HasPrefix(string(command), "PING"):
+			_, err = conn.Write([]byte("OK PONG\r\n"))
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "PUTNX"), strings.HasPrefix(string(command), "PUTXX"), strings.HasPrefix(string(command), "CAS"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.ConditionalWrite(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "ACK "):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// ACK <none|one|all> <command> writes a key on its owner once as many of its read replicas as the mode asks
+			// for applied the write
+			response, err := h.Cluster.Ack(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "WAIT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// WAIT <replicas> <timeout ms> waits for the read replicas of the primary nodes the client wrote to
+			response, err := h.Cluster.Wait(command, written)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "PUT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.WriteToOwner(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR write error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "DEL"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.WriteToOwner(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR read error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SETBIT"), strings.HasPrefix(string(command), "GETBIT"), strings.HasPrefix(string(command), "BITCOUNT"), strings.HasPrefix(string(command), "BITOP"),
+			strings.HasPrefix(string(command), "PFADD"), strings.HasPrefix(string(command), "PFCOUNT"), strings.HasPrefix(string(command), "PFMERGE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Analytics(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "TS."):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.TimeSeries(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "JSON."):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Document(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "VCREATE"), strings.HasPrefix(string(command), "VADD"), strings.HasPrefix(string(command), "VSEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Vector(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "FT.CREATE"), strings.HasPrefix(string(command), "SEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Search(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "RANGE"), strings.HasPrefix(string(command), "PREFIX"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Ordered(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SCAN"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Scan(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "AGG"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Aggregate(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "MIGRATE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// Keys are moved onto the node owning their slot
+			response, err := h.Cluster.Migrate()
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "HISTORY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.History(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUERY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Query(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "GET"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// Old versions read with GET <key> AT <timestamp> must not be taken for stale copies and deleted
+			if args := strings.Fields(string(command)); len(args) == 4 && strings.ToUpper(args[2]) == "AT" {
+				response, err := h.Cluster.GetAt(command)
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				if err != nil {
+					response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+				}
+
+				_, err = conn.Write(response)
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Get(command)
+			if err != nil {
+				_, err = conn.Write([]byte("ERR read error\r\n"))
+				if err != nil {
+					h.Cluster.NodeConnectionsLock.RUnlock()
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+
+				if err != nil {
+					_, err = conn.Write([]byte("ERR write error\r\n"))
+					if err != nil {
+						h.Cluster.NodeConnectionsLock.RUnlock()
+						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+						return
+					}
+				}
+				h.Cluster.NodeConnectionsLock.RUnlock()
+
+				continue
+			}
+
+			h.Cluster.NodeConnectionsLock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "REGX"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.ParallelRegx(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR read error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+
+				if err != nil {
+					_, err = conn.Write([]byte("ERR write error\r\n"))
+					if err != nil {
+						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+						return
+					}
+				}
+
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "INCR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We write to the primary node owning the key
+			response, err := h.Cluster.IncrDecr(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR write error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+
+				if err != nil {
+					_, err = conn.Write([]byte("ERR write error\r\n"))
+					if err != nil {
+						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+						return
+					}
+				}
+
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "DECR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We write to the primary node owning the key
+			response, err := h.Cluster.IncrDecr(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR write error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "QPUSH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// Jobs are spread across primary nodes the same way as writes
+			response, err := h.Cluster.WriteToNode(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR write error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QRESERVE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+			h.Cluster.NodeConnectionsLock.RUnlock()
+
+			response, err := h.Cluster.ReserveFromAny(command)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QACK"), strings.HasPrefix(string(command), "QNACK"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We don't know which primary node holds the job so we ask all of them
+			response := []byte("ERR job not found\r\n")
+			for _, rec := range h.Cluster.broadcastToPrimaries(command) {
+				if bytes.HasPrefix(rec, []byte("OK")) {
+					response = rec
+					break
+				}
+			}
+			h.Cluster.NodeConnectionsLock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QSTATS"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We check if there are any primary nodes
+			h.Cluster.NodeConnectionsLock.RLock()
+			if len(h.Cluster.NodeConnections) == 0 {
+				h.Cluster.NodeConnectionsLock.RUnlock()
+				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.ParallelQueueStats(command)
+			h.Cluster.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUIT"):
+			_, err = conn.Write([]byte("OK see ya later\r\n"))
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+			return
+		case strings.HasPrefix(string(command), "STAT"):
+			stats := h.Cluster.Stats()
+
+			_, err = conn.Write(stats)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "DECOMMISSION"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Decommission(command)
+			if err != nil {
+				response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "FAILOVER"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.Failover(command)
+			if err != nil {
+				response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "REBALANCE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Cluster.StartRebalance()
+			if err != nil {
+				response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "RCNF"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			err = h.Cluster.ReloadConfig()
+			if err != nil {
+				h.Cluster.Logger.Warn("reload error", "error", err)
+				_, err = conn.Write([]byte("ERR reload error\r\n"))
+				if err != nil {
+					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		default:
+			_, err = conn.Write([]byte("ERR unknown command\r\n"))
+			if err != nil {
+				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		}
+
+	}
+}
+
+// clusterStats retrieves basic stats for the cluster
+func (c *Cluster) clusterStats() []byte {
+	response := []byte(fmt.Sprintf("CLUSTER %s\r\n", c.Config.ServerConfig.Address))
+
+	// current sequence n
+	response = append(response, fmt.Sprintf("\tcurrent_sequence %d\r\n", c.Sequence.Load())...)
+	response = append(response, fmt.Sprintf("\tclient_connection_count %d\r\n", c.Server.GetConnCount())...)
+
+	// slots <node> <ranges>
+	if c.Slots != nil {
+		for _, nodeConn := range c.NodeConnections {
+			address := nodeConn.Config.Node.ServerAddress
+			response = append(response, fmt.Sprintf("\tslots %s %s\r\n", address, c.Slots.Ranges(address))...)
+		}
+	}
+
+	// placement <node> weight <weight> memory <percent> keys <n> latency <duration> placed <n>
+	c.Lock.RLock()
+	for _, nodeConn := range c.NodeConnections {
+		load := nodeConn.Load
+		response = append(response, fmt.Sprintf("\tplacement %s weight %.2f memory %.2f keys %d latency %s placed %d\r\n", nodeConn.Config.Node.ServerAddress, load.weight(), load.Memory, load.Keys, load.Latency, load.Placed)...)
+	}
+	c.Lock.RUnlock()
+
+	// replica <replica> applied <sequence number> lag_entries <n> lag_seconds <seconds> <serving|lagging|down>
+	for _, nodeConn := range c.NodeConnections {
+		nodeConn.Lock.Lock()
+		replicas := append([]*ReplicaConnection(nil), nodeConn.Replicas...)
+		nodeConn.Lock.Unlock()
+
+		for _, replicaConn := range replicas {
+			replicaConn.Lock.Lock()
+			state := "serving"
+			switch {
+			case !replicaConn.Health:
+				state = "down"
+			case c.lagging(replicaConn, 0):
+				state = "lagging"
+			}
+			lag := replicaConn.Lag
+			replicaConn.Lock.Unlock()
+
+			response = append(response, fmt.Sprintf("\treplica %s applied %d lag_entries %d lag_seconds %.3f %s\r\n", replicaConn.Config.ServerAddress, lag.Applied, lag.Entries, lag.current().Seconds(), state)...)
+		}
+	}
+
+	// rebalance <source> <target> <slots> <keys moved> <moving|done|failed>
+	if c.Rebalance != nil {
+		for _, move := range c.Rebalance.Moves {
+			response = append(response, fmt.Sprintf("\trebalance %s %s %s %d %s\r\n", move.Source.Config.Node.ServerAddress, move.Target, move.Ranges, move.Keys.Load(), move.State())...)
+		}
+	}
+
+	return response
+}
+
+// Stats get stats on the cluster and it's nodes
+func (c *Cluster) Stats() []byte {
+	response := []byte("OK\r\n")
+
+	// We get the cluster stats
+	response = append(response, c.clusterStats()...)
+
+	// We send a stat command to all nodes in parallel to avoid blocking
+	var wg sync.WaitGroup
+	var responseLock sync.Mutex
+
+	for _, nodeConn := range c.NodeConnections {
+		nodeConn.Lock.Lock()
+
+		// Add node header to response
+		responseLock.Lock()
+		response = append(response, fmt.Sprintf("PRIMARY %s\r\n", nodeConn.Config.Node.ServerAddress)...)
+		responseLock.Unlock()
+
+		if !nodeConn.Health {
+			// Node is down
+			responseLock.Lock()
+			response = append(response, []byte("down\r\n")...)
+			responseLock.Unlock()
+			nodeConn.Lock.Unlock()
+		} else {
+			// Use goroutine to get stats from healthy node
+			wg.Add(1)
+			go func(nc *NodeConnection) {
+				defer wg.Done()
+				defer nc.Lock.Unlock()
+
+				// Send the STAT command
+				if err := nc.Client.Send(nc.Context, []byte("STAT\r\n")); err != nil {
+					c.Logger.Warn("write error", "error", err, "node", nc.Config.Node.ServerAddress)
+					responseLock.Lock()
+					response = append(response, []byte("error: failed to send command\r\n")...)
+					responseLock.Unlock()
+					return
+				}
+
+				// Receive the response
+				rec, err := nc.Client.Receive(nc.Context)
+				if err != nil {
+					c.Logger.Warn("read error", "error", err, "node", nc.Config.Node.ServerAddress)
+					responseLock.Lock()
+					response = append(response, []byte("error: failed to receive stats\r\n")...)
+					responseLock.Unlock()
+					return
+				}
+
+				// Trim the OK prefix and add to response
+				rec = bytes.TrimPrefix(rec, []byte("OK\r\n"))
+				responseLock.Lock()
+				response = append(response, rec...)
+				responseLock.Unlock()
+			}(nodeConn)
+		}
+
+		// Process replicas for this node
+		for _, replicaConn := range nodeConn.Replicas {
+			replicaConn.Lock.Lock()
+
+			// Add replica header to response
+			responseLock.Lock()
+			response = append(response, fmt.Sprintf("REPLICA %s\r\n", replicaConn.Config.ServerAddress)...)
+			responseLock.Unlock()
+
+			if !replicaConn.Health {
+				// Replica is down
+				responseLock.Lock()
+				response = append(response, []byte("down\r\n")...)
+				responseLock.Unlock()
+				replicaConn.Lock.Unlock()
+			} else {
+				// Use goroutine to get stats from healthy replica
+				wg.Add(1)
+				go func(rc *ReplicaConnection) {
+					defer wg.Done()
+					defer rc.Lock.Unlock()
+
+					// Send the STAT command
+					if err := rc.Client.Send(rc.Context, []byte("STAT\r\n")); err != nil {
+						c.Logger.Warn("write error", "error", err, "replica", rc.Config.ServerAddress)
+						responseLock.Lock()
+						response = append(response, []byte("error: failed to send command\r\n")...)
+						responseLock.Unlock()
+						return
+					}
+
+					// Receive the response
+					rec, err := rc.Client.Receive(rc.Context)
+					if err != nil {
+						c.Logger.Warn("read error", "error", err, "replica", rc.Config.ServerAddress)
+						responseLock.Lock()
+						response = append(response, []byte("error: failed to receive stats\r\n")...)
+						responseLock.Unlock()
+						return
+					}
+
+					// Trim the OK prefix and add to response
+					rec = bytes.TrimPrefix(rec, []byte("OK\r\n"))
+					responseLock.Lock()
+					response = append(response, rec...)
+					responseLock.Unlock()
+				}(replicaConn)
+			}
+		}
+	}
+
+	// Wait for all stats gathering to complete
+	wg.Wait()
+
+	return response
+}
+
+// ParallelRegx reads from all replicas in parallel using REGX command
+// replaces duplicate keys comparing timestamps
+func (c *Cluster) ParallelRegx(command []byte) ([]byte, error) {
+	// We collect results with keys as map keys for easy deduplication
+	resultMap := make(map[string]*struct {
+		TimeStamp hlc.Timestamp
+		Key       []byte
+		Data      []byte
+		Node      *NodeConnection
+	})
+
+	wg := sync.WaitGroup{}
+	resultLock := sync.Mutex{}
+
+	// Process all nodes
+	for _, nodeConn := range c.NodeConnections {
+		nodeConn.Lock.Lock()
+
+		if !nodeConn.Health {
+			nodeConn.Lock.Unlock()
+
+			// Process replicas if primary is down, replicas lagging behind it do not serve reads
+			for _, replicaConn := range nodeConn.Replicas {
+				replicaConn.Lock.Lock()
+
+				if !replicaConn.Health || c.lagging(replicaConn, 0) {
+					replicaConn.Lock.Unlock()
+					continue
+				}
+
+				wg.Add(1)
+				go func(nodeConn *NodeConnection, replicaConn *ReplicaConnection) {
+					defer wg.Done()
+					defer replicaConn.Lock.Unlock()
+
+					// Send the command
+					err := replicaConn.Client.Send(replicaConn.Context, command)
+					if err != nil {
+						c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
+						return
+					}
+
+					// Receive the response
+					rec, err := replicaConn.Client.Receive(replicaConn.Context)
+					if err != nil {
+						c.Logger.Warn("read error", "error", err, "replica", replicaConn.Config.ServerAddress)
+						return
+					}
+
+					// Process successful response
+					if bytes.HasPrefix(rec, []byte("OK")) {
+						results := bytes.Split(rec, []byte("\r\n"))
+						for i, result := range results {
+							if len(result) == 0 {
+								continue
+							}
+
+							// Parse the result line
+							var timestampBytes []byte
+							var keyBytes []byte
+							var dataBytes []byte
+
+							parts := bytes.Split(result, []byte(" "))
+							if len(parts) < 2 {
+								continue
+							}
+
+							if i == 0 { // First line format OK <timestamp> <key> <data>
+								if len(parts) < 3 {
+									continue
+								}
+								timestampBytes = parts[1]
+								keyBytes = parts[2]
+								dataBytes = bytes.Join(parts[3:], []byte(" "))
+							} else { // Other lines format <timestamp> <key> <data>
+								timestampBytes = parts[0]
+								keyBytes = parts[1]
+								dataBytes = bytes.Join(parts[2:], []byte(" "))
+							}
+
+							// Parse timestamp
+							ts, err := hlc.Parse(string(timestampBytes))
+							if err != nil {
+								c.Logger.Warn("time parse error", "error", err, "replica", replicaConn.Config.ServerAddress)
+								continue
+							}
+
+							// Add to results map with deduplication
+							resultLock.Lock()
+							keyStr := string(keyBytes)
+							existing, exists := resultMap[keyStr]
+
+							if !exists || ts.After(existing.TimeStamp) {
+								// Replace or add new entry
+								resultMap[keyStr] = &struct {
+									TimeStamp hlc.Timestamp
+									Key       []byte
+									Data      []byte
+									Node      *NodeConnection
+								}{
+									TimeStamp: ts,
+									Key:       keyBytes,
+									Data:      dataBytes,
+									Node:      nodeConn,
+								}
+
+								// If we had an older version, schedule it for deletion
+								if exists && !bytes.Equal(existing.Key, keyBytes) {
+									go func(n *NodeConnection, k []byte) {
+										n.Lock.Lock()
+										defer n.Lock.Unlock()
+										if !n.Health {
+											return
+										}
+
+										err := n.Client.Send(n.Context, []byte(fmt.Sprintf("DEL %s", k)))
+										if err != nil {
+											return
+										}
+
+										// Just receive without checking
+										_, _ = n.Client.Receive(n.Context)
+									}(existing.Node, existing.Key)
+								}
+							}
+							resultLock.Unlock()
+						}
+					}
+				}(nodeConn, replicaConn)
+			}
+		} else {
+			// Process healthy primary node
+			wg.Add(1)
+			go func(nodeConn *NodeConnection) {
+				defer wg.Done()
+				defer nodeConn.Lock.Unlock()
+
+				// Send the command
+				err := nodeConn.Client.Send(nodeConn.Context, command)
+				if err != nil {
+					c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+					return
+				}
+
+				// Receive the response
+				rec, err := nodeConn.Client.Receive(nodeConn.Context)
+				if err != nil {
+					c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+					return
+				}
+
+				// Process successful response
+				if bytes.HasPrefix(rec, []byte("OK")) {
+					results := bytes.Split(rec, []byte("\r\n"))
+					for i, result := range results {
+						if len(result) == 0 {
+							continue
+						}
+
+						// Parse the result line
+						var timestampBytes []byte
+						var keyBytes []byte
+						var dataBytes []byte
+
+						parts := bytes.Split(result, []byte(" "))
+						if len(parts) < 2 {
+							continue
+						}
+
+						if i == 0 { // First line format OK <timestamp> <key> <data>
+							if len(parts) < 3 {
+								continue
+							}
+							timestampBytes = parts[1]
+							keyBytes = parts[2]
+							dataBytes = bytes.Join(parts[3:], []byte(" "))
+						} else { // Other lines format <timestamp> <key> <data>
+							timestampBytes = parts[0]
+							keyBytes = parts[1]
+							dataBytes = bytes.Join(parts[2:], []byte(" "))
+						}
+
+						// Parse timestamp
+						ts, err := hlc.Parse(string(timestampBytes))
+						if err != nil {
+							c.Logger.Warn("time parse error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+							continue
+						}
+
+						// Add to results map with deduplication
+						resultLock.Lock()
+						keyStr := string(keyBytes)
+						existing, exists := resultMap[keyStr]
+
+						if !exists || ts.After(existing.TimeStamp) {
+							// Replace or add new entry
+							resultMap[keyStr] = &struct {
+								TimeStamp hlc.Timestamp
+								Key       []byte
+								Data      []byte
+								Node      *NodeConnection
+							}{
+								TimeStamp: ts,
+								Key:       keyBytes,
+								Data:      dataBytes,
+								Node:      nodeConn,
+							}
+
+							// If we had an older version, schedule it for deletion
+							if exists && !bytes.Equal(existing.Key, keyBytes) {
+								go func(n *NodeConnection, k []byte) {
+									n.Lock.Lock()
+									defer n.Lock.Unlock()
+									if !n.Health {
+										return
+									}
+
+									err := n.Client.Send(n.Context, []byte(fmt.Sprintf("DEL %s", k)))
+									if err != nil {
+										return
+									}
+
+									// Just receive without checking
+									_, _ = n.Client.Receive(n.Context)
+								}(existing.Node, existing.Key)
+							}
+						}
+						resultLock.Unlock()
+					}
+				}
+			}(nodeConn)
+		}
+	}
+
+	// Wait for all goroutines to finish
+	wg.Wait()
+
+	// Keys deleted after their copy was written are stale, the copies are dropped and deleted
+	if fields := bytes.Fields(command); len(fields) > 1 {
+		for _, rec := range c.queryShards([]byte(fmt.Sprintf("TOMBSTONES %s\r\n", fields[1])), (*client.Client).ReceiveLines) {
+			if !bytes.HasPrefix(rec, []byte("OK ")) {
+				continue
+			}
+
+			lines := strings.Split(strings.TrimSuffix(string(rec), "\r\n"), "\r\n")
+			for _, line := range lines[1:] {
+				parts := strings.SplitN(line, " ", 2)
+				if len(parts) != 2 {
+					continue
+				}
+
+				deleted, err := hlc.Parse(parts[0])
+				if err != nil {
+					continue
+				}
+
+				if result, ok := resultMap[parts[1]]; ok && deleted.After(result.TimeStamp) {
+					c.deleteStale(result.Node, parts[1], result.TimeStamp)
+					delete(resultMap, parts[1])
+				}
+			}
+		}
+	}
+
+	// Check if we found any results
+	if len(resultMap) == 0 {
+		return []byte("ERR no keys found\r\n"), nil
+	}
+
+	// Format final response
+	var responseArray [][]byte
+	responseArray = append(responseArray, []byte("OK"))
+
+	// Convert map to array of <version> <key> <value> results
+	for _, result := range resultMap {
+		responseArray = append(responseArray, []byte(fmt.Sprintf("%s %s %s", result.TimeStamp, result.Key, result.Data)))
+	}
+
+	// Join with CRLF
+	response := bytes.Join(responseArray, []byte("\r\n"))
+	response = append(response, []byte("\r\n")...)
+
+	return response, nil
+}
+
+// owner returns the connection to the primary node owning the slot of a key, nil if no node owns it
+func (c *Cluster) owner(key string) *NodeConnection {
+	if c.Slots == nil {
+		return nil
+	}
+
+	address := c.Slots.Owner(key)
+	for _, nodeConn := range c.NodeConnections {
+		if nodeConn.Config.Node.ServerAddress == address {
+			return nodeConn
+		}
+	}
+
+	return nil
+}
+
+// WriteToNode writes to a primary node chosen by smooth weighted round-robin on the placement weights
+// Fuller or slower nodes get fewer writes, a node at its memory threshold gets none while another node can take them
+func (c *Cluster) WriteToNode(data []byte) ([]byte, error) {
+	tried := make(map[*NodeConnection]bool)
+	for len(tried) < len(c.NodeConnections) {
+		nodeConn := c.place(tried)
+		tried[nodeConn] = true
+
+		nodeConn.Lock.Lock()
+		if !nodeConn.Health {
+			nodeConn.Lock.Unlock()
+			continue
+		}
+
+		response, err := c.sendToNode(nodeConn, data)
+		nodeConn.Lock.Unlock()
+		if err == nil {
+			c.Lock.Lock()
+			nodeConn.Load.Placed++
+			c.Lock.Unlock()
+
+			// Only update sequence on successful write
+			c.Sequence.Store(int32((slices.Index(c.NodeConnections, nodeConn) + 1) % len(c.NodeConnections)))
+			return response, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no healthy nodes available")
+}
+
+// place returns the next primary node not yet tried by smooth weighted round-robin
+// Every node gains its weight, the node with the most is chosen and gives back the total, so writes are interleaved in
+// proportion to the weights
+func (c *Cluster) place(tried map[*NodeConnection]bool) *NodeConnection {
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	var chosen *NodeConnection
+	total := 0.0
+	for _, nodeConn := range c.NodeConnections {
+		if tried[nodeConn] {
+			continue
+		}
+
+		nodeConn.Load.Current += nodeConn.Load.weight()
+		total += nodeConn.Load.weight()
+		if chosen == nil || nodeConn.Load.Current > chosen.Load.Current {
+			chosen = nodeConn
+		}
+	}
+
+	chosen.Load.Current -= total
+	return chosen
+}
+
+// WriteToOwner writes to the primary node owning the slot of the key
+// The key is the first argument of the command
+func (c *Cluster) WriteToOwner(data []byte) ([]byte, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	return c.sendToOwner(fields[1], data)
+}
+
+// Ack runs an ACK <none|one|all> <command> command, the write is sent with its acknowledgement mode to the primary
+// node owning the slot of its key, the key being the first argument of the write
+func (c *Cluster) Ack(data []byte) ([]byte, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	switch strings.ToLower(fields[1]) {
+	case "none", "one", "all":
+	default:
+		return nil, fmt.Errorf("invalid ack mode")
+	}
+
+	return c.sendToOwner(fields[3], data)
+}
+
+// Wait runs a WAIT <replicas> <timeout ms> command on the primary nodes a client wrote to, each waits for its read
+// replicas to apply the writes sent to it by the cluster.  Responds with the fewest read replicas that applied them on
+// a node, OK 0 if the client wrote nothing
+func (c *Cluster) Wait(data []byte, written map[*NodeConnection]bool) ([]byte, error) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	if needed, err := strconv.Atoi(fields[1]); err != nil || needed < 0 {
+		return nil, fmt.Errorf("invalid number of replicas")
+	}
+
+	if timeout, err := strconv.Atoi(fields[2]); err != nil || timeout < 0 {
+		return nil, fmt.Errorf("invalid timeout")
+	}
+
+	// Nodes decommissioned since are gone with their writes
+	var nodeConns []*NodeConnection
+	for _, nodeConn := range c.NodeConnections {
+		if written[nodeConn] {
+			nodeConns = append(nodeConns, nodeConn)
+		}
+	}
+
+	if len(nodeConns) == 0 {
+		return []byte("OK 0\r\n"), nil
+	}
+
+	// The nodes wait at the same time so the timeout is not added up
+	command := []byte(fmt.Sprintf("WAIT %s %s\r\n", fields[1], fields[2]))
+	responses := make([][]byte, len(nodeConns))
+
+	wg := sync.WaitGroup{}
+	for i, nodeConn := range nodeConns {
+		wg.Add(1)
+		go func(i int, nodeConn *NodeConnection) {
+			defer wg.Done()
+			responses[i] = c.sendLocked(nodeConn, command, (*client.Client).ReceiveLine)
+		}(i, nodeConn)
+	}
+
+	wg.Wait()
+
+	fewest := -1
+	for _, rec := range responses {
+		if rec == nil {
+			return nil, fmt.Errorf("node is down")
+		}
+
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
+
+		var got int
+		if _, err := fmt.Sscanf(string(rec), "OK %d", &got); err != nil {
+			return nil, fmt.Errorf("invalid response %q", strings.TrimSpace(string(rec)))
+		}
+
+		if fewest < 0 || got < fewest {
+			fewest = got
+		}
+	}
+
+	return []byte(fmt.Sprintf("OK %d\r\n", fewest)), nil
+}
+
+// wrote records the primary nodes a command may write to in the primary nodes a client wrote to.  A key written on
+// the primary node owning its slot records that node, writes placed by weight or sent to every shard such as jobs,
+// samples, documents and indexes record every primary node
+func (c *Cluster) wrote(written map[*NodeConnection]bool, fields []string) {
+	if len(fields) > 3 && fields[0] == "ACK" {
+		fields = fields[2:]
+	}
+
+	if len(fields) < 2 {
+		return
+	}
+
+	c.NodeConnectionsLock.RLock()
+	defer c.NodeConnectionsLock.RUnlock()
+
+	switch fields[0] {
+	case "PUT", "PUTNX", "PUTXX", "CAS", "DEL", "INCR", "DECR":
+		if nodeConn := c.owner(fields[1]); nodeConn != nil {
+			written[nodeConn] = true
+		}
+	case "SETBIT", "BITOP", "PFADD", "PFMERGE", "TS.CREATE", "TS.ADD", "JSON.SET", "JSON.DEL", "JSON.NUMINCRBY",
+		"JSON.ARRAPPEND", "VCREATE", "VADD", "FT.CREATE", "QPUSH", "QRESERVE", "QACK":
+		for _, nodeConn := range c.NodeConnections {
+			written[nodeConn] = true
+		}
+	}
+}
+
+// sendToOwner sends a command to the primary node owning the slot of the key
+func (c *Cluster) sendToOwner(key string, data []byte) ([]byte, error) {
+	c.pull(key)
+
+	nodeConn := c.owner(key)
+	if nodeConn == nil {
+		return nil, fmt.Errorf("slot has no owner")
+	}
+
+	nodeConn.Lock.Lock()
+	defer nodeConn.Lock.Unlock()
+
+	if !nodeConn.Health {
+		return nil, fmt.Errorf("node is down")
+	}
+
+	return c.sendToNode(nodeConn, data)
+}
+
+// Get runs a GET <key> [MAXLAG <duration>] command on the shard owning the key
+// A read replica answers when the primary node is down, with MAXLAG only one at most the duration behind the primary
+func (c *Cluster) Get(command []byte) ([]byte, error) {
+	fields := strings.Fields(string(command))
+	if len(fields) != 2 && (len(fields) != 4 || strings.ToUpper(fields[2]) != "MAXLAG") {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	var maxLag time.Duration
+	if len(fields) == 4 {
+		var err error
+		maxLag, err = time.ParseDuration(fields[3])
+		if err != nil || maxLag <= 0 {
+			return nil, fmt.Errorf("invalid max lag")
+		}
+
+		command = []byte(fmt.Sprintf("GET %s\r\n", fields[1]))
+	}
+
+	c.pull(fields[1])
+
+	nodeConn := c.owner(fields[1])
+	if nodeConn == nil {
+		return nil, fmt.Errorf("slot has no owner")
+	}
+
+	rec := c.queryShardMaxLag(nodeConn, command, (*client.Client).ReceiveLine, maxLag)
+	if rec == nil {
+		return nil, fmt.Errorf("node is down")
+	}
+
+	// A deleted key is reported as not found, the tombstone is internal to the shard
+	if _, ok := deletedAt(rec); ok {
+		return []byte("ERR key not found\r\n"), nil
+	}
+
+	// The shard responds OK <version> <key> <value>, the version is kept for conditional writes
+	return rec, nil
+}
+
+// IncrDecr runs an INCR or DECR command on the primary node owning the key
+func (c *Cluster) IncrDecr(command []byte) ([]byte, error) {
+	rec, err := c.WriteToOwner(command)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := deletedAt(rec); ok {
+		return []byte("ERR key not found\r\n"), nil
+	}
+
+	// The node responds OK <version> <key> <value> with the version of the incremented value
+	return rec, nil
+}
+
+// broadcastToPrimaries sends a command to all healthy primary nodes in parallel and returns their responses
+func (c *Cluster) broadcastToPrimaries(command []byte) [][]byte {
+	responses := make([][]byte, len(c.NodeConnections))
+
+	wg := sync.WaitGroup{}
+
+	for i, nodeConn := range c.NodeConnections {
+		nodeConn.Lock.Lock()
+
+		if !nodeConn.Health {
+			nodeConn.Lock.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, nodeConn *NodeConnection) {
+			defer wg.Done()
+			defer nodeConn.Lock.Unlock() // Always release the lock
+
+			rec, err := c.sendToNode(nodeConn, command)
+			if err != nil {
+				c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+				return
+			}
+
+			responses[i] = rec
+		}(i, nodeConn)
+	}
+
+	wg.Wait()
+
+	return responses
+}
+
+// ReserveFromAny reserves a job from the first primary node that has one ready
+// Each reserve starts at the next primary node so consumers drain all shards
+// With BLOCK the primary nodes are polled until a job is ready or the block timeout passes, a block of 0 waits forever
+func (c *Cluster) ReserveFromAny(command []byte) ([]byte, error) {
+	// QRESERVE <key> <visibility timeout ms> [BLOCK <ms>]
+	args := strings.Fields(string(command))
+	if len(args) != 3 && (len(args) != 5 || !strings.EqualFold(args[3], "BLOCK")) {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	block, blocking := 0, len(args) == 5
+	if blocking {
+		var err error
+		block, err = strconv.Atoi(args[4])
+		if err != nil || block < 0 {
+			return nil, fmt.Errorf("invalid block timeout")
+		}
+	}
+
+	deadline := time.Now().Add(time.Duration(block) * time.Millisecond)
+
+	// Nodes are asked without blocking, otherwise one empty shard would hold up the others
+	reserve := []byte(fmt.Sprintf("QRESERVE %s %s\r\n", args[1], args[2]))
+
+	for {
+		c.NodeConnectionsLock.RLock()
+
+		count := len(c.NodeConnections)
+		start := 0
+		if count > 0 {
+			start = int(uint32(c.ReserveSequence.Add(1)) % uint32(count))
+		}
+
+		for i := 0; i < count; i++ {
+			nodeConn := c.NodeConnections[(start+i)%count]
+
+			nodeConn.Lock.Lock()
+			if !nodeConn.Health {
+				nodeConn.Lock.Unlock()
+				continue
+			}
+
+			rec, err := c.sendToNode(nodeConn, reserve)
+			nodeConn.Lock.Unlock()
+
+			if err != nil {
+				c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+				continue
+			}
+
+			if bytes.HasPrefix(rec, []byte("OK")) {
+				c.NodeConnectionsLock.RUnlock()
+				return rec, nil
+			}
+		}
+
+		c.NodeConnectionsLock.RUnlock()
+
+		if !blocking || (block > 0 && time.Now().After(deadline)) {
+			return nil, fmt.Errorf("no jobs ready")
+		}
+
+		time.Sleep(QueuePollInterval)
+	}
+}
+
+// ParallelQueueStats sums the stats of a queue across all primary nodes
+func (c *Cluster) ParallelQueueStats(command []byte) ([]byte, error) {
+	var ready, reserved, dead int
+
+	for _, rec := range c.broadcastToPrimaries(command) {
+		if rec == nil {
+			continue
+		}
+
+		// OK ready <n> reserved <n> dead <n>
+		var r, rs, d int
+		_, err := fmt.Sscanf(string(rec), "OK ready %d reserved %d dead %d", &r, &rs, &d)
+		if err != nil {
+			return nil, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(string(rec), "ERR")))
+		}
+
+		ready += r
+		reserved += rs
+		dead += d
+	}
+
+	return []byte(fmt.Sprintf("OK ready %d reserved %d dead %d\r\n", ready, reserved, dead)), nil
+}
+
+// deleteStale deletes a stale copy of a key from a primary node in the background
+// The delete carries the version of the copy so the tombstone it leaves never hides a newer copy
+func (c *Cluster) deleteStale(nodeConn *NodeConnection, key string, version hlc.Timestamp) {
+	go func() {
+		nodeConn.Lock.Lock()
+		defer nodeConn.Lock.Unlock()
+
+		if !nodeConn.Health {
+			return
+		}
+
+		err := nodeConn.Client.Send(nodeConn.Context, []byte(fmt.Sprintf("DEL %s %s\r\n", key, version)))
+		if err != nil {
+			c.Logger.Warn("write error during cleanup", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+			return
+		}
+
+		// Check deletion response
+		rec, err := nodeConn.Client.Receive(nodeConn.Context)
+		if err != nil {
+			c.Logger.Warn("read error during cleanup", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+			return
+		}
+
+		if !bytes.HasPrefix(rec, []byte("OK")) {
+			c.Logger.Warn("delete error during cleanup", "response", string(rec), "node", nodeConn.Config.Node.ServerAddress)
+			return
+		}
+
+		c.Logger.Info("deleted stale key", "key", key, "node", nodeConn.Config.Node.ServerAddress)
+	}()
+}
+
+// deletedAt returns the version of the delete in an ERR key deleted <version> response
+func deletedAt(rec []byte) (hlc.Timestamp, bool) {
+	ts, ok := strings.CutPrefix(strings.TrimSpace(string(rec)), "ERR key deleted ")
+	if !ok {
+		return hlc.Timestamp{}, false
+	}
+
+	deleted, err := hlc.Parse(ts)
+	if err != nil {
+		return hlc.Timestamp{}, false
+	}
+
+	return deleted, true
+}
+
+// queryShards sends a command to every shard in parallel and returns the responses in node connection order
+// receive reads the response, such as (*client.Client).ReceiveLine
+func (c *Cluster) queryShards(command []byte, receive func(*client.Client, context.Context) ([]byte, error)) [][]byte {
+	responses := make([][]byte, len(c.NodeConnections))
+
+	wg := sync.WaitGroup{}
+
+	for i, nodeConn := range c.NodeConnections {
+		wg.Add(1)
+		go func(i int, nodeConn *NodeConnection) {
+			defer wg.Done()
+			responses[i] = c.queryShard(nodeConn, command, receive)
+		}(i, nodeConn)
+	}
+
+	wg.Wait()
+
+	return responses
+}
+
+// queryShard sends a command to a shard and returns the response, nil if the shard could not answer
+// The primary node is asked when healthy, otherwise its first healthy read replica within the lag limit of the cluster
+func (c *Cluster) queryShard(nodeConn *NodeConnection, command []byte, receive func(*client.Client, context.Context) ([]byte, error)) []byte {
+	return c.queryShardMaxLag(nodeConn, command, receive, 0)
+}
+
+// queryShardMaxLag is queryShard with a read replica answering only when it is at most maxLag behind its primary node
+func (c *Cluster) queryShardMaxLag(nodeConn *NodeConnection, command []byte, receive func(*client.Client, context.Context) ([]byte, error), maxLag time.Duration) []byte {
+	nodeConn.Lock.Lock()
+
+	if nodeConn.Health {
+		defer nodeConn.Lock.Unlock() // Always release the lock
+
+		err := nodeConn.Client.Send(nodeConn.Context, command)
+		if err != nil {
+			c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+			return nil
+		}
+
+		rec, err := receive(nodeConn.Client, nodeConn.Context)
+		if err != nil {
+			c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+			return nil
+		}
+
+		return rec
+	}
+
+	nodeConn.Lock.Unlock()
+
+	// The primary is down, we ask the first healthy replica not lagging behind
+	for _, replicaConn := range nodeConn.Replicas {
+		replicaConn.Lock.Lock()
+		if !replicaConn.Health || c.lagging(replicaConn, maxLag) {
+			replicaConn.Lock.Unlock()
+			continue
+		}
+
+		defer replicaConn.Lock.Unlock() // Always release the lock
+
+		err := replicaConn.Client.Send(replicaConn.Context, command)
+		if err != nil {
+			c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
+			return nil
+		}
+
+		rec, err := receive(replicaConn.Client, replicaConn.Context)
+		if err != nil {
+			c.Logger.Warn("read error", "error", err, "replica", replicaConn.Config.ServerAddress)
+			return nil
+		}
+
+		return rec
+	}
+
+	return nil
+}
+
+// shardError returns the error of a shard response other than a missing key
+func shardError(rec []byte) error {
+	if rec == nil || bytes.HasPrefix(rec, []byte("OK")) || bytes.HasPrefix(rec, []byte("ERR key not found")) {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(string(rec), "ERR")))
+}
+
+// mergedBitmap returns the union of the copies of a bitmap on every shard, nil if no shard has the key
+func (c *Cluster) mergedBitmap(key string) (*bitmap.Bitmap, error) {
+	var merged *bitmap.Bitmap
+
+	for _, rec := range c.queryShards([]byte(fmt.Sprintf("BITDUMP %s\r\n", key)), (*client.Client).ReceiveLine) {
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			continue
+		}
+
+		b, err := bitmap.Decode(strings.TrimSpace(string(rec[3:])))
+		if err != nil {
+			return nil, err
+		}
+
+		if merged == nil {
+			merged = bitmap.New()
+		}
+		merged.Merge(b)
+	}
+
+	return merged, nil
+}
+
+// mergedHyperLogLog returns the union of the hyperloglogs stored under keys on every shard
+func (c *Cluster) mergedHyperLogLog(keys []string) (*hyperloglog.HyperLogLog, error) {
+	merged := hyperloglog.New()
+
+	for _, rec := range c.queryShards([]byte(fmt.Sprintf("PFDUMP %s\r\n", strings.Join(keys, " "))), (*client.Client).ReceiveLine) {
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
 
-		// Check if the command is complete (ends with \r\n)
-		if !bytes.HasSuffix(tempBuffer, []byte("\r\n")) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
 			continue
 		}
 
-		// Process the complete command
-		command := tempBuffer
-		tempBuffer = nil // Reset the temporary buffer for the next command
+		h, err := hyperloglog.Decode(strings.TrimSpace(string(rec[3:])))
+		if err != nil {
+			return nil, err
+		}
 
-		switch {
-		case strings.HasPrefix(string(command), "AUTH"):
-			// We check if the client is already authenticated
-			if authenticated {
-				_, err = conn.Write([]byte("ERR already authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+		merged.Merge(h)
+	}
 
-			// We get base64 encoded "username\0password"
-			credentials := bytes.TrimSuffix(bytes.Split(command, []byte(" "))[1], []byte("\r\n"))
+	return merged, nil
+}
 
-			decoded, err := base64.StdEncoding.DecodeString(string(credentials))
-			if err != nil {
-				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+// TimeSeries runs a time series command
+// Samples of a series are spread over the primary nodes like any other write, so ranges fetch the raw samples
+// from every shard and aggregate them here
+func (c *Cluster) TimeSeries(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
 
-			// We split the decoded credentials into username and password
-			creds := bytes.Split(decoded, []byte("\\0"))
-			if len(creds) != 2 {
-				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+	switch args[0] {
+	case "TS.CREATE":
+		// The series is created on every primary node so the retention applies wherever samples land
+		return c.createOnPrimaries(command)
+	case "TS.ADD":
+		return c.WriteToNode(command)
+	case "TS.RANGE":
+		// TS.RANGE <key> <from> <to> [AGGREGATION <type> <bucket ms>]
+		if len(args) < 4 {
+			return nil, fmt.Errorf("invalid command")
+		}
 
-			// We check if the username and password match
-			if string(creds[0]) != h.Cluster.Username || string(creds[1]) != h.Cluster.Password {
-				_, err = conn.Write([]byte("ERR invalid credentials\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+		_, _, agg, err := timeseries.ParseRangeArgs(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		series, err := c.shardSamples([]byte(fmt.Sprintf("TS.RANGE %s %s %s\r\n", args[1], args[2], args[3])), false)
+		if err != nil {
+			return nil, err
+		}
+
+		samples, ok := series[args[1]]
+		if !ok {
+			return nil, fmt.Errorf("key not found")
+		}
+
+		if agg != nil {
+			samples = agg.Apply(samples)
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(samples)))
+		for _, sample := range samples {
+			response = append(response, fmt.Sprintf("%d %s\r\n", sample.Timestamp, timeseries.FormatValue(sample.Value))...)
+		}
+
+		return response, nil
+	case "TS.MRANGE":
+		// TS.MRANGE <from> <to> <pattern> [AGGREGATION <type> <bucket ms>]
+		if len(args) < 4 {
+			return nil, fmt.Errorf("invalid command")
+		}
+
+		_, _, agg, err := timeseries.ParseRangeArgs(append([]string{args[1], args[2]}, args[4:]...))
+		if err != nil {
+			return nil, err
+		}
+
+		series, err := c.shardSamples([]byte(fmt.Sprintf("TS.MRANGE %s %s %s\r\n", args[1], args[2], args[3])), true)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := make([]string, 0, len(series))
+		for key := range series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var lines []string
+		for _, key := range keys {
+			samples := series[key]
+			if agg != nil {
+				samples = agg.Apply(samples)
 			}
 
-			// We authenticate the client
-			authenticated = true
-			_, err = conn.Write([]byte("OK authenticated\r\n"))
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+			for _, sample := range samples {
+				lines = append(lines, fmt.Sprintf("%s %d %s\r\n", key, sample.Timestamp, timeseries.FormatValue(sample.Value)))
 			}
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n%s", len(lines), strings.Join(lines, ""))), nil
+	}
+
+	return nil, fmt.Errorf("invalid command")
+}
+
+// shardSamples sends a raw TS.RANGE or TS.MRANGE to every shard and merges the samples by key in time order
+// keyed is true when the response lines start with the key
+func (c *Cluster) shardSamples(command []byte, keyed bool) (map[string][]timeseries.Sample, error) {
+	series := make(map[string][]timeseries.Sample)
+	key := strings.Fields(string(command))[1]
+
+	for _, rec := range c.queryShards(command, (*client.Client).ReceiveLines) {
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
 			continue
-		case strings.HasPrefix(string(command), "PING"):
-			_, err = conn.Write([]byte("OK PONG\r\n"))
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-		case strings.HasPrefix(string(command), "PUT"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+		}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+		lines := strings.Split(strings.TrimSpace(string(rec)), "\r\n")
+		if _, ok := series[key]; !ok && !keyed {
+			// The series exists on this shard even if no samples are in range
+			series[key] = nil
+		}
 
-			response, err := h.Cluster.WriteToNode(command)
-			if err != nil {
-				_, err = conn.Write([]byte("ERR write error\r\n"))
-				if err != nil {
-					h.Cluster.NodeConnectionsLock.RUnlock()
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-			} else {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write(response)
-				if err != nil {
-					h.Cluster.NodeConnectionsLock.RUnlock()
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-			}
-		case strings.HasPrefix(string(command), "DEL"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+		for _, line := range lines[1:] {
+			fields := strings.Fields(line)
+			if keyed && len(fields) == 3 {
+				key, fields = fields[0], fields[1:]
 			}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid shard response")
 			}
 
-			response, err := h.Cluster.ParallelDelete(command)
+			timestamp, err := strconv.ParseInt(fields[0], 10, 64)
 			if err != nil {
-				_, err = conn.Write([]byte("ERR read error\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
+				return nil, err
 			}
 
-			_, err = conn.Write(response)
+			value, err := strconv.ParseFloat(fields[1], 64)
 			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-		case strings.HasPrefix(string(command), "GET"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+				return nil, err
 			}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
+			series[key] = append(series[key], timeseries.Sample{Timestamp: timestamp, Value: value})
+		}
+	}
+
+	for _, samples := range series {
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+	}
+
+	return series, nil
+}
+
+// Document runs a JSON document command
+// A document lives on a single primary node, setting the root replaces any other copy and other updates
+// are sent to every primary node where only the one holding the document applies them
+func (c *Cluster) Document(command []byte) ([]byte, error) {
+	args := strings.SplitN(strings.TrimSuffix(string(command), "\r\n"), " ", 4)
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	var responses [][]byte
+	switch {
+	case args[0] == "JSON.GET":
+		responses = c.queryShards(command, (*client.Client).ReceiveLine)
+	case args[0] == "JSON.SET" && len(args) > 2 && args[2] == "$":
+		rec, err := c.replaceOnShards(args[1], command)
+		if err != nil {
+			return nil, err
+		}
+		responses = [][]byte{rec}
+	default:
+		responses = c.broadcastToPrimaries(command)
+	}
+
+	// The shard holding the document answers, the others do not have the key
+	err := fmt.Errorf("key not found")
+	for _, rec := range responses {
+		if bytes.HasPrefix(rec, []byte("OK")) {
+			return rec, nil
+		}
+
+		if shardErr := shardError(rec); shardErr != nil {
+			err = shardErr
+		}
+	}
+
+	return nil, err
+}
+
+// createOnPrimaries sends a create command to every primary node
+// Returns the first successful response, or an error if no primary node created it
+func (c *Cluster) createOnPrimaries(command []byte) ([]byte, error) {
+	err := fmt.Errorf("no primary nodes available")
+	for _, rec := range c.broadcastToPrimaries(command) {
+		if bytes.HasPrefix(rec, []byte("OK")) {
+			return rec, nil
+		}
+
+		if shardErr := shardError(rec); shardErr != nil {
+			err = shardErr
+		}
+	}
+
+	return nil, err
+}
+
+// Vector runs a vector command
+// Indexes are created on every primary node, a vector lives on a single one and searches merge the nearest
+// vectors of every shard
+func (c *Cluster) Vector(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
+	if len(args) < 3 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	switch args[0] {
+	case "VCREATE":
+		return c.createOnPrimaries(command)
+	case "VADD":
+		// Setting a vector again replaces the copy wherever it is
+		return c.replaceOnShards(args[1], command)
+	case "VSEARCH":
+		k, _, _, _, err := vector.ParseSearchArgs(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		var results []vector.Result
+		answered := false
+		for _, rec := range c.queryShards(command, (*client.Client).ReceiveLines) {
+			if !bytes.HasPrefix(rec, []byte("OK ")) {
+				// A shard error is only returned if no shard could search
+				if shardErr := shardError(rec); shardErr != nil {
+					err = shardErr
 				}
 				continue
 			}
+			answered = true
 
-			response, err := h.Cluster.ParallelGet(command)
-			if err != nil {
-				_, err = conn.Write([]byte("ERR read error\r\n"))
-				if err != nil {
-					h.Cluster.NodeConnectionsLock.RUnlock()
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
+			lines := strings.Split(strings.TrimSpace(string(rec)), "\r\n")
+			for _, line := range lines[1:] {
+				fields := strings.Fields(line)
+				if len(fields) != 2 {
+					return nil, fmt.Errorf("invalid shard response")
 				}
 
+				distance, err := strconv.ParseFloat(fields[1], 32)
 				if err != nil {
-					_, err = conn.Write([]byte("ERR write error\r\n"))
-					if err != nil {
-						h.Cluster.NodeConnectionsLock.RUnlock()
-						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-						return
-					}
+					return nil, err
 				}
-				h.Cluster.NodeConnectionsLock.RUnlock()
 
-				continue
+				results = append(results, vector.Result{Key: fields[0], Distance: float32(distance)})
 			}
+		}
 
-			h.Cluster.NodeConnectionsLock.RUnlock()
-
-			_, err = conn.Write(response)
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-		case strings.HasPrefix(string(command), "REGX"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+		if !answered {
+			if err == nil {
+				err = fmt.Errorf("no nodes available")
 			}
+			return nil, err
+		}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
+		vector.SortResults(results)
+		if len(results) > k {
+			results = results[:k]
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(float64(r.Distance), 'f', -1, 32))...)
+		}
+
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("invalid command")
+}
+
+// Search runs a full-text command
+// Indexes are created on every primary node and searches merge the best results of every shard.  Shards score
+// with their own term statistics, values spread evenly across shards keep the scores comparable
+func (c *Cluster) Search(command []byte) ([]byte, error) {
+	args := strings.SplitN(strings.TrimSuffix(string(command), "\r\n"), " ", 3)
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	switch args[0] {
+	case "FT.CREATE":
+		return c.createOnPrimaries(command)
+	case "SEARCH":
+		if len(args) < 3 {
+			return nil, fmt.Errorf("invalid command")
+		}
+
+		_, limit, err := fulltext.ParseSearchArgs(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		var results []fulltext.Result
+		answered := false
+		for _, rec := range c.queryShards(command, (*client.Client).ReceiveLines) {
+			if !bytes.HasPrefix(rec, []byte("OK ")) {
+				// A shard error is only returned if no shard could search
+				if shardErr := shardError(rec); shardErr != nil {
+					err = shardErr
 				}
 				continue
 			}
+			answered = true
 
-			response, err := h.Cluster.ParallelRegx(command)
-			if err != nil {
-				_, err = conn.Write([]byte("ERR read error\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
+			lines := strings.Split(strings.TrimSpace(string(rec)), "\r\n")
+			for _, line := range lines[1:] {
+				fields := strings.Fields(line)
+				if len(fields) != 2 {
+					return nil, fmt.Errorf("invalid shard response")
 				}
 
+				score, err := strconv.ParseFloat(fields[1], 64)
 				if err != nil {
-					_, err = conn.Write([]byte("ERR write error\r\n"))
-					if err != nil {
-						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-						return
-					}
+					return nil, err
 				}
 
-				continue
+				results = append(results, fulltext.Result{Key: fields[0], Score: score})
 			}
+		}
 
-			_, err = conn.Write(response)
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-		case strings.HasPrefix(string(command), "INCR"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+		if !answered {
+			if err == nil {
+				err = fmt.Errorf("no nodes available")
 			}
+			return nil, err
+		}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
-			}
+		fulltext.SortResults(results)
+		if len(results) > limit {
+			results = results[:limit]
+		}
 
-			// We write to all primary nodes in parallel
-			response, err := h.Cluster.ParallelIncrDecr(command)
-			if err != nil {
-				_, err = conn.Write([]byte("ERR write error\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(r.Score, 'f', -1, 64))...)
+		}
 
-				if err != nil {
-					_, err = conn.Write([]byte("ERR write error\r\n"))
-					if err != nil {
-						h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-						return
-					}
-				}
+		return response, nil
+	}
 
-				continue
+	return nil, fmt.Errorf("invalid command")
+}
+
+// Query runs a QUERY command
+// The query is validated here and pushed down to every shard in canonical form.  Like ParallelRegx, a key returned by
+// several shards keeps its newest copy
+func (c *Cluster) Query(command []byte) ([]byte, error) {
+	q, err := query.Parse(strings.TrimPrefix(strings.TrimSuffix(string(command), "\r\n"), "QUERY"))
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		TimeStamp hlc.Timestamp
+		Line      string
+	}
+
+	results := make(map[string]*result)
+	answered := false
+
+	for _, rec := range c.queryShards([]byte(fmt.Sprintf("QUERY %s\r\n", q)), (*client.Client).ReceiveLines) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			// A shard error is only returned if no shard answered
+			if shardErr := shardError(rec); shardErr != nil {
+				err = shardErr
 			}
+			continue
+		}
+		answered = true
 
-			_, err = conn.Write(response)
+		lines := strings.Split(strings.TrimSuffix(string(rec), "\r\n"), "\r\n")
+		for _, line := range lines[1:] {
+			fields := strings.SplitN(line, " ", 3)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid shard response")
+			}
+
+			ts, err := hlc.Parse(fields[0])
 			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+				return nil, fmt.Errorf("invalid shard response")
 			}
 
-		case strings.HasPrefix(string(command), "DECR"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+			if existing, ok := results[fields[1]]; !ok || ts.After(existing.TimeStamp) {
+				results[fields[1]] = &result{TimeStamp: ts, Line: line}
 			}
+		}
+	}
 
-			// We check if there are any primary nodes
-			h.Cluster.NodeConnectionsLock.RLock()
-			if len(h.Cluster.NodeConnections) == 0 {
-				h.Cluster.NodeConnectionsLock.RUnlock()
-				_, err = conn.Write([]byte("ERR no primary nodes available\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+	if !answered {
+		if err == nil {
+			err = fmt.Errorf("no nodes available")
+		}
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if q.Limit > 0 && len(keys) > q.Limit {
+		keys = keys[:q.Limit]
+	}
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(keys)))
+	for _, key := range keys {
+		response = append(response, results[key].Line+"\r\n"...)
+	}
+
+	return response, nil
+}
+
+// Aggregate runs an AGG <COUNT|SUM|AVG|MIN|MAX> <pattern> [EXCLUDE <key>...] command in two phases
+// Every shard first lists its numeric keys matching the pattern.  A key found on several shards is only kept on the
+// shard with its newest copy, the other shards exclude it from the partial aggregates they return in the second phase
+func (c *Cluster) Aggregate(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
+	op, pattern, exclude, err := hashtable.ParseAggregateArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	if !slices.Contains(hashtable.AggregateOps, op) {
+		return nil, fmt.Errorf("invalid aggregation")
+	}
+
+	type copyOf struct {
+		TimeStamp hlc.Timestamp
+		Shard     int
+	}
+
+	newest := make(map[string]copyOf)
+	excluded := make([][]string, len(c.NodeConnections))
+	answered := make([]bool, len(c.NodeConnections))
+	keysCommand := strings.Join(append([]string{"AGG", "KEYS"}, args[2:]...), " ") + "\r\n"
+
+	for i, rec := range c.queryShards([]byte(keysCommand), (*client.Client).ReceiveLines) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			// A shard error is only returned if no shard answered
+			if shardErr := shardError(rec); shardErr != nil {
+				err = shardErr
 			}
+			continue
+		}
+		answered[i] = true
 
-			// We write to all primary nodes in parallel
-			response, err := h.Cluster.ParallelIncrDecr(command)
-			if err != nil {
-				_, err = conn.Write([]byte("ERR write error\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
+		lines := strings.Split(strings.TrimSuffix(string(rec), "\r\n"), "\r\n")
+		for _, line := range lines[1:] {
+			fields := strings.SplitN(line, " ", 2)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("invalid shard response")
 			}
 
-			_, err = conn.Write(response)
+			ts, err := hlc.Parse(fields[0])
 			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+				return nil, fmt.Errorf("invalid shard response")
 			}
 
-		case strings.HasPrefix(string(command), "QUIT"):
-			_, err = conn.Write([]byte("OK see ya later\r\n"))
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+			existing, ok := newest[fields[1]]
+			switch {
+			case !ok:
+				newest[fields[1]] = copyOf{TimeStamp: ts, Shard: i}
+			case ts.After(existing.TimeStamp):
+				excluded[existing.Shard] = append(excluded[existing.Shard], fields[1])
+				newest[fields[1]] = copyOf{TimeStamp: ts, Shard: i}
+			default:
+				excluded[i] = append(excluded[i], fields[1])
 			}
+		}
+	}
 
-			return
-		case strings.HasPrefix(string(command), "STAT"):
-			stats := h.Cluster.Stats()
+	if !slices.Contains(answered, true) {
+		if err == nil {
+			err = fmt.Errorf("no nodes available")
+		}
+		return nil, err
+	}
 
-			_, err = conn.Write(stats)
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+	responses := make([][]byte, len(c.NodeConnections))
+	wg := sync.WaitGroup{}
+
+	for i, nodeConn := range c.NodeConnections {
+		if !answered[i] {
+			continue
+		}
+
+		partialCommand := []string{"AGG", "PARTIAL", pattern}
+		if skip := append(slices.Clone(exclude), excluded[i]...); len(skip) > 0 {
+			partialCommand = append(append(partialCommand, "EXCLUDE"), skip...)
+		}
+
+		wg.Add(1)
+		go func(i int, nodeConn *NodeConnection, command []byte) {
+			defer wg.Done()
+			responses[i] = c.queryShard(nodeConn, command, (*client.Client).ReceiveLine)
+		}(i, nodeConn, []byte(strings.Join(partialCommand, " ")+"\r\n"))
+	}
+
+	wg.Wait()
+
+	var agg hashtable.Aggregate
+	for i, rec := range responses {
+		if !answered[i] {
+			continue
+		}
+
+		// A shard that answered the first phase must answer the second, or keys it won would be missing
+		if rec == nil {
+			return nil, fmt.Errorf("no nodes available")
+		}
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
+
+		partial, err := hashtable.ParseAggregate(strings.TrimPrefix(strings.TrimSpace(string(rec)), "OK "))
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard response")
+		}
+
+		agg.Merge(partial)
+	}
+
+	result, err := agg.Result(op)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("OK %s\r\n", result)), nil
+}
+
+// GetAt runs a GET <key> AT <timestamp> command
+// Every shard answers with the version of the key current at the time, the newest of them is returned
+func (c *Cluster) GetAt(command []byte) ([]byte, error) {
+	var newest []byte
+	var newestTs time.Time
+	var err error
+
+	for _, rec := range c.queryShards(command, (*client.Client).ReceiveLine) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			if shardErr := shardError(rec); shardErr != nil {
+				err = shardErr
 			}
-		case strings.HasPrefix(string(command), "RCNF"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-				continue
+			continue
+		}
+
+		fields := strings.SplitN(string(rec), " ", 3)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid shard response")
+		}
+
+		ts, parseErr := time.Parse(time.RFC3339Nano, fields[1])
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid shard response")
+		}
+
+		if newest == nil || ts.After(newestTs) {
+			newest, newestTs = rec, ts
+		}
+	}
+
+	if newest != nil {
+		return newest, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, fmt.Errorf("key not found")
+}
+
+// ConditionalWrite runs a PUTNX, PUTXX or CAS command
+// The condition is checked against the newest copy of the key on every shard, a copy left on another shard by
+// round-robin writes is restored onto the node owning the key and the others are deleted.  The owner checks the
+// condition again under its lock and writes the key, so concurrent writes meet on the same node
+func (c *Cluster) ConditionalWrite(command []byte) ([]byte, error) {
+	fields := strings.Fields(string(command))
+	if len(fields) < 3 || (fields[0] == "CAS" && len(fields) < 4) {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	key := fields[1]
+
+	var expected hlc.Timestamp
+	if fields[0] == "CAS" {
+		var err error
+		if expected, err = hlc.Parse(fields[2]); err != nil {
+			return nil, fmt.Errorf("invalid version")
+		}
+	}
+
+	c.pull(key)
+
+	// We read every copy of the key
+	responses := c.queryShards([]byte(fmt.Sprintf("GET %s\r\n", key)), (*client.Client).ReceiveLine)
+
+	newest := -1
+	copies := make(map[int]hlc.Timestamp)
+	values := make(map[int]string)
+	var tombstone hlc.Timestamp
+	for i, rec := range responses {
+		if deleted, ok := deletedAt(rec); ok {
+			if deleted.After(tombstone) {
+				tombstone = deleted
 			}
+			continue
+		}
+
+		if err := shardError(rec); err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			continue
+		}
+
+		version, err := hlc.Parse(strings.Fields(string(rec))[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid shard response")
+		}
+
+		copies[i] = version
+		if parts := strings.SplitN(strings.TrimRight(string(rec), "\r\n"), " ", 4); len(parts) == 4 {
+			values[i] = parts[3]
+		}
+		if newest < 0 || version.After(copies[newest]) {
+			newest = i
+		}
+	}
+
+	// A delete newer than every copy means the key does not exist
+	if newest >= 0 && tombstone.After(copies[newest]) {
+		newest = -1
+	}
+
+	switch {
+	case fields[0] == "PUTNX" && newest >= 0:
+		return []byte(fmt.Sprintf("ERR key exists %s\r\n", copies[newest])), nil
+	case fields[0] != "PUTNX" && newest < 0:
+		return []byte("ERR key not found\r\n"), nil
+	case fields[0] == "CAS" && copies[newest] != expected:
+		return []byte(fmt.Sprintf("ERR version mismatch %s\r\n", copies[newest])), nil
+	}
+
+	nodeConn := c.owner(key)
+	if nodeConn == nil {
+		return nil, fmt.Errorf("slot has no owner")
+	}
+
+	target := slices.Index(c.NodeConnections, nodeConn)
+
+	nodeConn.Lock.Lock()
+	defer nodeConn.Lock.Unlock()
+
+	if !nodeConn.Health {
+		return nil, fmt.Errorf("node is down")
+	}
+
+	if newest >= 0 && newest != target {
+		// The newest copy is moved onto the owner so the owner checks the condition against it
+		rec, err := c.sendToNode(nodeConn, []byte(fmt.Sprintf("RESTORE %s %s %s\r\n", key, copies[newest], values[newest])))
+		if err != nil {
+			return nil, err
+		}
+
+		if !bytes.HasPrefix(rec, []byte("OK")) {
+			return nil, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(string(rec), "ERR")))
+		}
+	} else if version, ok := copies[target]; ok && newest < 0 {
+		// A stale copy on the owner of a deleted key is deleted first so the create is not refused
+		if _, err := c.sendToNode(nodeConn, []byte(fmt.Sprintf("DEL %s %s\r\n", key, version))); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, version := range copies {
+		if i != target {
+			c.deleteStale(c.NodeConnections[i], key, version)
+		}
+	}
+
+	if err := nodeConn.Client.Send(nodeConn.Context, command); err != nil {
+		return nil, err
+	}
+
+	return nodeConn.Client.ReceiveLine(nodeConn.Context)
+}
+
+// Migrate runs a MIGRATE command
+// String keys left on a shard that does not own their slot, such as the copies written round-robin before slots, are
+// restored onto their owner in batches then deleted from the shard.  A copy older than the one on the owner is only
+// deleted.  Responds with OK <n>, the number of keys moved off their shards
+func (c *Cluster) Migrate() ([]byte, error) {
+	if c.Slots == nil {
+		return nil, fmt.Errorf("no slots assigned")
+	}
+
+	moved := 0
+	for _, nodeConn := range c.NodeConnections {
+		misplaced := c.Slots.Ranges(nodeConn.Config.Node.ServerAddress).Complement()
+		if misplaced.Len() == 0 {
+			continue
+		}
 
-			err = h.Cluster.ReloadConfig()
+		// Keys that could not be moved stay on the shard, a batch without progress ends the migration of the shard
+		for {
+			n, err := c.migrateBatch(nodeConn, misplaced)
 			if err != nil {
-				_, err = conn.Write([]byte("ERR reload error\r\n"))
-				if err != nil {
-					h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
+				return nil, err
 			}
 
-			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+			if n == 0 {
+				break
 			}
-		default:
-			_, err = conn.Write([]byte("ERR unknown command\r\n"))
-			if err != nil {
-				h.Cluster.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+			moved += n
+		}
+	}
+
+	return []byte(fmt.Sprintf("OK %d\r\n", moved)), nil
+}
+
+// migrateBatch moves a batch of the keys of a shard in the given slots to their owners
+// Returns the number of keys deleted from the shard
+func (c *Cluster) migrateBatch(nodeConn *NodeConnection, misplaced slots.Ranges) (int, error) {
+	rec := c.sendLocked(nodeConn, []byte(fmt.Sprintf("SLOTDUMP %s COUNT %d\r\n", misplaced, MigrateBatchSize)), (*client.Client).ReceiveLines)
+	if rec == nil {
+		return 0, nil
+	}
+
+	if !bytes.HasPrefix(rec, []byte("OK ")) {
+		return 0, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(string(rec), "ERR")))
+	}
+
+	moved := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(rec)), "\r\n")[1:] {
+		// ENTRIES <key> <entry>... for keys other than strings
+		if strings.HasPrefix(line, "ENTRIES ") {
+			parts := strings.SplitN(strings.TrimPrefix(line, "ENTRIES "), " ", 2)
+			if len(parts) != 2 {
+				return moved, fmt.Errorf("invalid shard response")
+			}
+
+			if c.moveEntries(nodeConn, parts[0], parts[1]) {
+				moved++
 			}
+			continue
+		}
+
+		// <version> <key> <value>
+		parts := strings.SplitN(line, " ", 3)
+		if len(parts) != 3 {
+			return moved, fmt.Errorf("invalid shard response")
 		}
 
+		if c.moveKey(nodeConn, parts[1], parts[0], parts[2]) {
+			moved++
+		}
 	}
+
+	return moved, nil
 }
 
-// clusterStats retrieves basic stats for the cluster
-func (c *Cluster) clusterStats() []byte {
-	response := []byte(fmt.Sprintf("CLUSTER %s\r\n", c.Config.ServerConfig.Address))
+// moveKey restores a copy of a key onto the primary node owning its slot then deletes the copy from the source
+// Returns true if the copy was deleted from the source
+func (c *Cluster) moveKey(source *NodeConnection, key, version, value string) bool {
+	owner := c.owner(key)
+	if owner == nil || owner == source {
+		return false
+	}
 
-	// current sequence n
-	response = append(response, fmt.Sprintf("\tcurrent_sequence %d\r\n", c.Sequence.Load())...)
-	response = append(response, fmt.Sprintf("\tclient_connection_count %d\r\n", c.Server.GetConnCount())...)
+	restored := c.sendLocked(owner, []byte(fmt.Sprintf("RESTORE %s %s %s\r\n", key, version, value)), (*client.Client).ReceiveLine)
+	if !bytes.HasPrefix(restored, []byte("OK")) && !bytes.HasPrefix(restored, []byte("ERR key exists")) && !bytes.HasPrefix(restored, []byte("ERR key deleted")) {
+		c.Logger.Warn("restore error during migration", "key", key, "response", string(restored), "node", owner.Config.Node.ServerAddress)
+		return false
+	}
 
-	return response
+	// The owner has this copy or a newer one, the delete carries the version so it never hides a newer copy
+	deleted := c.sendLocked(source, []byte(fmt.Sprintf("DEL %s %s\r\n", key, version)), (*client.Client).ReceiveLine)
+	if !bytes.HasPrefix(deleted, []byte("OK")) {
+		c.Logger.Warn("delete error during migration", "key", key, "response", string(deleted), "node", source.Config.Node.ServerAddress)
+		return false
+	}
+
+	return true
 }
 
-// ParallelDelete deletes a key from all primary nodes in parallel
-func (c *Cluster) ParallelDelete(command []byte) ([]byte, error) {
-	// We delete from all primary nodes
-	var response *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
+// moveEntries restores a key other than a string onto the primary node owning its slot from the journal entries
+// rebuilding its value, the owner merges it with its own copy, then deletes the copy from the source
+// Returns true if the copy was deleted from the source
+func (c *Cluster) moveEntries(source *NodeConnection, key, entries string) bool {
+	owner := c.owner(key)
+	if owner == nil || owner == source {
+		return false
 	}
 
-	responseChannel := make(chan *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
-	}, len(c.NodeConnections))
+	restored := c.sendLocked(owner, []byte(fmt.Sprintf("RESTOREENTRIES %s %s\r\n", key, entries)), (*client.Client).ReceiveLine)
+	if !bytes.HasPrefix(restored, []byte("OK")) {
+		c.Logger.Warn("restore error during migration", "key", key, "response", string(restored), "node", owner.Config.Node.ServerAddress)
+		return false
+	}
 
-	wg := sync.WaitGroup{}
+	// The key lives on in the owner so the source drops its copy without a tombstone
+	deleted := c.sendLocked(source, []byte(fmt.Sprintf("DEL %s MOVED\r\n", key)), (*client.Client).ReceiveLine)
+	if !bytes.HasPrefix(deleted, []byte("OK")) {
+		c.Logger.Warn("delete error during migration", "key", key, "response", string(deleted), "node", source.Config.Node.ServerAddress)
+		return false
+	}
 
-	for _, nodeConn := range c.NodeConnections {
-		nodeConn.Lock.Lock()
+	return true
+}
 
-		if !nodeConn.Health {
-			nodeConn.Lock.Unlock()
-			continue
-		}
+// StartRebalance runs a REBALANCE command
+// The slots are spread evenly between the primary nodes keeping as many as possible in place, the new owners are saved
+// in the config and the keys of the moving slots are streamed in the background.  Responds with OK <n> slots moving,
+// the progress is reported by STAT
+func (c *Cluster) StartRebalance() ([]byte, error) {
+	c.ConfigLock.Lock()
+	defer c.ConfigLock.Unlock()
 
-		wg.Add(1)
-		go func(nodeConn *NodeConnection) {
-			defer wg.Done()
-			defer nodeConn.Lock.Unlock() // Always release the lock
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
 
-			// We send the command
-			err := nodeConn.Client.Send(nodeConn.Context, command)
-			if err != nil {
-				c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-				return
-			}
+	if c.Slots == nil {
+		return nil, fmt.Errorf("no slots assigned")
+	}
 
-			// We receive the response
-			rec, err := nodeConn.Client.Receive(nodeConn.Context)
-			if err != nil {
-				c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-				return
-			}
+	if c.Rebalance.Active() {
+		return nil, fmt.Errorf("rebalance in progress")
+	}
 
-			// If OK
-			if bytes.HasPrefix(rec, []byte("OK")) {
-				parts := bytes.Split(rec, []byte(" "))
-				if len(parts) < 3 {
-					c.Logger.Warn("invalid response format", "response", string(rec), "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+	if c.Decommissioning.Load() {
+		return nil, fmt.Errorf("decommission in progress")
+	}
 
-				// We parse the received response
-				timestamp := parts[1]
-				data := bytes.Join(parts[2:], []byte(" "))
+	moving, err := c.rebalanceWeighted()
+	if err != nil {
+		return nil, err
+	}
 
-				ts, err := time.Parse(time.RFC3339, string(timestamp))
-				if err != nil {
-					c.Logger.Warn("time parse error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+	return []byte(fmt.Sprintf("OK %d slots moving\r\n", moving)), nil
+}
 
-				// Send the response to the channel
-				responseChannel <- &struct {
-					TimeStamp time.Time
-					Data      []byte
-					Node      *NodeConnection
-				}{
-					TimeStamp: ts,
-					Data:      data,
-					Node:      nodeConn,
-				}
-			} else {
-				// This node doesn't have the key - log but don't treat as error
-				c.Logger.Debug("node doesn't have key to delete",
-					"node", nodeConn.Config.Node.ServerAddress,
-					"response", string(rec),
-					"command", string(command))
-			}
-		}(nodeConn)
+// rebalanceWeighted spreads the slots between the primary nodes in proportion to their placement weights, saves the
+// new owners in the config and starts moving the keys.  Returns the number of slots moving
+// The caller holds the config lock and the node connections lock
+func (c *Cluster) rebalanceWeighted() (int, error) {
+	owned := make(map[string]slots.Ranges)
+	nodes := make([]string, 0, len(c.Config.NodeConfigs))
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		owned[nodeConfig.Node.ServerAddress] = c.Slots.Ranges(nodeConfig.Node.ServerAddress)
+		nodes = append(nodes, nodeConfig.Node.ServerAddress)
 	}
 
-	// Wait in a separate goroutine and close the channel when done
-	go func() {
-		wg.Wait()
-		close(responseChannel)
-	}()
+	// Fuller or slower nodes get fewer slots
+	owned, err := slots.BalanceWeighted(owned, nodes, c.weights(nodes))
+	if err != nil {
+		return 0, err
+	}
 
-	// Process all responses and find the one with the most recent timestamp
-	responseLock := sync.Mutex{}
-	for resp := range responseChannel {
-		responseLock.Lock()
-		if response == nil || resp.TimeStamp.After(response.TimeStamp) {
-			response = resp
-		}
-		responseLock.Unlock()
+	table, err := slots.NewTable(owned)
+	if err != nil {
+		return 0, err
 	}
 
-	// If we didn't get any successful responses
-	if response == nil {
-		return []byte("ERR key not found\r\n"), nil
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		nodeConfig.Slots = owned[nodeConfig.Node.ServerAddress].String()
 	}
 
-	// Clean up any older versions on other nodes
-	for _, nodeConn := range c.NodeConnections {
-		if nodeConn != response.Node && nodeConn.Health {
-			// Run deletion in background to not block the main flow
-			go func(node *NodeConnection) {
-				node.Lock.Lock()
-				defer node.Lock.Unlock()
+	err = saveConfigFile(c.Wd, c.Config)
+	if err != nil {
+		return 0, err
+	}
 
-				key := bytes.Split(command, []byte(" "))[1]
-				err := node.Client.Send(node.Context, []byte(fmt.Sprintf("DEL %s", key)))
-				if err != nil {
-					c.Logger.Warn("cleanup delete error", "error", err, "node", node.Config.Node.ServerAddress)
-					return
-				}
+	return c.startRebalance(table, c.NodeConnections), nil
+}
 
-				// We don't need to check the response - it might not exist on this node
-				_, _ = node.Client.Receive(node.Context)
-			}(nodeConn)
-		}
+// rebalanceByLoad moves slots off primary nodes owning more than their weighted share so fuller or slower nodes own
+// fewer slots and get fewer new keys, a node at its memory threshold ends up owning none
+// Run by health checks, a node may own a tenth of an even share over its weighted share before slots move so small
+// changes in load do not move keys back and forth
+func (c *Cluster) rebalanceByLoad() {
+	c.ConfigLock.Lock()
+	defer c.ConfigLock.Unlock()
+
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
+
+	if c.Slots == nil || c.Rebalance.Active() || c.Decommissioning.Load() || len(c.Config.NodeConfigs) < 2 {
+		return
 	}
 
-	return response.Data, nil
-}
+	nodes := make([]string, 0, len(c.Config.NodeConfigs))
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		nodes = append(nodes, nodeConfig.Node.ServerAddress)
+	}
 
-// Stats get stats on the cluster and it's nodes
-func (c *Cluster) Stats() []byte {
-	response := []byte("OK\r\n")
+	if !c.overShare(nodes) {
+		return
+	}
 
-	// We get the cluster stats
-	response = append(response, c.clusterStats()...)
+	moving, err := c.rebalanceWeighted()
+	if err != nil {
+		c.Logger.Warn("rebalance by load error", "error", err)
+		return
+	}
 
-	// We send a stat command to all nodes in parallel to avoid blocking
-	var wg sync.WaitGroup
-	var responseLock sync.Mutex
+	c.Logger.Info("rebalancing slots by node load", "slots_moving", moving)
+}
 
-	for _, nodeConn := range c.NodeConnections {
-		nodeConn.Lock.Lock()
+// overShare returns true if one of the primary nodes with the addresses owns more slots than its weighted share and
+// the tolerance, the caller holds the node connections lock
+func (c *Cluster) overShare(nodes []string) bool {
+	shares := slots.Shares(c.weights(nodes), len(nodes))
+	tolerance := slots.Count / len(nodes) / 10
 
-		// Add node header to response
-		responseLock.Lock()
-		response = append(response, fmt.Sprintf("PRIMARY %s\r\n", nodeConn.Config.Node.ServerAddress)...)
-		responseLock.Unlock()
+	for i, node := range nodes {
+		if c.Slots.Ranges(node).Len() > shares[i]+tolerance {
+			return true
+		}
+	}
 
-		if !nodeConn.Health {
-			// Node is down
-			responseLock.Lock()
-			response = append(response, []byte("down\r\n")...)
-			responseLock.Unlock()
-			nodeConn.Lock.Unlock()
-		} else {
-			// Use goroutine to get stats from healthy node
-			wg.Add(1)
-			go func(nc *NodeConnection) {
-				defer wg.Done()
-				defer nc.Lock.Unlock()
+	return false
+}
 
-				// Send the STAT command
-				if err := nc.Client.Send(nc.Context, []byte("STAT\r\n")); err != nil {
-					c.Logger.Warn("write error", "error", err, "node", nc.Config.Node.ServerAddress)
-					responseLock.Lock()
-					response = append(response, []byte("error: failed to send command\r\n")...)
-					responseLock.Unlock()
-					return
+// weights returns the placement weights of the primary nodes with the addresses, in order
+// Weights are rounded to a tenth so small differences in load do not move slots, a node under its memory threshold
+// weighs at least a tenth so it keeps some slots
+func (c *Cluster) weights(nodes []string) []float64 {
+	c.Lock.RLock()
+	defer c.Lock.RUnlock()
+
+	weights := make([]float64, len(nodes))
+	for i, address := range nodes {
+		weights[i] = 1
+		for _, nodeConn := range c.NodeConnections {
+			if nodeConn.Config.Node.ServerAddress == address {
+				if weight := nodeConn.Load.weight(); weight > 0 {
+					weights[i] = max(math.Round(weight*10)/10, 0.1)
+				} else {
+					weights[i] = 0
 				}
+			}
+		}
+	}
 
-				// Receive the response
-				rec, err := nc.Client.Receive(nc.Context)
-				if err != nil {
-					c.Logger.Warn("read error", "error", err, "node", nc.Config.Node.ServerAddress)
-					responseLock.Lock()
-					response = append(response, []byte("error: failed to receive stats\r\n")...)
-					responseLock.Unlock()
-					return
-				}
+	return weights
+}
 
-				// Trim the OK prefix and add to response
-				rec = bytes.TrimPrefix(rec, []byte("OK\r\n"))
-				responseLock.Lock()
-				response = append(response, rec...)
-				responseLock.Unlock()
-			}(nodeConn)
+// startRebalance routes keys with the next slot table and moves the keys of the slots changing owner in the background
+// sources are the connections to the current owners, nodes removed from the config included, a removed node is closed
+// once its slots moved.  Returns the number of slots moving, the caller holds the node connections lock
+func (c *Cluster) startRebalance(next *slots.Table, sources []*NodeConnection) int {
+	r := &Rebalance{}
+	moving := 0
+	for _, move := range c.Slots.Moves(next) {
+		i := slices.IndexFunc(sources, func(nodeConn *NodeConnection) bool {
+			return nodeConn.Config.Node.ServerAddress == move.Source
+		})
+		if i < 0 {
+			continue
 		}
 
-		// Process replicas for this node
-		for _, replicaConn := range nodeConn.Replicas {
-			replicaConn.Lock.Lock()
+		r.Moves = append(r.Moves, &SlotMove{Source: sources[i], Target: move.Target, Ranges: move.Ranges})
+		moving += move.Ranges.Len()
+	}
 
-			// Add replica header to response
-			responseLock.Lock()
-			response = append(response, fmt.Sprintf("REPLICA %s\r\n", replicaConn.Config.ServerAddress)...)
-			responseLock.Unlock()
+	c.Slots = next
 
-			if !replicaConn.Health {
-				// Replica is down
-				responseLock.Lock()
-				response = append(response, []byte("down\r\n")...)
-				responseLock.Unlock()
-				replicaConn.Lock.Unlock()
-			} else {
-				// Use goroutine to get stats from healthy replica
-				wg.Add(1)
-				go func(rc *ReplicaConnection) {
-					defer wg.Done()
-					defer rc.Lock.Unlock()
+	if len(r.Moves) > 0 {
+		c.Rebalance = r
+		go c.rebalance(r)
+	}
 
-					// Send the STAT command
-					if err := rc.Client.Send(rc.Context, []byte("STAT\r\n")); err != nil {
-						c.Logger.Warn("write error", "error", err, "replica", rc.Config.ServerAddress)
-						responseLock.Lock()
-						response = append(response, []byte("error: failed to send command\r\n")...)
-						responseLock.Unlock()
-						return
-					}
+	return moving
+}
 
-					// Receive the response
-					rec, err := rc.Client.Receive(rc.Context)
-					if err != nil {
-						c.Logger.Warn("read error", "error", err, "replica", rc.Config.ServerAddress)
-						responseLock.Lock()
-						response = append(response, []byte("error: failed to receive stats\r\n")...)
-						responseLock.Unlock()
-						return
-					}
+// rebalance moves the slots then closes the nodes removed from the config
+func (c *Cluster) rebalance(r *Rebalance) {
+	c.moveSlots(r)
 
-					// Trim the OK prefix and add to response
-					rec = bytes.TrimPrefix(rec, []byte("OK\r\n"))
-					responseLock.Lock()
-					response = append(response, rec...)
-					responseLock.Unlock()
-				}(replicaConn)
-			}
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
+
+	// Nodes removed from the config are closed once their slots moved
+	for _, move := range r.Moves {
+		if !slices.Contains(c.NodeConnections, move.Source) {
+			c.closeNode(move.Source)
 		}
 	}
+}
 
-	// Wait for all stats gathering to complete
-	wg.Wait()
+// moveSlots streams the keys of the moving slots to their new owners in batches, one move at a time
+// Keys that could not be moved stay on the source and the move is marked failed, MIGRATE moves them later
+func (c *Cluster) moveSlots(r *Rebalance) {
+	for _, move := range r.Moves {
+		// A node just added to the config is connected by the next health check
+		deadline := time.Now().Add(3 * time.Duration(c.Config.HealthCheckInterval) * time.Second)
+		for !c.healthy(move.Target) && time.Now().Before(deadline) {
+			time.Sleep(QueuePollInterval)
+		}
 
-	return response
+		for {
+			c.NodeConnectionsLock.RLock()
+			n, err := c.migrateBatch(move.Source, move.Ranges)
+			c.NodeConnectionsLock.RUnlock()
+			if err != nil {
+				c.Logger.Warn("rebalance error", "error", err, "node", move.Source.Config.Node.ServerAddress)
+				break
+			}
+
+			if n == 0 {
+				break
+			}
+			move.Keys.Add(int64(n))
+		}
+
+		rec := c.sendLocked(move.Source, []byte(fmt.Sprintf("SLOTDUMP %s COUNT 1\r\n", move.Ranges)), (*client.Client).ReceiveLines)
+		if !bytes.Equal(rec, []byte("OK 0\r\n")) {
+			move.Failed.Store(true)
+			c.Logger.Warn("keys left after moving slots", "node", move.Source.Config.Node.ServerAddress, "target", move.Target, "slots", move.Ranges.String())
+		}
+
+		move.Done.Store(true)
+		c.Logger.Info("slots moved", "node", move.Source.Config.Node.ServerAddress, "target", move.Target, "slots", move.Ranges.String(), "keys", move.Keys.Load())
+	}
 }
 
-// ParallelIncrDecr increments a key in all primary nodes in parallel
-func (c *Cluster) ParallelIncrDecr(command []byte) ([]byte, error) {
-	// We incr|decr from all primary nodes
-	var response *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
+// closeNode closes the connections to a primary node and its read replicas
+func (c *Cluster) closeNode(nodeConn *NodeConnection) {
+	nodeConn.Lock.Lock()
+	if nodeConn.Client != nil && nodeConn.Health {
+		if err := nodeConn.Client.Close(); err != nil {
+			c.Logger.Warn("error closing node client", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+		}
+		nodeConn.Health = false
 	}
+	nodeConn.Lock.Unlock()
 
-	responseChannel := make(chan *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
-	}, len(c.NodeConnections))
+	for _, replicaConn := range nodeConn.Replicas {
+		replicaConn.Lock.Lock()
+		if replicaConn.Client != nil && replicaConn.Health {
+			if err := replicaConn.Client.Close(); err != nil {
+				c.Logger.Warn("error closing replica client", "error", err, "replica", replicaConn.Config.ServerAddress)
+			}
+			replicaConn.Health = false
+		}
+		replicaConn.Lock.Unlock()
+	}
+}
 
-	wg := sync.WaitGroup{}
+// Decommission runs a DECOMMISSION <address> command
+// The slots of the primary node are handed to the remaining primary nodes so it takes no new writes, then all of its
+// keys are streamed to their new owners with their versions.  Once the number of keys moved matches the number of keys
+// the node held it is removed from the config and closed with its read replicas.  Responds with OK <n> keys moved
+func (c *Cluster) Decommission(command []byte) ([]byte, error) {
+	fields := strings.Fields(string(command))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	// The config is locked while the slots are handed over, it cannot be reloaded or rebalanced until the node is gone
+	c.ConfigLock.Lock()
 
-	for _, nodeConn := range c.NodeConnections {
-		nodeConn.Lock.Lock()
+	if !c.Decommissioning.CompareAndSwap(false, true) {
+		c.ConfigLock.Unlock()
+		return nil, fmt.Errorf("decommission in progress")
+	}
+	defer c.Decommissioning.Store(false)
 
-		if !nodeConn.Health {
-			nodeConn.Lock.Unlock()
-			continue
-		}
+	c.NodeConnectionsLock.Lock()
 
-		wg.Add(1)
-		go func(nodeConn *NodeConnection) {
-			defer wg.Done()
-			defer nodeConn.Lock.Unlock() // Always release the lock
+	i := slices.IndexFunc(c.NodeConnections, func(nodeConn *NodeConnection) bool {
+		return nodeConn.Config.Node.ServerAddress == fields[1]
+	})
+	if i < 0 {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, fmt.Errorf("node not found")
+	}
+	nodeConn := c.NodeConnections[i]
 
-			// We send the command
-			err := nodeConn.Client.Send(nodeConn.Context, command)
-			if err != nil {
-				c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-				return
-			}
+	if len(c.NodeConnections) == 1 {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, fmt.Errorf("cannot decommission the last primary node")
+	}
 
-			// We receive the response
-			rec, err := nodeConn.Client.Receive(nodeConn.Context)
-			if err != nil {
-				c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-				return
-			}
+	if c.Rebalance.Active() {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, fmt.Errorf("rebalance in progress")
+	}
 
-			// If OK
-			if bytes.HasPrefix(rec, []byte("OK")) {
-				parts := bytes.Split(rec, []byte(" "))
-				if len(parts) < 3 {
-					c.Logger.Warn("invalid response format", "response", string(rec), "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+	all := slots.Even(1)[0]
+	before, err := c.countKeys(nodeConn, all)
+	if err != nil {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, err
+	}
 
-				// We parse the received response
-				timestamp := parts[1]
-				data := bytes.Join(parts[2:], []byte(" "))
+	owned := make(map[string]slots.Ranges)
+	var nodes []string
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		if nodeConfig.Node.ServerAddress != fields[1] {
+			owned[nodeConfig.Node.ServerAddress] = c.Slots.Ranges(nodeConfig.Node.ServerAddress)
+			nodes = append(nodes, nodeConfig.Node.ServerAddress)
+		}
+	}
 
-				ts, err := time.Parse(time.RFC3339, string(timestamp))
-				if err != nil {
-					c.Logger.Warn("time parse error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+	owned, err = slots.Balance(owned, nodes)
+	if err != nil {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, err
+	}
 
-				// Send the response to the channel
-				responseChannel <- &struct {
-					TimeStamp time.Time
-					Data      []byte
-					Node      *NodeConnection
-				}{
-					TimeStamp: ts,
-					Data:      data,
-					Node:      nodeConn,
-				}
-			} else {
-				// This node doesn't have the key or had an error - log but don't treat as error
-				c.Logger.Debug("node operation failed for incr/decr",
-					"node", nodeConn.Config.Node.ServerAddress,
-					"response", string(rec),
-					"command", string(command))
-			}
-		}(nodeConn)
+	table, err := slots.NewTable(owned)
+	if err != nil {
+		c.NodeConnectionsLock.Unlock()
+		c.ConfigLock.Unlock()
+		return nil, err
 	}
 
-	// Wait in a separate goroutine and close the channel when done
-	go func() {
-		wg.Wait()
-		close(responseChannel)
-	}()
+	// The node takes no new writes from now on, its keys are pulled to their new owners when used
+	c.NodeConnections = slices.Concat(c.NodeConnections[:i], c.NodeConnections[i+1:])
+	r := &Rebalance{}
+	for _, move := range c.Slots.Moves(table) {
+		r.Moves = append(r.Moves, &SlotMove{Source: nodeConn, Target: move.Target, Ranges: move.Ranges})
+	}
+	c.Slots = table
+	c.Rebalance = r
 
-	// Process all responses and find the one with the most recent timestamp
-	responseLock := sync.Mutex{}
-	for resp := range responseChannel {
-		responseLock.Lock()
-		if response == nil || resp.TimeStamp.After(response.TimeStamp) {
-			// If we found a newer response, clean up the older one
-			if response != nil {
-				// Run deletion in background to not block the main flow
-				go func(oldNode *NodeConnection) {
-					oldNode.Lock.Lock()
-					defer oldNode.Lock.Unlock()
-
-					if !oldNode.Health {
-						return
-					}
+	c.NodeConnectionsLock.Unlock()
 
-					key := bytes.Split(command, []byte(" "))[1]
-					err := oldNode.Client.Send(oldNode.Context, []byte(fmt.Sprintf("DEL %s", key)))
-					if err != nil {
-						c.Logger.Warn("cleanup delete error", "error", err, "node", oldNode.Config.Node.ServerAddress)
-						return
-					}
+	// Health checks keep running while the keys stream
+	c.ConfigLock.Unlock()
 
-					// Check delete response
-					delResp, err := oldNode.Client.Receive(oldNode.Context)
-					if err != nil {
-						c.Logger.Warn("cleanup read error", "error", err, "node", oldNode.Config.Node.ServerAddress)
-						return
-					}
+	c.moveSlots(r)
 
-					if bytes.HasPrefix(delResp, []byte("OK")) {
-						c.Logger.Info("deleted stale key during incr/decr",
-							"key", string(bytes.Split(command, []byte(" "))[1]),
-							"node", oldNode.Config.Node.ServerAddress)
-					}
-				}(response.Node)
-			}
+	var moved int64
+	for _, move := range r.Moves {
+		moved += move.Keys.Load()
+	}
 
-			response = resp
+	// Keys outside the slots the node owned, such as copies left by an earlier attempt, are moved too
+	for {
+		c.NodeConnectionsLock.RLock()
+		n, err := c.migrateBatch(nodeConn, all)
+		c.NodeConnectionsLock.RUnlock()
+		if err != nil || n == 0 {
+			break
 		}
-		responseLock.Unlock()
+		moved += int64(n)
 	}
 
-	// If we didn't get any successful responses
-	if response == nil {
-		return []byte("ERR key not found\r\n"), nil
-	}
+	c.ConfigLock.Lock()
+	defer c.ConfigLock.Unlock()
 
-	return response.Data, nil
-}
+	c.NodeConnectionsLock.Lock()
+	defer c.NodeConnectionsLock.Unlock()
 
-// ParallelGet reads from all replicas in parallel
-func (c *Cluster) ParallelGet(command []byte) ([]byte, error) {
-	// We get from all primary nodes and replicas
-	var response *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
+	left, err := c.countKeys(nodeConn, all)
+	if err != nil || left != 0 || moved < before {
+		// The node stays connected without slots, DECOMMISSION can be run again or MIGRATE moves the rest
+		c.NodeConnections = append(c.NodeConnections, nodeConn)
+		return nil, fmt.Errorf("%d of %d keys moved, node kept", moved, before)
 	}
 
-	responseChannel := make(chan *struct {
-		TimeStamp time.Time
-		Data      []byte
-		Node      *NodeConnection
-	}, len(c.NodeConnections)*2) // Buffer for all possible responses
+	c.Config.NodeConfigs = slices.DeleteFunc(slices.Clone(c.Config.NodeConfigs), func(nodeConfig *NodeConfig) bool {
+		return nodeConfig.Node.ServerAddress == fields[1]
+	})
+	// A failover while the keys streamed may have replaced a primary node
+	for _, nodeConfig := range c.Config.NodeConfigs {
+		nodeConfig.Slots = c.Slots.Ranges(nodeConfig.Node.ServerAddress).String()
+	}
 
-	wg := sync.WaitGroup{}
-	responseLock := sync.Mutex{}
+	err = saveConfigFile(c.Wd, c.Config)
+	if err != nil {
+		return nil, err
+	}
 
-	// Process all node connections
-	for _, nodeConn := range c.NodeConnections {
-		nodeConn.Lock.Lock()
+	// The node and its read replicas are retired
+	c.closeNode(nodeConn)
 
-		// Check if the primary node is healthy
-		if nodeConn.Health {
-			// Handle primary node
-			wg.Add(1)
-			go func(nodeConn *NodeConnection) {
-				defer wg.Done()
-				defer nodeConn.Lock.Unlock() // Always release the lock
+	c.Logger.Info("node decommissioned", "node", fields[1], "keys", moved)
 
-				// Send the command
-				err := nodeConn.Client.Send(nodeConn.Context, command)
-				if err != nil {
-					c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+	return []byte(fmt.Sprintf("OK %d keys moved\r\n", moved)), nil
+}
 
-				// Receive the response
-				rec, err := nodeConn.Client.Receive(nodeConn.Context)
-				if err != nil {
-					c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+// countKeys returns the number of string keys hashed to the slots on a primary node
+func (c *Cluster) countKeys(nodeConn *NodeConnection, ranges slots.Ranges) (int64, error) {
+	rec := c.sendLocked(nodeConn, []byte(fmt.Sprintf("SLOTCOUNT %s\r\n", ranges)), (*client.Client).ReceiveLine)
+	if rec == nil {
+		return 0, fmt.Errorf("node is down")
+	}
 
-				// If the response starts with "OK", this node has the data
-				if bytes.HasPrefix(rec, []byte("OK")) {
-					parts := bytes.Split(rec, []byte(" "))
-					if len(parts) < 3 {
-						c.Logger.Warn("invalid response format", "response", string(rec), "node", nodeConn.Config.Node.ServerAddress)
-						return
-					}
+	n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimPrefix(string(rec), "OK ")), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(string(rec), "ERR")))
+	}
 
-					timestamp := parts[1]
-					data := bytes.Join(parts[2:], []byte(" "))
+	return n, nil
+}
 
-					ts, err := time.Parse(time.RFC3339, string(timestamp))
-					if err != nil {
-						c.Logger.Warn("time parse error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-						return
-					}
+// healthy returns true if the primary node with the address is connected
+func (c *Cluster) healthy(address string) bool {
+	c.NodeConnectionsLock.RLock()
+	defer c.NodeConnectionsLock.RUnlock()
 
-					// Send this response to the channel
-					responseChannel <- &struct {
-						TimeStamp time.Time
-						Data      []byte
-						Node      *NodeConnection
-					}{
-						TimeStamp: ts,
-						Data:      data,
-						Node:      nodeConn,
-					}
-				} else {
-					// This node doesn't have the data - log it but don't treat as an error
-					c.Logger.Debug("node doesn't have key",
-						"node", nodeConn.Config.Node.ServerAddress,
-						"response", string(rec),
-						"command", string(command))
-				}
-			}(nodeConn)
-		} else {
-			// Primary node is unhealthy, release its lock
-			nodeConn.Lock.Unlock()
+	for _, nodeConn := range c.NodeConnections {
+		if nodeConn.Config.Node.ServerAddress == address {
+			nodeConn.Lock.Lock()
+			defer nodeConn.Lock.Unlock()
+			return nodeConn.Health
+		}
+	}
 
-			// Try replicas for this node
-			for _, replicaConn := range nodeConn.Replicas {
-				replicaConn.Lock.Lock()
+	return false
+}
 
-				if !replicaConn.Health {
-					// Replica is unhealthy, skip it
-					replicaConn.Lock.Unlock()
-					continue
-				}
+// pull moves a key in a moving slot from its old owner to its new one so a command on the key sees its latest copy
+// The caller holds the node connections lock
+func (c *Cluster) pull(key string) {
+	move := c.Rebalance.Move(key)
+	if move == nil {
+		return
+	}
 
-				// Process healthy replica
-				wg.Add(1)
-				go func(nodeConn *NodeConnection, replicaConn *ReplicaConnection) {
-					defer wg.Done()
-					defer replicaConn.Lock.Unlock() // Always release the lock
+	// OK <version> <key> <value>
+	rec := c.sendLocked(move.Source, []byte(fmt.Sprintf("GET %s\r\n", key)), (*client.Client).ReceiveLine)
+	parts := strings.SplitN(strings.TrimRight(string(rec), "\r\n"), " ", 4)
+	if len(parts) != 4 || parts[0] != "OK" {
+		return
+	}
 
-					// Send the command
-					err := replicaConn.Client.Send(replicaConn.Context, command)
-					if err != nil {
-						c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
-						return
-					}
+	if c.moveKey(move.Source, key, parts[1], parts[3]) {
+		move.Keys.Add(1)
+	}
+}
 
-					// Receive the response
-					rec, err := replicaConn.Client.Receive(replicaConn.Context)
-					if err != nil {
-						c.Logger.Warn("read error", "error", err, "replica", replicaConn.Config.ServerAddress)
-						return
-					}
+// Active returns true while slots are moving
+func (r *Rebalance) Active() bool {
+	if r == nil {
+		return false
+	}
 
-					// If the response starts with "OK", this replica has the data
-					if bytes.HasPrefix(rec, []byte("OK")) {
-						parts := bytes.Split(rec, []byte(" "))
-						if len(parts) < 3 {
-							c.Logger.Warn("invalid response format", "response", string(rec), "replica", replicaConn.Config.ServerAddress)
-							return
-						}
+	for _, move := range r.Moves {
+		if !move.Done.Load() {
+			return true
+		}
+	}
 
-						timestamp := parts[1]
-						data := bytes.Join(parts[2:], []byte(" "))
+	return false
+}
 
-						ts, err := time.Parse(time.RFC3339, string(timestamp))
-						if err != nil {
-							c.Logger.Warn("time parse error", "error", err, "replica", replicaConn.Config.ServerAddress)
-							return
-						}
+// Move returns the unfinished move of the slot of a key, nil if the slot is not moving
+func (r *Rebalance) Move(key string) *SlotMove {
+	if r == nil {
+		return nil
+	}
 
-						// Send this response to the channel
-						responseChannel <- &struct {
-							TimeStamp time.Time
-							Data      []byte
-							Node      *NodeConnection
-						}{
-							TimeStamp: ts,
-							Data:      data,
-							Node:      nodeConn,
-						}
-					} else {
-						// This replica doesn't have the data - log it but don't treat as an error
-						c.Logger.Debug("replica doesn't have key",
-							"replica", replicaConn.Config.ServerAddress,
-							"response", string(rec),
-							"command", string(command))
-					}
-				}(nodeConn, replicaConn)
-			}
+	slot := slots.Slot(key)
+	for _, move := range r.Moves {
+		if !move.Done.Load() && move.Ranges.Contains(slot) {
+			return move
 		}
 	}
 
-	// Wait in a separate goroutine
-	go func() {
-		wg.Wait()
-		close(responseChannel)
-	}()
+	return nil
+}
 
-	// Process all responses and find the one with the most recent timestamp
-	for resp := range responseChannel {
-		responseLock.Lock()
-		if response == nil || resp.TimeStamp.After(response.TimeStamp) {
-			// If we already have a response with an older timestamp, we should delete that key
-			if response != nil {
-				key := bytes.Split(command, []byte(" "))[1]
+// State returns moving, done or failed
+func (m *SlotMove) State() string {
+	switch {
+	case !m.Done.Load():
+		return "moving"
+	case m.Failed.Load():
+		return "failed"
+	default:
+		return "done"
+	}
+}
 
-				// Run deletion in background to not block the main flow
-				go func(oldNode *NodeConnection, keyToDelete []byte) {
-					oldNode.Lock.Lock()
-					defer oldNode.Lock.Unlock()
+// sendLocked sends a command to a healthy primary node under its lock and returns the response, nil if the node could
+// not answer
+func (c *Cluster) sendLocked(nodeConn *NodeConnection, command []byte, receive func(*client.Client, context.Context) ([]byte, error)) []byte {
+	nodeConn.Lock.Lock()
+	defer nodeConn.Lock.Unlock()
 
-					if !oldNode.Health {
-						return
-					}
+	if !nodeConn.Health {
+		return nil
+	}
 
-					err := oldNode.Client.Send(oldNode.Context, []byte(fmt.Sprintf("DEL %s", keyToDelete)))
-					if err != nil {
-						c.Logger.Warn("write error during cleanup", "error", err, "node", oldNode.Config.Node.ServerAddress)
-						return
-					}
+	err := nodeConn.Client.Send(nodeConn.Context, command)
+	if err != nil {
+		c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+		return nil
+	}
 
-					// Check deletion response
-					delResp, err := oldNode.Client.Receive(oldNode.Context)
-					if err != nil {
-						c.Logger.Warn("read error during cleanup", "error", err, "node", oldNode.Config.Node.ServerAddress)
-						return
-					}
+	rec, err := receive(nodeConn.Client, nodeConn.Context)
+	if err != nil {
+		c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
+		return nil
+	}
 
-					if !bytes.HasPrefix(delResp, []byte("OK")) {
-						c.Logger.Warn("delete error during cleanup", "response", string(delResp), "node", oldNode.Config.Node.ServerAddress)
-						return
-					}
+	return rec
+}
+
+// History runs a HISTORY <key> command
+// The versions kept by every shard are merged newest first, a version kept by several shards is returned once
+func (c *Cluster) History(command []byte) ([]byte, error) {
+	if len(strings.Fields(string(command))) != 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
+
+	var history []versions.Version
+	seen := make(map[string]bool)
+	answered := false
+	var err error
 
-					c.Logger.Info("deleted stale key", "key", string(keyToDelete), "node", oldNode.Config.Node.ServerAddress)
-				}(response.Node, key)
+	for _, rec := range c.queryShards(command, (*client.Client).ReceiveLines) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			// A shard error is only returned if no shard answered
+			if shardErr := shardError(rec); shardErr != nil {
+				err = shardErr
+			}
+			continue
+		}
+		answered = true
+
+		lines := strings.Split(strings.TrimSuffix(string(rec), "\r\n"), "\r\n")
+		for _, line := range lines[1:] {
+			v, err := versions.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid shard response")
 			}
 
-			// Update our response to the more recent one
-			response = resp
+			if !seen[line] {
+				seen[line] = true
+				history = append(history, v)
+			}
 		}
-		responseLock.Unlock()
 	}
 
-	// Check if we found any response
-	if response == nil {
-		return []byte("ERR key not found\r\n"), nil
+	if !answered {
+		if err == nil {
+			err = fmt.Errorf("no nodes available")
+		}
+		return nil, err
 	}
 
-	// Format the response data
-	return []byte(fmt.Sprintf("OK %s", response.Data)), nil
-}
+	sort.SliceStable(history, func(i, j int) bool { return history[i].Timestamp.After(history[j].Timestamp) })
 
-// ParallelRegx reads from all replicas in parallel using REGX command
-// replaces duplicate keys comparing timestamps
-func (c *Cluster) ParallelRegx(command []byte) ([]byte, error) {
-	// We collect results with keys as map keys for easy deduplication
-	resultMap := make(map[string]*struct {
-		TimeStamp time.Time
-		Key       []byte
-		Data      []byte
-		Node      *NodeConnection
-	})
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(history)))
+	for _, v := range history {
+		response = append(response, v.String()+"\r\n"...)
+	}
 
-	wg := sync.WaitGroup{}
-	resultLock := sync.Mutex{}
+	return response, nil
+}
 
-	// Process all nodes
-	for _, nodeConn := range c.NodeConnections {
-		nodeConn.Lock.Lock()
+// ScanShardShift is the bit position of the shard in a cluster scan cursor, the lower bits are the node cursor
+const ScanShardShift = 48
 
-		if !nodeConn.Health {
-			nodeConn.Lock.Unlock()
+// Scan runs a SCAN command
+// The cluster cursor encodes the shard being scanned and the cursor within it.  Shards are scanned one after another
+// in node connection order, a call returns the keys of a single shard and may return none when moving to the next one
+func (c *Cluster) Scan(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
 
-			// Process replicas if primary is down
-			for _, replicaConn := range nodeConn.Replicas {
-				replicaConn.Lock.Lock()
+	cursor, _, _, _, err := hashtable.ParseScanArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
 
-				if !replicaConn.Health {
-					replicaConn.Lock.Unlock()
-					continue
-				}
+	shard := int(cursor >> ScanShardShift)
+	if shard >= len(c.NodeConnections) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
 
-				wg.Add(1)
-				go func(nodeConn *NodeConnection, replicaConn *ReplicaConnection) {
-					defer wg.Done()
-					defer replicaConn.Lock.Unlock()
+	// We ask the shard with its own cursor
+	args[1] = strconv.FormatUint(cursor&(1<<ScanShardShift-1), 10)
+	rec := c.queryShard(c.NodeConnections[shard], []byte(strings.Join(args, " ")+"\r\n"), (*client.Client).ReceiveLines)
+	if rec == nil {
+		return nil, fmt.Errorf("no nodes available")
+	}
 
-					// Send the command
-					err := replicaConn.Client.Send(replicaConn.Context, command)
-					if err != nil {
-						c.Logger.Warn("write error", "error", err, "replica", replicaConn.Config.ServerAddress)
-						return
-					}
+	if !bytes.HasPrefix(rec, []byte("OK ")) {
+		return rec, nil
+	}
 
-					// Receive the response
-					rec, err := replicaConn.Client.Receive(replicaConn.Context)
-					if err != nil {
-						c.Logger.Warn("read error", "error", err, "replica", replicaConn.Config.ServerAddress)
-						return
-					}
+	lines := strings.Split(strings.TrimSpace(string(rec)), "\r\n")
+	header := strings.Fields(lines[0])
+	if len(header) != 3 {
+		return nil, fmt.Errorf("invalid shard response")
+	}
 
-					// Process successful response
-					if bytes.HasPrefix(rec, []byte("OK")) {
-						results := bytes.Split(rec, []byte("\r\n"))
-						for i, result := range results {
-							if len(result) == 0 {
-								continue
-							}
+	next, err := strconv.ParseUint(header[2], 10, 64)
+	if err != nil || next >= 1<<ScanShardShift {
+		return nil, fmt.Errorf("invalid shard response")
+	}
 
-							// Parse the result line
-							var timestampBytes []byte
-							var keyBytes []byte
-							var dataBytes []byte
+	// A finished shard moves the scan to the next one, the scan ends after the last shard
+	if next == 0 && shard+1 < len(c.NodeConnections) {
+		next = uint64(shard+1) << ScanShardShift
+	} else if next != 0 {
+		next |= uint64(shard) << ScanShardShift
+	}
 
-							parts := bytes.Split(result, []byte(" "))
-							if len(parts) < 2 {
-								continue
-							}
+	response := []byte(fmt.Sprintf("OK %d %d\r\n", len(lines)-1, next))
+	for _, key := range lines[1:] {
+		response = append(response, key+"\r\n"...)
+	}
 
-							if i == 0 { // First line format OK <timestamp> <key> <data>
-								if len(parts) < 3 {
-									continue
-								}
-								timestampBytes = parts[1]
-								keyBytes = parts[2]
-								dataBytes = bytes.Join(parts[3:], []byte(" "))
-							} else { // Other lines format <timestamp> <key> <data>
-								timestampBytes = parts[0]
-								keyBytes = parts[1]
-								dataBytes = bytes.Join(parts[2:], []byte(" "))
-							}
+	return response, nil
+}
 
-							// Parse timestamp
-							ts, err := time.Parse(time.RFC3339, string(timestampBytes))
-							if err != nil {
-								c.Logger.Warn("time parse error", "error", err, "replica", replicaConn.Config.ServerAddress)
-								continue
-							}
+// Ordered runs a RANGE or PREFIX command
+// Every shard returns its keys in order and the sorted lists are merged, each shard applies the limit so the
+// first limit keys of the merge are the first limit keys of the cluster
+func (c *Cluster) Ordered(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
+
+	var limit int
+	var err error
+	switch args[0] {
+	case "RANGE":
+		_, _, limit, err = hashtable.ParseRangeArgs(args[1:])
+	case "PREFIX":
+		_, limit, err = hashtable.ParsePrefixArgs(args[1:])
+	default:
+		err = fmt.Errorf("invalid command")
+	}
+	if err != nil {
+		return nil, err
+	}
 
-							// Add to results map with deduplication
-							resultLock.Lock()
-							keyStr := string(keyBytes)
-							existing, exists := resultMap[keyStr]
+	var lists [][]string
+	for _, rec := range c.queryShards(command, (*client.Client).ReceiveLines) {
+		if !bytes.HasPrefix(rec, []byte("OK ")) {
+			// A shard error is only returned if no shard answered
+			if shardErr := shardError(rec); shardErr != nil {
+				err = shardErr
+			}
+			continue
+		}
 
-							if !exists || ts.After(existing.TimeStamp) {
-								// Replace or add new entry
-								resultMap[keyStr] = &struct {
-									TimeStamp time.Time
-									Key       []byte
-									Data      []byte
-									Node      *NodeConnection
-								}{
-									TimeStamp: ts,
-									Key:       keyBytes,
-									Data:      dataBytes,
-									Node:      nodeConn,
-								}
+		lines := strings.Split(strings.TrimSpace(string(rec)), "\r\n")
+		lists = append(lists, lines[1:])
+	}
 
-								// If we had an older version, schedule it for deletion
-								if exists && !bytes.Equal(existing.Key, keyBytes) {
-									go func(n *NodeConnection, k []byte) {
-										n.Lock.Lock()
-										defer n.Lock.Unlock()
-										if !n.Health {
-											return
-										}
+	if lists == nil {
+		if err == nil {
+			err = fmt.Errorf("no nodes available")
+		}
+		return nil, err
+	}
 
-										err := n.Client.Send(n.Context, []byte(fmt.Sprintf("DEL %s", k)))
-										if err != nil {
-											return
-										}
+	keys := mergeSorted(lists, limit)
 
-										// Just receive without checking
-										_, _ = n.Client.Receive(n.Context)
-									}(existing.Node, existing.Key)
-								}
-							}
-							resultLock.Unlock()
-						}
-					}
-				}(nodeConn, replicaConn)
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(keys)))
+	for _, key := range keys {
+		response = append(response, key+"\r\n"...)
+	}
+
+	return response, nil
+}
+
+// mergeSorted merges sorted lists of keys into one sorted list without duplicates
+// A limit of 0 keeps every key
+func mergeSorted(lists [][]string, limit int) []string {
+	var merged []string
+	positions := make([]int, len(lists))
+
+	for limit <= 0 || len(merged) < limit {
+		// We pick the smallest head of the lists
+		smallest := -1
+		for i, list := range lists {
+			if positions[i] < len(list) && (smallest < 0 || list[positions[i]] < lists[smallest][positions[smallest]]) {
+				smallest = i
 			}
-		} else {
-			// Process healthy primary node
-			wg.Add(1)
-			go func(nodeConn *NodeConnection) {
-				defer wg.Done()
-				defer nodeConn.Lock.Unlock()
+		}
 
-				// Send the command
-				err := nodeConn.Client.Send(nodeConn.Context, command)
-				if err != nil {
-					c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+		if smallest < 0 {
+			break
+		}
 
-				// Receive the response
-				rec, err := nodeConn.Client.Receive(nodeConn.Context)
-				if err != nil {
-					c.Logger.Warn("read error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-					return
-				}
+		key := lists[smallest][positions[smallest]]
+		positions[smallest]++
 
-				// Process successful response
-				if bytes.HasPrefix(rec, []byte("OK")) {
-					results := bytes.Split(rec, []byte("\r\n"))
-					for i, result := range results {
-						if len(result) == 0 {
-							continue
-						}
+		if len(merged) == 0 || merged[len(merged)-1] != key {
+			merged = append(merged, key)
+		}
+	}
 
-						// Parse the result line
-						var timestampBytes []byte
-						var keyBytes []byte
-						var dataBytes []byte
+	return merged
+}
 
-						parts := bytes.Split(result, []byte(" "))
-						if len(parts) < 2 {
-							continue
-						}
+// replaceOnShards deletes a key from every primary node then stores a new value on one of them
+func (c *Cluster) replaceOnShards(key string, store []byte) ([]byte, error) {
+	c.broadcastToPrimaries([]byte(fmt.Sprintf("DEL %s\r\n", key)))
+	return c.WriteToNode(store)
+}
 
-						if i == 0 { // First line format OK <timestamp> <key> <data>
-							if len(parts) < 3 {
-								continue
-							}
-							timestampBytes = parts[1]
-							keyBytes = parts[2]
-							dataBytes = bytes.Join(parts[3:], []byte(" "))
-						} else { // Other lines format <timestamp> <key> <data>
-							timestampBytes = parts[0]
-							keyBytes = parts[1]
-							dataBytes = bytes.Join(parts[2:], []byte(" "))
-						}
+// Analytics runs a bitmap or hyperloglog command
+// Copies of a key on different shards are merged rather than versioned, a bitmap is the OR of its copies
+// and a hyperloglog the max of each register, so writes can go to any primary node
+func (c *Cluster) Analytics(command []byte) ([]byte, error) {
+	args := strings.Fields(string(command))
+	if len(args) < 2 {
+		return nil, fmt.Errorf("invalid command")
+	}
 
-						// Parse timestamp
-						ts, err := time.Parse(time.RFC3339, string(timestampBytes))
-						if err != nil {
-							c.Logger.Warn("time parse error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
-							continue
-						}
+	key := args[1]
 
-						// Add to results map with deduplication
-						resultLock.Lock()
-						keyStr := string(keyBytes)
-						existing, exists := resultMap[keyStr]
+	switch args[0] {
+	case "SETBIT":
+		// SETBIT <key> <offset> <0|1>
+		if len(args) != 4 || (args[3] != "0" && args[3] != "1") {
+			return nil, fmt.Errorf("invalid command")
+		}
 
-						if !exists || ts.After(existing.TimeStamp) {
-							// Replace or add new entry
-							resultMap[keyStr] = &struct {
-								TimeStamp time.Time
-								Key       []byte
-								Data      []byte
-								Node      *NodeConnection
-							}{
-								TimeStamp: ts,
-								Key:       keyBytes,
-								Data:      dataBytes,
-								Node:      nodeConn,
-							}
+		// We find which shards have the bit set
+		responses := c.queryShards([]byte(fmt.Sprintf("GETBIT %s %s\r\n", key, args[2])), (*client.Client).ReceiveLine)
+		old := 0
+		for _, rec := range responses {
+			if err := shardError(rec); err != nil {
+				return nil, err
+			}
 
-							// If we had an older version, schedule it for deletion
-							if exists && !bytes.Equal(existing.Key, keyBytes) {
-								go func(n *NodeConnection, k []byte) {
-									n.Lock.Lock()
-									defer n.Lock.Unlock()
-									if !n.Health {
-										return
-									}
+			if bytes.HasPrefix(rec, []byte("OK 1")) {
+				old = 1
+			}
+		}
 
-									err := n.Client.Send(n.Context, []byte(fmt.Sprintf("DEL %s", k)))
-									if err != nil {
-										return
-									}
+		if args[3] == "1" && old == 0 {
+			rec, err := c.WriteToNode(command)
+			if err != nil {
+				return nil, err
+			}
 
-									// Just receive without checking
-									_, _ = n.Client.Receive(n.Context)
-								}(existing.Node, existing.Key)
-							}
-						}
-						resultLock.Unlock()
+			if err = shardError(rec); err != nil {
+				return nil, err
+			}
+		}
+
+		if args[3] == "0" && old == 1 {
+			// The bit is cleared on every primary node that has it set
+			for i, rec := range responses {
+				if !bytes.HasPrefix(rec, []byte("OK 1")) {
+					continue
+				}
+
+				nodeConn := c.NodeConnections[i]
+				nodeConn.Lock.Lock()
+				if nodeConn.Health {
+					_, err := c.sendToNode(nodeConn, command)
+					if err != nil {
+						c.Logger.Warn("write error", "error", err, "node", nodeConn.Config.Node.ServerAddress)
 					}
 				}
-			}(nodeConn)
+				nodeConn.Lock.Unlock()
+			}
 		}
-	}
 
-	// Wait for all goroutines to finish
-	wg.Wait()
+		return []byte(fmt.Sprintf("OK %d\r\n", old)), nil
+	case "GETBIT":
+		// GETBIT <key> <offset>
+		if len(args) != 3 {
+			return nil, fmt.Errorf("invalid command")
+		}
 
-	// Check if we found any results
-	if len(resultMap) == 0 {
-		return []byte("ERR no keys found\r\n"), nil
-	}
+		bit := 0
+		for _, rec := range c.queryShards(command, (*client.Client).ReceiveLine) {
+			if err := shardError(rec); err != nil {
+				return nil, err
+			}
 
-	// Format final response
-	var responseArray [][]byte
-	responseArray = append(responseArray, []byte("OK"))
+			if bytes.HasPrefix(rec, []byte("OK 1")) {
+				bit = 1
+			}
+		}
 
-	// Convert map to array of results
-	for _, result := range resultMap {
-		responseArray = append(responseArray, []byte(fmt.Sprintf("%s %s", result.Key, result.Data)))
-	}
+		return []byte(fmt.Sprintf("OK %d\r\n", bit)), nil
+	case "BITCOUNT":
+		// BITCOUNT <key> [<start byte> <end byte>]
+		start, end := int64(0), int64(-1)
+		if len(args) == 4 {
+			var err error
+			start, end, err = bitmap.ParseRange(args[2], args[3])
+			if err != nil {
+				return nil, err
+			}
+		} else if len(args) != 2 {
+			return nil, fmt.Errorf("invalid command")
+		}
 
-	// Join with CRLF
-	response := bytes.Join(responseArray, []byte("\r\n"))
-	response = append(response, []byte("\r\n")...)
+		merged, err := c.mergedBitmap(key)
+		if err != nil {
+			return nil, err
+		}
 
-	return response, nil
-}
+		if merged == nil {
+			return []byte("OK 0\r\n"), nil
+		}
 
-// WriteToNode writes to a primary node in sequence
-// Always starts at 0 and goes up to connected node count
-func (c *Cluster) WriteToNode(data []byte) ([]byte, error) {
-	// Handle single node case first
-	if len(c.NodeConnections) == 1 {
+		return []byte(fmt.Sprintf("OK %d\r\n", merged.Count(start, end))), nil
+	case "BITOP":
+		// BITOP <AND|OR|XOR|NOT> <destination> <source>...
+		if len(args) < 4 {
+			return nil, fmt.Errorf("invalid command")
+		}
 
-		nodeConn := c.NodeConnections[0]
-		if !nodeConn.Health {
-			return nil, fmt.Errorf("node is down")
+		var sources []*bitmap.Bitmap
+		for _, src := range args[3:] {
+			merged, err := c.mergedBitmap(src)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, merged)
+		}
+
+		result, err := bitmap.Op(args[1], sources)
+		if err != nil {
+			return nil, err
+		}
+
+		rec, err := c.replaceOnShards(args[2], []byte(fmt.Sprintf("BITSTORE %s %s\r\n", args[2], result.Encode())))
+		if err != nil {
+			return nil, err
 		}
-		return c.sendToNode(nodeConn, data)
-	}
 
-	// Try writing to nodes starting from current sequence
-	startSeq := c.Sequence.Load()
-	attempts := 0
-	maxAttempts := len(c.NodeConnections)
+		if err = shardError(rec); err != nil {
+			return nil, err
+		}
 
-	for attempts < maxAttempts {
-		seq := (startSeq + int32(attempts)) % int32(len(c.NodeConnections))
-		nodeConn := c.NodeConnections[seq]
+		return []byte(fmt.Sprintf("OK %d\r\n", len(result.Bits))), nil
+	case "PFADD":
+		// PFADD <key> <element>...
+		return c.WriteToNode(command)
+	case "PFCOUNT":
+		// PFCOUNT <key>...
+		merged, err := c.mergedHyperLogLog(args[1:])
+		if err != nil {
+			return nil, err
+		}
 
-		if nodeConn.Health {
-			response, err := c.sendToNode(nodeConn, data)
-			if err == nil {
-				// Only update sequence on successful write
-				c.Sequence.Store((seq + 1) % int32(len(c.NodeConnections)))
-				return response, nil
-			}
+		return []byte(fmt.Sprintf("OK %d\r\n", merged.Count())), nil
+	case "PFMERGE":
+		// PFMERGE <destination> <source>...
+		merged, err := c.mergedHyperLogLog(args[1:])
+		if err != nil {
+			return nil, err
 		}
 
-		attempts++
+		rec, err := c.replaceOnShards(key, []byte(fmt.Sprintf("PFSTORE %s %s\r\n", key, merged.Encode())))
+		if err != nil {
+			return nil, err
+		}
+
+		if err = shardError(rec); err != nil {
+			return nil, err
+		}
+
+		return []byte("OK\r\n"), nil
 	}
 
-	return nil, fmt.Errorf("no healthy nodes available")
+	return nil, fmt.Errorf("invalid command")
 }
 
 // sendToNode sends data to a node and returns the response
@@ -1791,14 +5100,41 @@ func (c *Cluster) ReloadConfig() error {
 	c.ConfigLock.Lock()
 	defer c.ConfigLock.Unlock()
 
+	// The config file still lists a node being decommissioned
+	if c.Decommissioning.Load() {
+		return fmt.Errorf("decommission in progress")
+	}
+
 	// Open the existing config file
 	config, err := openExistingConfigFile(c.Wd)
 	if err != nil {
 		return err
 	}
 
+	// Slots left without an owner by removed nodes and new nodes without slots are balanced
+	table, assigned, err := assignSlots(config)
+	if err != nil {
+		return err
+	}
+
+	// The slots cannot change owner again while a rebalance is moving them
+	c.NodeConnectionsLock.RLock()
+	busy := c.Rebalance.Active() && len(c.Slots.Moves(table)) > 0
+	c.NodeConnectionsLock.RUnlock()
+	if busy {
+		return fmt.Errorf("rebalance in progress")
+	}
+
+	if assigned {
+		err = saveConfigFile(c.Wd, config)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Update the cluster config
 	c.Config = config
+	c.MaxReplicaLag.Store(int64(config.MaxReplicaLag))
 
 	// Update the server config
 	c.Server.Config = config.ServerConfig
@@ -1807,6 +5143,9 @@ func (c *Cluster) ReloadConfig() error {
 	c.NodeConnectionsLock.Lock()
 	defer c.NodeConnectionsLock.Unlock()
 
+	// The current owners are the sources of the slots changing owner
+	sources := slices.Clone(c.NodeConnections)
+
 	// Track existing node connections by server address for faster lookup
 	existingNodes := make(map[string]*NodeConnection)
 	for _, nodeConn := range c.NodeConnections {
@@ -1853,7 +5192,12 @@ func (c *Cluster) ReloadConfig() error {
 	var updatedConnections []*NodeConnection
 	for _, nodeConn := range c.NodeConnections {
 		if !newConfigNodes[nodeConn.Config.Node.ServerAddress] {
-			// Node no longer in config, close and skip
+			// Node no longer in config, a node owning slots is closed once its keys moved to the new owners
+			if table != nil && c.Slots != nil && c.Slots.Ranges(nodeConn.Config.Node.ServerAddress).Len() > 0 {
+				continue
+			}
+
+			// Close and skip
 			if nodeConn.Client != nil && nodeConn.Health {
 				nodeConn.Lock.Lock()
 				if err := nodeConn.Client.Close(); err != nil {
@@ -1872,6 +5216,9 @@ func (c *Cluster) ReloadConfig() error {
 	// Update connections list
 	c.NodeConnections = updatedConnections
 
+	// Keys are routed to the new slot owners from now on
+	c.startRebalance(table, sources)
+
 	// Send RCNF command to all nodes - must be done after releasing the NodeConnectionsLock
 	// to avoid potential deadlocks
 	c.NodeConnectionsLock.Unlock()
@@ -36,14 +36,22 @@ import (
 	"io/ioutil"
 	"log"
 	"log/slog"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"supermassive/hlc"
 	"supermassive/instance/node"
 	"supermassive/instance/nodereplica"
 	"supermassive/network/client"
 	"supermassive/network/server"
+	"supermassive/slots"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/stream"
+	"sync"
 	"testing"
 	"time"
 )
@@ -1643,3 +1651,1857 @@ func TestServerCrudPrimaryDownUseReplica(t *testing.T) {
 	replica.Close()
 
 }
+
+// We push jobs through the cluster so they spread across primaries
+// and reserve them all without knowing which primary holds them
+func TestServerQueueMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4021")
+	shard2 := startTestNode(t, logger, "localhost:4022")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4020", "localhost:4021", "localhost:4022")
+
+	conn := dialTestCluster(t, "localhost:4020")
+
+	for i := 0; i < 4; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("QPUSH jobs job %d", i)); !strings.HasPrefix(resp, "OK ") {
+			t.Fatalf("Expected job id, got %s", resp)
+		}
+	}
+
+	// Both primaries hold some of the jobs
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		_, _, ok := shard.Storage.Get("jobs")
+		shard.Lock.RUnlock()
+		if !ok {
+			t.Fatalf("Expected jobs on every primary")
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "QSTATS jobs"); resp != "OK ready 4 reserved 0 dead 0\r\n" {
+		t.Fatalf("Unexpected QSTATS response %q", resp)
+	}
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		resp := sendTestCommand(t, conn, "QRESERVE jobs 60000")
+		if !strings.HasPrefix(resp, "OK ") {
+			t.Fatalf("Expected a job, got %s", resp)
+		}
+		ids = append(ids, strings.Fields(resp)[1])
+	}
+
+	if resp := sendTestCommand(t, conn, "QRESERVE jobs 60000 BLOCK 200"); resp != "ERR no jobs ready\r\n" {
+		t.Fatalf("Expected 'ERR no jobs ready', got %s", resp)
+	}
+
+	for _, id := range ids {
+		if resp := sendTestCommand(t, conn, "QACK jobs "+id); resp != "OK job acknowledged\r\n" {
+			t.Fatalf("Expected 'OK job acknowledged', got %s", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "QSTATS jobs"); resp != "OK ready 0 reserved 0 dead 0\r\n" {
+		t.Fatalf("Unexpected QSTATS response %q", resp)
+	}
+}
+
+func TestServerBitmapHyperLogLogMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4024")
+	shard2 := startTestNode(t, logger, "localhost:4025")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4023", "localhost:4024", "localhost:4025")
+
+	conn := dialTestCluster(t, "localhost:4023")
+
+	// Writes are spread over both primaries
+	for _, command := range []string{"PFADD users alice bob", "PFADD users carol", "PFADD users dave alice"} {
+		if resp := sendTestCommand(t, conn, command); !strings.HasPrefix(resp, "OK ") {
+			t.Fatalf("Unexpected PFADD response %s", resp)
+		}
+	}
+
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		_, _, ok := shard.Storage.Get("users")
+		shard.Lock.RUnlock()
+		if !ok {
+			t.Fatalf("Expected a hyperloglog on every primary")
+		}
+	}
+
+	// The copies are merged when counting
+	if resp := sendTestCommand(t, conn, "PFCOUNT users"); resp != "OK 4\r\n" {
+		t.Fatalf("Expected 'OK 4', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFMERGE everyone users"); resp != "OK\r\n" {
+		t.Fatalf("Expected 'OK', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFCOUNT everyone"); resp != "OK 4\r\n" {
+		t.Fatalf("Expected 'OK 4', got %s", resp)
+	}
+
+	for _, offset := range []int{1, 2, 3} {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("SETBIT flags %d 1", offset)); resp != "OK 0\r\n" {
+			t.Fatalf("Expected 'OK 0', got %s", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "SETBIT flags 2 1"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT flags"); resp != "OK 3\r\n" {
+		t.Fatalf("Expected 'OK 3', got %s", resp)
+	}
+
+	// Clearing a bit clears it on every primary
+	if resp := sendTestCommand(t, conn, "SETBIT flags 2 0"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GETBIT flags 2"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected 'OK 0', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITOP NOT inverted flags"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT inverted"); resp != "OK 6\r\n" {
+		t.Fatalf("Expected 'OK 6', got %s", resp)
+	}
+}
+
+func TestServerTimeSeriesMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4027")
+	shard2 := startTestNode(t, logger, "localhost:4028")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4026", "localhost:4027", "localhost:4028")
+
+	conn := dialTestCluster(t, "localhost:4026")
+
+	if resp := sendTestCommand(t, conn, "TS.CREATE cpu RETENTION 3600000"); resp != "OK series created\r\n" {
+		t.Fatalf("Expected 'OK series created', got %s", resp)
+	}
+
+	// Samples are spread over both primaries
+	for i := 0; i < 6; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("TS.ADD cpu %d %d", 1000+i*10, i)); !strings.HasPrefix(resp, "OK ") {
+			t.Fatalf("Unexpected TS.ADD response %s", resp)
+		}
+		_ = sendTestCommand(t, conn, fmt.Sprintf("TS.ADD mem %d 100", 1000+i*10))
+	}
+
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		_, _, ok := shard.Storage.Get("cpu")
+		shard.Lock.RUnlock()
+		if !ok {
+			t.Fatalf("Expected a series on every primary")
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE cpu 1010 1030"); resp != "OK 3\r\n1010 1\r\n1020 2\r\n1030 3\r\n" {
+		t.Fatalf("Unexpected TS.RANGE response %q", resp)
+	}
+
+	// Averages are computed over the samples of every shard
+	if resp := sendTestCommand(t, conn, "TS.RANGE cpu - + AGGREGATION avg 30"); resp != "OK 3\r\n990 0.5\r\n1020 3\r\n1050 5\r\n" {
+		t.Fatalf("Unexpected TS.RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.MRANGE - + ^(cpu|mem)$ AGGREGATION sum 1000"); resp != "OK 2\r\ncpu 1000 15\r\nmem 1000 600\r\n" {
+		t.Fatalf("Unexpected TS.MRANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE missing - +"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %s", resp)
+	}
+}
+
+func TestServerDocumentMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4030")
+	shard2 := startTestNode(t, logger, "localhost:4031")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4029", "localhost:4030", "localhost:4031")
+
+	conn := dialTestCluster(t, "localhost:4029")
+
+	// Setting the root twice still leaves a single copy
+	for i := 0; i < 2; i++ {
+		if resp := sendTestCommand(t, conn, `JSON.SET user $ {"visits": 0, "tags": []}`); resp != "OK\r\n" {
+			t.Fatalf("Expected 'OK', got %s", resp)
+		}
+	}
+
+	copies := 0
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		if _, _, ok := shard.Storage.Get("user"); ok {
+			copies++
+		}
+		shard.Lock.RUnlock()
+	}
+
+	if copies != 1 {
+		t.Fatalf("Expected a single copy of the document, got %d", copies)
+	}
+
+	// Updates reach the primary holding the document whichever is next in the rotation
+	for i := 1; i <= 3; i++ {
+		if resp := sendTestCommand(t, conn, "JSON.NUMINCRBY user $.visits 1"); resp != fmt.Sprintf("OK [%d]\r\n", i) {
+			t.Fatalf("Unexpected JSON.NUMINCRBY response %q", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, `JSON.ARRAPPEND user $.tags "x"`); resp != "OK [1]\r\n" {
+		t.Fatalf("Unexpected JSON.ARRAPPEND response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.GET user"); resp != `OK [{"tags":["x"],"visits":3}]`+"\r\n" {
+		t.Fatalf("Unexpected JSON.GET response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.NUMINCRBY missing $.visits 1"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %s", resp)
+	}
+}
+
+func TestServerVectorMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4033")
+	shard2 := startTestNode(t, logger, "localhost:4034")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4032", "localhost:4033", "localhost:4034")
+
+	conn := dialTestCluster(t, "localhost:4032")
+
+	if resp := sendTestCommand(t, conn, "VCREATE items DIM 2 METRIC l2"); resp != "OK index created\r\n" {
+		t.Fatalf("Expected 'OK index created', got %s", resp)
+	}
+
+	for i := 0; i < 6; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("VADD items:%d %d 0", i, i)); resp != "OK vector added\r\n" {
+			t.Fatalf("Expected 'OK vector added', got %s", resp)
+		}
+	}
+
+	// Moving a vector leaves a single copy
+	_ = sendTestCommand(t, conn, "VADD items:5 2.5 0")
+
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		ix := shard.VectorIndexes["items"]
+		shard.Lock.RUnlock()
+		if ix == nil {
+			t.Fatalf("Expected the index on every primary")
+		}
+	}
+
+	// The nearest vectors of both shards are merged
+	resp := sendTestCommand(t, conn, "VSEARCH items 3 2.4 0")
+	lines := strings.Split(strings.TrimSpace(resp), "\r\n")
+	if len(lines) != 4 || lines[0] != "OK 3" || !strings.HasPrefix(lines[1], "items:5 ") || !strings.HasPrefix(lines[2], "items:2 ") || !strings.HasPrefix(lines[3], "items:3 ") {
+		t.Fatalf("Unexpected VSEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH items 2 0 0 EXACT"); resp != "OK 2\r\nitems:0 0\r\nitems:1 1\r\n" {
+		t.Fatalf("Unexpected VSEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH missing 1 0 0"); resp != "ERR index not found\r\n" {
+		t.Fatalf("Expected 'ERR index not found', got %s", resp)
+	}
+}
+
+func TestServerFullTextMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4036")
+	shard2 := startTestNode(t, logger, "localhost:4037")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4035", "localhost:4036", "localhost:4037")
+
+	conn := dialTestCluster(t, "localhost:4035")
+
+	if resp := sendTestCommand(t, conn, "FT.CREATE articles"); resp != "OK index created\r\n" {
+		t.Fatalf("Expected 'OK index created', got %s", resp)
+	}
+
+	texts := []string{"red fox", "brown fox", "lazy dog", "red dog", "fox and dog", "blue bird"}
+	for i, text := range texts {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT articles:%d %s", i, text)); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		ix := shard.TextIndexes["articles"]
+		shard.Lock.RUnlock()
+		if ix == nil {
+			t.Fatalf("Expected the index on every primary")
+		}
+	}
+
+	// Matches from both shards are merged
+	resp := sendTestCommand(t, conn, `SEARCH articles "fox OR dog"`)
+	lines := strings.Split(strings.TrimSpace(resp), "\r\n")
+	if len(lines) != 6 || lines[0] != "OK 5" || strings.Contains(resp, "articles:5 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	resp = sendTestCommand(t, conn, `SEARCH articles "red -dog"`)
+	if !strings.HasPrefix(resp, "OK 1\r\narticles:0 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	resp = sendTestCommand(t, conn, `SEARCH articles "fox OR dog" LIMIT 2`)
+	if !strings.HasPrefix(resp, "OK 2\r\n") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SEARCH missing fox"); resp != "ERR index not found\r\n" {
+		t.Fatalf("Expected 'ERR index not found', got %s", resp)
+	}
+}
+
+func TestServerOrderedKeysMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	startTestNode(t, logger, "localhost:4039")
+	startTestNode(t, logger, "localhost:4040")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4038", "localhost:4039", "localhost:4040")
+
+	conn := dialTestCluster(t, "localhost:4038")
+
+	// Writes are spread over both primaries
+	for _, key := range []string{"k05", "k02", "k09", "k01", "k07", "k03", "other"} {
+		if resp := sendTestCommand(t, conn, "PUT "+key+" value"); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "PREFIX k"); resp != "OK 6\r\nk01\r\nk02\r\nk03\r\nk05\r\nk07\r\nk09\r\n" {
+		t.Fatalf("Unexpected PREFIX response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RANGE k02 k07 LIMIT 3"); resp != "OK 3\r\nk02\r\nk03\r\nk05\r\n" {
+		t.Fatalf("Unexpected RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RANGE k08 +"); resp != "OK 2\r\nk09\r\nother\r\n" {
+		t.Fatalf("Unexpected RANGE response %q", resp)
+	}
+}
+
+func TestServerScanMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	startTestNode(t, logger, "localhost:4042")
+	startTestNode(t, logger, "localhost:4043")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4041", "localhost:4042", "localhost:4043")
+
+	conn := dialTestCluster(t, "localhost:4041")
+
+	for i := 0; i < 40; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT key:%d value", i)); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	seen := make(map[string]int)
+	shards := make(map[uint64]bool)
+	cursor := "0"
+	for calls := 0; calls < 1000; calls++ {
+		resp := sendTestCommand(t, conn, "SCAN "+cursor+" MATCH ^key: COUNT 4")
+		lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+		header := strings.Fields(lines[0])
+		if len(header) != 3 || header[0] != "OK" {
+			t.Fatalf("Unexpected SCAN response %q", resp)
+		}
+
+		for _, key := range lines[1:] {
+			if key != "" {
+				seen[key]++
+			}
+		}
+
+		cursor = header[2]
+		next, _ := strconv.ParseUint(cursor, 10, 64)
+		shards[next>>ScanShardShift] = true
+		if cursor == "0" {
+			break
+		}
+	}
+
+	if len(seen) != 40 {
+		t.Fatalf("Expected 40 keys across both shards, got %d", len(seen))
+	}
+
+	if !shards[1] {
+		t.Fatalf("Expected the cursor to move to the second shard")
+	}
+
+	if resp := sendTestCommand(t, conn, fmt.Sprintf("SCAN %d", uint64(5)<<ScanShardShift)); resp != "ERR invalid cursor\r\n" {
+		t.Fatalf("Expected 'ERR invalid cursor', got %s", resp)
+	}
+}
+
+func TestServerQueryMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4045")
+	shard2 := startTestNode(t, logger, "localhost:4046")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4044", "localhost:4045", "localhost:4046")
+
+	conn := dialTestCluster(t, "localhost:4044")
+
+	for i := 0; i < 6; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT user_%d %d", i, i*10)); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	// A stale copy of a key on the other shard is replaced by the newest one
+	shard1.Lock.Lock()
+	shard1.Storage.Put("dup", "old")
+	shard1.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	shard2.Lock.Lock()
+	shard2.Storage.Put("dup", "new")
+	shard2.Lock.Unlock()
+
+	resp := sendTestCommand(t, conn, "QUERY WHERE key ~ '^user_' AND num(value) >= 20 LIMIT 3")
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 4 || lines[0] != "OK 3" || !strings.HasSuffix(lines[1], " user_2 20") || !strings.HasSuffix(lines[3], " user_4 40") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "QUERY WHERE key = dup"); !strings.HasPrefix(resp, "OK 1\r\n") || !strings.HasSuffix(resp, " dup new\r\n") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	// Invalid queries are rejected by the cluster
+	if resp = sendTestCommand(t, conn, "QUERY WHERE ts > yesterday"); resp != "ERR invalid timestamp yesterday\r\n" {
+		t.Fatalf("Expected 'ERR invalid timestamp yesterday', got %s", resp)
+	}
+}
+
+func TestServerAggregateMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4048")
+	shard2 := startTestNode(t, logger, "localhost:4049")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4047", "localhost:4048", "localhost:4049")
+
+	conn := dialTestCluster(t, "localhost:4047")
+
+	for i := 1; i <= 6; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT counter_%d %d", i, i*10)); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	// A stale copy of a counter on the other shard is only counted once, with its newest value
+	shard1.Lock.Lock()
+	shard1.Storage.Put("counter_dup", "1000")
+	shard1.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	shard2.Lock.Lock()
+	shard2.Storage.Put("counter_dup", "0.5")
+	shard2.Lock.Unlock()
+
+	expected := map[string]string{
+		"AGG COUNT ^counter_":                   "OK 7\r\n",
+		"AGG SUM ^counter_":                     "OK 210.5\r\n",
+		"AGG AVG ^counter_":                     "OK 30.071428571428573\r\n",
+		"AGG MIN ^counter_":                     "OK 0.5\r\n",
+		"AGG MAX ^counter_":                     "OK 60\r\n",
+		"AGG SUM ^counter_[1-6]$":               "OK 210\r\n",
+		"AGG SUM ^counter_ EXCLUDE counter_dup": "OK 210\r\n",
+		"AGG MIN ^missing":                      "ERR no numeric values\r\n",
+		"AGG KEYS ^counter_":                    "ERR invalid aggregation\r\n",
+	}
+
+	for command, want := range expected {
+		if resp := sendTestCommand(t, conn, command); resp != want {
+			t.Fatalf("Expected %q for %s, got %q", want, command, resp)
+		}
+	}
+}
+
+func TestServerVersionsMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4051")
+	shard2 := startTestNode(t, logger, "localhost:4052")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4050", "localhost:4051", "localhost:4052")
+
+	conn := dialTestCluster(t, "localhost:4050")
+
+	// A key written on one shard and later on the other
+	shard1.Lock.Lock()
+	shard1.Storage.Put("dup", "old")
+	shard1.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	between := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+	shard2.Lock.Lock()
+	shard2.Storage.Put("dup", "new")
+	shard2.Lock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "GET dup AT "+between); !strings.HasPrefix(resp, "OK ") || !strings.HasSuffix(resp, " dup old\r\n") {
+		t.Fatalf("Expected old version, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET dup AT "+time.Now().UTC().Format(time.RFC3339Nano)); !strings.HasSuffix(resp, " dup new\r\n") {
+		t.Fatalf("Expected new version, got %q", resp)
+	}
+
+	// Reading an old version does not delete the copy holding it
+	shard1.Lock.RLock()
+	_, _, ok := shard1.Storage.Get("dup")
+	shard1.Lock.RUnlock()
+	if !ok {
+		t.Fatal("Expected the old copy to be kept")
+	}
+
+	resp := sendTestCommand(t, conn, "HISTORY dup")
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 3 || lines[0] != "OK 2" || !strings.HasSuffix(lines[1], " PUT new") || !strings.HasSuffix(lines[2], " PUT old") {
+		t.Fatalf("Unexpected HISTORY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "GET missing AT 2025-01-01"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+}
+
+func TestServerTombstonesMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4054")
+	shard2 := startTestNode(t, logger, "localhost:4055")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4053", "localhost:4054", "localhost:4055")
+
+	conn := dialTestCluster(t, "localhost:4053")
+
+	// Keys owned by the first shard
+	gone, count, back := slotKey("gone", slots.Even(2)[0]), slotKey("count", slots.Even(2)[0]), slotKey("back", slots.Even(2)[0])
+
+	// Stale copies on the second shard, which missed the deletes seen by the first
+	shard2.Lock.Lock()
+	for _, key := range []string{gone, count, "regx:1"} {
+		shard2.Storage.Put(key, "1")
+	}
+	shard2.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	shard1.Lock.Lock()
+	for _, key := range []string{gone, count, "regx:1", back} {
+		shard1.Tombstones.Add(key, shard1.Clock.Now())
+	}
+	shard1.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+
+	// A copy written after the delete wins
+	shard1.Lock.Lock()
+	shard1.Storage.Put(back, "again")
+	shard1.Lock.Unlock()
+	shard2.Lock.Lock()
+	shard2.Storage.Put("regx:2", "2")
+	shard2.Lock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "GET "+gone); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET "+back); withoutVersion(t, resp) != fmt.Sprintf("OK %s again\r\n", back) {
+		t.Fatalf("Expected the copy written after the delete, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "INCR "+count+" 1"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "REGX ^regx:"); withoutVersion(t, resp) != "OK\r\nregx:2 2\r\n" {
+		t.Fatalf("Unexpected REGX response %q", resp)
+	}
+
+	time.Sleep(100 * time.Millisecond) // Wait for stale copies to be deleted
+
+	shard2.Lock.RLock()
+	defer shard2.Lock.RUnlock()
+	if _, _, ok := shard2.Storage.Get("regx:1"); ok {
+		t.Fatal("Expected the stale copy of regx:1 to be deleted")
+	}
+
+	if _, _, ok := shard2.Storage.Get("regx:2"); !ok {
+		t.Fatal("Expected the newer copy to be kept")
+	}
+}
+
+func TestServerHybridLogicalClockMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4057")
+	shard2 := startTestNode(t, logger, "localhost:4058")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4056", "localhost:4057", "localhost:4058")
+
+	conn := dialTestCluster(t, "localhost:4056")
+
+	// Copies written at the same physical time are ordered by their logical counter, then by node
+	wall := time.Now().UnixNano()
+	shard1.Lock.Lock()
+	shard1.Storage.PutVersion("counter", "1", hlc.Timestamp{Wall: wall, Logical: 2, Node: 1})
+	shard1.Storage.PutVersion("tie", "first", hlc.Timestamp{Wall: wall, Node: 2})
+	shard1.Lock.Unlock()
+
+	shard2.Lock.Lock()
+	shard2.Storage.PutVersion("counter", "10", hlc.Timestamp{Wall: wall, Logical: 1, Node: 2})
+	shard2.Storage.PutVersion("tie", "second", hlc.Timestamp{Wall: wall, Node: 1})
+	shard2.Lock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "REGX ^tie$"); resp != fmt.Sprintf("OK\r\n%s tie first\r\n", hlc.Timestamp{Wall: wall, Node: 2}) {
+		t.Fatalf("Expected the copy from the higher node ID, got %q", resp)
+	}
+
+	// Migrating the keys onto their owners keeps the newest copy
+	if resp := sendTestCommand(t, conn, "MIGRATE"); resp != "OK 2\r\n" {
+		t.Fatalf("Expected the copies on the other shard moved, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET tie"); resp != fmt.Sprintf("OK %s tie first\r\n", hlc.Timestamp{Wall: wall, Node: 2}) {
+		t.Fatalf("Expected the copy from the higher node ID, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "INCR counter 1"); withoutVersion(t, resp) != "OK counter 2\r\n" {
+		t.Fatalf("Expected the copy with the higher logical counter incremented, got %q", resp)
+	}
+
+	for _, key := range []string{"tie", "counter"} {
+		found := 0
+		for _, shard := range []*node.Node{shard1, shard2} {
+			shard.Lock.RLock()
+			if _, _, ok := shard.Storage.Get(key); ok {
+				found++
+			}
+			shard.Lock.RUnlock()
+		}
+
+		if found != 1 {
+			t.Fatalf("Expected %s on a single shard, found on %d", key, found)
+		}
+	}
+}
+
+func TestServerConditionalWritesMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4060")
+	shard2 := startTestNode(t, logger, "localhost:4061")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	startTestCluster(t, logger, "localhost:4059", "localhost:4060", "localhost:4061")
+
+	conn := dialTestCluster(t, "localhost:4059")
+
+	// copies returns the values of a key on each shard
+	copies := func(key string) []interface{} {
+		var values []interface{}
+		for _, shard := range []*node.Node{shard1, shard2} {
+			shard.Lock.RLock()
+			value, _, _ := shard.Storage.Get(key)
+			shard.Lock.RUnlock()
+			values = append(values, value)
+		}
+		return values
+	}
+
+	resp := sendTestCommand(t, conn, "PUTNX new 1")
+	if !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected PUTNX to write, got %q", resp)
+	}
+	created := strings.TrimSpace(strings.TrimPrefix(resp, "OK "))
+
+	if resp = sendTestCommand(t, conn, "PUTNX new 2"); resp != fmt.Sprintf("ERR key exists %s\r\n", created) {
+		t.Fatalf("Expected 'ERR key exists', got %q", resp)
+	}
+
+	if values := copies("new"); (values[0] == nil) == (values[1] == nil) {
+		t.Fatalf("Expected the key on a single shard, got %v", values)
+	}
+
+	if resp = sendTestCommand(t, conn, "PUTXX missing 1"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	// A key with copies on both shards is written on its owner with the newest copy
+	shard1.Lock.Lock()
+	shard1.Storage.Put("dup", "old")
+	shard1.Lock.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	shard2.Lock.Lock()
+	shard2.Storage.Put("dup", "new")
+	_, version, _ := shard2.Storage.GetVersion("dup")
+	shard2.Lock.Unlock()
+
+	if resp = sendTestCommand(t, conn, "CAS dup 2025-01-01T00:00:00Z value"); resp != fmt.Sprintf("ERR version mismatch %s\r\n", version) {
+		t.Fatalf("Expected 'ERR version mismatch', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, fmt.Sprintf("CAS dup %s newer", version)); !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected CAS to write, got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "PUTXX dup newest"); !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected PUTXX to write, got %q", resp)
+	}
+
+	time.Sleep(100 * time.Millisecond) // Wait for stale copies to be deleted
+
+	owner := 0
+	if !slots.Even(2)[0].Contains(slots.Slot("dup")) {
+		owner = 1
+	}
+
+	if values := copies("dup"); values[owner] != "newest" || values[1-owner] != nil {
+		t.Fatalf("Expected the newest copy on the owner only, got %v", values)
+	}
+
+	if resp = sendTestCommand(t, conn, "CAS dup"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %q", resp)
+	}
+}
+
+func TestServerSlotsMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4063")
+	shard2 := startTestNode(t, logger, "localhost:4064")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	c := startTestCluster(t, logger, "localhost:4062", "localhost:4063", "localhost:4064")
+
+	conn := dialTestCluster(t, "localhost:4062")
+
+	// The slots are split between the nodes and saved in the config file
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+
+	config := &Config{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		t.Fatalf("Failed to unmarshal config data: %v", err)
+	}
+
+	if config.NodeConfigs[0].Slots != "0-8191" || config.NodeConfigs[1].Slots != "8192-16383" {
+		t.Fatalf("Unexpected slots %q and %q", config.NodeConfigs[0].Slots, config.NodeConfigs[1].Slots)
+	}
+
+	if stats := string(c.clusterStats()); !strings.Contains(stats, "\tslots localhost:4064 8192-16383\r\n") {
+		t.Fatalf("Expected the slots of each node in the stats, got %q", stats)
+	}
+
+	if stats := string(c.clusterStats()); !strings.Contains(stats, "\tplacement localhost:4064 weight ") {
+		t.Fatalf("Expected the placement of each node in the stats, got %q", stats)
+	}
+
+	// Writes of a key always go to its owner
+	key := slotKey("key", slots.Even(2)[1])
+	for i := 0; i < 4; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT %s %d", key, i)); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected PUT to write, got %q", resp)
+		}
+	}
+
+	shard1.Lock.RLock()
+	_, _, ok := shard1.Storage.Get(key)
+	shard1.Lock.RUnlock()
+	if ok {
+		t.Fatal("Expected no copy on the shard not owning the key")
+	}
+
+	if resp := sendTestCommand(t, conn, "GET "+key); withoutVersion(t, resp) != fmt.Sprintf("OK %s 3\r\n", key) {
+		t.Fatalf("Expected the last write, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "DEL "+key); !strings.HasPrefix(resp, "OK") {
+		t.Fatalf("Expected DEL to delete, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET "+key); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	// A key written round-robin before slots is only found once migrated to its owner
+	misplaced := slotKey("misplaced", slots.Even(2)[1])
+	shard1.Lock.Lock()
+	shard1.Storage.Put(misplaced, "value")
+	shard1.Lock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "GET "+misplaced); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	// Keys of other types move too, merged with the copy on the owner
+	bits := slotKey("bits", slots.Even(2)[1])
+	for _, shard := range []*node.Node{shard1, shard2} {
+		b := bitmap.New()
+		if shard == shard1 {
+			_, _ = b.SetBit(1, true)
+		} else {
+			_, _ = b.SetBit(2, true)
+		}
+
+		shard.Lock.Lock()
+		shard.Storage.Put(bits, b)
+		shard.Lock.Unlock()
+	}
+
+	// A stream is not merged with the copy on the owner, the source keeps its copy
+	events := slotKey("events", slots.Even(2)[1])
+	for i, shard := range []*node.Node{shard1, shard2} {
+		s := stream.New()
+		_ = s.Add(stream.ID{Ms: uint64(i + 1)}, []string{"n", fmt.Sprint(i)})
+
+		shard.Lock.Lock()
+		shard.Storage.Put(events, s)
+		shard.Lock.Unlock()
+	}
+
+	if resp := sendTestCommand(t, conn, "MIGRATE"); resp != "OK 2\r\n" {
+		t.Fatalf("Expected two keys moved, got %q", resp)
+	}
+
+	for _, shard := range []*node.Node{shard1, shard2} {
+		shard.Lock.RLock()
+		value, _, _ := shard.Storage.Get(events)
+		shard.Lock.RUnlock()
+		if s, ok := value.(*stream.Stream); !ok || s.Len() != 1 {
+			t.Fatalf("Expected each shard to keep its stream, got %v", value)
+		}
+	}
+
+	shard1.Lock.RLock()
+	_, _, ok = shard1.Storage.Get(bits)
+	shard1.Lock.RUnlock()
+	if ok {
+		t.Fatal("Expected the misplaced bitmap to be deleted")
+	}
+
+	shard2.Lock.RLock()
+	value, _, _ := shard2.Storage.Get(bits)
+	shard2.Lock.RUnlock()
+	if b, ok := value.(*bitmap.Bitmap); !ok || !b.GetBit(1) || !b.GetBit(2) {
+		t.Fatalf("Expected the bitmaps merged on the owner, got %v", value)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET "+misplaced); withoutVersion(t, resp) != fmt.Sprintf("OK %s value\r\n", misplaced) {
+		t.Fatalf("Expected the migrated key, got %q", resp)
+	}
+
+	shard1.Lock.RLock()
+	_, _, ok = shard1.Storage.Get(misplaced)
+	shard1.Lock.RUnlock()
+	if ok {
+		t.Fatal("Expected the misplaced copy to be deleted")
+	}
+
+	shard2.Lock.RLock()
+	_, _, ok = shard2.Storage.Get(misplaced)
+	shard2.Lock.RUnlock()
+	if !ok {
+		t.Fatal("Expected the key on its owner")
+	}
+
+	if resp := sendTestCommand(t, conn, "MIGRATE"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected nothing left to move, got %q", resp)
+	}
+}
+
+func TestServerRebalanceMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4066")
+	shard2 := startTestNode(t, logger, "localhost:4067")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	c := startTestCluster(t, logger, "localhost:4065", "localhost:4066")
+
+	conn := dialTestCluster(t, "localhost:4065")
+
+	for i := 0; i < 50; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT key%d %d", i, i)); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected PUT to write, got %q", resp)
+		}
+	}
+
+	// keys returns the number of keys on a shard
+	keys := func(shard *node.Node) int {
+		shard.Lock.RLock()
+		defer shard.Lock.RUnlock()
+		return len(shard.Storage.Traverse(func(entry hashtable.Entry) bool { return true }))
+	}
+
+	// reload rewrites the config file with the nodes and reloads it
+	reload := func(nodeConfigs ...*NodeConfig) {
+		data, err := os.ReadFile(ConfigFile)
+		if err != nil {
+			t.Fatalf("Failed to read config file: %v", err)
+		}
+
+		config := &Config{}
+		if err = yaml.Unmarshal(data, config); err != nil {
+			t.Fatalf("Failed to unmarshal config data: %v", err)
+		}
+		config.NodeConfigs = nodeConfigs
+
+		if data, err = yaml.Marshal(config); err != nil {
+			t.Fatalf("Failed to marshal config data: %v", err)
+		}
+
+		if err = os.WriteFile(ConfigFile, data, 0644); err != nil {
+			t.Fatalf("Failed to write config file: %v", err)
+		}
+
+		if resp := sendTestCommand(t, conn, "RCNF"); resp != "OK configs reloaded\r\n" {
+			t.Fatalf("Expected 'OK configs reloaded', got %q", resp)
+		}
+	}
+
+	// wait waits for the rebalance to end
+	wait := func() {
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			c.NodeConnectionsLock.RLock()
+			active := c.Rebalance.Active()
+			c.NodeConnectionsLock.RUnlock()
+			if !active {
+				return
+			}
+		}
+		t.Fatal("Expected the rebalance to end")
+	}
+
+	// Adding a node moves half of the slots and their keys to it
+	reload(c.Config.NodeConfigs[0], &NodeConfig{Node: &client.Config{ServerAddress: "localhost:4067", ConnectTimeout: 5, WriteTimeout: 5, ReadTimeout: 5, MaxRetries: 3, RetryWaitTime: 1, BufferSize: 1024}})
+	wait()
+
+	if c.Config.NodeConfigs[0].Slots != "0-8191" || c.Config.NodeConfigs[1].Slots != "8192-16383" {
+		t.Fatalf("Unexpected slots %q and %q", c.Config.NodeConfigs[0].Slots, c.Config.NodeConfigs[1].Slots)
+	}
+
+	moved := 0
+	for i := 0; i < 50; i++ {
+		if slots.Slot(fmt.Sprintf("key%d", i)) > 8191 {
+			moved++
+		}
+	}
+
+	if keys(shard1) != 50-moved || keys(shard2) != moved {
+		t.Fatalf("Expected %d keys moved, shards have %d and %d", moved, keys(shard1), keys(shard2))
+	}
+
+	if stats := string(c.clusterStats()); !strings.Contains(stats, fmt.Sprintf("\trebalance localhost:4066 localhost:4067 8192-16383 %d done\r\n", moved)) {
+		t.Fatalf("Expected the rebalance in the stats, got %q", stats)
+	}
+
+	for i := 0; i < 50; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("GET key%d", i)); withoutVersion(t, resp) != fmt.Sprintf("OK key%d %d\r\n", i, i) {
+			t.Fatalf("Expected key%d, got %q", i, resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "REBALANCE"); resp != "OK 0 slots moving\r\n" {
+		t.Fatalf("Expected nothing to move, got %q", resp)
+	}
+
+	// A key in a moving slot is pulled to its new owner before a command on it runs
+	misplaced := slotKey("misplaced", slots.Even(2)[1])
+	shard1.Lock.Lock()
+	shard1.Storage.Put(misplaced, "value")
+	shard1.Lock.Unlock()
+
+	c.NodeConnectionsLock.Lock()
+	move := &SlotMove{Source: c.NodeConnections[0], Target: "localhost:4067", Ranges: slots.Even(2)[1]}
+	c.Rebalance = &Rebalance{Moves: []*SlotMove{move}}
+	c.NodeConnectionsLock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "GET "+misplaced); withoutVersion(t, resp) != fmt.Sprintf("OK %s value\r\n", misplaced) {
+		t.Fatalf("Expected the pulled key, got %q", resp)
+	}
+	move.Done.Store(true)
+
+	if keys(shard1) != 50-moved || move.Keys.Load() != 1 {
+		t.Fatalf("Expected the key moved off the old owner, %d keys left", keys(shard1))
+	}
+
+	// Removing a node moves its slots and keys to the remaining nodes before it is closed
+	reload(c.Config.NodeConfigs[1])
+	wait()
+
+	if keys(shard1) != 0 || keys(shard2) != 51 {
+		t.Fatalf("Expected every key on the remaining shard, shards have %d and %d", keys(shard1), keys(shard2))
+	}
+
+	if c.Config.NodeConfigs[0].Slots != "0-16383" {
+		t.Fatalf("Unexpected slots %q", c.Config.NodeConfigs[0].Slots)
+	}
+
+	for i := 0; i < 50; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("GET key%d", i)); withoutVersion(t, resp) != fmt.Sprintf("OK key%d %d\r\n", i, i) {
+			t.Fatalf("Expected key%d, got %q", i, resp)
+		}
+	}
+}
+
+func TestServerDecommissionMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	shard1 := startTestNode(t, logger, "localhost:4069")
+	shard2 := startTestNode(t, logger, "localhost:4070")
+	time.Sleep(time.Second) // Wait for primaries to open
+
+	c := startTestCluster(t, logger, "localhost:4068", "localhost:4069", "localhost:4070")
+
+	conn := dialTestCluster(t, "localhost:4068")
+
+	for i := 0; i < 40; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT key%d %d", i, i)); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected PUT to write, got %q", resp)
+		}
+	}
+
+	// keys returns the number of keys on a shard
+	keys := func(shard *node.Node) int {
+		shard.Lock.RLock()
+		defer shard.Lock.RUnlock()
+		return len(shard.Storage.Traverse(func(entry hashtable.Entry) bool { return true }))
+	}
+
+	before := keys(shard1)
+	if before == 0 {
+		t.Fatal("Expected keys on the first shard")
+	}
+
+	if resp := sendTestCommand(t, conn, "DECOMMISSION localhost:4099"); resp != "ERR node not found\r\n" {
+		t.Fatalf("Expected 'ERR node not found', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "DECOMMISSION localhost:4069"); resp != fmt.Sprintf("OK %d keys moved\r\n", before) {
+		t.Fatalf("Expected the keys of the first shard moved, got %q", resp)
+	}
+
+	if keys(shard1) != 0 || keys(shard2) != 40 {
+		t.Fatalf("Expected every key on the remaining shard, shards have %d and %d", keys(shard1), keys(shard2))
+	}
+
+	for i := 0; i < 40; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("GET key%d", i)); withoutVersion(t, resp) != fmt.Sprintf("OK key%d %d\r\n", i, i) {
+			t.Fatalf("Expected key%d, got %q", i, resp)
+		}
+	}
+
+	// The node is removed from the config
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+
+	config := &Config{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		t.Fatalf("Failed to unmarshal config data: %v", err)
+	}
+
+	if len(config.NodeConfigs) != 1 || config.NodeConfigs[0].Node.ServerAddress != "localhost:4070" || config.NodeConfigs[0].Slots != "0-16383" {
+		t.Fatalf("Expected only the remaining node owning every slot, got %+v", config.NodeConfigs)
+	}
+
+	if len(c.NodeConnections) != 1 {
+		t.Fatalf("Expected 1 node connection, got %d", len(c.NodeConnections))
+	}
+
+	if resp := sendTestCommand(t, conn, "DECOMMISSION localhost:4070"); resp != "ERR cannot decommission the last primary node\r\n" {
+		t.Fatalf("Expected 'ERR cannot decommission the last primary node', got %q", resp)
+	}
+}
+
+func TestPlacement(t *testing.T) {
+	c := &Cluster{Config: &Config{PlacementWeights: &PlacementWeights{Memory: 1, Keys: 1}}, Lock: &sync.RWMutex{}, ConfigLock: &sync.RWMutex{}}
+
+	// An empty node, a half full node with the most keys and a full node
+	for i, load := range []NodeLoad{{Measured: true}, {Memory: 50, Keys: 100, Measured: true}, {Memory: 100, Measured: true}} {
+		c.NodeConnections = append(c.NodeConnections, &NodeConnection{
+			Config: &NodeConfig{Node: &client.Config{ServerAddress: fmt.Sprintf("localhost:%d", 4001+i)}},
+			Load:   load,
+		})
+	}
+
+	c.updateWeights()
+
+	expected := []float64{1, 0.4, 0}
+	for i, nodeConn := range c.NodeConnections {
+		if math.Abs(nodeConn.Load.Weight-expected[i]) > 1e-9 {
+			t.Errorf("Expected weight %f for node %d, got %f", expected[i], i, nodeConn.Load.Weight)
+		}
+	}
+
+	// Writes are placed in proportion to the weights
+	placed := make(map[*NodeConnection]int)
+	for i := 0; i < 14; i++ {
+		placed[c.place(nil)]++
+	}
+
+	if placed[c.NodeConnections[0]] != 10 || placed[c.NodeConnections[1]] != 4 || placed[c.NodeConnections[2]] != 0 {
+		t.Errorf("Unexpected placement %d %d %d", placed[c.NodeConnections[0]], placed[c.NodeConnections[1]], placed[c.NodeConnections[2]])
+	}
+
+	// A node tried already is skipped even if it weighs the most
+	if nodeConn := c.place(map[*NodeConnection]bool{c.NodeConnections[0]: true, c.NodeConnections[1]: true}); nodeConn != c.NodeConnections[2] {
+		t.Errorf("Expected the only node left, got %s", nodeConn.Config.Node.ServerAddress)
+	}
+
+	if weights := c.weights([]string{"localhost:4002", "localhost:4099"}); weights[0] != 0.4 || weights[1] != 1 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+
+	// A node under its memory threshold keeps some slots however loaded
+	c.NodeConnections[1].Load.Weight = 0.01
+	if weights := c.weights([]string{"localhost:4001", "localhost:4002", "localhost:4003"}); weights[0] != 1 || weights[1] != 0.1 || weights[2] != 0 {
+		t.Errorf("Unexpected weights %v", weights)
+	}
+
+	// Slots split evenly are over the share of the loaded and the full node, so they move
+	nodes := []string{"localhost:4001", "localhost:4002", "localhost:4003"}
+	owned := make(map[string]slots.Ranges)
+	for i, ranges := range slots.Even(3) {
+		owned[nodes[i]] = ranges
+	}
+
+	var err error
+	c.Slots, err = slots.NewTable(owned)
+	if err != nil {
+		t.Fatalf("Failed to create slot table: %v", err)
+	}
+
+	if !c.overShare(nodes) {
+		t.Error("Expected the even slots over the share of the fuller nodes")
+	}
+
+	// Slots within a tenth of an even share of the weighted shares stay
+	for _, nodeConn := range c.NodeConnections {
+		nodeConn.Load.Weight = 1
+	}
+	c.NodeConnections[0].Load.Weight = 0.9
+
+	if c.overShare(nodes) {
+		t.Error("Expected the slots to stay for a small difference in load")
+	}
+}
+
+func TestReplicaLag(t *testing.T) {
+	c := &Cluster{Config: &Config{MaxReplicaLag: 1000}, Logger: slog.New(slog.NewTextHandler(os.Stdout, nil))}
+	c.MaxReplicaLag.Store(1000)
+
+	caughtUp := &ReplicaConnection{Health: true, Lock: &sync.Mutex{}, Config: &client.Config{ServerAddress: "localhost:4002"}, Lag: ReplicaLag{Applied: 10, At: time.Now(), Measured: true}}
+	behind := &ReplicaConnection{Health: true, Lock: &sync.Mutex{}, Config: &client.Config{ServerAddress: "localhost:4003"}, Lag: ReplicaLag{Applied: 8, Entries: 2, Behind: 500 * time.Millisecond, At: time.Now(), Measured: true}}
+	lagging := &ReplicaConnection{Health: true, Lock: &sync.Mutex{}, Config: &client.Config{ServerAddress: "localhost:4004"}, Lag: ReplicaLag{Applied: 1, Entries: 9, Behind: 5 * time.Second, At: time.Now(), Measured: true}}
+	unmeasured := &ReplicaConnection{Health: true, Lock: &sync.Mutex{}, Config: &client.Config{ServerAddress: "localhost:4005"}}
+	outOfContact := &ReplicaConnection{Health: true, Lock: &sync.Mutex{}, Config: &client.Config{ServerAddress: "localhost:4006"}, Lag: ReplicaLag{Applied: 10, Behind: 800 * time.Millisecond, At: time.Now(), Measured: true}}
+
+	if c.lagging(caughtUp, 0) || c.lagging(behind, 0) {
+		t.Errorf("Expected replicas within the lag limit of the cluster to serve reads")
+	}
+
+	if !c.lagging(lagging, 0) || !c.lagging(unmeasured, 0) {
+		t.Errorf("Expected replicas over the lag limit of the cluster or not measured to not serve reads")
+	}
+
+	// A read asking for a lower limit skips replicas within the limit of the cluster
+	if !c.lagging(behind, 100*time.Millisecond) || c.lagging(caughtUp, 100*time.Millisecond) {
+		t.Errorf("Expected only the replica caught up to serve a read with a max lag of 100ms")
+	}
+
+	// A replica missing writes falls further behind after it was measured
+	behind.Lag.At = time.Now().Add(-time.Second)
+	if !c.lagging(behind, 0) {
+		t.Errorf("Expected the replica to lag once a second passed since it was measured")
+	}
+
+	// So does a replica that applied every write it was sent but has not heard from its primary node
+	if c.lagging(outOfContact, 0) {
+		t.Errorf("Expected the replica out of contact for 800ms to serve reads")
+	}
+
+	outOfContact.Lag.At = time.Now().Add(-time.Second)
+	if !c.lagging(outOfContact, 0) {
+		t.Errorf("Expected the replica out of contact to lag once a second passed since it was measured")
+	}
+
+	// Without a limit every healthy replica serves reads
+	c.MaxReplicaLag.Store(0)
+	if c.lagging(lagging, 0) || c.lagging(unmeasured, 0) {
+		t.Errorf("Expected every replica to serve reads without a lag limit")
+	}
+
+	// With the primary node down and every replica lagging no shard answers
+	nodeConn := &NodeConnection{Lock: &sync.Mutex{}, Replicas: []*ReplicaConnection{behind, lagging}}
+	if rec := c.queryShardMaxLag(nodeConn, []byte("GET a\r\n"), (*client.Client).ReceiveLine, 100*time.Millisecond); rec != nil {
+		t.Errorf("Expected no replica to answer, got %q", rec)
+	}
+
+	for _, command := range []string{"GET a MAXLAG 500", "GET a MAXLAG -1s", "GET a MAXAGE 500ms"} {
+		if _, err := c.Get([]byte(command + "\r\n")); err == nil {
+			t.Errorf("Expected %q to fail", command)
+		}
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	replica1 := startTestReplica(t, logger, "localhost:4073")
+	replica2 := startTestReplica(t, logger, "localhost:4074")
+	time.Sleep(time.Second) // Wait for replicas to open
+
+	// The primary is stopped by hand as if it crashed
+	primary := startTestNode(t, logger, "localhost:4072", "localhost:4073", "localhost:4074")
+	time.Sleep(3 * time.Second) // Wait for the primary to connect to its replicas
+
+	openTestCluster(t, logger, &Config{
+		HealthCheckInterval: 1,
+		FailoverAfter:       2,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4071",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		NodeConfigs: []*NodeConfig{
+			{
+				Node:     testClientConfig("localhost:4072"),
+				Replicas: []*client.Config{testClientConfig("localhost:4073"), testClientConfig("localhost:4074")},
+			},
+		},
+	})
+
+	conn := dialTestCluster(t, "localhost:4071")
+
+	for i := 0; i < 10; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT key%d %d", i, i)); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected PUT to write, got %q", resp)
+		}
+	}
+
+	primaryDir := primary.Wd
+	primary.Server.Close()
+	primary.Journal.Close()
+	for _, replicaConn := range primary.ReplicaConnections {
+		replicaConn.Client.Close()
+	}
+
+	// Both replicas are as far along, the first one is promoted
+	select {
+	case <-replica1.Promoted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the first replica to be promoted")
+	}
+
+	select {
+	case <-replica2.Promoted:
+		t.Fatal("Expected only one replica promoted")
+	default:
+	}
+
+	// The process restarts the promoted replica as a node, like main does
+	nodeData, err := os.ReadFile(filepath.Join(replica1.Wd, node.ConfigFile))
+	if err != nil {
+		t.Fatalf("Expected a node config, got %v", err)
+	}
+
+	// The node config takes the health check interval and the read replica configs of the cluster
+	promotedConfig := &node.Config{}
+	if err = yaml.Unmarshal(nodeData, promotedConfig); err != nil {
+		t.Fatalf("Failed to unmarshal node config: %v", err)
+	}
+
+	if promotedConfig.HealthCheckInterval != 1 || len(promotedConfig.ReadReplicas) != 2 || *promotedConfig.ReadReplicas[0] != *testClientConfig("localhost:4074") || *promotedConfig.ReadReplicas[1] != *testClientConfig("localhost:4072") {
+		t.Fatalf("Unexpected node config after promotion %+v", promotedConfig)
+	}
+
+	promoted, err := node.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = promoted.Open(&replica1.Wd)
+	}()
+
+	t.Cleanup(func() {
+		promoted.Server.Close()
+		promoted.Journal.Close()
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for resp := ""; resp != "OK key-value written\r\n"; resp = sendTestCommand(t, conn, "PUT after failover") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected writes to the promoted node, got %q", resp)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for i := 0; i < 10; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("GET key%d", i)); withoutVersion(t, resp) != fmt.Sprintf("OK key%d %d\r\n", i, i) {
+			t.Fatalf("Expected key%d on the promoted node, got %q", i, resp)
+		}
+	}
+
+	// The config names the replica as the primary and the failed node as a replica
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+
+	config := &Config{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		t.Fatalf("Failed to unmarshal config data: %v", err)
+	}
+
+	nodeConfig := config.NodeConfigs[0]
+	if nodeConfig.Node.ServerAddress != "localhost:4073" || len(nodeConfig.Replicas) != 2 || nodeConfig.Replicas[0].ServerAddress != "localhost:4074" || nodeConfig.Replicas[1].ServerAddress != "localhost:4072" || nodeConfig.Slots != "0-16383" {
+		t.Fatalf("Unexpected node config after failover %+v", nodeConfig)
+	}
+
+	// The failed node comes back as a node and is demoted
+	returned, err := node.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = returned.Open(&primaryDir)
+	}()
+
+	select {
+	case <-returned.Demoted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the returned node to be demoted")
+	}
+
+	if _, err = os.Stat(filepath.Join(primaryDir, node.ConfigFile)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the node config removed, got %v", err)
+	}
+
+	rejoined, err := nodereplica.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	go func() {
+		_ = rejoined.Open(&primaryDir)
+	}()
+
+	t.Cleanup(func() {
+		rejoined.Server.Close()
+		rejoined.Journal.Close()
+	})
+
+	// The promoted node syncs its journal to the rejoined replica
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		rejoined.Lock.RLock()
+		_, _, ok := rejoined.Storage.Get("after")
+		rejoined.Lock.RUnlock()
+		if ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the rejoined replica to be synced from the promoted node")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestServerSwitchover(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	replica1 := startTestReplica(t, logger, "localhost:4077")
+	replica2 := startTestReplica(t, logger, "localhost:4078")
+	time.Sleep(time.Second) // Wait for replicas to open
+
+	primary := startTestNode(t, logger, "localhost:4076", "localhost:4077", "localhost:4078")
+	time.Sleep(3 * time.Second) // Wait for the primary to connect to its replicas
+
+	openTestCluster(t, logger, &Config{
+		HealthCheckInterval: 1,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4075",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		NodeConfigs: []*NodeConfig{
+			{
+				Node:     testClientConfig("localhost:4076"),
+				Replicas: []*client.Config{testClientConfig("localhost:4077"), testClientConfig("localhost:4078")},
+			},
+		},
+	})
+
+	conn := dialTestCluster(t, "localhost:4075")
+
+	for i := 0; i < 10; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("PUT key%d %d", i, i)); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected PUT to write, got %q", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "FAILOVER localhost:4099"); resp != "ERR node not found\r\n" {
+		t.Fatalf("Expected unknown node error, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "FAILOVER localhost:4076 TO localhost:4099"); resp != "ERR replica not found\r\n" {
+		t.Fatalf("Expected unknown replica error, got %q", resp)
+	}
+
+	// The process changes the role of each side, like main does
+	promoted := make(chan *node.Node, 1)
+	go func() {
+		<-replica1.Promoted
+		n, err := node.New(logger, "test-key")
+		if err != nil {
+			return
+		}
+		promoted <- n
+		_ = n.Open(&replica1.Wd)
+	}()
+
+	demoted := make(chan *nodereplica.NodeReplica, 1)
+	go func() {
+		<-primary.Demoted
+		nr, err := nodereplica.New(logger, "test-key")
+		if err != nil {
+			return
+		}
+		demoted <- nr
+		_ = nr.Open(&primary.Wd)
+	}()
+
+	// Writes sent during the switchover wait for the promoted node
+	writer := dialTestCluster(t, "localhost:4075")
+	written := make(chan string, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		written <- sendTestCommand(t, writer, "PUT during switchover")
+	}()
+
+	if resp := sendTestCommand(t, conn, "FAILOVER localhost:4076 TO localhost:4077"); resp != "OK switched over to localhost:4077\r\n" {
+		t.Fatalf("Expected switchover, got %q", resp)
+	}
+
+	if resp := <-written; resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected the write during the switchover on the promoted node, got %q", resp)
+	}
+
+	newPrimary := <-promoted
+	t.Cleanup(func() {
+		newPrimary.Server.Close()
+		newPrimary.Journal.Close()
+	})
+
+	newReplica := <-demoted
+	t.Cleanup(func() {
+		newReplica.Server.Close()
+		newReplica.Journal.Close()
+	})
+
+	select {
+	case <-replica2.Promoted:
+		t.Fatal("Expected only the chosen replica promoted")
+	default:
+	}
+
+	// The promoted node is connected once the switchover is answered
+	if resp := sendTestCommand(t, conn, "PUT after switchover"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected writes to the promoted node, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET during"); withoutVersion(t, resp) != "OK during switchover\r\n" {
+		t.Fatalf("Expected the write during the switchover on the promoted node, got %q", resp)
+	}
+
+	for i := 0; i < 10; i++ {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("GET key%d", i)); withoutVersion(t, resp) != fmt.Sprintf("OK key%d %d\r\n", i, i) {
+			t.Fatalf("Expected key%d on the promoted node, got %q", i, resp)
+		}
+	}
+
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		t.Fatalf("Failed to read config file: %v", err)
+	}
+
+	config := &Config{}
+	if err = yaml.Unmarshal(data, config); err != nil {
+		t.Fatalf("Failed to unmarshal config data: %v", err)
+	}
+
+	nodeConfig := config.NodeConfigs[0]
+	if nodeConfig.Node.ServerAddress != "localhost:4077" || len(nodeConfig.Replicas) != 2 || nodeConfig.Replicas[0].ServerAddress != "localhost:4078" || nodeConfig.Replicas[1].ServerAddress != "localhost:4076" || nodeConfig.Slots != "0-16383" {
+		t.Fatalf("Unexpected node config after switchover %+v", nodeConfig)
+	}
+
+	// The demoted node is synced from the promoted node as a read replica
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		newReplica.Lock.RLock()
+		_, _, ok := newReplica.Storage.Get("after")
+		newReplica.Lock.RUnlock()
+		if ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the demoted node to be synced from the promoted node")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestServerAckMultiplePrimaries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	replica := startTestReplica(t, logger, "localhost:4088")
+	time.Sleep(time.Second) // Wait for the replica to open
+
+	// The read replica of the second shard is down for the whole test
+	shard1 := startTestNode(t, logger, "localhost:4087", "localhost:4088")
+	startTestNode(t, logger, "localhost:4089", "localhost:4090")
+	time.Sleep(3 * time.Second) // Wait for the primaries to connect to their replicas
+
+	startTestCluster(t, logger, "localhost:4086", "localhost:4087", "localhost:4089")
+
+	conn := dialTestCluster(t, "localhost:4086")
+
+	synced, unsynced := slotKey("synced", slots.Even(2)[0]), slotKey("unsynced", slots.Even(2)[1])
+
+	// A write waiting for one replica is on the replica of its shard once answered
+	if resp := sendTestCommand(t, conn, "ACK one PUT "+synced+" 1"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	replica.Lock.RLock()
+	_, _, ok := replica.Storage.Get(synced)
+	replica.Lock.RUnlock()
+	if !ok {
+		t.Fatalf("Expected %s on the replica once the write was answered", synced)
+	}
+
+	shard1.Lock.RLock()
+	_, _, ok = shard1.Storage.Get(synced)
+	shard1.Lock.RUnlock()
+	if !ok {
+		t.Fatalf("Expected %s on the primary owning its slot", synced)
+	}
+
+	// WAIT waits on the shards the client wrote to
+	if resp := sendTestCommand(t, conn, "WAIT 1 1000"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected one replica to acknowledge the writes, got %q", resp)
+	}
+
+	// The write is applied on the primary of the other shard but no replica acknowledged it
+	if resp := sendTestCommand(t, conn, "ACK one PUT "+unsynced+" 2"); resp != "ERR write acknowledged by 0 of 1 read replicas\r\n" {
+		t.Fatalf("Expected the write unacknowledged, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET "+unsynced); withoutVersion(t, resp) != fmt.Sprintf("OK %s 2\r\n", unsynced) {
+		t.Fatalf("Expected the unacknowledged write applied, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT 1 200"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected no replica to acknowledge the writes of the other shard, got %q", resp)
+	}
+
+	// Another client waits only on the shard it wrote to
+	other := dialTestCluster(t, "localhost:4086")
+
+	if resp := sendTestCommand(t, other, "WAIT 1 200"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected nothing to wait for without writes, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, other, "PUT "+synced+" 3"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, other, "WAIT 1 1000"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected one replica to acknowledge the writes of the client, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "ACK most PUT "+synced+" 3"); resp != "ERR invalid ack mode\r\n" {
+		t.Fatalf("Expected 'ERR invalid ack mode', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT "+synced+" 1 1000"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %q", resp)
+	}
+}
+
+// slotKey returns the first key made of the prefix and a number hashed to one of the slots
+func slotKey(prefix string, ranges slots.Ranges) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("%s%d", prefix, i)
+		if ranges.Contains(slots.Slot(key)) {
+			return key
+		}
+	}
+}
+
+// startTestNode opens a primary node with the read replicas in a temporary directory
+func startTestNode(t *testing.T, logger *slog.Logger, address string, replicas ...string) *node.Node {
+	dir := t.TempDir()
+
+	config := &node.Config{
+		HealthCheckInterval: 2,
+		MaxMemoryThreshold:  75,
+		OrderedIndex:        true,
+		ReplicationAck:      node.AckAll, // Writes are answered once the replicas have them so a failover loses none
+		ServerConfig: &server.Config{
+			Address:     address,
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+	}
+
+	for _, replica := range replicas {
+		config.ReadReplicas = append(config.ReadReplicas, testClientConfig(replica))
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to marshal config data: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, node.ConfigFile), data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	n, err := node.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = n.Open(&dir)
+	}()
+
+	t.Cleanup(func() { n.Close() })
+
+	return n
+}
+
+// startTestReplica opens a read replica in a temporary directory
+// The replica is closed after the test dropping the connections of nodes, unless it was promoted
+func startTestReplica(t *testing.T, logger *slog.Logger, address string) *nodereplica.NodeReplica {
+	dir := t.TempDir()
+
+	config := &nodereplica.Config{
+		MaxMemoryThreshold: 75,
+		ServerConfig: &server.Config{
+			Address:     address,
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+	}
+
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to marshal config data: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, nodereplica.ConfigFile), data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	nr, err := nodereplica.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	go func() {
+		_ = nr.Open(&dir)
+	}()
+
+	t.Cleanup(func() {
+		select {
+		case <-nr.Promoted:
+		default:
+			nr.Server.Close()
+			nr.Journal.Close()
+		}
+	})
+
+	return nr
+}
+
+// testClientConfig returns the config of a connection to a test instance
+func testClientConfig(address string) *client.Config {
+	return &client.Config{
+		ServerAddress:  address,
+		ConnectTimeout: 5,
+		WriteTimeout:   5,
+		ReadTimeout:    5,
+		MaxRetries:     3,
+		RetryWaitTime:  1,
+		BufferSize:     1024,
+	}
+}
+
+// startTestCluster opens a cluster in front of the given primary nodes
+func startTestCluster(t *testing.T, logger *slog.Logger, address string, nodes ...string) *Cluster {
+	config := &Config{
+		HealthCheckInterval: 1,
+		ServerConfig: &server.Config{
+			Address:     address,
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+	}
+
+	for _, address := range nodes {
+		config.NodeConfigs = append(config.NodeConfigs, &NodeConfig{Node: testClientConfig(address)})
+	}
+
+	return openTestCluster(t, logger, config)
+}
+
+// openTestCluster writes the config and opens a cluster
+func openTestCluster(t *testing.T, logger *slog.Logger, config *Config) *Cluster {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to marshal config data: %v", err)
+	}
+
+	err = os.WriteFile(ConfigFile, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	c, err := New(logger, "test-key", "test-user", "test-pass")
+	if err != nil {
+		t.Fatalf("Failed to create cluster: %v", err)
+	}
+
+	go func() {
+		_ = c.Open()
+	}()
+
+	t.Cleanup(func() {
+		c.Close()
+		os.Remove(ConfigFile)
+	})
+
+	time.Sleep(2 * time.Second) // Wait for cluster to start and connect to primaries
+
+	return c
+}
+
+// dialTestCluster connects and authenticates to a cluster
+func dialTestCluster(t *testing.T, address string) *net.TCPConn {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", address)
+	if err != nil {
+		t.Fatalf("Failed to resolve address: %v", err)
+	}
+
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	authStr := base64.StdEncoding.EncodeToString([]byte("test-user\\0test-pass"))
+	if resp := sendTestCommand(t, conn, "AUTH "+authStr); resp != "OK authenticated\r\n" {
+		t.Fatalf("Expected 'OK authenticated', got %s", resp)
+	}
+
+	return conn
+}
+
+// withoutVersion drops the versions of the values in a GET, INCR, DECR or REGX response so it can be compared
+// OK <version> <key> <value> becomes OK <key> <value>, the <version> <key> <value> lines of REGX become <key> <value>
+func withoutVersion(t *testing.T, resp string) string {
+	lines := strings.Split(resp, "\r\n")
+	for i, line := range lines {
+		prefix := ""
+		if i == 0 {
+			if !strings.HasPrefix(line, "OK ") {
+				continue
+			}
+			prefix, line = "OK ", line[3:]
+		}
+
+		version, rest, ok := strings.Cut(line, " ")
+		if !ok {
+			continue
+		}
+
+		if _, err := hlc.Parse(version); err != nil {
+			t.Fatalf("Expected a version in %q, got %v", resp, err)
+		}
+		lines[i] = prefix + rest
+	}
+
+	return strings.Join(lines, "\r\n")
+}
+
+// sendTestCommand writes a command and returns the response
+func sendTestCommand(t *testing.T, conn *net.TCPConn, command string) string {
+	_, err := conn.Write([]byte(command + "\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	return string(buf[:n])
+}
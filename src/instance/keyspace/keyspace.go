@@ -0,0 +1,378 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package keyspace
+
+// The read commands a node and its read replicas share over their storage
+// The caller holds the lock of the node or read replica over the storage, its versions and its tombstones while
+// a command runs.  Responses are formatted the same on both so the cluster can read from either.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/journal"
+	"supermassive/query"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/tombstone"
+	"supermassive/storage/vector"
+	"supermassive/storage/versions"
+	"time"
+)
+
+// TypeNames are the value types SCAN can filter on
+var TypeNames = []string{"string", "stream", "queue", "bitmap", "hyperloglog", "timeseries", "json", "vector", "vectorindex", "textindex"}
+
+// TypeName returns the type name of a stored value
+func TypeName(value interface{}) string {
+	switch value.(type) {
+	case *stream.Stream:
+		return "stream"
+	case *queue.Queue:
+		return "queue"
+	case *bitmap.Bitmap:
+		return "bitmap"
+	case *hyperloglog.HyperLogLog:
+		return "hyperloglog"
+	case *timeseries.Series:
+		return "timeseries"
+	case *document.Document:
+		return "json"
+	case *vector.Vector:
+		return "vector"
+	case *vector.Index:
+		return "vectorindex"
+	case *fulltext.Index:
+		return "textindex"
+	}
+	return "string"
+}
+
+// Query runs QUERY [WHERE <condition>] [LIMIT <n>] over every entry
+// Responds with OK <n> followed by n <timestamp> <key> <value> lines ordered by key, timestamps have nanoseconds
+// so the cluster can tell copies of a key apart
+func Query(storage *hashtable.HashTable, command string) ([]byte, error) {
+	q, err := query.Parse(strings.TrimPrefix(command, "QUERY"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := storage.Traverse(q.Filter(TypeName))
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(entries)))
+	for _, entry := range entries {
+		response = append(response, fmt.Sprintf("%s %s %v\r\n", entry.Version, entry.Key, entry.Value)...)
+	}
+
+	return response, nil
+}
+
+// Aggregate runs AGG <COUNT|SUM|AVG|MIN|MAX> <pattern> [EXCLUDE <key>...] over the string values of keys matching the
+// pattern, values that are not numeric are skipped.  Responds with OK <result>
+// AGG KEYS responds with OK <n> followed by n <timestamp> <key> lines of the numeric keys and AGG PARTIAL with
+// OK <partial aggregate>, the cluster uses them to combine shards without counting a key twice
+func Aggregate(storage *hashtable.HashTable, args []string) ([]byte, error) {
+	op, pattern, exclude, err := hashtable.ParseAggregateArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := storage.Traverse(func(entry hashtable.Entry) bool {
+		return re.MatchString(entry.Key) && TypeName(entry.Value) == "string" && !slices.Contains(exclude, entry.Key)
+	})
+
+	var agg hashtable.Aggregate
+	var keys []hashtable.Entry
+	for _, entry := range entries {
+		if num, ok := hashtable.ParseNumeric(entry.Value); ok {
+			agg.Add(num)
+			keys = append(keys, entry)
+		}
+	}
+
+	switch op {
+	case "KEYS":
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(keys)))
+		for _, entry := range keys {
+			response = append(response, fmt.Sprintf("%s %s\r\n", entry.Version, entry.Key)...)
+		}
+		return response, nil
+	case "PARTIAL":
+		return []byte(fmt.Sprintf("OK %s\r\n", agg.String())), nil
+	}
+
+	result, err := agg.Result(op)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("OK %s\r\n", result)), nil
+}
+
+// Scan runs SCAN <cursor> [MATCH <pattern>] [COUNT <n>] [TYPE <type>]
+// Responds with OK <n> <next cursor> followed by n keys
+func Scan(storage *hashtable.HashTable, args []string) ([]byte, error) {
+	cursor, pattern, count, typ, err := hashtable.ParseScanArgs(args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	var re *regexp.Regexp
+	if pattern != "" {
+		if re, err = regexp.Compile(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	if typ != "" && !slices.Contains(TypeNames, typ) {
+		return nil, errors.New("invalid type")
+	}
+
+	entries, next := storage.Scan(cursor, count, func(entry hashtable.Entry) bool {
+		return (re == nil || re.MatchString(entry.Key)) && (typ == "" || TypeName(entry.Value) == typ)
+	})
+
+	response := []byte(fmt.Sprintf("OK %d %d\r\n", len(entries), next))
+	for _, entry := range entries {
+		response = append(response, entry.Key+"\r\n"...)
+	}
+
+	return response, nil
+}
+
+// Ordered runs RANGE <start> <end> [LIMIT <n>] and PREFIX <prefix> [LIMIT <n>] over the ordered keys
+// Responds with OK <n> followed by n keys
+func Ordered(storage *hashtable.HashTable, args []string) ([]byte, error) {
+	var entries []hashtable.Entry
+	var err error
+
+	switch args[0] {
+	case "RANGE":
+		// RANGE <start> <end> [LIMIT <n>]
+		var start, end string
+		var limit int
+		if start, end, limit, err = hashtable.ParseRangeArgs(args[1:]); err != nil {
+			return nil, err
+		}
+		entries, err = storage.Range(start, end, limit)
+	case "PREFIX":
+		// PREFIX <prefix> [LIMIT <n>]
+		var prefix string
+		var limit int
+		if prefix, limit, err = hashtable.ParsePrefixArgs(args[1:]); err != nil {
+			return nil, err
+		}
+		entries, err = storage.Prefix(prefix, limit)
+	default:
+		return nil, errors.New("invalid command")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(entries)))
+	for _, entry := range entries {
+		response = append(response, entry.Key+"\r\n"...)
+	}
+
+	return response, nil
+}
+
+// GetAt runs GET <key> AT <timestamp>
+// Keys without versions are found if their current value was written at or before the timestamp
+// Responds with OK <timestamp> <key> <value>, the timestamp has nanoseconds so the cluster can tell copies apart
+func GetAt(storage *hashtable.HashTable, history *versions.History, key, at string) ([]byte, error) {
+	ts, err := query.ParseTime(at)
+	if err != nil {
+		return nil, err
+	}
+
+	if history.Rule(key) != nil {
+		v, ok := history.At(key, ts, time.Now())
+		if !ok {
+			return nil, errors.New("key not found")
+		}
+		return []byte(fmt.Sprintf("OK %s %s %s\r\n", v.Timestamp.Format(time.RFC3339Nano), key, v.Value)), nil
+	}
+
+	value, written, ok := storage.Get(key)
+	if !ok || written.After(ts) || TypeName(value) != "string" {
+		return nil, errors.New("key not found")
+	}
+
+	return []byte(fmt.Sprintf("OK %s %s %s\r\n", written.Format(time.RFC3339Nano), key, value)), nil
+}
+
+// History runs HISTORY <key>
+// Responds with OK <n> followed by n versions newest first, see versions.Version.String
+// Keys without versions have their current value as only version
+func History(storage *hashtable.HashTable, history *versions.History, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	kept := history.Versions(key, time.Now())
+	if history.Rule(key) == nil {
+		if value, written, ok := storage.Get(key); ok && TypeName(value) == "string" {
+			kept = []versions.Version{{Value: fmt.Sprint(value), Timestamp: written}}
+		}
+	}
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(kept)))
+	for _, v := range kept {
+		response = append(response, v.String()+"\r\n"...)
+	}
+
+	return response, nil
+}
+
+// Tombstones runs TOMBSTONES <pattern>
+// Responds with OK <n> followed by n <version> <key> lines of the deleted keys matching the pattern
+func Tombstones(storage *hashtable.HashTable, tombstones *tombstone.Set, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	re, err := regexp.Compile(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := tombstones.Match(re, func(key string) bool {
+		_, _, ok := storage.Get(key)
+		return ok
+	}, time.Now())
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(deleted)))
+	for _, t := range deleted {
+		response = append(response, fmt.Sprintf("%s %s\r\n", t.Version, t.Key)...)
+	}
+
+	return response, nil
+}
+
+// DeletedError reports a key not found that has a tombstone as deleted with the version of the delete
+// The cluster compares the version of the delete with the copies of the key on other nodes so the delete wins against
+// older ones
+func DeletedError(tombstones *tombstone.Set, key string, err error) error {
+	if err.Error() != "key not found" {
+		return err
+	}
+
+	if deleted, ok := tombstones.Get(key, time.Now()); ok {
+		return fmt.Errorf("key deleted %s", deleted)
+	}
+
+	return err
+}
+
+// RecordVersion adds the value of a key after a write to its history while the caller holds the write lock
+// A zero time stamps the version with the time the value was written, or now for a deleted key
+func RecordVersion(storage *hashtable.HashTable, history *versions.History, key string, at time.Time) {
+	if history.Rule(key) == nil {
+		return
+	}
+
+	value, written, ok := storage.Get(key)
+	if at.IsZero() {
+		at = written
+		if !ok {
+			at = time.Now()
+		}
+	}
+
+	if !ok {
+		history.Record(key, versions.Version{Timestamp: at, Deleted: true}, time.Now())
+		return
+	}
+
+	if TypeName(value) == "string" {
+		history.Record(key, versions.Version{Value: fmt.Sprint(value), Timestamp: at}, time.Now())
+	}
+}
+
+// ReplayEntry records the versions and tombstones of a key after its entry was applied to the storage, as its writes
+// are replayed from the journal.  Returns the version of a delete that left a tombstone, a zero timestamp otherwise
+// Entries journaled before entries had timestamps cannot be placed in time and are skipped
+func ReplayEntry(storage *hashtable.HashTable, history *versions.History, tombstones *tombstone.Set, e *journal.Entry) hlc.Timestamp {
+	if e.Timestamp.IsZero() {
+		return hlc.Timestamp{}
+	}
+
+	switch e.Op {
+	case journal.PUT, journal.INCR, journal.DECR:
+		written := e.Timestamp
+		if !e.Version.IsZero() {
+			written = e.Version.Time()
+		}
+		RecordVersion(storage, history, e.Key, written)
+	case journal.DEL:
+		// Copies moved to another node leave no tombstone
+		if e.Value == journal.Moved {
+			return hlc.Timestamp{}
+		}
+
+		// Deletes are journaled with their version, entries journaled before deletes were versioned are dated when
+		// they were journaled
+		deletedAt := hlc.FromTime(e.Timestamp)
+		if version, err := hlc.Parse(e.Value); err == nil {
+			deletedAt = version
+		}
+
+		tombstones.Add(e.Key, deletedAt)
+		RecordVersion(storage, history, e.Key, deletedAt.Time())
+
+		return deletedAt
+	}
+
+	return hlc.Timestamp{}
+}
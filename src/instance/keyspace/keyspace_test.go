@@ -0,0 +1,140 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package keyspace
+
+import (
+	"errors"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/journal"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/tombstone"
+	"supermassive/storage/versions"
+	"testing"
+	"time"
+)
+
+func TestTypeName(t *testing.T) {
+	if name := TypeName("value"); name != "string" {
+		t.Fatalf("expected string, got %s", name)
+	}
+
+	if name := TypeName(bitmap.New()); name != "bitmap" {
+		t.Fatalf("expected bitmap, got %s", name)
+	}
+}
+
+// scanAll follows the cursor of SCAN until it returns to 0 and returns the keys found
+func scanAll(t *testing.T, storage *hashtable.HashTable, args ...string) map[string]bool {
+	keys := make(map[string]bool)
+	cursor := "0"
+	for {
+		response, err := Scan(storage, append([]string{"SCAN", cursor}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(response), "\r\n"), "\r\n")
+		fields := strings.Fields(lines[0])
+		for _, key := range lines[1:] {
+			keys[key] = true
+		}
+
+		if cursor = fields[2]; cursor == "0" {
+			return keys
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	storage := hashtable.New()
+	storage.Put("user_1", "a")
+	storage.Put("user_2", "b")
+	storage.Put("flags", bitmap.New())
+
+	keys := scanAll(t, storage, "MATCH", "^user_")
+	if len(keys) != 2 || !keys["user_1"] || !keys["user_2"] {
+		t.Fatalf("expected user_1 and user_2, got %v", keys)
+	}
+
+	keys = scanAll(t, storage, "TYPE", "bitmap")
+	if len(keys) != 1 || !keys["flags"] {
+		t.Fatalf("expected flags, got %v", keys)
+	}
+
+	if _, err := Scan(storage, []string{"SCAN", "0", "TYPE", "table"}); err == nil || err.Error() != "invalid type" {
+		t.Fatalf("expected invalid type, got %v", err)
+	}
+}
+
+func TestReplayEntry(t *testing.T) {
+	storage := hashtable.New()
+	history, err := versions.New([]*versions.Rule{{Pattern: "^doc_"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstones := tombstone.New(time.Hour)
+
+	written := time.Now().Add(-time.Minute)
+	put := &journal.Entry{Key: "doc_1", Value: "v1", Op: journal.PUT, Timestamp: written}
+	if err = journal.Apply(storage, put); err != nil {
+		t.Fatal(err)
+	}
+
+	if deletedAt := ReplayEntry(storage, history, tombstones, put); !deletedAt.IsZero() {
+		t.Fatalf("expected no delete version for a put, got %s", deletedAt)
+	}
+
+	version := hlc.FromTime(written.Add(time.Second))
+	del := &journal.Entry{Key: "doc_1", Value: version.String(), Op: journal.DEL, Timestamp: time.Now()}
+	if err = journal.Apply(storage, del); err != nil {
+		t.Fatal(err)
+	}
+
+	if deletedAt := ReplayEntry(storage, history, tombstones, del); deletedAt != version {
+		t.Fatalf("expected delete version %s, got %s", version, deletedAt)
+	}
+
+	kept := history.Versions("doc_1", time.Now())
+	if len(kept) != 2 || !kept[0].Deleted || kept[1].Value != "v1" {
+		t.Fatalf("unexpected versions %v", kept)
+	}
+
+	err = DeletedError(tombstones, "doc_1", errors.New("key not found"))
+	if err == nil || err.Error() != "key deleted "+version.String() {
+		t.Fatalf("expected key deleted %s, got %v", version, err)
+	}
+
+	// Moved copies leave no tombstone
+	moved := &journal.Entry{Key: "doc_2", Value: journal.Moved, Op: journal.DEL, Timestamp: time.Now()}
+	if deletedAt := ReplayEntry(storage, history, tombstones, moved); !deletedAt.IsZero() {
+		t.Fatalf("expected no delete version for a moved key, got %s", deletedAt)
+	}
+}
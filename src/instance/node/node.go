@@ -32,19 +32,35 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"log/slog"
 	"net"
 	"os"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"supermassive/hlc"
+	"supermassive/instance/keyspace"
 	"supermassive/journal"
 	"supermassive/network/client"
 	"supermassive/network/server"
+	"supermassive/slots"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
 	"supermassive/storage/hashtable"
-	"supermassive/storage/pager"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/tombstone"
+	"supermassive/storage/vector"
+	"supermassive/storage/versions"
 	"supermassive/utility"
 	"sync"
 	"time"
@@ -56,35 +72,107 @@ const ConfigFile = ".node"
 // JournalFile is the journal file for this node
 const JournalFile = ".journal"
 
+// ReplicaConfigFile is the config file a demoted node leaves for the read replica it restarts as
+// A node replica reads the keys it shares with the node config and ignores the rest
+const ReplicaConfigFile = ".nodereplica"
+
+// DemotedJournalFile is where a demoted node keeps its journal, the read replica is synced afresh from the new primary
+const DemotedJournalFile = ".journal.demoted"
+
 // Config is the node configurations
 type Config struct {
-	HealthCheckInterval int              `yaml:"health-check-interval"` // Health check interval
-	MaxMemoryThreshold  uint64           `yaml:"max-memory-threshold"`  // Maximum memory threshold, default 75% of system memory
-	ServerConfig        *server.Config   `yaml:"server-config"`         // Node server configs
-	ReadReplicas        []*client.Config `yaml:"read-replicas"`         // Read replica configs
+	HealthCheckInterval int              `yaml:"health-check-interval"`   // Health check interval
+	MaxMemoryThreshold  uint64           `yaml:"max-memory-threshold"`    // Maximum memory threshold, default 75% of system memory
+	ServerConfig        *server.Config   `yaml:"server-config"`           // Node server configs
+	ReadReplicas        []*client.Config `yaml:"read-replicas"`           // Read replica configs
+	QueueMaxDeliveries  int              `yaml:"queue-max-deliveries"`    // Deliveries before a job is moved to the dead letter queue, default 5
+	QueueDeadLetter     string           `yaml:"queue-dead-letter"`       // Suffix appended to a queue key for its dead letter queue, default _dead
+	OrderedIndex        bool             `yaml:"ordered-index"`           // Keep keys in lexicographic order for RANGE and PREFIX
+	Versions            []*versions.Rule `yaml:"versions"`                // Keys keeping old versions for point-in-time reads
+	TombstoneGrace      int              `yaml:"tombstone-grace-period"`  // Seconds deleted keys keep their tombstone, default 86400
+	ReplicationAck      string           `yaml:"replication-ack"`         // Read replicas a write waits for, none, one or all, default none
+	AckTimeout          int              `yaml:"replication-ack-timeout"` // Milliseconds a write waits for read replicas, default 1000
+	ReplicationBuffer   int              `yaml:"replication-buffer"`      // Writes buffered for a read replica before it is resynced, default 10000
 }
 
+// DefaultQueueMaxDeliveries is the default number of deliveries before a job is dead lettered
+const DefaultQueueMaxDeliveries = 5
+
+// DefaultQueueDeadLetter is the default dead letter queue key suffix
+const DefaultQueueDeadLetter = "_dead"
+
+// Acknowledgement modes, how many read replicas a write waits for before it is answered
+const (
+	AckNone = "none" // The write is answered once applied on the node
+	AckOne  = "one"  // The write is answered once a read replica applied it
+	AckAll  = "all"  // The write is answered once every read replica connected to the node applied it
+)
+
+// AllReplicas waits for every read replica connected to the node rather than a number of them
+const AllReplicas = -1
+
+// DefaultAckTimeout is the default number of milliseconds a write waits for read replicas
+const DefaultAckTimeout = 1000
+
+// DefaultReplicationBuffer is the default number of writes buffered for a read replica
+const DefaultReplicationBuffer = 10000
+
+// ReplicationBatchSize is the maximum number of buffered writes sent to a read replica at once
+const ReplicationBatchSize = 256
+
+// ReplicationHeartbeat is the longest a read replica goes without a batch, it is sent empty ones while there are no
+// writes so it knows its primary node is up
+const ReplicationHeartbeat = time.Second
+
 // Node is the main struct for the node
 type Node struct {
-	Config             *Config              // Is the node configuration
-	ConfigLock         *sync.RWMutex        // Is the lock for the config file
-	Server             *server.Server       // Is the node server
-	Logger             *slog.Logger         // Is the logger for the node
-	ReplicaConnections []*ReplicaConnection // Are the connections to read replicas
-	SharedKey          string               // Is the shared key for the node
-	Storage            *hashtable.HashTable // Is the storage for the node
-	Journal            *journal.Journal     // Is the journal for the node
-	Lock               *sync.RWMutex        // Is the lock for the node
-	MaxMemory          uint64               // Is the maximum memory for the system
-	Wd                 string               // Is the working directory for the node
+	Config             *Config                    // Is the node configuration
+	ConfigLock         *sync.RWMutex              // Is the lock for the config file
+	Server             *server.Server             // Is the node server
+	Logger             *slog.Logger               // Is the logger for the node
+	ReplicaConnections []*ReplicaConnection       // Are the connections to read replicas
+	SharedKey          string                     // Is the shared key for the node
+	Storage            *hashtable.HashTable       // Is the storage for the node
+	Journal            *journal.Journal           // Is the journal for the node
+	Lock               *sync.RWMutex              // Is the lock for the node
+	MaxMemory          uint64                     // Is the maximum memory for the system
+	Wd                 string                     // Is the working directory for the node
+	Notifier           *utility.Notifier          // Is the notifier used to wake blocking reads
+	VectorIndexes      map[string]*vector.Index   // Are the vector indexes by name
+	TextIndexes        map[string]*fulltext.Index // Are the full-text indexes by name
+	History            *versions.History          // Are the old versions of keys
+	Tombstones         *tombstone.Set             // Are the tombstones of deleted keys
+	Clock              *hlc.Clock                 // Assigns the versions of writes
+	Demoted            chan struct{}              // Is closed once the node was demoted by the cluster and closed
+	Closing            chan struct{}              // Is closed once the node is closing, blocking reads stop waiting
+	Acks               *utility.Notifier          // Is the notifier used to wake writes waiting for read replicas
 }
 
 // ReplicaConnection is the connection to a read replica
 type ReplicaConnection struct {
-	Client  *client.Client  // Is the connection to the replica
-	Health  bool            // Is the health status of the replica connection
-	Context context.Context // Is the context for the replica connection
-	Lock    *sync.Mutex     // Is the lock for the replica connection
+	Client   *client.Client  // Is the connection to the replica
+	Health   bool            // Is the health status of the replica connection
+	Context  context.Context // Is the context for the replica connection
+	Lock     *sync.Mutex     // Is the lock for the replica connection
+	Synced   uint64          // Is the sequence number the replica was last synced to, writes up to it are not relayed again
+	Diverged bool            // Is true once a write relayed to the replica failed on it, it is sent a snapshot when resynced
+	Sent     time.Time       // Is when the last batch was sent to the replica
+
+	BufferLock *sync.Mutex   // Is the lock for the replication stream fields below
+	Buffer     []replicated  // Are the relayed writes waiting to be sent to the replica
+	Overflowed bool          // Is true once writes were dropped from a full buffer, the replica is resynced
+	Acked      uint64        // Is the sequence number of the last write the replica acknowledged
+	Connected  bool          // Is true once the replica is synced until its connection fails, writes wait only for connected replicas
+	Behind     time.Time     // Is when the oldest write the replica has not acknowledged was relayed, zero once caught up
+	Wake       chan struct{} // Is signalled when writes are buffered
+	Done       chan struct{} // Is closed once the replica is removed from the node
+}
+
+// replicated is a write buffered for a read replica
+type replicated struct {
+	Seq     uint64    // The sequence number of the journal entry of the write
+	Command string    // The command to apply the write
+	Time    time.Time // When the write was relayed
 }
 
 // ServerConnectionHandler is the handler for the server connections
@@ -109,7 +197,7 @@ func New(logger *slog.Logger, sharedKey string) (*Node, error) {
 		return nil, err
 	}
 
-	return &Node{Logger: logger, SharedKey: sharedKey, Storage: hashtable.New(), Lock: &sync.RWMutex{}, MaxMemory: maxMem, ConfigLock: &sync.RWMutex{}}, nil
+	return &Node{Logger: logger, SharedKey: sharedKey, Storage: hashtable.New(), Lock: &sync.RWMutex{}, MaxMemory: maxMem, ConfigLock: &sync.RWMutex{}, Notifier: utility.NewNotifier(), VectorIndexes: make(map[string]*vector.Index), TextIndexes: make(map[string]*fulltext.Index), Demoted: make(chan struct{}), Closing: make(chan struct{}), Acks: utility.NewNotifier()}, nil
 }
 
 // Open opens a new node instance
@@ -160,13 +248,7 @@ func (n *Node) Open(dir *string) error {
 
 	// Create connections to the read replicas
 	for _, replicaConfig := range n.Config.ReadReplicas {
-		replicaConn := &ReplicaConnection{
-			Client: client.New(replicaConfig, n.Logger),
-			Health: false,
-			Lock:   &sync.Mutex{},
-		}
-
-		n.ReplicaConnections = append(n.ReplicaConnections, replicaConn)
+		n.ReplicaConnections = append(n.ReplicaConnections, n.newReplicaConnection(replicaConfig))
 	}
 
 	n.Journal, err = journal.Open(fmt.Sprintf("%s%s%s", wd, string(os.PathSeparator), JournalFile))
@@ -176,12 +258,34 @@ func (n *Node) Open(dir *string) error {
 
 	go n.backgroundHealthChecks()
 
+	n.History, err = versions.New(n.Config.Versions)
+	if err != nil {
+		return err
+	}
+
+	n.Tombstones = tombstone.New(tombstone.GracePeriod(n.Config.TombstoneGrace))
+
+	// Writes are versioned with a hybrid logical clock so copies of a key on different nodes compare deterministically
+	n.Clock = hlc.NewClock(hlc.NodeID(n.Config.ServerConfig.Address))
+	n.Storage.SetClock(n.Clock)
+
 	// We recover from journal
-	// Populates the storage with the journal data
-	if err = n.Journal.Recover(n.Storage); err != nil {
+	// Populates the storage with the journal data, old versions and tombstones of keys are rebuilt as their writes are replayed
+	if err = n.Journal.RecoverWith(n.Storage, n.replayEntry); err != nil {
 		return err
 	}
 
+	// Vector index graphs are not journaled, we rebuild them from the recovered vectors
+	n.VectorIndexes = vector.Rebuild(n.Storage)
+
+	// Full-text postings are not journaled either, we rebuild them from the recovered values
+	n.TextIndexes = fulltext.Rebuild(n.Storage)
+
+	// The ordered index is built once from the recovered keys rather than on every replayed write
+	if n.Config.OrderedIndex {
+		n.Storage.EnableOrderedIndex()
+	}
+
 	// We start the server
 	err = n.Server.Start()
 	if err != nil {
@@ -196,6 +300,14 @@ func (n *Node) Close() error {
 	n.Lock.Lock()
 	defer n.Lock.Unlock()
 
+	// Blocking reads stop waiting, the server waits for their connections to finish.  The replication streams stop
+	if !n.closing() {
+		close(n.Closing)
+		for _, replicaConn := range n.ReplicaConnections {
+			close(replicaConn.Done)
+		}
+	}
+
 	// We close the server
 	err := n.Server.Shutdown()
 	if err != nil {
@@ -254,6 +366,13 @@ func createDefaultConfigFile(wd string) (*Config, error) {
 	config := &Config{
 		HealthCheckInterval: 2,
 		MaxMemoryThreshold:  75,
+		QueueMaxDeliveries:  DefaultQueueMaxDeliveries,
+		QueueDeadLetter:     DefaultQueueDeadLetter,
+		OrderedIndex:        true,
+		TombstoneGrace:      tombstone.DefaultGracePeriod,
+		ReplicationAck:      AckNone,
+		AckTimeout:          DefaultAckTimeout,
+		ReplicationBuffer:   DefaultReplicationBuffer,
 		ServerConfig: &server.Config{
 			Address:     "localhost:4001",
 			UseTLS:      false,
@@ -299,6 +418,7 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 	var tempBuffer []byte // Temporary buffer to store data (larger than buffer)
 
 	authenticated := false // Is the connection authenticated
+	var written uint64     // Is the journal sequence number of the last write of the connection, WAIT waits for it
 
 	for {
 
@@ -328,6 +448,25 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 
 		command = bytes.TrimSuffix(command, []byte("\r\n"))
 
+		// ACK <none|one|all> <command> answers a write once the read replicas the mode asks for applied it, rather than
+		// as many as the mode of the node asks for
+		ack := ""
+		if authenticated && bytes.HasPrefix(command, []byte("ACK ")) {
+			fields := bytes.SplitN(command, []byte(" "), 3)
+			if len(fields) == 3 {
+				ack, err = parseAck(string(fields[1]))
+				if err != nil {
+					_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+					if err != nil {
+						h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+						return
+					}
+					continue
+				}
+				command = fields[2]
+			}
+		}
+
 		switch {
 		// A cluster authenticating
 		case strings.HasPrefix(string(command), "NAUTH"):
@@ -410,9 +549,9 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 
 			for i, entry := range entries {
 				if i == 0 {
-					results = append(results, []byte(fmt.Sprintf("OK %s %s %s\r\n", entry.Timestamp.Format(time.RFC3339), entry.Key, entry.Value)))
+					results = append(results, []byte(fmt.Sprintf("OK %s %s %s\r\n", entry.Version, entry.Key, entry.Value)))
 				} else {
-					results = append(results, []byte(fmt.Sprintf("%s %s %s\r\n", entry.Timestamp.Format(time.RFC3339), entry.Key, entry.Value)))
+					results = append(results, []byte(fmt.Sprintf("%s %s %s\r\n", entry.Version, entry.Key, entry.Value)))
 				}
 
 			}
@@ -426,7 +565,7 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				return
 			}
 
-		case strings.HasPrefix(string(command), "PUT"):
+		case strings.HasPrefix(string(command), "RESTOREENTRIES"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -446,34 +585,34 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We put the data
-			key := strings.Split(string(command), " ")[1]
-			value := strings.Join(strings.Split(string(command), " ")[2:], " ")
-
-			go func() {
-				err := h.Node.Journal.Append(key, value, journal.PUT)
+			response, seq, err := h.Node.restoreEntriesCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
-					h.Node.Logger.Warn("journal append error", "error", err)
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
 				}
-			}()
-
-			// We lock the node
-			h.Node.Lock.Lock()
-
-			h.Node.Storage.Put(key, value)
-
-			// We unlock the node
-			h.Node.Lock.Unlock()
+				continue
+			}
 
-			// We relay to the read replicas
-			h.Node.relayToReplicas(string(command))
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-			_, err = conn.Write([]byte("OK key-value written\r\n"))
+			_, err = conn.Write(response)
 			if err != nil {
 				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-		case strings.HasPrefix(string(command), "GET"):
+
+		case strings.HasPrefix(string(command), "RESTORE"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -483,35 +622,30 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We get the data
-			key := strings.Split(string(command), " ")[1]
-
-			// We get read lock
-			h.Node.Lock.RLock()
-
-			value, ts, ok := h.Node.Storage.Get(key)
-
-			// We release read lock
-			h.Node.Lock.RUnlock()
-
-			if ok {
-				// Format time in RFC3339
-				// OK 2021-09-01T12:00:00Z key value
-				_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, value)))
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
-			} else {
-				_, err = conn.Write([]byte("ERR key not found\r\n"))
+				continue
+			}
+
+			response, seq, err := h.Node.restoreCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
-		case strings.HasPrefix(string(command), "DEL"):
-			if !authenticated {
-				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -519,45 +653,37 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We delete the data
-			key := strings.Split(string(command), " ")[1]
-
-			go func() {
-				err := h.Node.Journal.Append(key, "", journal.DEL)
-				if err != nil {
-					h.Node.Logger.Warn("journal append error", "error", err)
-				}
-			}()
-
-			// We get lock
-			h.Node.Lock.Lock()
-
-			ok := h.Node.Storage.Delete(key)
-
-			if ok {
-				// We release lock
-				h.Node.Lock.Unlock()
-
-				// We relay to the read replicas
-				h.Node.relayToReplicas(string(command))
-
-				_, err = conn.Write([]byte("OK key-value deleted\r\n"))
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "LOAD"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
-			} else {
-
-				// We release lock
-				h.Node.Lock.Unlock()
+				continue
+			}
 
-				_, err = conn.Write([]byte("ERR key-value not found\r\n"))
+			response, err := h.Node.loadCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
-		case strings.HasPrefix(string(command), "INCR"):
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "ROLE"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -567,11 +693,14 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			key := strings.Split(string(command), " ")[1] // We get incrementing key
-
-			// We check if we have incrementing value
-			if len(strings.Split(string(command), " ")) < 3 {
-				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+			_, err = conn.Write([]byte("OK primary\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "WAIT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -579,40 +708,35 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			go func() {
-				err = h.Node.Journal.Append(key, strings.Split(string(command), " ")[2], journal.PUT)
-				if err != nil {
-					h.Node.Logger.Warn("journal append error", "error", err)
-				}
-			}()
-
-			// We get lock
-			h.Node.Lock.Lock()
+			// WAIT <replicas> <timeout ms>
+			// Waits for the read replicas to apply the writes of the client
+			response, err := h.Node.wait(strings.Fields(string(command))[1:], written)
+			if err != nil {
+				response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+			}
 
-			val, ts, err := h.Node.Storage.Incr(key, strings.Split(string(command), " ")[2])
+			_, err = conn.Write(response)
 			if err != nil {
-				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "JOURNALPOS"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					h.Node.Lock.Unlock()
 					return
 				}
-				h.Node.Lock.Unlock()
 				continue
 			}
 
-			h.Node.Lock.Unlock()
-
-			// We relay to the read replicas
-			h.Node.relayToReplicas(string(command))
-
-			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, val)))
+			// The cluster waits for a read replica to reach this sequence number before switching over to it
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %d\r\n", h.Node.Journal.Seq())))
 			if err != nil {
 				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-
-		case strings.HasPrefix(string(command), "DECR"):
+		case strings.HasPrefix(string(command), "DEMOTE"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -622,11 +746,9 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			key := strings.Split(string(command), " ")[1] // We get decrementing key
-
-			// We check if we have a decrementing value
-			if len(strings.Split(string(command), " ")) < 3 {
-				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+			err = h.Node.demote()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -634,47 +756,41 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			go func() {
-				err = h.Node.Journal.Append(key, strings.Split(string(command), " ")[2], journal.PUT)
-				if err != nil {
-					h.Node.Logger.Warn("journal append error", "error", err)
-				}
-			}()
+			_, err = conn.Write([]byte("OK demoted\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+			}
 
-			// We get lock
-			h.Node.Lock.Lock()
+			// The node closes once this connection is done, the process restarts it as a read replica
+			go h.Node.stepDown()
 
-			val, ts, err := h.Node.Storage.Decr(key, strings.Split(string(command), " ")[2])
-			if err != nil {
-				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+			return
+		case strings.HasPrefix(string(command), "SLOTCOUNT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					h.Node.Lock.Unlock()
 					return
 				}
-				h.Node.Lock.Unlock()
-				return
+				continue
 			}
 
-			h.Node.Lock.Unlock()
-
-			// We relay to the read replicas
-			h.Node.relayToReplicas(string(command))
-
-			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, val)))
+			response, err := h.Node.slotCountCommand(strings.Fields(string(command)))
 			if err != nil {
-				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
 			}
-		case strings.HasPrefix(string(command), "QUIT"):
-			_, err = conn.Write([]byte("OK see ya later\r\n"))
+
+			_, err = conn.Write(response)
 			if err != nil {
 				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-
-			return
-		case strings.HasPrefix(string(command), "STAT"):
+		case strings.HasPrefix(string(command), "SLOTDUMP"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -684,20 +800,14 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			storageStats := h.Node.Journal.Pager.Stats()
-			hashtableStats := h.Node.Storage.Stats()
-
-			// We create one byte array for response
-			var response []byte
-			response = append(response, []byte("OK\r\n")...)
-			response = append(response, []byte(fmt.Sprintf("DISK\r\n"))...)
-			for k, v := range storageStats {
-				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
-			}
-
-			response = append(response, []byte(fmt.Sprintf("MEMORY\r\n"))...)
-			for k, v := range hashtableStats {
-				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			response, err := h.Node.slotDumpCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
 			}
 
 			_, err = conn.Write(response)
@@ -705,8 +815,7 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-
-		case strings.HasPrefix(string(command), "RCNF"):
+		case strings.HasPrefix(string(command), "PUTNX"), strings.HasPrefix(string(command), "PUTXX"), strings.HasPrefix(string(command), "CAS"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -716,357 +825,4076 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			err = h.Node.ReloadConfig()
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.conditionalCommand(string(command))
 			if err != nil {
-				_, err = conn.Write([]byte("ERR reload error\r\n"))
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
 
-			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
 			if err != nil {
-				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
 			}
 
-		default:
-			_, err = conn.Write([]byte("ERR unknown command\r\n"))
+			_, err = conn.Write(response)
 			if err != nil {
 				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-		}
+		case strings.HasPrefix(string(command), "PUT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We put the data
+			key := strings.Split(string(command), " ")[1]
+			value := strings.Join(strings.Split(string(command), " ")[2:], " ")
+
+			version := h.Node.Clock.Now()
+
+			// We lock the node
+			h.Node.Lock.Lock()
+
+			// The write is journaled while the lock is held so a snapshot matches the sequence number it is taken at,
+			// and relayed with the sequence number of its entry
+			seq := h.Node.journalEntry(journal.Entry{Key: key, Value: value, Op: journal.PUT, Version: version})
+
+			h.Node.Storage.PutVersion(key, value, version)
+			h.Node.updateTextIndexes(key)
+			h.Node.recordVersion(key, time.Time{})
+
+			// We unlock the node
+			h.Node.Lock.Unlock()
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte("OK key-value written\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SETBIT"), strings.HasPrefix(string(command), "GETBIT"), strings.HasPrefix(string(command), "BITCOUNT"), strings.HasPrefix(string(command), "BITOP"), strings.HasPrefix(string(command), "BITDUMP"), strings.HasPrefix(string(command), "BITSTORE"),
+			strings.HasPrefix(string(command), "PFADD"), strings.HasPrefix(string(command), "PFCOUNT"), strings.HasPrefix(string(command), "PFMERGE"), strings.HasPrefix(string(command), "PFDUMP"), strings.HasPrefix(string(command), "PFSTORE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.analyticsCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "TS."):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.timeSeriesCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "JSON."):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.documentCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "VCREATE"), strings.HasPrefix(string(command), "VADD"), strings.HasPrefix(string(command), "VSEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.vectorCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "FT.CREATE"), strings.HasPrefix(string(command), "SEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, seq, err := h.Node.textCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "RANGE"), strings.HasPrefix(string(command), "PREFIX"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.orderedCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SCAN"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.scanCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "AGG"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.aggCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "HISTORY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.historyCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "TOMBSTONES"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.tombstonesCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUERY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.queryCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "GET"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get the data
+			key := strings.Split(string(command), " ")[1]
+
+			// GET <key> AT <timestamp> reads the version that was current at the time
+			if args := strings.Fields(string(command)); len(args) == 4 && strings.ToUpper(args[2]) == "AT" {
+				response, err := h.Node.getAtCommand(key, args[3])
+				if err != nil {
+					response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+				}
+
+				_, err = conn.Write(response)
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get read lock
+			h.Node.Lock.RLock()
+
+			value, version, ok := h.Node.Storage.GetVersion(key)
+			notFound := h.Node.deletedError(key, errors.New("key not found"))
+
+			// We release read lock
+			h.Node.Lock.RUnlock()
+
+			// Bitmaps, hyperloglogs, time series, vector and full-text indexes exist on several nodes at once
+			// so they are not returned by GET, the cluster would otherwise delete the other copies as stale
+			switch value.(type) {
+			case *bitmap.Bitmap, *hyperloglog.HyperLogLog, *timeseries.Series, *vector.Index, *fulltext.Index:
+				_, err = conn.Write([]byte("ERR wrong type\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if ok {
+				// The version is the hybrid logical clock timestamp of the write so copies on different nodes can be ordered
+				// OK 2021-09-01T12:00:00.123456789Z/0/1a2b3c4d key value
+				_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, value)))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			} else {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", notFound.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+		case strings.HasPrefix(string(command), "DEL"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We delete the data
+			key := strings.Split(string(command), " ")[1]
+
+			// A delete is versioned by the clock like a write, the version is journaled as the value of the entry.
+			// DEL <key> <version> deletes a stale copy, its tombstone is dated with the version of the copy so it does
+			// not win against the newer copy kept on another node.  DEL <key> MOVED deletes a copy moved to another
+			// node without a tombstone
+			var version hlc.Timestamp
+			deletedAt := h.Node.Clock.Now()
+			if args := strings.Fields(string(command)); len(args) == 3 {
+				if version, err = hlc.Parse(args[2]); err == nil {
+					deletedAt = version
+				} else if args[2] == journal.Moved {
+					deletedAt = hlc.Timestamp{}
+				}
+			}
+
+			journaled := journal.Moved
+			if !deletedAt.IsZero() {
+				journaled = deletedAt.String()
+			}
+
+			// We get lock
+			h.Node.Lock.Lock()
+
+			// A stale copy written again since it was read is newer than the version, it is kept
+			if _, current, ok := h.Node.Storage.GetVersion(key); ok && !version.IsZero() && current.After(version) {
+				h.Node.Lock.Unlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR key exists %s\r\n", current)))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// The delete is journaled and relayed while the lock is held, like a write.  The tombstone is journaled
+			// even when the key was not found
+			seq := h.Node.journalEntry(journal.Entry{Key: key, Value: journaled, Op: journal.DEL, Version: deletedAt})
+
+			ok := h.Node.Storage.Delete(key)
+			if journaled != journal.Moved {
+				h.Node.Tombstones.Add(key, deletedAt)
+				h.Node.recordVersion(key, deletedAt.Time())
+			}
+			h.Node.updateTextIndexes(key)
+
+			// We release lock
+			h.Node.Lock.Unlock()
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if ok {
+				_, err = conn.Write([]byte("OK key-value deleted\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			} else {
+				_, err = conn.Write([]byte("ERR key-value not found\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+		case strings.HasPrefix(string(command), "INCR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := strings.Split(string(command), " ")[1] // We get incrementing key
+
+			// We check if we have incrementing value
+			if len(strings.Split(string(command), " ")) < 3 {
+				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get lock
+			h.Node.Lock.Lock()
+
+			val, _, err := h.Node.Storage.Incr(key, strings.Split(string(command), " ")[2])
+			if err != nil {
+				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", h.Node.deletedError(key, err).Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					h.Node.Lock.Unlock()
+					return
+				}
+				h.Node.Lock.Unlock()
+				continue
+			}
+
+			// The incremented value has a version of its own, it is journaled and relayed with it
+			_, version, _ := h.Node.Storage.GetVersion(key)
+			seq := h.Node.journalVersion(key, strings.Split(string(command), " ")[2], journal.INCR)
+			h.Node.updateTextIndexes(key)
+			h.Node.recordVersion(key, time.Time{})
+
+			h.Node.Lock.Unlock()
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, val)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "DECR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := strings.Split(string(command), " ")[1] // We get decrementing key
+
+			// We check if we have a decrementing value
+			if len(strings.Split(string(command), " ")) < 3 {
+				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get lock
+			h.Node.Lock.Lock()
+
+			val, _, err := h.Node.Storage.Decr(key, strings.Split(string(command), " ")[2])
+			if err != nil {
+				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", h.Node.deletedError(key, err).Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					h.Node.Lock.Unlock()
+					return
+				}
+				h.Node.Lock.Unlock()
+				return
+			}
+
+			// The decremented value has a version of its own, it is journaled and relayed with it
+			_, version, _ := h.Node.Storage.GetVersion(key)
+			seq := h.Node.journalVersion(key, strings.Split(string(command), " ")[2], journal.DECR)
+			h.Node.updateTextIndexes(key)
+			h.Node.recordVersion(key, time.Time{})
+
+			h.Node.Lock.Unlock()
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, val)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XADD"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XADD <key> <id|*> <field> <value> [<field> <value>...]
+			args := strings.Fields(string(command))
+			if len(args) < 5 || len(args[3:])%2 != 0 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := args[1]
+
+			// We lock the node
+			h.Node.Lock.Lock()
+
+			id, seq, err := h.Node.streamAdd(key, args[2], args[3:])
+			if err != nil {
+				h.Node.Lock.Unlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We unlock the node
+			h.Node.Lock.Unlock()
+
+			// We wake up any blocked readers
+			h.Node.Notifier.Notify(key)
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s\r\n", id)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XRANGE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XRANGE <key> <start|-> <end|+> [COUNT <n>]
+			args := strings.Fields(string(command))
+			start, end, count, err := parseStreamRange(args)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We acquire read lock
+			h.Node.Lock.RLock()
+
+			s, err := stream.Load(h.Node.Storage, args[1], false)
+			if err != nil {
+				h.Node.Lock.RUnlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response := []byte("OK\r\n")
+			for _, entry := range s.Range(start, end, count) {
+				response = append(response, []byte(fmt.Sprintf("%s\r\n", entry))...)
+			}
+
+			// We release read lock
+			h.Node.Lock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XREADGROUP"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XREADGROUP GROUP <group> <consumer> [COUNT <n>] [BLOCK <ms>] STREAMS <key>... <id|>>...
+			args := strings.Fields(string(command))
+			if len(args) < 4 || !strings.EqualFold(args[1], "GROUP") {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			group, consumer := args[2], args[3]
+
+			read, err := parseStreamRead(args[4:])
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.streamReadGroup(group, consumer, read, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XREAD"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XREAD [COUNT <n>] [BLOCK <ms>] STREAMS <key>... <id|$>...
+			read, err := parseStreamRead(strings.Fields(string(command))[1:])
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.Node.streamRead(read)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XGROUP"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XGROUP CREATE <key> <group> <id|$> [MKSTREAM]
+			// XGROUP DESTROY <key> <group>
+			args := strings.Fields(string(command))
+
+			h.Node.Lock.Lock()
+			seq, response, err := h.Node.streamGroup(args)
+			h.Node.Lock.Unlock()
+
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(response))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XACK"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XACK <key> <group> <id>...
+			args := strings.Fields(string(command))
+			if len(args) < 4 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			ids, err := stream.ParseIDs(args[3:])
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We lock the node
+			h.Node.Lock.Lock()
+
+			s, err := stream.Load(h.Node.Storage, args[1], false)
+			acked := 0
+			if err == nil {
+				acked, err = s.Ack(args[2], ids)
+			}
+
+			if err != nil {
+				h.Node.Lock.Unlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			var seq uint64
+			if acked > 0 {
+				seq = h.Node.journalWrite(args[1], strings.Join(args[2:], " "), journal.XACK)
+			}
+
+			// We unlock the node
+			h.Node.Lock.Unlock()
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %d\r\n", acked)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XPENDING"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XPENDING <key> <group>
+			args := strings.Fields(string(command))
+			if len(args) != 3 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We acquire read lock
+			h.Node.Lock.RLock()
+
+			s, err := stream.Load(h.Node.Storage, args[1], false)
+			var pending []*stream.PendingEntry
+			if err == nil {
+				pending, err = s.Pending(args[2])
+			}
+
+			if err != nil {
+				h.Node.Lock.RUnlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// OK <count> CRLF <id> <consumer> <idle ms> <deliveries> CRLF...
+			response := []byte(fmt.Sprintf("OK %d\r\n", len(pending)))
+			for _, pe := range pending {
+				response = append(response, []byte(fmt.Sprintf("%s %s %d %d\r\n", pe.ID, pe.Consumer, time.Since(pe.DeliveredAt).Milliseconds(), pe.Deliveries))...)
+			}
+
+			// We release read lock
+			h.Node.Lock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QPUSH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if h.Node.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// QPUSH <key> <payload>
+			args := strings.SplitN(string(command), " ", 3)
+			if len(args) != 3 || args[1] == "" || args[2] == "" {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := args[1]
+
+			id, err := queue.NewID()
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We lock the node
+			h.Node.Lock.Lock()
+
+			q, err := queue.Load(h.Node.Storage, key, true)
+			if err == nil {
+				err = q.Push(id, args[2])
+			}
+
+			if err != nil {
+				h.Node.Lock.Unlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			seq := h.Node.queueWrite(key, fmt.Sprintf("%s %s", id, args[2]), journal.QPUSH)
+
+			// We unlock the node
+			h.Node.Lock.Unlock()
+
+			// We wake up any blocked consumers
+			h.Node.Notifier.Notify(key)
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s\r\n", id)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QRESERVE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// QRESERVE <key> <visibility timeout ms> [BLOCK <ms>]
+			args := strings.Fields(string(command))
+			if len(args) != 3 && (len(args) != 5 || !strings.EqualFold(args[3], "BLOCK")) {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			visibility, err := strconv.Atoi(args[2])
+			if err != nil || visibility <= 0 {
+				_, err = conn.Write([]byte("ERR invalid visibility timeout\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			block, blocking := 0, len(args) == 5
+			if blocking {
+				block, err = strconv.Atoi(args[4])
+				if err != nil || block < 0 {
+					_, err = conn.Write([]byte("ERR invalid block timeout\r\n"))
+					if err != nil {
+						h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+						return
+					}
+					continue
+				}
+			}
+
+			response, err := h.Node.queueReserveBlocking(args[1], time.Duration(visibility)*time.Millisecond, time.Duration(block)*time.Millisecond, blocking, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QACK"), strings.HasPrefix(string(command), "QNACK"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// QACK <key> <id>
+			// QNACK <key> <id>
+			args := strings.Fields(string(command))
+			if len(args) != 3 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key, id := args[1], args[2]
+
+			// We lock the node
+			h.Node.Lock.Lock()
+
+			var seq uint64
+			found := false
+
+			q, err := queue.Load(h.Node.Storage, key, false)
+			if err == nil {
+				if args[0] == "QACK" {
+					found = q.Ack(id)
+					if found {
+						seq = h.Node.queueWrite(key, id, journal.QACK)
+					}
+				} else {
+					found = q.Nack(id)
+					if found {
+						seq = h.Node.queueWrite(key, id, journal.QNACK)
+						seq = max(seq, h.Node.queueDeadLetter(key, q))
+					}
+				}
+			}
+
+			// We unlock the node
+			h.Node.Lock.Unlock()
+
+			if !found {
+				_, err = conn.Write([]byte("ERR job not found\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if args[0] == "QNACK" {
+				// A released job is ready again
+				h.Node.Notifier.Notify(key)
+			}
+
+			// We wait for the read replicas, a write they did not acknowledge in time is reported to the client
+			err = h.Node.waitForAck(seq, ack, &written)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response := "OK job acknowledged\r\n"
+			if args[0] == "QNACK" {
+				response = "OK job released\r\n"
+			}
+
+			_, err = conn.Write([]byte(response))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QSTATS"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// QSTATS <key>
+			args := strings.Fields(string(command))
+			if len(args) != 2 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, suffix := h.Node.queueSettings()
+			ready, reserved, dead := 0, 0, 0
+			now := time.Now()
+
+			// We acquire read lock
+			h.Node.Lock.RLock()
+
+			q, err := queue.Load(h.Node.Storage, args[1], false)
+			if err == nil {
+				ready, reserved = q.Stats(now)
+			}
+
+			d, derr := queue.Load(h.Node.Storage, args[1]+suffix, false)
+			if derr == nil {
+				dead = len(d.Ready) + len(d.Reserved)
+			}
+
+			// We release read lock
+			h.Node.Lock.RUnlock()
+
+			if err != nil && err.Error() != "key not found" {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK ready %d reserved %d dead %d\r\n", ready, reserved, dead)))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUIT"):
+			_, err = conn.Write([]byte("OK see ya later\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+			return
+		case strings.HasPrefix(string(command), "STAT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			storageStats := h.Node.Journal.Pager.Stats()
+			hashtableStats := h.Node.Storage.Stats()
+
+			// We create one byte array for response
+			var response []byte
+			response = append(response, []byte("OK\r\n")...)
+			response = append(response, []byte(fmt.Sprintf("DISK\r\n"))...)
+			for k, v := range storageStats {
+				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			}
+
+			response = append(response, []byte(fmt.Sprintf("MEMORY\r\n"))...)
+			for k, v := range hashtableStats {
+				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			}
+
+			// <replica> applied <sequence number> lag_entries <n> lag_seconds <seconds>
+			response = append(response, []byte("REPLICATION\r\n")...)
+			for _, replicaConn := range h.Node.ReplicaConnections {
+				applied, entries, lag := h.Node.replicaLag(replicaConn)
+				response = append(response, []byte(fmt.Sprintf("\t%s applied %d lag_entries %d lag_seconds %.3f\r\n", replicaConn.Client.Config.ServerAddress, applied, entries, lag.Seconds()))...)
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "RCNF"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			err = h.Node.ReloadConfig()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR reload error\r\n"))
+				if err != nil {
+					h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+
+			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		default:
+			_, err = conn.Write([]byte("ERR unknown command\r\n"))
+			if err != nil {
+				h.Node.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		}
+
+	}
+}
+
+// backgroundHealthChecks performs background health checks on the nodes
+func (n *Node) backgroundHealthChecks() {
+	ticker := time.NewTicker(time.Duration(n.Config.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.Demoted:
+			return
+		case <-ticker.C:
+
+			for _, replicaConn := range n.ReplicaConnections {
+				replicaConn.Lock.Lock()
+				if !replicaConn.Health {
+
+					n.Logger.Warn("node replica is unhealthy", "replica", replicaConn.Client.Config.ServerAddress)
+					if replicaConn.Context == nil {
+						replicaConn.Context = context.Background()
+					}
+					if replicaConn.Client == nil {
+						replicaConn.Client = client.New(replicaConn.Client.Config, n.Logger)
+
+					}
+
+					if err := replicaConn.Client.Connect(replicaConn.Context); err != nil {
+						n.Logger.Warn("node connection error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					sharedKeyHash := sha256.Sum256([]byte(n.SharedKey))
+					err := replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("NAUTH %x\r\n", sharedKeyHash)))
+					if err != nil {
+						n.Logger.Warn("authentication error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					response, err := replicaConn.Client.Receive(replicaConn.Context)
+					if err != nil || string(response) != "OK authenticated\r\n" {
+						n.Logger.Warn("authentication error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					replicaConn.Health = true
+					n.Logger.Info("node replica is reconnected and healthy", "node", replicaConn.Client.Config.ServerAddress)
+
+					err = replicaConn.Client.Send(replicaConn.Context, []byte("STARTSYNC\r\n"))
+					if err != nil {
+						n.Logger.Warn("sync error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					response, err = replicaConn.Client.Receive(replicaConn.Context)
+					if err != nil {
+						n.Logger.Warn("read error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					// A node that has not rejoined as a read replica yet, such as a failed primary coming back, is not written to
+					command := strings.TrimSuffix(string(response), "\r\n")
+					if !strings.HasPrefix(command, "SYNCFROM") {
+						n.Logger.Warn("not a read replica", "response", command, "replica", replicaConn.Client.Config.ServerAddress)
+						n.disconnect(replicaConn)
+						replicaConn.Client.Close()
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					parts := strings.Split(command, " ")
+					if len(parts) < 2 {
+						err = replicaConn.Client.Send(replicaConn.Context, []byte("ERR invalid command\r\n"))
+						if err != nil {
+							n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+						}
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					// The replica sends the sequence number of the last write of a primary node it applied
+					seq, err := strconv.ParseUint(parts[1], 10, 64)
+					if err != nil {
+						n.Logger.Warn("invalid sequence number", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					// A replica that cannot resume from its sequence number is sent a snapshot of the storage and resumes from
+					// the sequence number of the snapshot
+					if replicaConn.Diverged || !n.resumable(seq) {
+						seq, err = n.sendSnapshot(replicaConn)
+						if err != nil {
+							n.Logger.Warn("snapshot error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+							n.disconnect(replicaConn)
+							replicaConn.Client.Close()
+							replicaConn.Lock.Unlock()
+							continue
+						}
+						replicaConn.Diverged = false
+					}
+
+					// Writes journaled from here on are relayed, the ones before are sent by the sync.  Writes are journaled
+					// and relayed under the write lock, the lock is only held to read where the relayed writes start
+					n.Lock.RLock()
+					replicaConn.Synced = n.Journal.Seq()
+					n.Lock.RUnlock()
+
+					if seq >= replicaConn.Synced {
+						err = replicaConn.Client.Send(replicaConn.Context, []byte("DONESYNC\r\n"))
+						if err != nil {
+							n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+						} else {
+							// OK synced
+							_, err = replicaConn.Client.Receive(replicaConn.Context)
+							if err == nil {
+								n.ack(replicaConn, replicaConn.Synced)
+							}
+						}
+						n.Logger.Warn("nothing to sync", "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					// Each write is sent with its sequence number, the replica journals it under the same one.  Writes
+					// keep being journaled while the journal is read, the ones after Synced are sent from the buffer of
+					// the replica once the sync is done
+					err = n.Journal.Since(seq, func(e *journal.Entry) error {
+						command := replicaCommand(e)
+						if command == "" || e.Seq > replicaConn.Synced {
+							return nil
+						}
+
+						err := replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("SEQ %d %s\r\n", e.Seq, command)))
+						if err != nil {
+							return err
+						}
+
+						// Read response
+						response, err := replicaConn.Client.Receive(replicaConn.Context)
+						if err != nil {
+							return err
+						}
+
+						if strings.HasPrefix(string(response), "ERR") {
+							return fmt.Errorf("%w: %s", errRelayFailed, strings.TrimSpace(string(response)))
+						}
+
+						return nil
+					})
+
+					// A replica that failed a write is sent a snapshot once reconnected, the writes it was sent are not
+					// acknowledged
+					if err != nil {
+						n.Logger.Warn("sync error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+						replicaConn.Diverged = errors.Is(err, errRelayFailed)
+						n.disconnect(replicaConn)
+						replicaConn.Client.Close()
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					err = replicaConn.Client.Send(replicaConn.Context, []byte("DONESYNC\r\n"))
+					if err != nil {
+						n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
+					}
+
+					// Read response
+					response, err = replicaConn.Client.Receive(replicaConn.Context)
+					if err != nil {
+						n.Logger.Warn("read error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					if string(response) != "OK synced\r\n" {
+						n.Logger.Warn("unexpected response", "response", string(response))
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					// The replica applied the writes up to the ones relayed from here on
+					n.ack(replicaConn, replicaConn.Synced)
+
+					replicaConn.Lock.Unlock()
+
+				} else {
+					// We create a temp connection to the replica using a new client
+					tempClient := client.New(replicaConn.Client.Config, n.Logger)
+					if err := tempClient.Connect(replicaConn.Context); err != nil {
+						n.Logger.Warn("node connection error", "error", err)
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					err := tempClient.Send(replicaConn.Context, []byte("PING\r\n"))
+					if err != nil {
+						n.disconnect(replicaConn)
+						tempClient.Close()
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					response, err := tempClient.Receive(replicaConn.Context)
+					if err != nil {
+						n.Logger.Warn("read error", "error", err)
+						n.disconnect(replicaConn)
+						tempClient.Close()
+						replicaConn.Lock.Unlock()
+						continue
+					}
+
+					if string(response) != "OK PONG\r\n" {
+						n.Logger.Warn("unexpected response", "response", string(response))
+						n.disconnect(replicaConn)
+					}
+
+					tempClient.Close()
+					replicaConn.Lock.Unlock()
+				}
+
+			}
+		}
+	}
+}
+
+// resumable returns true if a read replica can resume from its sequence number with the journal entries after it
+// A new replica, a replica ahead of the journal which has diverged, or one behind the first entry is sent a snapshot
+func (n *Node) resumable(seq uint64) bool {
+	last, first := n.Journal.Seq(), n.Journal.First()
+	if last == 0 {
+		return seq == 0
+	}
+
+	return seq > 0 && seq+1 >= first && seq <= last
+}
+
+// sendSnapshot sends a snapshot of the storage to a read replica which loads it in place of its own, the caller holds
+// the replica connection lock
+// Returns the sequence number of the snapshot, the writes journaled after it are sent once the snapshot is loaded
+func (n *Node) sendSnapshot(replicaConn *ReplicaConnection) (uint64, error) {
+	// Writes are journaled while the lock is held so the snapshot matches the sequence number it is taken at
+	n.Lock.RLock()
+	seq := n.Journal.Seq()
+	entries := n.snapshotHistory(time.Now())
+	for _, entry := range n.Storage.Traverse(nil) {
+		entries = append(entries, journal.Snapshot(entry.Key, entry.Value, entry.Version)...)
+	}
+	n.Lock.RUnlock()
+
+	err := n.sendReplica(replicaConn, fmt.Sprintf("SNAPSHOT %d", seq))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range entries {
+		encoded, err := encodeEntry(e)
+		if err != nil {
+			return 0, err
+		}
+
+		err = n.sendReplica(replicaConn, "SNAPSHOTENTRY "+encoded)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = n.sendReplica(replicaConn, "SNAPSHOTDONE")
+	if err != nil {
+		return 0, err
+	}
+
+	n.Logger.Info("snapshot sent to node replica", "replica", replicaConn.Client.Config.ServerAddress, "journal_seq", seq, "entries", len(entries))
+
+	return seq, nil
+}
+
+// snapshotHistory returns the entries recreating the tombstones and old versions of keys on a read replica, sent
+// before the current values.  Tombstones kept as a deletion in the history of their key are sent with it, the current
+// value of a key is left to the storage.  The caller holds the lock
+func (n *Node) snapshotHistory(now time.Time) []journal.Entry {
+	history := make(map[string][]versions.Version)
+	for _, key := range n.History.Keys() {
+		value, _, exists := n.Storage.Get(key)
+		if exists && keyspace.TypeName(value) != "string" {
+			// Only strings keep versions, an older string would not take the entries of the current value
+			continue
+		}
+
+		// Versions are returned newest first, the newest one is the current value unless the key was deleted
+		kept := n.History.Versions(key, now)
+		if exists && len(kept) > 0 && !kept[0].Deleted {
+			kept = kept[1:]
+		}
+		history[key] = kept
+	}
+
+	var entries []journal.Entry
+	for _, t := range n.Tombstones.All(now) {
+		if !slices.ContainsFunc(history[t.Key], func(v versions.Version) bool {
+			return v.Deleted && v.Timestamp.Equal(t.Version.Time())
+		}) {
+			entries = append(entries, journal.Entry{Key: t.Key, Value: t.Version.String(), Op: journal.DEL, Timestamp: t.Version.Time()})
+		}
+	}
+
+	for _, key := range n.History.Keys() {
+		kept := history[key]
+		for i := len(kept) - 1; i >= 0; i-- {
+			v := kept[i]
+			if v.Deleted {
+				entries = append(entries, journal.Entry{Key: key, Value: hlc.FromTime(v.Timestamp).String(), Op: journal.DEL, Timestamp: v.Timestamp})
+			} else {
+				entries = append(entries, journal.Entry{Key: key, Value: v.Value, Op: journal.PUT, Version: hlc.FromTime(v.Timestamp), Timestamp: v.Timestamp})
+			}
+		}
+	}
+
+	return entries
+}
+
+// sendReplica sends a command to a read replica and returns an error if it is not applied
+func (n *Node) sendReplica(replicaConn *ReplicaConnection, command string) error {
+	err := replicaConn.Client.Send(replicaConn.Context, []byte(command+"\r\n"))
+	if err != nil {
+		return err
+	}
+
+	response, err := replicaConn.Client.Receive(replicaConn.Context)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(string(response), "OK") {
+		return fmt.Errorf("unexpected response %q", strings.TrimSpace(string(response)))
+	}
+
+	return nil
+}
+
+// replicaCommand returns the command replaying a journal entry on a read replica, empty for entries not replayed
+// Entries are sent encoded so the replica applies them with the version the primary node wrote them with
+func replicaCommand(e *journal.Entry) string {
+	encoded, err := encodeEntry(*e)
+	if err != nil {
+		return ""
+	}
+	return "RESTOREENTRY " + encoded
+}
+
+// relay buffers the command applying a journal entry for the replication stream of every read replica with the
+// sequence number of the entry.  Returns the sequence number
+// The caller holds the write lock the write was journaled under, so writes are buffered in the order of their entries.
+// An entry that cannot be encoded is not relayed, a replica whose buffer is full is resynced from the journal rather
+// than holding up writes
+func (n *Node) relay(e *journal.Entry) uint64 {
+	seq, command := e.Seq, replicaCommand(e)
+	if command == "" {
+		n.Logger.Warn("relay error", "error", "entry could not be encoded", "key", e.Key)
+		return seq
+	}
+
+	_, _, size := n.replicationSettings()
+
+	now := time.Now()
+	for _, replicaConn := range n.ReplicaConnections {
+		replicaConn.BufferLock.Lock()
+		if len(replicaConn.Buffer) < size {
+			replicaConn.Buffer = append(replicaConn.Buffer, replicated{Seq: seq, Command: command, Time: now})
+		} else {
+			replicaConn.Overflowed = true
+		}
+
+		if replicaConn.Behind.IsZero() {
+			replicaConn.Behind = now
+		}
+		replicaConn.BufferLock.Unlock()
+
+		select {
+		case replicaConn.Wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return seq
+}
+
+// newReplicaConnection creates the connection to a read replica and starts its replication stream
+// Each replica is written to from its own stream so a slow replica does not hold up writes or the other replicas
+func (n *Node) newReplicaConnection(config *client.Config) *ReplicaConnection {
+	replicaConn := &ReplicaConnection{
+		Client:     client.New(config, n.Logger),
+		Health:     false,
+		Lock:       &sync.Mutex{},
+		BufferLock: &sync.Mutex{},
+		Wake:       make(chan struct{}, 1),
+		Done:       make(chan struct{}),
+	}
+
+	go n.replicate(replicaConn)
+
+	return replicaConn
+}
+
+// replicate sends the writes buffered for a read replica in batches until the node is demoted or the replica removed
+// The writes of a batch are pipelined and followed by ACKPOS, the replica answers it with the sequence number of the
+// last write it applied once the writes before it are applied
+func (n *Node) replicate(replicaConn *ReplicaConnection) {
+	heartbeat := time.NewTicker(ReplicationHeartbeat / 2)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-n.Demoted:
+			return
+		case <-replicaConn.Done:
+			return
+		case <-heartbeat.C:
+			n.sendBatch(replicaConn, nil, false)
+			continue
+		case <-replicaConn.Wake:
+		}
+
+		for {
+			replicaConn.BufferLock.Lock()
+			batch := replicaConn.Buffer
+			if len(batch) > ReplicationBatchSize {
+				batch = batch[:ReplicationBatchSize]
+			}
+			replicaConn.Buffer = replicaConn.Buffer[len(batch):]
+			overflowed := replicaConn.Overflowed
+			replicaConn.Overflowed = false
+			replicaConn.BufferLock.Unlock()
+
+			if len(batch) == 0 && !overflowed {
+				break
+			}
+
+			n.sendBatch(replicaConn, batch, overflowed)
+		}
+	}
+}
+
+// sendBatch sends a batch of buffered writes to a read replica and records the writes it acknowledged
+// A replica that missed writes is marked unhealthy, the health checks reconnect and resync it from the journal.  An
+// empty batch is a heartbeat, sent only once half of ReplicationHeartbeat passed since the last batch
+func (n *Node) sendBatch(replicaConn *ReplicaConnection, batch []replicated, overflowed bool) {
+	replicaConn.Lock.Lock()
+	defer replicaConn.Lock.Unlock()
+
+	if !replicaConn.Health {
+		return
+	}
+
+	if overflowed {
+		n.Logger.Warn("replication buffer full, resyncing node replica", "replica", replicaConn.Client.Config.ServerAddress)
+		n.disconnect(replicaConn)
+		_ = replicaConn.Client.Close()
+		return
+	}
+
+	var data []byte
+	for _, w := range batch {
+		// A write journaled while the replica was synced was sent by the sync
+		if w.Seq > replicaConn.Synced {
+			data = append(data, fmt.Sprintf("SEQ %d %s\r\n", w.Seq, w.Command)...)
+		}
+	}
+
+	if len(data) == 0 && (len(batch) > 0 || time.Since(replicaConn.Sent) < ReplicationHeartbeat/2) {
+		return
+	}
+
+	// The replica is told the last write journaled and how long ago the first write after the batch was relayed, so it
+	// knows how far behind it is once the batch is applied
+	head, behind := n.Journal.Seq(), time.Duration(0)
+	replicaConn.BufferLock.Lock()
+	last := replicaConn.Acked
+	if len(batch) > 0 {
+		last = batch[len(batch)-1].Seq
+	}
+	if head > last {
+		behind = time.Since(relayedAfter(replicaConn, last))
+	}
+	replicaConn.BufferLock.Unlock()
+
+	data = append(data, fmt.Sprintf("ACKPOS %d %d\r\n", head, behind.Milliseconds())...)
+
+	err := replicaConn.Client.Send(replicaConn.Context, data)
+	if err != nil {
+		n.Logger.Warn("write error", "error", err)
+		n.disconnect(replicaConn)
+		return
+	}
+	replicaConn.Sent = time.Now()
+
+	acked, err := n.receiveAck(replicaConn)
+	if errors.Is(err, errRelayFailed) {
+		// The replica no longer matches the journal, it is resynced with a snapshot
+		n.Logger.Warn("resyncing diverged node replica", "error", err, "replica", replicaConn.Client.Config.ServerAddress)
+		replicaConn.Diverged = true
+		n.disconnect(replicaConn)
+		_ = replicaConn.Client.Close()
+		return
+	}
+
+	if err != nil {
+		n.Logger.Warn("read error", "error", err)
+		n.disconnect(replicaConn)
+		return
+	}
+
+	n.ack(replicaConn, acked)
+}
+
+// errRelayFailed is returned for a batch a read replica failed to apply a write of
+var errRelayFailed = errors.New("relayed write failed")
+
+// receiveAck reads the responses to a batch up to the ACK <sequence number> answering its ACKPOS
+// A batch with a failed write is not acknowledged, errRelayFailed is returned once its responses are read
+func (n *Node) receiveAck(replicaConn *ReplicaConnection) (uint64, error) {
+	var failed string
+	for {
+		response, err := replicaConn.Client.ReceiveLine(replicaConn.Context)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, line := range strings.Split(strings.TrimSuffix(string(response), "\r\n"), "\r\n") {
+			if strings.HasPrefix(line, "ERR") && failed == "" {
+				failed = line
+			}
+
+			if seq, ok := strings.CutPrefix(line, "ACK "); ok {
+				if failed != "" {
+					return 0, fmt.Errorf("%w: %s", errRelayFailed, failed)
+				}
+				return strconv.ParseUint(seq, 10, 64)
+			}
+		}
+	}
+}
+
+// ack records the sequence number of the last write a read replica applied and wakes the writes waiting for it
+// A replica acknowledging writes is connected
+func (n *Node) ack(replicaConn *ReplicaConnection, seq uint64) {
+	head := n.Journal.Seq()
+
+	replicaConn.BufferLock.Lock()
+	replicaConn.Connected = true
+	if seq > replicaConn.Acked {
+		replicaConn.Acked = seq
+	}
+
+	if replicaConn.Acked >= head {
+		replicaConn.Behind = time.Time{}
+	} else {
+		replicaConn.Behind = relayedAfter(replicaConn, replicaConn.Acked)
+	}
+	replicaConn.BufferLock.Unlock()
+
+	n.Acks.Notify(ackKey)
+}
+
+// disconnect marks a read replica unhealthy so the health checks reconnect and resync it, writes stop waiting for it
+// The caller holds the replica connection lock
+func (n *Node) disconnect(replicaConn *ReplicaConnection) {
+	replicaConn.Health = false
+
+	replicaConn.BufferLock.Lock()
+	replicaConn.Connected = false
+	replicaConn.BufferLock.Unlock()
+
+	n.Acks.Notify(ackKey)
+}
+
+// relayedAfter returns when the first write buffered for a read replica after the sequence number was relayed, now if
+// it was not buffered yet.  The caller holds the buffer lock
+func relayedAfter(replicaConn *ReplicaConnection, seq uint64) time.Time {
+	for _, w := range replicaConn.Buffer {
+		if w.Seq > seq {
+			return w.Time
+		}
+	}
+
+	return time.Now()
+}
+
+// replicaLag returns the sequence number of the last write a read replica acknowledged, the number of journaled writes
+// it is behind and how long ago the oldest of them was relayed
+func (n *Node) replicaLag(replicaConn *ReplicaConnection) (uint64, uint64, time.Duration) {
+	head := n.Journal.Seq()
+
+	replicaConn.BufferLock.Lock()
+	defer replicaConn.BufferLock.Unlock()
+
+	if replicaConn.Acked >= head {
+		return replicaConn.Acked, 0, 0
+	}
+
+	var lag time.Duration
+	if !replicaConn.Behind.IsZero() {
+		lag = time.Since(replicaConn.Behind)
+	}
+
+	return replicaConn.Acked, head - replicaConn.Acked, lag
+}
+
+// ackKey is the key writes waiting for read replicas wait on
+const ackKey = "acks"
+
+// acked returns the number of connected read replicas that applied the writes up to the sequence number and the
+// number of connected read replicas
+func (n *Node) acked(seq uint64) (int, int) {
+	count, connected := 0, 0
+	for _, replicaConn := range n.ReplicaConnections {
+		replicaConn.BufferLock.Lock()
+		if replicaConn.Connected {
+			connected++
+			if replicaConn.Acked >= seq {
+				count++
+			}
+		}
+		replicaConn.BufferLock.Unlock()
+	}
+
+	return count, connected
+}
+
+// waitForAck records the sequence number as the last write of a client connection and waits for the read replicas the
+// acknowledgement mode asks for to apply the writes up to it
+// An empty mode is the mode of the node, all waits for the replicas connected to the node.  A write not acknowledged in
+// time is applied on the node all the same, the error tells the client how many replicas have it
+func (n *Node) waitForAck(seq uint64, ack string, written *uint64) error {
+	*written = max(*written, seq)
+
+	mode, timeout, _ := n.replicationSettings()
+	if ack != "" {
+		mode = ack
+	}
+
+	var needed int
+	switch mode {
+	case AckOne:
+		needed = 1
+	case AckAll:
+		needed = AllReplicas
+	default:
+		return nil
+	}
+
+	if seq == 0 {
+		return nil
+	}
+
+	got, needed := n.waitAcks(seq, needed, timeout)
+	if got < needed {
+		n.Logger.Warn("write not acknowledged by read replicas in time", "journal_seq", seq, "ack", mode, "acked", got)
+		return fmt.Errorf("write acknowledged by %d of %d read replicas", got, needed)
+	}
+
+	return nil
+}
+
+// waitAcks waits until the number of connected read replicas applied the writes up to the sequence number or the
+// timeout passes, AllReplicas waits for every connected replica.  Returns the number of replicas that applied them and
+// the number waited for
+func (n *Node) waitAcks(seq uint64, needed int, timeout time.Duration) (int, int) {
+	deadline := time.Now().Add(timeout)
+	for {
+		// The channel is gathered before counting so no acknowledgement is missed
+		channel := n.Acks.Wait(ackKey)
+
+		got, connected := n.acked(seq)
+		want := needed
+		if needed == AllReplicas {
+			want = connected
+		}
+
+		wait := time.Until(deadline)
+		if got >= want || wait <= 0 {
+			return got, want
+		}
+
+		// A timeout is noticed by the next count
+		utility.WaitAny([]<-chan struct{}{channel}, wait, nil)
+	}
+}
+
+// replicationSettings returns the acknowledgement mode, how long a write waits for read replicas and the number of
+// writes buffered for a read replica
+func (n *Node) replicationSettings() (string, time.Duration, int) {
+	n.ConfigLock.RLock()
+	defer n.ConfigLock.RUnlock()
+
+	mode, timeout, size := AckNone, DefaultAckTimeout, DefaultReplicationBuffer
+	if n.Config != nil {
+		if n.Config.ReplicationAck != "" {
+			mode = n.Config.ReplicationAck
+		}
+
+		if n.Config.AckTimeout > 0 {
+			timeout = n.Config.AckTimeout
+		}
+
+		if n.Config.ReplicationBuffer > 0 {
+			size = n.Config.ReplicationBuffer
+		}
+	}
+
+	return mode, time.Duration(timeout) * time.Millisecond, size
+}
+
+// wait handles WAIT, returns OK and the number of connected read replicas that applied the writes of the client
+// connection up to its last write once there are as many as asked for or the timeout passed
+func (n *Node) wait(args []string, written uint64) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	needed, err := strconv.Atoi(args[0])
+	if err != nil || needed < 0 {
+		return nil, errors.New("invalid number of replicas")
+	}
+
+	timeout, err := strconv.Atoi(args[1])
+	if err != nil || timeout < 0 {
+		return nil, errors.New("invalid timeout")
+	}
+
+	// A timeout of 0 waits as long as a write does
+	wait := time.Duration(timeout) * time.Millisecond
+	if timeout == 0 {
+		_, wait, _ = n.replicationSettings()
+	}
+
+	got, _ := n.waitAcks(written, needed, wait)
+
+	return []byte(fmt.Sprintf("OK %d\r\n", got)), nil
+}
+
+// parseAck parses an acknowledgement mode
+func parseAck(mode string) (string, error) {
+	switch strings.ToLower(mode) {
+	case AckNone, AckOne, AckAll:
+		return strings.ToLower(mode), nil
+	}
+
+	return "", errors.New("invalid ack mode")
+}
+
+// MemoryCheck checks the memory usage of the node
+// true for ok (not out of memory), false for out of memory
+func (n *Node) MemoryCheck() bool {
+	// Get the current memory usage
+	currentMemoryUsage := utility.GetCurrentMemoryUsage()
+
+	// Calculate the percentage of current memory usage relative to nr.MaxMemory
+	memoryUsagePercentage := (float64(currentMemoryUsage) / float64(n.MaxMemory)) * 100
+
+	// We compare it with the MaxMemoryThreshold set in Config
+	if memoryUsagePercentage > float64(n.Config.MaxMemoryThreshold) {
+		return false
+	}
+
+	return true
+}
+
+// loadCommand runs LOAD
+// Responds with OK <memory> <keys>, the memory used as a percentage of the max memory threshold and the number of keys.
+// The cluster places fewer new keys and jobs on fuller nodes
+func (n *Node) loadCommand(args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("invalid command")
+	}
+
+	threshold := float64(n.Config.MaxMemoryThreshold)
+	if threshold == 0 {
+		threshold = 100
+	}
+
+	memory := float64(utility.GetCurrentMemoryUsage()) / float64(n.MaxMemory) * 100 / threshold * 100
+
+	n.Lock.RLock()
+	keys := n.Storage.Size()
+	n.Lock.RUnlock()
+
+	return []byte(fmt.Sprintf("OK %.2f %d\r\n", memory, keys)), nil
+}
+
+// demote turns the node into a read replica of the node the cluster promoted in its place
+// The node config without read replicas is written as the read replica config and the node config is removed, so the
+// process restarts as a read replica
+func (n *Node) demote() error {
+	n.ConfigLock.RLock()
+	config := *n.Config
+	n.ConfigLock.RUnlock()
+
+	config.ReadReplicas = nil
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(fmt.Sprintf("%s%s%s", n.Wd, string(os.PathSeparator), ReplicaConfigFile), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(fmt.Sprintf("%s%s%s", n.Wd, string(os.PathSeparator), ConfigFile))
+}
+
+// stepDown closes a demoted node dropping open connections and moves its journal aside
+// Writes the node took after its read replicas last synced are not on the new primary, the journal is kept so they
+// can be recovered by hand.  Demoted is closed once done
+func (n *Node) stepDown() {
+	err := n.Server.Close()
+	if err != nil {
+		n.Logger.Warn("error closing server", "error", err)
+	}
+
+	n.Lock.Lock()
+
+	err = n.Journal.Close()
+	if err != nil {
+		n.Logger.Warn("error closing journal", "error", err)
+	}
+
+	err = os.Rename(fmt.Sprintf("%s%s%s", n.Wd, string(os.PathSeparator), JournalFile), fmt.Sprintf("%s%s%s", n.Wd, string(os.PathSeparator), DemotedJournalFile))
+	if err != nil {
+		n.Logger.Warn("error moving journal", "error", err)
+	}
+
+	for _, replicaConn := range n.ReplicaConnections {
+		_ = replicaConn.Client.Close()
+	}
+
+	n.Lock.Unlock()
+
+	n.Logger.Info("node demoted to read replica", "node", n.Config.ServerConfig.Address)
+
+	close(n.Demoted)
+}
+
+// ReloadConfig reloads node config file
+func (n *Node) ReloadConfig() error {
+	n.ConfigLock.Lock()
+	defer n.ConfigLock.Unlock()
+	// We open the existing config file
+	config, err := openExistingConfigFile(n.Wd)
+	if err != nil {
+		return err
+	}
+
+	// We update the node config
+	n.Config = config
+
+	// We update the server config
+	n.Server.Config = config.ServerConfig
+
+	for _, replicaConfig := range config.ReadReplicas {
+		// We check if the replica connection already exists
+		var exists bool
+		for _, replicaConn := range n.ReplicaConnections {
+			if replicaConn.Client.Config.ServerAddress == replicaConfig.ServerAddress {
+				exists = true
+				break
+			}
+		}
+
+		if exists {
+			continue
+		}
+
+		n.ReplicaConnections = append(n.ReplicaConnections, n.newReplicaConnection(replicaConfig))
+	}
+
+	// Now we find what replicas to remove
+	var remove []int
+	for i, replicaConn := range n.ReplicaConnections {
+		var found bool
+		for _, replicaConfig := range config.ReadReplicas {
+			if replicaConfig.ServerAddress == replicaConn.Client.Config.ServerAddress {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			remove = append(remove, i)
+		}
+	}
+
+	// We remove the replicas
+	for _, i := range remove {
+		// We stop its replication stream and close the client
+		close(n.ReplicaConnections[i].Done)
+		if n.ReplicaConnections[i].Client != nil {
+			err = n.ReplicaConnections[i].Client.Close()
+			if err != nil {
+				return err
+			}
+		}
+		n.ReplicaConnections = append(n.ReplicaConnections[:i], n.ReplicaConnections[i+1:]...)
+	}
+
+	return nil
+}
+
+// streamReadArgs are the parsed options of an XREAD or XREADGROUP command
+type streamReadArgs struct {
+	Count    int           // Maximum entries returned per stream, 0 is unlimited
+	Block    time.Duration // How long to block for, 0 blocks forever
+	Blocking bool          // Whether BLOCK was provided
+	Keys     []string      // Stream keys to read from
+	IDs      []string      // IDs to read after, one per key
+}
+
+// parseStreamRead parses [COUNT <n>] [BLOCK <ms>] STREAMS <key>... <id>...
+func parseStreamRead(args []string) (*streamReadArgs, error) {
+	read := &streamReadArgs{}
+
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT":
+			if i+1 >= len(args) {
+				return nil, errors.New("invalid command")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil || count < 0 {
+				return nil, errors.New("invalid count")
+			}
+			read.Count = count
+			i++
+		case "BLOCK":
+			if i+1 >= len(args) {
+				return nil, errors.New("invalid command")
+			}
+			ms, err := strconv.Atoi(args[i+1])
+			if err != nil || ms < 0 {
+				return nil, errors.New("invalid block timeout")
+			}
+			read.Block = time.Duration(ms) * time.Millisecond
+			read.Blocking = true
+			i++
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return nil, errors.New("unbalanced streams and ids")
+			}
+			read.Keys = rest[:len(rest)/2]
+			read.IDs = rest[len(rest)/2:]
+			return read, nil
+		default:
+			return nil, errors.New("invalid command")
+		}
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// parseStreamRange parses XRANGE <key> <start> <end> [COUNT <n>]
+func parseStreamRange(args []string) (stream.ID, stream.ID, int, error) {
+	if len(args) != 4 && len(args) != 6 {
+		return stream.ID{}, stream.ID{}, 0, errors.New("invalid command")
+	}
+
+	start, end, err := stream.ParseRange(args[2], args[3])
+	if err != nil {
+		return stream.ID{}, stream.ID{}, 0, err
+	}
+
+	count := 0
+	if len(args) == 6 {
+		if !strings.EqualFold(args[4], "COUNT") {
+			return stream.ID{}, stream.ID{}, 0, errors.New("invalid command")
+		}
+		count, err = strconv.Atoi(args[5])
+		if err != nil || count < 0 {
+			return stream.ID{}, stream.ID{}, 0, errors.New("invalid count")
+		}
+	}
+
+	return start, end, count, nil
+}
+
+// streamAdd adds an entry to a stream, journals it and relays it to read replicas, the caller must hold the write lock
+// Stream operations are journaled in order while the lock is held as replaying them out of order would fail.  Returns
+// the id of the entry and the sequence number of its journal entry
+func (n *Node) streamAdd(key, rawID string, fields []string) (stream.ID, uint64, error) {
+	s, err := stream.Load(n.Storage, key, true)
+	if err != nil {
+		return stream.ID{}, 0, err
+	}
+
+	var id stream.ID
+	if rawID == "*" {
+		id = s.NextID(time.Now())
+	} else {
+		id, err = stream.ParseID(rawID, 0)
+		if err != nil {
+			return stream.ID{}, 0, err
+		}
+	}
+
+	err = s.Add(id, fields)
+	if err != nil {
+		return stream.ID{}, 0, err
+	}
+
+	value := fmt.Sprintf("%s %s", id, strings.Join(fields, " "))
+
+	// Read replicas get the generated id so they store the same entry
+	return id, n.journalWrite(key, value, journal.XADD), nil
+}
+
+// streamGroup handles XGROUP CREATE and DESTROY, the caller must hold the write lock
+// Returns the sequence number of the write relayed to read replicas and the response
+func (n *Node) streamGroup(args []string) (uint64, string, error) {
+	if len(args) < 4 {
+		return 0, "", errors.New("invalid command")
+	}
+
+	key, group := args[2], args[3]
+
+	switch strings.ToUpper(args[1]) {
+	case "CREATE":
+		if len(args) != 5 && len(args) != 6 {
+			return 0, "", errors.New("invalid command")
+		}
+
+		mkStream := len(args) == 6
+		if mkStream && !strings.EqualFold(args[5], "MKSTREAM") {
+			return 0, "", errors.New("invalid command")
+		}
+
+		s, err := stream.Load(n.Storage, key, mkStream)
+		if err != nil {
+			return 0, "", err
+		}
+
+		// $ starts the group at the end of the stream, we resolve it so replicas start at the same id
+		id := s.LastID
+		if args[4] != "$" {
+			id, err = stream.ParseID(args[4], 0)
+			if err != nil {
+				return 0, "", err
+			}
+		}
+
+		err = s.CreateGroup(group, id)
+		if err != nil {
+			return 0, "", err
+		}
+
+		value := fmt.Sprintf("%s %s", group, id)
+		seq := n.journalWrite(key, value, journal.XGROUPCREATE)
+
+		return seq, "OK group created\r\n", nil
+	case "DESTROY":
+		if len(args) != 4 {
+			return 0, "", errors.New("invalid command")
+		}
+
+		s, err := stream.Load(n.Storage, key, false)
+		if err != nil {
+			return 0, "", err
+		}
+
+		if !s.DestroyGroup(group) {
+			return 0, "", errors.New("group not found")
+		}
+
+		seq := n.journalWrite(key, group, journal.XGROUPDESTROY)
+
+		return seq, "OK group destroyed\r\n", nil
+	}
+
+	return 0, "", errors.New("invalid command")
+}
+
+// streamRead reads entries after the given ids from one or more streams
+// When blocking it waits until an entry is added to one of the streams or the timeout passes
+func (n *Node) streamRead(read *streamReadArgs) ([]byte, error) {
+	deadline := time.Now().Add(read.Block)
+	after := make([]stream.ID, len(read.Keys))
+
+	// We resolve the ids once, $ means entries added after this call
+	n.Lock.RLock()
+	for i, key := range read.Keys {
+		if read.IDs[i] == "$" {
+			s, err := stream.Load(n.Storage, key, false)
+			if err == nil {
+				after[i] = s.LastID
+			}
+			continue
+		}
+
+		id, err := stream.ParseID(read.IDs[i], 0)
+		if err != nil {
+			n.Lock.RUnlock()
+			return nil, err
+		}
+		after[i] = id
+	}
+	n.Lock.RUnlock()
+
+	for {
+		// We gather wait channels before reading so an add between the read and the wait is not missed
+		var channels []<-chan struct{}
+		if read.Blocking {
+			for _, key := range read.Keys {
+				channels = append(channels, n.Notifier.Wait(key))
+			}
+		}
+
+		response := []byte("OK\r\n")
+		found := false
+
+		n.Lock.RLock()
+		for i, key := range read.Keys {
+			s, err := stream.Load(n.Storage, key, false)
+			if err != nil {
+				if err.Error() == "key not found" {
+					continue
+				}
+				n.Lock.RUnlock()
+				return nil, err
+			}
+
+			for _, entry := range s.After(after[i], read.Count) {
+				response = append(response, []byte(fmt.Sprintf("%s %s\r\n", key, entry))...)
+				found = true
+			}
+		}
+		n.Lock.RUnlock()
+
+		wait, ok := blockRemaining(deadline, read.Block)
+		if found || !read.Blocking || !ok || !utility.WaitAny(channels, wait, n.Closing) {
+			return response, nil
+		}
+	}
+}
+
+// streamReadGroup reads entries for a consumer of a consumer group
+// An id of > delivers new entries to the consumer, any other id returns the consumer's pending entries after it.  The
+// deliveries are recorded as writes of the client connection in written
+func (n *Node) streamReadGroup(group, consumer string, read *streamReadArgs, ack string, written *uint64) ([]byte, error) {
+	deadline := time.Now().Add(read.Block)
+
+	// Only reads of new entries block, pending entries are returned immediately
+	blocking := false
+	for _, id := range read.IDs {
+		if id == ">" {
+			blocking = read.Blocking
+		}
+	}
+
+	for {
+		var channels []<-chan struct{}
+		if blocking {
+			for _, key := range read.Keys {
+				channels = append(channels, n.Notifier.Wait(key))
+			}
+		}
+
+		response := []byte("OK\r\n")
+		found := false
+		var last uint64
+
+		n.Lock.Lock()
+		for i, key := range read.Keys {
+			s, err := stream.Load(n.Storage, key, false)
+			if err != nil {
+				n.Lock.Unlock()
+				return nil, err
+			}
+
+			var entries []stream.Entry
+			if read.IDs[i] == ">" {
+				entries, err = s.Undelivered(group, read.Count)
+				if err != nil {
+					n.Lock.Unlock()
+					return nil, err
+				}
+
+				if len(entries) > 0 {
+					// Delivery times are journaled in milliseconds, we truncate so the journal replays the same state
+					now := time.UnixMilli(time.Now().UnixMilli())
+
+					ids := make([]stream.ID, len(entries))
+					rawIDs := make([]string, len(entries))
+					for j, entry := range entries {
+						ids[j] = entry.ID
+						rawIDs[j] = entry.ID.String()
+					}
+
+					err = s.Deliver(group, consumer, ids, now)
+					if err != nil {
+						n.Lock.Unlock()
+						return nil, err
+					}
+
+					value := fmt.Sprintf("%s %s %d %s", group, consumer, now.UnixMilli(), strings.Join(rawIDs, " "))
+					last = n.journalWrite(key, value, journal.XDELIVER)
+				}
+			} else {
+				after, err := stream.ParseID(read.IDs[i], 0)
+				if err != nil {
+					n.Lock.Unlock()
+					return nil, err
+				}
+
+				entries, err = s.PendingFor(group, consumer, after, read.Count)
+				if err != nil {
+					n.Lock.Unlock()
+					return nil, err
+				}
+			}
+
+			for _, entry := range entries {
+				response = append(response, []byte(fmt.Sprintf("%s %s\r\n", key, entry))...)
+				found = true
+			}
+		}
+		n.Lock.Unlock()
+
+		// We wait for the read replicas to get the deliveries so their pending entries match
+		err := n.waitForAck(last, ack, written)
+		if err != nil {
+			return nil, err
+		}
+
+		wait, ok := blockRemaining(deadline, read.Block)
+		if found || !blocking || !ok || !utility.WaitAny(channels, wait, n.Closing) {
+			return response, nil
+		}
+	}
+}
+
+// closing returns whether the node is closing
+func (n *Node) closing() bool {
+	select {
+	case <-n.Closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// blockRemaining returns how long a blocking read still waits until its deadline, 0 for a block of 0 which waits
+// until woken.  Returns false once the deadline passed
+func blockRemaining(deadline time.Time, block time.Duration) (time.Duration, bool) {
+	if block == 0 {
+		return 0, true
+	}
+
+	wait := time.Until(deadline)
+	return wait, wait > 0
+}
+
+// queueSettings returns the max deliveries and dead letter suffix for queues
+func (n *Node) queueSettings() (int, string) {
+	n.ConfigLock.RLock()
+	defer n.ConfigLock.RUnlock()
+
+	maxDeliveries, suffix := DefaultQueueMaxDeliveries, DefaultQueueDeadLetter
+	if n.Config != nil {
+		if n.Config.QueueMaxDeliveries > 0 {
+			maxDeliveries = n.Config.QueueMaxDeliveries
+		}
+
+		if n.Config.QueueDeadLetter != "" {
+			suffix = n.Config.QueueDeadLetter
+		}
+	}
+
+	return maxDeliveries, suffix
+}
+
+// queueWrite journals a queue operation and relays it to read replicas, returns the sequence number of its entry
+// Queue operations are journaled in order while the lock is held as replaying them out of order would fail
+func (n *Node) queueWrite(key, value string, op journal.Operation) uint64 {
+	return n.journalWrite(key, value, op)
+}
+
+// queueDeadLetter moves ready jobs that reached the max deliveries to the dead letter queue, the caller must hold the write lock
+// Returns the sequence number of the last move, 0 if none
+func (n *Node) queueDeadLetter(key string, q *queue.Queue) uint64 {
+	maxDeliveries, suffix := n.queueSettings()
+
+	ids := q.Exhausted(maxDeliveries)
+	if len(ids) == 0 {
+		return 0
+	}
+
+	dead, err := queue.Load(n.Storage, key+suffix, true)
+	if err != nil {
+		n.Logger.Warn("dead letter queue error", "error", err, "key", key+suffix)
+		return 0
+	}
+
+	var last uint64
+	for _, id := range ids {
+		job, _ := q.Remove(id)
+
+		err = dead.Push(job.ID, job.Payload)
+		if err != nil {
+			n.Logger.Warn("dead letter queue error", "error", err, "key", key+suffix)
+			continue
+		}
+
+		last = max(last, n.queueWrite(key, fmt.Sprintf("%s %s", key+suffix, id), journal.QDEAD))
+	}
+
+	return last
+}
+
+// queueReserve reserves the next ready job of a queue, the caller must hold the write lock
+// Returns a nil job when no job is ready, and the sequence number of the last write relayed to read replicas
+func (n *Node) queueReserve(key string, visibility time.Duration) (*queue.Job, uint64, error) {
+	q, err := queue.Load(n.Storage, key, false)
+	if err != nil {
+		if err.Error() == "key not found" {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	// Times are journaled in milliseconds, we truncate so the journal replays the same state
+	now := time.UnixMilli(time.Now().UnixMilli())
+
+	var last uint64
+	if q.Expire(now) > 0 {
+		last = n.queueWrite(key, strconv.FormatInt(now.UnixMilli(), 10), journal.QEXPIRE)
+	}
+
+	last = max(last, n.queueDeadLetter(key, q))
+
+	next := q.Next()
+	if next == nil {
+		return nil, last, nil
+	}
+
+	until := now.Add(visibility)
+
+	job, err := q.Reserve(next.ID, until)
+	if err != nil {
+		return nil, last, err
+	}
+
+	return job, n.queueWrite(key, fmt.Sprintf("%s %d", job.ID, until.UnixMilli()), journal.QRESERVE), nil
+}
+
+// queueReserveBlocking reserves the next ready job of a queue
+// When blocking it waits until a job is pushed, released or its visibility timeout passes, a block of 0 waits forever.
+// The reservation is recorded as a write of the client connection in written
+func (n *Node) queueReserveBlocking(key string, visibility, block time.Duration, blocking bool, ack string, written *uint64) ([]byte, error) {
+	deadline := time.Now().Add(block)
+
+	for {
+		// We gather the wait channel before reserving so a push between the reserve and the wait is not missed
+		var channels []<-chan struct{}
+		if blocking {
+			channels = append(channels, n.Notifier.Wait(key))
+		}
+
+		var response []byte
+		var nextVisible time.Time
+		var hasReserved bool
+
+		n.Lock.Lock()
+		job, seq, err := n.queueReserve(key, visibility)
+		if job != nil {
+			response = []byte(fmt.Sprintf("OK %s %d %s\r\n", job.ID, job.Deliveries, job.Payload))
+		} else if q, qerr := queue.Load(n.Storage, key, false); qerr == nil {
+			nextVisible, hasReserved = q.NextVisible()
+		}
+		n.Lock.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		// We wait for the read replicas
+		err = n.waitForAck(seq, ack, written)
+		if err != nil {
+			return nil, err
+		}
+
+		if response != nil {
+			return response, nil
+		}
+
+		if !blocking {
+			return nil, errors.New("no jobs ready")
+		}
+
+		// We wait for a push, the block timeout or the next reserved job to become visible
+		wait, ok := blockRemaining(deadline, block)
+		if !ok {
+			return nil, errors.New("no jobs ready")
+		}
+
+		if hasReserved {
+			untilVisible := time.Until(nextVisible) + time.Millisecond
+			if wait == 0 || untilVisible < wait {
+				wait = untilVisible
+			}
+		}
+
+		// A closing node stops waiting
+		if !utility.WaitAny(channels, wait, n.Closing) && n.closing() {
+			return nil, errors.New("no jobs ready")
+		}
+	}
+}
+
+// analyticsCommand runs a bitmap or hyperloglog command
+// Returns the response and, for writes, the sequence number of the entry relayed to read replicas
+// BITOP and PFMERGE are journaled and relayed as a store of their result so replaying them doesn't depend on the sources
+func (n *Node) analyticsCommand(args []string) ([]byte, uint64, error) {
+	if len(args) < 2 {
+		return nil, 0, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	switch args[0] {
+	case "SETBIT":
+		// SETBIT <key> <offset> <0|1>
+		if len(args) != 4 || (args[3] != "0" && args[3] != "1") {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		offset, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, 0, errors.New("invalid bit offset")
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		b, err := bitmap.Load(n.Storage, key, true)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		old, err := b.SetBit(offset, args[3] == "1")
+		if err != nil {
+			return nil, 0, err
+		}
+
+		seq := n.journalWrite(key, fmt.Sprintf("%d %s", offset, args[3]), journal.SETBIT)
+
+		return []byte(fmt.Sprintf("OK %d\r\n", boolToBit(old))), seq, nil
+	case "GETBIT":
+		// GETBIT <key> <offset>
+		if len(args) != 3 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		offset, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, 0, errors.New("invalid bit offset")
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		b, err := bitmap.Load(n.Storage, key, false)
+		if err != nil {
+			if err.Error() == "key not found" {
+				return []byte("OK 0\r\n"), 0, nil
+			}
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n", boolToBit(b.GetBit(offset)))), 0, nil
+	case "BITCOUNT":
+		// BITCOUNT <key> [<start byte> <end byte>]
+		start, end, err := parseBitRange(args)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		b, err := bitmap.Load(n.Storage, key, false)
+		if err != nil {
+			if err.Error() == "key not found" {
+				return []byte("OK 0\r\n"), 0, nil
+			}
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n", b.Count(start, end))), 0, nil
+	case "BITOP":
+		// BITOP <AND|OR|XOR|NOT> <destination> <source>...
+		if len(args) < 4 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		dest := args[2]
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		var sources []*bitmap.Bitmap
+		for _, src := range args[3:] {
+			b, err := bitmap.Load(n.Storage, src, false)
+			if err != nil && err.Error() != "key not found" {
+				return nil, 0, err
+			}
+			sources = append(sources, b)
+		}
+
+		result, err := bitmap.Op(args[1], sources)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Storage.Put(dest, result)
+
+		encoded := result.Encode()
+		seq := n.journalWrite(dest, encoded, journal.BITSTORE)
+
+		return []byte(fmt.Sprintf("OK %d\r\n", len(result.Bits))), seq, nil
+	case "BITDUMP":
+		// BITDUMP <key>
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		b, err := bitmap.Load(n.Storage, key, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", b.Encode())), 0, nil
+	case "BITSTORE":
+		// BITSTORE <key> <base64 bitmap>
+		b, err := bitmap.Decode(strings.Join(args[2:], ""))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		n.Storage.Put(key, b)
+		seq := n.journalWrite(key, b.Encode(), journal.BITSTORE)
+
+		return []byte("OK\r\n"), seq, nil
+	case "PFADD":
+		// PFADD <key> <element>...
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		_, _, exists := n.Storage.Get(key)
+
+		h, err := hyperloglog.Load(n.Storage, key, true)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		changed := !exists
+		for _, element := range args[2:] {
+			if h.Add([]byte(element)) {
+				changed = true
+			}
+		}
+
+		if !changed {
+			return []byte("OK 0\r\n"), 0, nil
+		}
+
+		seq := n.journalWrite(key, strings.Join(args[2:], " "), journal.PFADD)
+
+		return []byte("OK 1\r\n"), seq, nil
+	case "PFCOUNT":
+		// PFCOUNT <key>...
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		union, err := n.mergeHyperLogLogs(args[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n", union.Count())), 0, nil
+	case "PFMERGE":
+		// PFMERGE <destination> <source>...
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		union, err := n.mergeHyperLogLogs(args[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Storage.Put(key, union)
+
+		encoded := union.Encode()
+		seq := n.journalWrite(key, encoded, journal.PFSTORE)
+
+		return []byte("OK\r\n"), seq, nil
+	case "PFDUMP":
+		// PFDUMP <key>...
+		// Returns the registers of the union so the cluster can merge them with other nodes
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
 
+		union, err := n.mergeHyperLogLogs(args[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", union.Encode())), 0, nil
+	case "PFSTORE":
+		// PFSTORE <key> <base64 registers>
+		h, err := hyperloglog.Decode(strings.Join(args[2:], ""))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		n.Storage.Put(key, h)
+		seq := n.journalWrite(key, h.Encode(), journal.PFSTORE)
+
+		return []byte("OK\r\n"), seq, nil
 	}
+
+	return nil, 0, errors.New("invalid command")
 }
 
-// backgroundHealthChecks performs background health checks on the nodes
-func (n *Node) backgroundHealthChecks() {
-	ticker := time.NewTicker(time.Duration(n.Config.HealthCheckInterval) * time.Second)
-	defer ticker.Stop()
+// mergeHyperLogLogs returns the union of the hyperloglogs stored under keys, missing keys are skipped
+// The caller must hold the lock
+func (n *Node) mergeHyperLogLogs(keys []string) (*hyperloglog.HyperLogLog, error) {
+	union := hyperloglog.New()
+	for _, key := range keys {
+		h, err := hyperloglog.Load(n.Storage, key, false)
+		if err != nil {
+			if err.Error() == "key not found" {
+				continue
+			}
+			return nil, err
+		}
+		union.Merge(h)
+	}
+	return union, nil
+}
 
-	for {
-		select {
-		case <-ticker.C:
+// journalWrite appends a write to the journal and relays it while the caller holds the write lock
+// Returns the sequence number of the entry, 0 if the write could not be journaled
+func (n *Node) journalWrite(key, value string, op journal.Operation) uint64 {
+	return n.journalEntry(journal.Entry{Key: key, Value: value, Op: op})
+}
 
-			for _, replicaConn := range n.ReplicaConnections {
-				replicaConn.Lock.Lock()
-				if !replicaConn.Health {
+// journalVersion journals and relays a write with the version of the value it left, the caller holds the lock
+// Returns the sequence number of the entry, 0 if the write could not be journaled
+func (n *Node) journalVersion(key, value string, op journal.Operation) uint64 {
+	_, version, _ := n.Storage.GetVersion(key)
+	return n.journalEntry(journal.Entry{Key: key, Value: value, Op: op, Version: version})
+}
 
-					n.Logger.Warn("node replica is unhealthy", "replica", replicaConn.Client.Config.ServerAddress)
-					if replicaConn.Context == nil {
-						replicaConn.Context = context.Background()
-					}
-					if replicaConn.Client == nil {
-						replicaConn.Client = client.New(replicaConn.Client.Config, n.Logger)
+// timeSeriesCommand runs a time series command
+// Returns the response and, for writes, the sequence number of the entry relayed to read replicas
+func (n *Node) timeSeriesCommand(args []string) ([]byte, uint64, error) {
+	if len(args) < 2 {
+		return nil, 0, errors.New("invalid command")
+	}
 
-					}
+	key := args[1]
+
+	switch args[0] {
+	case "TS.CREATE":
+		// TS.CREATE <key> [RETENTION <ms>]
+		retention := int64(0)
+		if len(args) == 4 && strings.ToUpper(args[2]) == "RETENTION" {
+			var err error
+			retention, err = strconv.ParseInt(args[3], 10, 64)
+			if err != nil || retention < 0 {
+				return nil, 0, errors.New("invalid retention")
+			}
+		} else if len(args) != 2 {
+			return nil, 0, errors.New("invalid command")
+		}
 
-					if err := replicaConn.Client.Connect(replicaConn.Context); err != nil {
-						n.Logger.Warn("node connection error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
 
-					sharedKeyHash := sha256.Sum256([]byte(n.SharedKey))
-					err := replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("NAUTH %x\r\n", sharedKeyHash)))
-					if err != nil {
-						n.Logger.Warn("authentication error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		if _, _, ok := n.Storage.Get(key); ok {
+			return nil, 0, errors.New("key already exists")
+		}
 
-					response, err := replicaConn.Client.Receive(replicaConn.Context)
-					if err != nil || string(response) != "OK authenticated\r\n" {
-						n.Logger.Warn("authentication error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		n.Storage.Put(key, timeseries.New(retention))
+		seq := n.journalWrite(key, strconv.FormatInt(retention, 10), journal.TSCREATE)
 
-					replicaConn.Health = true
-					n.Logger.Info("node replica is reconnected and healthy", "node", replicaConn.Client.Config.ServerAddress)
+		return []byte("OK series created\r\n"), seq, nil
+	case "TS.ADD":
+		// TS.ADD <key> <timestamp ms|*> <value>
+		if len(args) != 4 {
+			return nil, 0, errors.New("invalid command")
+		}
 
-					err = replicaConn.Client.Send(replicaConn.Context, []byte("STARTSYNC\r\n"))
-					if err != nil {
-						n.Logger.Warn("sync error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		timestamp := time.Now().UnixMilli()
+		if args[2] != "*" {
+			var err error
+			timestamp, err = strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return nil, 0, errors.New("invalid timestamp")
+			}
+		}
 
-					response, err = replicaConn.Client.Receive(replicaConn.Context)
-					if err != nil {
-						n.Logger.Warn("read error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		value, err := strconv.ParseFloat(args[3], 64)
+		if err != nil {
+			return nil, 0, errors.New("invalid value")
+		}
 
-					command := strings.TrimSuffix(string(response), "\r\n")
-					if !strings.HasPrefix(command, "SYNCFROM") {
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
 
-					parts := strings.Split(command, " ")
-					if len(parts) < 2 {
-						err = replicaConn.Client.Send(replicaConn.Context, []byte("ERR invalid command\r\n"))
-						if err != nil {
-							n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-						}
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		s, err := timeseries.Load(n.Storage, key, true)
+		if err != nil {
+			return nil, 0, err
+		}
 
-					lastJournalPage := parts[1]
-					lastJournalPageInt, err := strconv.Atoi(lastJournalPage)
-					if err != nil {
-						n.Logger.Warn("invalid page number", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		err = s.Add(timestamp, value)
+		if err != nil {
+			return nil, 0, err
+		}
 
-					n.Lock.RLock()
+		sample := fmt.Sprintf("%d %s", timestamp, timeseries.FormatValue(value))
+		seq := n.journalWrite(key, sample, journal.TSADD)
 
-					it, err := pager.NewIteratorAtPage(n.Journal.Pager, lastJournalPageInt)
-					if err != nil {
-						if err.Error() == "invalid start page: must be >= 0" || err.Error() == "start page exceeds maximum pages 0" {
-							err = replicaConn.Client.Send(replicaConn.Context, []byte("DONESYNC\r\n"))
-							if err != nil {
-								n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-							}
-							n.Logger.Warn("nothing to sync", "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-							n.Lock.RUnlock()
-							replicaConn.Lock.Unlock()
-							continue
-						}
-						err = replicaConn.Client.Send(replicaConn.Context, []byte("ERR invalid command\r\n"))
-						if err != nil {
-							n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-						}
-						n.Lock.RUnlock()
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		return []byte(fmt.Sprintf("OK %d\r\n", timestamp)), seq, nil
+	case "TS.RANGE":
+		// TS.RANGE <key> <from> <to> [AGGREGATION <type> <bucket ms>]
+		from, to, agg, err := timeseries.ParseRangeArgs(args[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		s, err := timeseries.Load(n.Storage, key, false)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		samples := s.Range(from, to)
+		if agg != nil {
+			samples = agg.Apply(samples)
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(samples)))
+		for _, sample := range samples {
+			response = append(response, fmt.Sprintf("%d %s\r\n", sample.Timestamp, timeseries.FormatValue(sample.Value))...)
+		}
+
+		return response, 0, nil
+	case "TS.MRANGE":
+		// TS.MRANGE <from> <to> <pattern> [AGGREGATION <type> <bucket ms>]
+		if len(args) < 4 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		// The pattern sits between the range and the aggregation
+		from, to, agg, err := timeseries.ParseRangeArgs(append([]string{args[1], args[2]}, args[4:]...))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		re, err := regexp.Compile(args[3])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		entries := n.Storage.Traverse(func(entry hashtable.Entry) bool {
+			_, ok := entry.Value.(*timeseries.Series)
+			return ok && re.MatchString(entry.Key)
+		})
+
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+		var lines []string
+		for _, entry := range entries {
+			samples := entry.Value.(*timeseries.Series).Range(from, to)
+			if agg != nil {
+				samples = agg.Apply(samples)
+			}
+
+			for _, sample := range samples {
+				lines = append(lines, fmt.Sprintf("%s %d %s\r\n", entry.Key, sample.Timestamp, timeseries.FormatValue(sample.Value)))
+			}
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n%s", len(lines), strings.Join(lines, ""))), 0, nil
+	}
+
+	return nil, 0, errors.New("invalid command")
+}
+
+// documentCommand runs a JSON document command
+// Updates are journaled and relayed as sets of the concrete paths they changed so replaying them twice is harmless
+// Returns the response and the sequence number of the last entry relayed to read replicas
+func (n *Node) documentCommand(command string) ([]byte, uint64, error) {
+	// JSON values may contain spaces, they are the remainder of the command
+	args := strings.SplitN(command, " ", 4)
+	if len(args) < 2 {
+		return nil, 0, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	path := document.Path{}
+	if len(args) > 2 {
+		var err error
+		path, err = document.ParsePath(args[2])
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	switch args[0] {
+	case "JSON.SET":
+		// JSON.SET <key> <path> <json>
+		if len(args) != 4 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		value, err := document.Parse(args[3])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		if path.IsRoot() {
+			if existing, _, ok := n.Storage.Get(key); ok {
+				if _, ok = existing.(*document.Document); !ok {
+					return nil, 0, errors.New("wrong type")
+				}
+			}
+
+			n.Storage.Put(key, document.New(value))
+			return []byte("OK\r\n"), n.journalDocument(key, []document.Change{{Path: "$", Value: value}}), nil
+		}
+
+		d, err := document.Load(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		changes, err := d.Set(path, value)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte("OK\r\n"), n.journalDocument(key, changes), nil
+	case "JSON.GET":
+		// JSON.GET <key> [<path>]
+		if len(args) > 3 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		d, err := document.Load(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", document.Encode(d.Get(path)))), 0, nil
+	case "JSON.DEL":
+		// JSON.DEL <key> [<path>]
+		if len(args) > 3 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		d, err := document.Load(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if path.IsRoot() {
+			deletedAt := n.Clock.Now()
+			n.Storage.Delete(key)
+			n.Tombstones.Add(key, deletedAt)
+			seq := n.journalEntry(journal.Entry{Key: key, Value: deletedAt.String(), Op: journal.DEL, Version: deletedAt})
+			return []byte("OK 1\r\n"), seq, nil
+		}
+
+		deleted, changes := d.Delete(path)
+		return []byte(fmt.Sprintf("OK %d\r\n", deleted)), n.journalDocument(key, changes), nil
+	case "JSON.NUMINCRBY":
+		// JSON.NUMINCRBY <key> <path> <number>
+		if len(args) != 4 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		if _, err := strconv.ParseFloat(args[3], 64); err != nil {
+			return nil, 0, errors.New("invalid number")
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		d, err := document.Load(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		results, changes, err := d.NumIncrBy(path, args[3])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", document.Encode(results))), n.journalDocument(key, changes), nil
+	case "JSON.ARRAPPEND":
+		// JSON.ARRAPPEND <key> <path> <json>...
+		if len(args) != 4 {
+			return nil, 0, errors.New("invalid command")
+		}
+
+		values, err := document.ParseAll(args[3])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		d, err := document.Load(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		results, changes, err := d.ArrAppend(path, values)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", document.Encode(results))), n.journalDocument(key, changes), nil
+	}
+
+	return nil, 0, errors.New("invalid command")
+}
+
+// journalDocument journals document changes and relays them to read replicas while the caller holds the write lock
+// Returns the sequence number of the last change, 0 if none
+func (n *Node) journalDocument(key string, changes []document.Change) uint64 {
+	var last uint64
+	for _, change := range changes {
+		value := fmt.Sprintf("%s %s", change.Path, document.Encode(change.Value))
+		last = max(last, n.journalWrite(key, value, journal.JSONSET))
+	}
+	return last
+}
+
+// vectorCommand runs a vector command
+// Returns the response and, for writes, the sequence number of the entry relayed to read replicas
+func (n *Node) vectorCommand(args []string) ([]byte, uint64, error) {
+	if len(args) < 2 {
+		return nil, 0, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	switch args[0] {
+	case "VCREATE":
+		// VCREATE <index> DIM <dimension> [METRIC <cosine|l2>] [PATTERN <pattern>]
+		ix, err := vector.ParseCreateArgs(key, args[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		if _, _, ok := n.Storage.Get(key); ok {
+			return nil, 0, errors.New("key already exists")
+		}
+
+		// We index the vectors already stored under covered keys
+		for _, entry := range n.Storage.Traverse(nil) {
+			if v, ok := entry.Value.(*vector.Vector); ok && ix.Covers(entry.Key) && len(v.Values) == ix.Dim {
+				_ = ix.Add(entry.Key, v)
+			}
+		}
+
+		n.Storage.Put(key, ix)
+		n.VectorIndexes[key] = ix
+		seq := n.journalWrite(key, fmt.Sprintf("%d %s %s", ix.Dim, ix.Metric, ix.Pattern), journal.VCREATE)
+
+		return []byte("OK index created\r\n"), seq, nil
+	case "VADD":
+		// VADD <key> <component>...
+		v, err := vector.Parse(args[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
+
+		if existing, _, ok := n.Storage.Get(key); ok {
+			if _, ok = existing.(*vector.Vector); !ok {
+				return nil, 0, errors.New("wrong type")
+			}
+		}
+
+		indexes := n.coveringIndexes(key)
+		for _, ix := range indexes {
+			if len(v.Values) != ix.Dim {
+				return nil, 0, fmt.Errorf("dimension mismatch for index %s", ix.Name)
+			}
+		}
+
+		n.Storage.Put(key, v)
+		for _, ix := range indexes {
+			_ = ix.Add(key, v)
+		}
+
+		seq := n.journalWrite(key, v.String(), journal.VADD)
+
+		return []byte("OK vector added\r\n"), seq, nil
+	case "VSEARCH":
+		// VSEARCH <index> <k> <component>... [EXACT] [EF <candidates>]
+		k, q, exact, ef, err := vector.ParseSearchArgs(args[2:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
+
+		ix, err := vector.LoadIndex(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var results []vector.Result
+		if exact {
+			results, err = ix.Exact(n.Storage, q.Values, k)
+		} else {
+			results, err = ix.Search(n.Storage, q.Values, k, ef)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(float64(r.Distance), 'f', -1, 32))...)
+		}
+
+		return response, 0, nil
+	}
+
+	return nil, 0, errors.New("invalid command")
+}
+
+// coveringIndexes returns the vector indexes covering a key while the caller holds the write lock
+// Indexes deleted or overwritten in storage are forgotten
+func (n *Node) coveringIndexes(key string) []*vector.Index {
+	var indexes []*vector.Index
+	for name, ix := range n.VectorIndexes {
+		if value, _, ok := n.Storage.Get(name); !ok || value != ix {
+			delete(n.VectorIndexes, name)
+			continue
+		}
+
+		if ix.Covers(key) {
+			indexes = append(indexes, ix)
+		}
+	}
+	return indexes
+}
 
-					for it.Next() {
-						data, err := it.Read()
-						if err != nil {
-							break
-						}
+// queryCommand runs QUERY, see keyspace.Query
+func (n *Node) queryCommand(command string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
 
-						e, err := journal.Deserialize(data)
-						if err != nil {
-							continue
-						}
+	return keyspace.Query(n.Storage, command)
+}
 
-						switch e.Op {
-						case journal.PUT:
-							err = replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("PUT %s %s\r\n", e.Key, e.Value)))
-						case journal.DEL:
-							err = replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("DEL %s\r\n", e.Key)))
-						case journal.INCR:
-							err = replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("INCR %s %s\r\n", e.Key, e.Value)))
-						case journal.DECR:
-							err = replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("DECR %s %s\r\n", e.Key, e.Value)))
+// aggCommand runs AGG, see keyspace.Aggregate
+func (n *Node) aggCommand(args []string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
 
-						}
-						if err != nil {
-							n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-							break
-						}
+	return keyspace.Aggregate(n.Storage, args)
+}
 
-						// Read response
-						response, err = replicaConn.Client.Receive(replicaConn.Context)
-						if err != nil {
-							n.Logger.Warn("read error", "error", err)
-							break
-						}
+// scanCommand runs SCAN, see keyspace.Scan
+func (n *Node) scanCommand(args []string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
 
-						if strings.HasPrefix(string(response), "ERR") {
-							n.Logger.Warn("unexpected response", "response", string(response))
-							break
-						}
+	return keyspace.Scan(n.Storage, args)
+}
 
-					}
+// orderedCommand runs an ordered key command, see keyspace.Ordered
+func (n *Node) orderedCommand(args []string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
 
-					n.Lock.RUnlock()
+	return keyspace.Ordered(n.Storage, args)
+}
 
-					err = replicaConn.Client.Send(replicaConn.Context, []byte("SYNCDONE\r\n"))
-					if err != nil {
-						n.Logger.Warn("write error", "error", err, "remote_addr", replicaConn.Client.Conn.RemoteAddr())
-					}
+// textCommand runs a full-text command
+// Returns the response and, for writes, the sequence number of the entry relayed to read replicas
+func (n *Node) textCommand(command string) ([]byte, uint64, error) {
+	args := strings.SplitN(command, " ", 3)
+	if len(args) < 2 {
+		return nil, 0, errors.New("invalid command")
+	}
 
-					// Read response
-					response, err = replicaConn.Client.Receive(replicaConn.Context)
-					if err != nil {
-						n.Logger.Warn("read error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+	key := args[1]
+	if len(args) == 2 {
+		args = append(args, "")
+	}
 
-					if string(response) != "OK synced\r\n" {
-						n.Logger.Warn("unexpected response", "response", string(response))
-						replicaConn.Lock.Unlock()
-						continue
-					}
+	switch args[0] {
+	case "FT.CREATE":
+		// FT.CREATE <index> [PATTERN <pattern>]
+		ix, err := fulltext.ParseCreateArgs(key, strings.Fields(args[2]))
+		if err != nil {
+			return nil, 0, err
+		}
 
-					replicaConn.Lock.Unlock()
+		n.Lock.Lock()
+		defer n.Lock.Unlock()
 
-				} else {
-					// We create a temp connection to the replica using a new client
-					tempClient := client.New(replicaConn.Client.Config, n.Logger)
-					if err := tempClient.Connect(replicaConn.Context); err != nil {
-						n.Logger.Warn("node connection error", "error", err)
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		if _, _, ok := n.Storage.Get(key); ok {
+			return nil, 0, errors.New("key already exists")
+		}
 
-					err := tempClient.Send(replicaConn.Context, []byte("PING\r\n"))
-					if err != nil {
-						replicaConn.Health = false
-						tempClient.Close()
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		// We index the values already stored under covered keys
+		for _, entry := range n.Storage.Traverse(nil) {
+			if value, ok := entry.Value.(string); ok && ix.Covers(entry.Key) {
+				ix.Update(entry.Key, value)
+			}
+		}
 
-					response, err := tempClient.Receive(replicaConn.Context)
-					if err != nil {
-						n.Logger.Warn("read error", "error", err)
-						replicaConn.Health = false
-						tempClient.Close()
-						replicaConn.Lock.Unlock()
-						continue
-					}
+		n.Storage.Put(key, ix)
+		n.TextIndexes[key] = ix
+		seq := n.journalWrite(key, ix.Pattern, journal.FTCREATE)
 
-					if string(response) != "OK PONG\r\n" {
-						n.Logger.Warn("unexpected response", "response", string(response))
-						replicaConn.Health = false
-					}
+		return []byte("OK index created\r\n"), seq, nil
+	case "SEARCH":
+		// SEARCH <index> "<query>" [LIMIT <n>]
+		terms, limit, err := fulltext.ParseSearchArgs(args[2])
+		if err != nil {
+			return nil, 0, err
+		}
 
-					tempClient.Close()
-					replicaConn.Lock.Unlock()
-				}
+		n.Lock.RLock()
+		defer n.Lock.RUnlock()
 
-			}
+		ix, err := fulltext.LoadIndex(n.Storage, key)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		results, err := ix.Search(n.Storage, terms, limit)
+		if err != nil {
+			return nil, 0, err
 		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(r.Score, 'f', -1, 64))...)
+		}
+
+		return response, 0, nil
 	}
+
+	return nil, 0, errors.New("invalid command")
 }
 
-// relayToReplicas relays the command to the read replicas
-func (n *Node) relayToReplicas(command string) {
-	for _, replicaConn := range n.ReplicaConnections {
-		replicaConn.Lock.Lock()
+// updateTextIndexes updates the full-text indexes covering a key after a write while the caller holds the write lock
+// Indexes deleted or overwritten in storage are forgotten
+func (n *Node) updateTextIndexes(key string) {
+	value, _, ok := n.Storage.Get(key)
+	text, isText := value.(string)
 
-		if replicaConn.Health {
-			// We send the command to the replica
-			err := replicaConn.Client.Send(replicaConn.Context, []byte(fmt.Sprintf("%s\r\n", command)))
-			if err != nil {
-				n.Logger.Warn("write error", "error", err)
-				replicaConn.Health = false
-				replicaConn.Lock.Unlock()
-				continue
-			}
+	for name, ix := range n.TextIndexes {
+		if stored, _, found := n.Storage.Get(name); !found || stored != ix {
+			delete(n.TextIndexes, name)
+			continue
+		}
 
-			// We read the response
-			_, err = replicaConn.Client.Receive(replicaConn.Context)
-			if err != nil {
-				n.Logger.Warn("read error", "error", err)
-				replicaConn.Health = false
-				replicaConn.Lock.Unlock()
-				continue
-			}
+		if !ix.Covers(key) {
+			continue
+		}
 
+		if ok && isText {
+			ix.Update(key, text)
+		} else {
+			ix.Remove(key)
 		}
+	}
+}
 
-		replicaConn.Lock.Unlock()
+// recordVersion adds the value of a key after a write to its history while the caller holds the write lock, see
+// keyspace.RecordVersion
+func (n *Node) recordVersion(key string, at time.Time) {
+	keyspace.RecordVersion(n.Storage, n.History, key, at)
+}
 
+// replayEntry records the versions and tombstones of a key as its writes are replayed from the journal, see
+// keyspace.ReplayEntry
+func (n *Node) replayEntry(e *journal.Entry) {
+	// Writes after the recovery are versioned after the delete
+	if deletedAt := keyspace.ReplayEntry(n.Storage, n.History, n.Tombstones, e); !deletedAt.IsZero() {
+		n.Clock.Update(deletedAt)
 	}
 }
 
-// MemoryCheck checks the memory usage of the node
-// true for ok (not out of memory), false for out of memory
-func (n *Node) MemoryCheck() bool {
-	// Get the current memory usage
-	currentMemoryUsage := utility.GetCurrentMemoryUsage()
+// conditionalCommand runs PUTNX <key> <value>, PUTXX <key> <value> and CAS <key> <version> <value>
+// PUTNX writes a key that does not exist, PUTXX a key that exists and CAS a key still at the version read by the client.
+// Responds with OK <version> of the written value, a failed condition reports the current version so the client can
+// read again and retry.  Returns the response and the sequence number of the PUT relayed to read replicas
+func (n *Node) conditionalCommand(command string) ([]byte, uint64, error) {
+	op, rest, _ := strings.Cut(command, " ")
+	if op != "PUTNX" && op != "PUTXX" && op != "CAS" {
+		return nil, 0, errors.New("invalid command")
+	}
 
-	// Calculate the percentage of current memory usage relative to nr.MaxMemory
-	memoryUsagePercentage := (float64(currentMemoryUsage) / float64(n.MaxMemory)) * 100
+	args := strings.SplitN(rest, " ", 2)
+	var expected hlc.Timestamp
+	if op == "CAS" {
+		// CAS <key> <version> <value>
+		args = strings.SplitN(rest, " ", 3)
+		if len(args) != 3 {
+			return nil, 0, errors.New("invalid command")
+		}
 
-	// We compare it with the MaxMemoryThreshold set in Config
-	if memoryUsagePercentage > float64(n.Config.MaxMemoryThreshold) {
-		return false
+		var err error
+		if expected, err = hlc.Parse(args[1]); err != nil {
+			return nil, 0, errors.New("invalid version")
+		}
+		args = []string{args[0], args[2]}
 	}
 
-	return true
+	if len(args) != 2 || args[0] == "" {
+		return nil, 0, errors.New("invalid command")
+	}
+	key, value := args[0], args[1]
+
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+
+	_, current, exists := n.Storage.GetVersion(key)
+	switch {
+	case op == "PUTNX" && exists:
+		return nil, 0, fmt.Errorf("key exists %s", current)
+	case op != "PUTNX" && !exists:
+		return nil, 0, n.deletedError(key, errors.New("key not found"))
+	case op == "CAS" && current != expected:
+		return nil, 0, fmt.Errorf("version mismatch %s", current)
+	}
+
+	version := n.Clock.Now()
+	n.Storage.PutVersion(key, value, version)
+	n.updateTextIndexes(key)
+	n.recordVersion(key, time.Time{})
+
+	seq := n.journalEntry(journal.Entry{Key: key, Value: value, Op: journal.PUT, Version: version})
+
+	return []byte(fmt.Sprintf("OK %s\r\n", version)), seq, nil
 }
 
-// ReloadConfig reloads node config file
-func (n *Node) ReloadConfig() error {
-	n.ConfigLock.Lock()
-	defer n.ConfigLock.Unlock()
-	// We open the existing config file
-	config, err := openExistingConfigFile(n.Wd)
+// slotDumpCommand runs SLOTDUMP <slot ranges> [COUNT <n>]
+// Responds with OK <n> followed by n lines of the keys hashed to the slots, at most COUNT when given.  A string key is
+// dumped as <version> <key> <value> and moved by the cluster to the node owning its slot with RESTORE, any other key as
+// ENTRIES <key> <entry>... with the base64 encoded journal entries rebuilding its value, moved with RESTOREENTRIES
+func (n *Node) slotDumpCommand(args []string) ([]byte, error) {
+	if len(args) != 2 && (len(args) != 4 || strings.ToUpper(args[2]) != "COUNT") {
+		return nil, errors.New("invalid command")
+	}
+
+	ranges, err := slots.ParseRanges(args[1])
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// We update the node config
-	n.Config = config
+	count := 0
+	if len(args) == 4 {
+		if count, err = strconv.Atoi(args[3]); err != nil || count <= 0 {
+			return nil, errors.New("invalid count")
+		}
+	}
 
-	// We update the server config
-	n.Server.Config = config.ServerConfig
+	entries := n.slotEntries(ranges)
 
-	for _, replicaConfig := range config.ReadReplicas {
-		// We check if the replica connection already exists
-		var exists bool
-		for _, replicaConn := range n.ReplicaConnections {
-			if replicaConn.Client.Config.ServerAddress == replicaConfig.ServerAddress {
-				exists = true
-				break
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+
+	response := []byte(fmt.Sprintf("OK %d\r\n", len(entries)))
+	for _, entry := range entries {
+		if value, ok := entry.Value.(string); ok {
+			response = append(response, fmt.Sprintf("%s %s %s\r\n", entry.Version, entry.Key, value)...)
+			continue
+		}
+
+		response = append(response, "ENTRIES "+entry.Key...)
+		for _, e := range journal.Snapshot(entry.Key, entry.Value, entry.Version) {
+			encoded, err := encodeEntry(e)
+			if err != nil {
+				return nil, err
 			}
+			response = append(response, " "+encoded...)
 		}
+		response = append(response, "\r\n"...)
+	}
 
-		if exists {
-			continue
+	return response, nil
+}
+
+// slotCountCommand runs SLOTCOUNT <slot ranges>
+// Responds with OK <n>, the number of keys hashed to the slots
+func (n *Node) slotCountCommand(args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	ranges, err := slots.ParseRanges(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("OK %d\r\n", len(n.slotEntries(ranges)))), nil
+}
+
+// slotEntries returns the entries of the keys hashed to the slots
+// Vector and full-text indexes are created on every primary node so they are not part of any slot
+func (n *Node) slotEntries(ranges slots.Ranges) []hashtable.Entry {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+
+	return n.Storage.Traverse(func(entry hashtable.Entry) bool {
+		switch entry.Value.(type) {
+		case *vector.Index, *fulltext.Index:
+			return false
 		}
+		return ranges.Contains(slots.Slot(entry.Key))
+	})
+}
+
+// restoreEntriesCommand runs RESTOREENTRIES <key> <entry>..., the write of a key other than a string moved from another
+// node as the base64 encoded journal entries rebuilding its value
+// A copy of the key on this node is merged with the moved value when the type allows it, bitmaps and HyperLogLogs are
+// unioned, the samples of time series combined and the jobs missing from a queue added.  Otherwise the copy on this
+// node is kept.  Returns the response and the sequence number of the last entry relayed to read replicas
+func (n *Node) restoreEntriesCommand(args []string) ([]byte, uint64, error) {
+	if len(args) < 3 {
+		return nil, 0, errors.New("invalid command")
+	}
+	key := args[1]
 
-		replicaConn := &ReplicaConnection{
-			Client: client.New(replicaConfig, n.Logger),
-			Health: false,
-			Lock:   &sync.Mutex{},
+	moved := hashtable.New()
+	for _, encoded := range args[2:] {
+		e, err := decodeEntry(encoded)
+		if err != nil || e.Key != key {
+			return nil, 0, errors.New("invalid entry")
 		}
 
-		n.ReplicaConnections = append(n.ReplicaConnections, replicaConn)
+		if err = journal.Apply(moved, e); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	// Now we find what replicas to remove
-	var remove []int
-	for i, replicaConn := range n.ReplicaConnections {
-		var found bool
-		for _, replicaConfig := range config.ReadReplicas {
-			if replicaConfig.ServerAddress == replicaConn.Client.Config.ServerAddress {
-				found = true
-				break
-			}
+	value, _, ok := moved.Get(key)
+	if !ok {
+		return nil, 0, errors.New("invalid entry")
+	}
+
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+
+	entries, err := n.mergedEntries(key, value)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var last uint64
+	for _, e := range entries {
+		if err = journal.Apply(n.Storage, &e); err != nil {
+			return nil, 0, err
 		}
 
-		if !found {
-			remove = append(remove, i)
+		last = n.journalEntry(e)
+	}
+
+	if v, ok := value.(*vector.Vector); ok && len(entries) > 0 {
+		for _, ix := range n.coveringIndexes(key) {
+			_ = ix.Add(key, v)
 		}
 	}
 
-	// We remove the replicas
-	for _, i := range remove {
-		// We close the client
-		if n.ReplicaConnections[i].Client != nil {
-			err = n.ReplicaConnections[i].Client.Close()
-			if err != nil {
-				return err
+	return []byte("OK restored\r\n"), last, nil
+}
+
+// mergedEntries returns the journal entries writing a value moved from another node over the copy of the key on this
+// node, none when the copy is kept.  Streams, documents and vectors are not merged, an error keeps the moved value on
+// its source.  The caller holds the write lock
+func (n *Node) mergedEntries(key string, moved interface{}) ([]journal.Entry, error) {
+	current, _, ok := n.Storage.Get(key)
+	if !ok {
+		return journal.Snapshot(key, moved, hlc.Timestamp{}), nil
+	}
+
+	if keyspace.TypeName(current) != keyspace.TypeName(moved) {
+		return nil, errors.New("wrong type")
+	}
+
+	switch c := current.(type) {
+	case *bitmap.Bitmap:
+		merged := bitmap.New()
+		merged.Merge(c)
+		merged.Merge(moved.(*bitmap.Bitmap))
+		return journal.Snapshot(key, merged, hlc.Timestamp{}), nil
+	case *hyperloglog.HyperLogLog:
+		merged := hyperloglog.New()
+		merged.Merge(c)
+		merged.Merge(moved.(*hyperloglog.HyperLogLog))
+		return journal.Snapshot(key, merged, hlc.Timestamp{}), nil
+	case *timeseries.Series:
+		return journal.Snapshot(key, c.Merge(moved.(*timeseries.Series)), hlc.Timestamp{}), nil
+	case *queue.Queue:
+		// Only the jobs missing from the queue are restored, ready jobs in the order of the moved queue
+		m := moved.(*queue.Queue)
+		jobs := append([]*queue.Job(nil), m.Ready...)
+		for _, job := range m.Reserved {
+			jobs = append(jobs, job)
+		}
+
+		missing := queue.New()
+		for _, job := range jobs {
+			if !c.Has(job.ID) {
+				_ = missing.Restore(job)
 			}
 		}
-		n.ReplicaConnections = append(n.ReplicaConnections[:i], n.ReplicaConnections[i+1:]...)
+
+		if len(missing.Ready) == 0 && len(missing.Reserved) == 0 {
+			return nil, nil
+		}
+		return journal.Snapshot(key, missing, hlc.Timestamp{}), nil
 	}
 
-	return nil
+	return nil, fmt.Errorf("key exists, cannot merge %s", keyspace.TypeName(current))
+}
+
+// journalEntry appends an entry to the journal and relays it to the read replicas while the caller holds the write
+// lock.  Returns the sequence number of the entry, 0 if it could not be journaled
+func (n *Node) journalEntry(e journal.Entry) uint64 {
+	seq, err := n.Journal.AppendVersion(e.Key, e.Value, e.Op, e.Version)
+	if err != nil {
+		n.Logger.Warn("journal append error", "error", err)
+		return 0
+	}
+
+	e.Seq, e.Timestamp = seq, time.Now()
+	return n.relay(&e)
+}
+
+// encodeEntry encodes a journal entry sent to another node or a read replica
+func encodeEntry(e journal.Entry) (string, error) {
+	b, err := journal.Serialize(e)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decodeEntry decodes a journal entry encoded by encodeEntry
+func decodeEntry(encoded string) (*journal.Entry, error) {
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return journal.Deserialize(b)
+}
+
+// restoreCommand runs RESTORE <key> <version> <value>, the write of a key moved from another node with its version
+// The value is kept only if it is newer than the copy and the tombstone of the key on this node, otherwise responds
+// with ERR key exists <version> or ERR key deleted <timestamp>.  Returns the response and the sequence number of the
+// PUT relayed to read replicas
+func (n *Node) restoreCommand(command string) ([]byte, uint64, error) {
+	args := strings.SplitN(command, " ", 4)
+	if len(args) != 4 || args[0] != "RESTORE" {
+		return nil, 0, errors.New("invalid command")
+	}
+
+	key, value := args[1], args[3]
+	version, err := hlc.Parse(args[2])
+	if err != nil {
+		return nil, 0, errors.New("invalid version")
+	}
+
+	n.Lock.Lock()
+	defer n.Lock.Unlock()
+
+	if _, current, ok := n.Storage.GetVersion(key); ok && !version.After(current) {
+		return nil, 0, fmt.Errorf("key exists %s", current)
+	}
+
+	if deleted, ok := n.Tombstones.Get(key, time.Now()); ok && deleted.After(version) {
+		return nil, 0, fmt.Errorf("key deleted %s", deleted)
+	}
+
+	n.Storage.PutVersion(key, value, version)
+	n.updateTextIndexes(key)
+	n.recordVersion(key, time.Time{})
+
+	seq := n.journalEntry(journal.Entry{Key: key, Value: value, Op: journal.PUT, Version: version})
+
+	return []byte("OK restored\r\n"), seq, nil
+}
+
+// deletedError reports a key not found that has a tombstone as deleted, see keyspace.DeletedError
+// The caller holds the lock
+func (n *Node) deletedError(key string, err error) error {
+	return keyspace.DeletedError(n.Tombstones, key, err)
+}
+
+// tombstonesCommand runs TOMBSTONES, see keyspace.Tombstones
+func (n *Node) tombstonesCommand(args []string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+
+	return keyspace.Tombstones(n.Storage, n.Tombstones, args)
+}
+
+// getAtCommand runs GET <key> AT <timestamp>, see keyspace.GetAt
+func (n *Node) getAtCommand(key, at string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+
+	return keyspace.GetAt(n.Storage, n.History, key, at)
+}
+
+// historyCommand runs HISTORY, see keyspace.History
+func (n *Node) historyCommand(args []string) ([]byte, error) {
+	n.Lock.RLock()
+	defer n.Lock.RUnlock()
+
+	return keyspace.History(n.Storage, n.History, args)
+}
+
+// parseBitRange parses the optional byte range of BITCOUNT <key> [<start> <end>]
+func parseBitRange(args []string) (int64, int64, error) {
+	switch len(args) {
+	case 2:
+		return 0, -1, nil
+	case 4:
+		return bitmap.ParseRange(args[2], args[3])
+	}
+
+	return 0, 0, errors.New("invalid command")
+}
+
+// boolToBit returns 1 for true and 0 for false
+func boolToBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
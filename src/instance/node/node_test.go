@@ -39,9 +39,14 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"supermassive/hlc"
 	"supermassive/instance/nodereplica"
+	"supermassive/journal"
 	"supermassive/network/client"
 	"supermassive/network/server"
+	"supermassive/slots"
+	"supermassive/storage/queue"
+	"supermassive/storage/versions"
 	"testing"
 	"time"
 )
@@ -635,6 +640,235 @@ func TestServerIncrDecr(t *testing.T) {
 
 }
 
+func TestServerStreams(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp := sendTestCommand(t, conn, "XADD orders 1-1 item apple qty 2"); resp != "OK 1-1\r\n" {
+		t.Fatalf("Expected 'OK 1-1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XADD orders 1-1 item pear"); !strings.HasPrefix(resp, "ERR") {
+		t.Fatalf("Expected error adding a duplicate id, got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XADD orders * item pear qty 1"); !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected generated id, got %s", resp)
+	}
+
+	resp := sendTestCommand(t, conn, "XRANGE orders - +")
+	if !strings.HasPrefix(resp, "OK\r\n1-1 item apple qty 2\r\n") || strings.Count(resp, "\r\n") != 3 {
+		t.Fatalf("Unexpected XRANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XREAD STREAMS orders 1-1"); !strings.Contains(resp, "orders ") || !strings.Contains(resp, "item pear qty 1") {
+		t.Fatalf("Unexpected XREAD response %q", resp)
+	}
+
+	// A group starting at 0 sees both entries
+	if resp := sendTestCommand(t, conn, "XGROUP CREATE orders workers 0"); resp != "OK group created\r\n" {
+		t.Fatalf("Expected 'OK group created', got %s", resp)
+	}
+
+	resp = sendTestCommand(t, conn, "XREADGROUP GROUP workers alice COUNT 1 STREAMS orders >")
+	if resp != "OK\r\norders 1-1 item apple qty 2\r\n" {
+		t.Fatalf("Unexpected XREADGROUP response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XPENDING orders workers"); !strings.HasPrefix(resp, "OK 1\r\n1-1 alice ") {
+		t.Fatalf("Unexpected XPENDING response %q", resp)
+	}
+
+	// alice's history still has the unacknowledged entry
+	if resp := sendTestCommand(t, conn, "XREADGROUP GROUP workers alice STREAMS orders 0"); resp != "OK\r\norders 1-1 item apple qty 2\r\n" {
+		t.Fatalf("Unexpected pending read %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XACK orders workers 1-1"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XPENDING orders workers"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected no pending entries, got %q", resp)
+	}
+
+	// A blocked reader is woken by an add from another client
+	reader := dialTestNode(t, "localhost:4001")
+	defer reader.Close()
+
+	result := make(chan string)
+	go func() {
+		buf := make([]byte, 4096)
+		reader.Write([]byte("XREAD BLOCK 5000 STREAMS orders $\r\n"))
+		n, _ := reader.Read(buf)
+		result <- string(buf[:n])
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if resp := sendTestCommand(t, conn, "XADD orders 9999999999999-0 item plum"); resp != "OK 9999999999999-0\r\n" {
+		t.Fatalf("Expected 'OK 9999999999999-0', got %s", resp)
+	}
+
+	select {
+	case resp := <-result:
+		if resp != "OK\r\norders 9999999999999-0 item plum\r\n" {
+			t.Fatalf("Unexpected blocked XREAD response %q", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Blocked XREAD was not woken")
+	}
+
+	// A blocking read with nothing to return times out empty
+	if resp := sendTestCommand(t, conn, "XREAD BLOCK 50 STREAMS orders $"); resp != "OK\r\n" {
+		t.Fatalf("Expected empty response, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "XGROUP DESTROY orders workers"); resp != "OK group destroyed\r\n" {
+		t.Fatalf("Expected 'OK group destroyed', got %s", resp)
+	}
+
+	// A read blocking without a timeout is answered empty once the node closes, its client then disconnects
+	blocked := dialTestNode(t, "localhost:4001")
+	go func() {
+		buf := make([]byte, 4096)
+		blocked.Write([]byte("XREAD BLOCK 0 STREAMS orders $\r\n"))
+		n, _ := blocked.Read(buf)
+		blocked.Close()
+		result <- string(buf[:n])
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn.Close()
+	reader.Close()
+
+	closed := make(chan error)
+	go func() {
+		closed <- nr.Close()
+	}()
+
+	select {
+	case resp := <-result:
+		if resp != "OK\r\n" {
+			t.Fatalf("Expected empty response, got %q", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the blocked read to stop once the node closes")
+	}
+
+	if err := <-closed; err != nil {
+		t.Fatalf("Failed to close node: %v", err)
+	}
+}
+
+func TestServerQueue(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	// Reserving from a missing queue returns no jobs
+	if resp := sendTestCommand(t, conn, "QRESERVE jobs 1000"); resp != "ERR no jobs ready\r\n" {
+		t.Fatalf("Expected 'ERR no jobs ready', got %s", resp)
+	}
+
+	resp := sendTestCommand(t, conn, "QPUSH jobs send welcome email")
+	if !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected job id, got %s", resp)
+	}
+	id := strings.TrimSpace(strings.TrimPrefix(resp, "OK "))
+
+	resp = sendTestCommand(t, conn, "QRESERVE jobs 100")
+	if resp != fmt.Sprintf("OK %s 1 send welcome email\r\n", id) {
+		t.Fatalf("Unexpected QRESERVE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "QSTATS jobs"); resp != "OK ready 0 reserved 1 dead 0\r\n" {
+		t.Fatalf("Unexpected QSTATS response %q", resp)
+	}
+
+	// The job is reserved so nothing is ready until the visibility timeout passes
+	if resp := sendTestCommand(t, conn, "QRESERVE jobs 100"); resp != "ERR no jobs ready\r\n" {
+		t.Fatalf("Expected 'ERR no jobs ready', got %s", resp)
+	}
+
+	// A blocking reserve picks the job up again once it becomes visible
+	resp = sendTestCommand(t, conn, "QRESERVE jobs 1000 BLOCK 2000")
+	if resp != fmt.Sprintf("OK %s 2 send welcome email\r\n", id) {
+		t.Fatalf("Expected redelivery, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "QACK jobs "+id); resp != "OK job acknowledged\r\n" {
+		t.Fatalf("Expected 'OK job acknowledged', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "QACK jobs "+id); resp != "ERR job not found\r\n" {
+		t.Fatalf("Expected 'ERR job not found', got %s", resp)
+	}
+
+	// A job released too many times moves to the dead letter queue
+	resp = sendTestCommand(t, conn, "QPUSH jobs resize image")
+	id = strings.TrimSpace(strings.TrimPrefix(resp, "OK "))
+
+	for i := 0; i < DefaultQueueMaxDeliveries; i++ {
+		if resp := sendTestCommand(t, conn, "QRESERVE jobs 1000"); !strings.HasPrefix(resp, "OK "+id) {
+			t.Fatalf("Expected job %s, got %s", id, resp)
+		}
+
+		if resp := sendTestCommand(t, conn, "QNACK jobs "+id); resp != "OK job released\r\n" {
+			t.Fatalf("Expected 'OK job released', got %s", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "QSTATS jobs"); resp != "OK ready 0 reserved 0 dead 1\r\n" {
+		t.Fatalf("Unexpected QSTATS response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "QRESERVE jobs_dead 1000"); !strings.HasPrefix(resp, "OK "+id+" 1 resize image") {
+		t.Fatalf("Expected job in dead letter queue, got %s", resp)
+	}
+
+	// A blocked consumer is woken by a push from another client
+	consumer := dialTestNode(t, "localhost:4001")
+	defer consumer.Close()
+
+	result := make(chan string)
+	go func() {
+		buf := make([]byte, 4096)
+		consumer.Write([]byte("QRESERVE jobs 1000 BLOCK 5000\r\n"))
+		n, _ := consumer.Read(buf)
+		result <- string(buf[:n])
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	sendTestCommand(t, conn, "QPUSH jobs charge card")
+
+	select {
+	case resp := <-result:
+		if !strings.HasSuffix(resp, " 1 charge card\r\n") {
+			t.Fatalf("Unexpected blocked QRESERVE response %q", resp)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Blocked QRESERVE was not woken")
+	}
+}
+
 func TestServerRegx(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
@@ -1189,6 +1423,7 @@ func TestServerRelayToReplicas(t *testing.T) {
 
 	primaryConfig := `health-check-interval: 1
 max-memory-threshold: 75
+replication-ack: all
 server-config:
     address: localhost:4006
     use-tls: false
@@ -1402,10 +1637,38 @@ read-replicas:
 
 	}
 
+	// The replica keeps the version the primary wrote the key with
+	responses := make([]string, 2)
+	for i, c := range []*net.TCPConn{conn, connRep2} {
+		_, err = c.Write([]byte("GET hello0\r\n"))
+		if err != nil {
+			t.Fatalf("Failed to get key-value: %v", err)
+		}
+
+		n, err = c.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		responses[i] = string(buf[:n])
+	}
+
+	if !strings.HasPrefix(responses[0], "OK ") || responses[1] != responses[0] {
+		t.Fatalf("Expected the replica to respond %q, got %q", responses[0], responses[1])
+	}
+
 	connRep2.Close()
 	conn.Close()
 	nr.Close()
 
+	// The replication streams stop with the node
+	for _, replicaConn := range nr.ReplicaConnections {
+		select {
+		case <-replicaConn.Done:
+		default:
+			t.Errorf("Expected the replication stream of %s to stop", replicaConn.Client.Config.ServerAddress)
+		}
+	}
+
 	replica.Close()
 	replica2.Close()
 
@@ -1475,6 +1738,7 @@ func TestServerReplicaSync(t *testing.T) {
 
 	primaryConfig := `health-check-interval: 1
 max-memory-threshold: 75
+replication-ack: all
 server-config:
     address: localhost:4008
     use-tls: false
@@ -1740,3 +2004,1674 @@ read-replicas:
 	nr.Close()
 	replica.Close()
 }
+
+func TestServerBitmapHyperLogLog(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp := sendTestCommand(t, conn, "SETBIT visits 7 1"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected 'OK 0', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SETBIT visits 7 1"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "SETBIT visits 8 1")
+
+	if resp := sendTestCommand(t, conn, "GETBIT visits 7"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GETBIT visits 100"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected 'OK 0', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT visits"); resp != "OK 2\r\n" {
+		t.Fatalf("Expected 'OK 2', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT visits 1 1"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "SETBIT other 8 1")
+	if resp := sendTestCommand(t, conn, "BITOP AND both visits other"); resp != "OK 2\r\n" {
+		t.Fatalf("Expected 'OK 2', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT both"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	// Bitmaps are not plain values
+	if resp := sendTestCommand(t, conn, "GET visits"); resp != "ERR wrong type\r\n" {
+		t.Fatalf("Expected 'ERR wrong type', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFADD users alice bob carol"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected 'OK 1', got %s", resp)
+	}
+
+	// Adding known elements does not change the registers
+	if resp := sendTestCommand(t, conn, "PFADD users alice"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected 'OK 0', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFCOUNT users"); resp != "OK 3\r\n" {
+		t.Fatalf("Expected 'OK 3', got %s", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "PFADD admins carol dave")
+	if resp := sendTestCommand(t, conn, "PFCOUNT users admins"); resp != "OK 4\r\n" {
+		t.Fatalf("Expected 'OK 4', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFMERGE everyone users admins"); resp != "OK\r\n" {
+		t.Fatalf("Expected 'OK', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PFCOUNT everyone"); resp != "OK 4\r\n" {
+		t.Fatalf("Expected 'OK 4', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SETBIT users 1 1"); resp != "ERR wrong type\r\n" {
+		t.Fatalf("Expected 'ERR wrong type', got %s", resp)
+	}
+}
+
+func TestServerTimeSeries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp := sendTestCommand(t, conn, "TS.CREATE cpu RETENTION 100000"); resp != "OK series created\r\n" {
+		t.Fatalf("Expected 'OK series created', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.CREATE cpu"); resp != "ERR key already exists\r\n" {
+		t.Fatalf("Expected 'ERR key already exists', got %s", resp)
+	}
+
+	for i, value := range []string{"1", "3", "2", "10"} {
+		ts := 1000 + i*30
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("TS.ADD cpu %d %s", ts, value)); resp != fmt.Sprintf("OK %d\r\n", ts) {
+			t.Fatalf("Expected 'OK %d', got %s", ts, resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.ADD cpu 1000 5"); resp != "ERR timestamp must be greater than the last sample\r\n" {
+		t.Fatalf("Expected out of order error, got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE cpu - +"); resp != "OK 4\r\n1000 1\r\n1030 3\r\n1060 2\r\n1090 10\r\n" {
+		t.Fatalf("Unexpected TS.RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE cpu 1000 1060 AGGREGATION avg 60"); resp != "OK 2\r\n960 1\r\n1020 2.5\r\n" {
+		t.Fatalf("Unexpected TS.RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE cpu - + AGGREGATION max 1000"); resp != "OK 1\r\n1000 10\r\n" {
+		t.Fatalf("Unexpected TS.RANGE response %q", resp)
+	}
+
+	// A series is created by its first sample
+	_ = sendTestCommand(t, conn, "TS.ADD mem 1000 512")
+	_ = sendTestCommand(t, conn, "PUT metric_plain 1")
+
+	if resp := sendTestCommand(t, conn, "TS.MRANGE - + ^(cpu|mem|metric_plain)$ AGGREGATION count 10000"); resp != "OK 2\r\ncpu 0 4\r\nmem 0 1\r\n" {
+		t.Fatalf("Unexpected TS.MRANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "TS.RANGE missing - +"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET cpu"); resp != "ERR wrong type\r\n" {
+		t.Fatalf("Expected 'ERR wrong type', got %s", resp)
+	}
+}
+
+func TestServerDocuments(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp := sendTestCommand(t, conn, `JSON.SET user $ {"name": "alice", "visits": 1, "tags": ["a"]}`); resp != "OK\r\n" {
+		t.Fatalf("Expected 'OK', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, `JSON.SET user $.address {"city": "Oslo"}`); resp != "OK\r\n" {
+		t.Fatalf("Expected 'OK', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.GET user $.address.city"); resp != "OK [\"Oslo\"]\r\n" {
+		t.Fatalf("Unexpected JSON.GET response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.NUMINCRBY user $.visits 2"); resp != "OK [3]\r\n" {
+		t.Fatalf("Unexpected JSON.NUMINCRBY response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.NUMINCRBY user $.name 2"); resp != "ERR value is not a number\r\n" {
+		t.Fatalf("Expected 'ERR value is not a number', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, `JSON.ARRAPPEND user $.tags "b c" {"d": 1}`); resp != "OK [3]\r\n" {
+		t.Fatalf("Unexpected JSON.ARRAPPEND response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.DEL user $.tags[0]"); resp != "OK 1\r\n" {
+		t.Fatalf("Unexpected JSON.DEL response %q", resp)
+	}
+
+	expected := `{"address":{"city":"Oslo"},"name":"alice","tags":["b c",{"d":1}],"visits":3}`
+	if resp := sendTestCommand(t, conn, "JSON.GET user"); resp != "OK ["+expected+"]\r\n" {
+		t.Fatalf("Unexpected JSON.GET response %q", resp)
+	}
+
+	// GET returns the whole document
+	if resp := sendTestCommand(t, conn, "GET user"); !strings.HasSuffix(resp, " user "+expected+"\r\n") {
+		t.Fatalf("Unexpected GET response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.SET user $.missing.field 1"); resp != "ERR path not found\r\n" {
+		t.Fatalf("Expected 'ERR path not found', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.SET user name"); resp != "ERR invalid path\r\n" {
+		t.Fatalf("Expected 'ERR invalid path', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.DEL user"); resp != "OK 1\r\n" {
+		t.Fatalf("Unexpected JSON.DEL response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JSON.GET user"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %s", resp)
+	}
+}
+
+func TestServerVectors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	// Vectors stored before the index is created are indexed too
+	if resp := sendTestCommand(t, conn, "VADD docs:1 1 0 0"); resp != "OK vector added\r\n" {
+		t.Fatalf("Expected 'OK vector added', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VCREATE docs DIM 3 METRIC cosine"); resp != "OK index created\r\n" {
+		t.Fatalf("Expected 'OK index created', got %s", resp)
+	}
+
+	for key, vec := range map[string]string{"docs:2": "0,1,0", "docs:3": "0.9,0.1,0", "other": "0 0 1"} {
+		if resp := sendTestCommand(t, conn, "VADD "+key+" "+vec); resp != "OK vector added\r\n" {
+			t.Fatalf("Expected 'OK vector added', got %s", resp)
+		}
+	}
+
+	// Keys covered by the index must have its dimension
+	if resp := sendTestCommand(t, conn, "VADD docs:4 1 0"); resp != "ERR dimension mismatch for index docs\r\n" {
+		t.Fatalf("Expected dimension mismatch, got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH docs 2 1 0 0"); !strings.HasPrefix(resp, "OK 2\r\ndocs:1 0\r\ndocs:3 0.006") {
+		t.Fatalf("Unexpected VSEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH docs 10 1 0 0 EXACT"); !strings.HasPrefix(resp, "OK 3\r\ndocs:1 0\r\ndocs:3 ") {
+		t.Fatalf("Unexpected exact VSEARCH response %q", resp)
+	}
+
+	// Overwritten vectors are searched by their new value
+	_ = sendTestCommand(t, conn, "VADD docs:1 0 1 0")
+	if resp := sendTestCommand(t, conn, "VSEARCH docs 1 0 1 0 EXACT"); !strings.HasPrefix(resp, "OK 1\r\ndocs:") || strings.Contains(resp, "docs:3") {
+		t.Fatalf("Unexpected VSEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH docs 1 1 0"); resp != "ERR dimension mismatch\r\n" {
+		t.Fatalf("Expected dimension mismatch, got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "VSEARCH missing 1 1 0 0"); resp != "ERR index not found\r\n" {
+		t.Fatalf("Expected 'ERR index not found', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET other"); !strings.HasSuffix(resp, " other 0 0 1\r\n") {
+		t.Fatalf("Unexpected GET response %q", resp)
+	}
+}
+
+func TestServerFullText(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	// Values stored before the index is created are indexed too
+	if resp := sendTestCommand(t, conn, "PUT notes:1 The quick brown fox jumps over the lazy dog"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "FT.CREATE notes"); resp != "OK index created\r\n" {
+		t.Fatalf("Expected 'OK index created', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "FT.CREATE notes"); resp != "ERR key already exists\r\n" {
+		t.Fatalf("Expected 'ERR key already exists', got %s", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "PUT notes:2 A quick brown dog")
+	_ = sendTestCommand(t, conn, "PUT notes:3 fox fox fox")
+	_ = sendTestCommand(t, conn, "PUT notes:4 42")
+	_ = sendTestCommand(t, conn, "PUT other quick fox outside the index")
+
+	if resp := sendTestCommand(t, conn, `SEARCH notes "fox"`); !strings.HasPrefix(resp, "OK 2\r\nnotes:3 ") || !strings.Contains(resp, "\r\nnotes:1 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, `SEARCH notes "quick -fox"`); !strings.HasPrefix(resp, "OK 1\r\nnotes:2 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, `SEARCH notes "fox OR dog" LIMIT 1`); !strings.HasPrefix(resp, "OK 1\r\nnotes:3 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	// Increments and deletes keep the index up to date
+	_ = sendTestCommand(t, conn, "INCR notes:4 1")
+	if resp := sendTestCommand(t, conn, "SEARCH notes 43"); !strings.HasPrefix(resp, "OK 1\r\nnotes:4 ") {
+		t.Fatalf("Unexpected SEARCH response %q", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "DEL notes:3")
+	_ = sendTestCommand(t, conn, "PUT notes:1 nothing to see")
+	if resp := sendTestCommand(t, conn, "SEARCH notes fox"); resp != "OK 0\r\n" {
+		t.Fatalf("Expected no results, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, `SEARCH notes "fox`); resp != "ERR unterminated query\r\n" {
+		t.Fatalf("Expected 'ERR unterminated query', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SEARCH missing fox"); resp != "ERR index not found\r\n" {
+		t.Fatalf("Expected 'ERR index not found', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET notes"); resp != "ERR wrong type\r\n" {
+		t.Fatalf("Expected 'ERR wrong type', got %s", resp)
+	}
+}
+
+func TestServerOrderedKeys(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	for _, key := range []string{"user:3", "user:1", "item:b", "user:2", "item:a", "users"} {
+		if resp := sendTestCommand(t, conn, "PUT "+key+" value"); resp != "OK key-value written\r\n" {
+			t.Fatalf("Expected 'OK key-value written', got %s", resp)
+		}
+	}
+
+	_ = sendTestCommand(t, conn, "DEL user:2")
+
+	if resp := sendTestCommand(t, conn, "PREFIX user:"); resp != "OK 2\r\nuser:1\r\nuser:3\r\n" {
+		t.Fatalf("Unexpected PREFIX response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RANGE item:b user:3"); resp != "OK 3\r\nitem:b\r\nuser:1\r\nuser:3\r\n" {
+		t.Fatalf("Unexpected RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RANGE - + LIMIT 2"); resp != "OK 2\r\nitem:a\r\nitem:b\r\n" {
+		t.Fatalf("Unexpected RANGE response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PREFIX missing"); resp != "OK 0\r\n" {
+		t.Fatalf("Unexpected PREFIX response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RANGE a"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %s", resp)
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	for i := 0; i < 50; i++ {
+		_ = sendTestCommand(t, conn, fmt.Sprintf("PUT user:%d value", i))
+	}
+	_ = sendTestCommand(t, conn, "XADD events * type login")
+
+	// scan runs a full scan and returns how many times each key was returned
+	scan := func(options string) map[string]int {
+		seen := make(map[string]int)
+		cursor := "0"
+		for {
+			resp := sendTestCommand(t, conn, "SCAN "+cursor+options)
+			lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+			header := strings.Fields(lines[0])
+			if len(header) != 3 || header[0] != "OK" {
+				t.Fatalf("Unexpected SCAN response %q", resp)
+			}
+
+			for _, key := range lines[1:] {
+				if key != "" {
+					seen[key]++
+				}
+			}
+
+			cursor = header[2]
+			if cursor == "0" {
+				return seen
+			}
+		}
+	}
+
+	if seen := scan(" COUNT 5"); len(seen) != 51 {
+		t.Fatalf("Expected 51 keys, got %d", len(seen))
+	}
+
+	if seen := scan(" MATCH ^user:1 COUNT 100"); len(seen) != 11 {
+		t.Fatalf("Expected 11 keys matching user:1, got %d", len(seen))
+	}
+
+	if seen := scan(" TYPE stream"); len(seen) != 1 || seen["events"] != 1 {
+		t.Fatalf("Expected only the stream, got %v", seen)
+	}
+
+	if resp := sendTestCommand(t, conn, "SCAN 0 TYPE nothing"); resp != "ERR invalid type\r\n" {
+		t.Fatalf("Expected 'ERR invalid type', got %s", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SCAN x"); resp != "ERR invalid cursor\r\n" {
+		t.Fatalf("Expected 'ERR invalid cursor', got %s", resp)
+	}
+}
+
+func TestServerQuery(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	_ = sendTestCommand(t, conn, "PUT user_1 5")
+	_ = sendTestCommand(t, conn, "PUT user_2 20")
+	_ = sendTestCommand(t, conn, "PUT user_3 hello world")
+	_ = sendTestCommand(t, conn, "PUT item_1 50")
+
+	resp := sendTestCommand(t, conn, "QUERY WHERE key ~ '^user_' AND num(value) > 1 LIMIT 100")
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 3 || lines[0] != "OK 2" || !strings.HasSuffix(lines[1], " user_1 5") || !strings.HasSuffix(lines[2], " user_2 20") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	// Only what changed since a point in time
+	since := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+	_ = sendTestCommand(t, conn, "PUT user_2 21")
+
+	resp = sendTestCommand(t, conn, "QUERY WHERE ts > "+since)
+	if !strings.HasPrefix(resp, "OK 1\r\n") || !strings.HasSuffix(resp, " user_2 21\r\n") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "QUERY WHERE type = string AND value = 'hello world'"); !strings.HasSuffix(resp, " user_3 hello world\r\n") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "QUERY LIMIT 1"); !strings.HasPrefix(resp, "OK 1\r\n") || !strings.Contains(resp, " item_1 50") {
+		t.Fatalf("Unexpected QUERY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "QUERY WHERE name = x"); resp != "ERR unknown field name\r\n" {
+		t.Fatalf("Expected 'ERR unknown field name', got %s", resp)
+	}
+}
+
+func TestServerAggregate(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	_ = sendTestCommand(t, conn, "PUT counter_1 5")
+	_ = sendTestCommand(t, conn, "PUT counter_2 20")
+	_ = sendTestCommand(t, conn, "PUT counter_3 2.5")
+	_ = sendTestCommand(t, conn, "PUT counter_4 hello")
+	_ = sendTestCommand(t, conn, "PUT other 100")
+
+	expected := map[string]string{
+		"AGG COUNT ^counter_":                 "OK 3\r\n",
+		"AGG SUM ^counter_":                   "OK 27.5\r\n",
+		"AGG AVG ^counter_":                   "OK 9.166666666666666\r\n",
+		"AGG MIN ^counter_":                   "OK 2.5\r\n",
+		"AGG MAX ^counter_":                   "OK 20\r\n",
+		"AGG SUM ^counter_[12]$":              "OK 25\r\n",
+		"AGG SUM ^counter_ EXCLUDE counter_3": "OK 25\r\n",
+		"AGG SUM ^missing":                    "OK 0\r\n",
+		"AGG MAX ^missing":                    "ERR no numeric values\r\n",
+		"AGG MEDIAN ^counter_":                "ERR invalid aggregation\r\n",
+	}
+
+	for command, want := range expected {
+		if resp := sendTestCommand(t, conn, command); resp != want {
+			t.Fatalf("Expected %q for %s, got %q", want, command, resp)
+		}
+	}
+
+	resp := sendTestCommand(t, conn, "AGG PARTIAL ^counter_")
+	if resp != "OK 3 25 f2.5 f2.5 20\r\n" {
+		t.Fatalf("Unexpected AGG PARTIAL response %q", resp)
+	}
+
+	resp = sendTestCommand(t, conn, "AGG KEYS ^counter_[12]$")
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 3 || lines[0] != "OK 2" {
+		t.Fatalf("Unexpected AGG KEYS response %q", resp)
+	}
+}
+
+func TestServerVersions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// Config keys keep their last 3 versions
+	config := &Config{
+		HealthCheckInterval: 2,
+		MaxMemoryThreshold:  75,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4001",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		Versions: []*versions.Rule{{Pattern: "^config:", Count: 3}},
+	}
+
+	writeTestConfig(t, config)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+
+	nr := openTestNode(t, logger)
+
+	conn := dialTestNode(t, "localhost:4001")
+
+	var written []time.Time
+	for _, value := range []string{"a", "b", "c", "d"} {
+		_ = sendTestCommand(t, conn, "PUT config:x "+value)
+		written = append(written, time.Now())
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_ = sendTestCommand(t, conn, "PUT counter 1")
+	_ = sendTestCommand(t, conn, "INCR counter 4")
+
+	resp := sendTestCommand(t, conn, "HISTORY config:x")
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 4 || lines[0] != "OK 3" || !strings.HasSuffix(lines[1], " PUT d") || !strings.HasSuffix(lines[3], " PUT b") {
+		t.Fatalf("Unexpected HISTORY response %q", resp)
+	}
+
+	at := written[2].UTC().Format(time.RFC3339Nano)
+	if resp = sendTestCommand(t, conn, "GET config:x AT "+at); !strings.HasPrefix(resp, "OK ") || !strings.HasSuffix(resp, " config:x c\r\n") {
+		t.Fatalf("Expected version c, got %q", resp)
+	}
+
+	// The first version is past the count
+	if resp = sendTestCommand(t, conn, "GET config:x AT "+written[0].UTC().Format(time.RFC3339Nano)); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "DEL config:x")
+	if resp = sendTestCommand(t, conn, "GET config:x AT "+time.Now().UTC().Format(time.RFC3339Nano)); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected deleted key, got %q", resp)
+	}
+
+	// Keys without versions only have their current value
+	if resp = sendTestCommand(t, conn, "HISTORY counter"); !strings.HasPrefix(resp, "OK 1\r\n") || !strings.HasSuffix(resp, " PUT 5\r\n") {
+		t.Fatalf("Unexpected HISTORY response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "GET counter AT yesterday"); resp != "ERR invalid timestamp yesterday\r\n" {
+		t.Fatalf("Expected 'ERR invalid timestamp yesterday', got %q", resp)
+	}
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond) // Wait for journal appends
+	nr.Close()
+
+	// Versions are rebuilt from the journal
+	nr = openTestNode(t, logger)
+	defer nr.Close()
+
+	conn = dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp = sendTestCommand(t, conn, "GET config:x AT "+at); !strings.HasSuffix(resp, " config:x c\r\n") {
+		t.Fatalf("Expected version c after recovery, got %q", resp)
+	}
+
+	resp = sendTestCommand(t, conn, "HISTORY config:x")
+	lines = strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 4 || lines[0] != "OK 3" || !strings.HasSuffix(lines[1], " DEL") {
+		t.Fatalf("Unexpected HISTORY response after recovery %q", resp)
+	}
+
+	// Increments are journaled as increments
+	if resp = sendTestCommand(t, conn, "GET counter"); !strings.HasSuffix(resp, " counter 5\r\n") {
+		t.Fatalf("Expected counter 5 after recovery, got %q", resp)
+	}
+}
+
+func TestServerTombstones(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	config := &Config{
+		HealthCheckInterval: 2,
+		MaxMemoryThreshold:  75,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4001",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		TombstoneGrace: 3600,
+	}
+
+	writeTestConfig(t, config)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+
+	nr := openTestNode(t, logger)
+
+	conn := dialTestNode(t, "localhost:4001")
+
+	// A copy moved from another node keeps the version it was written with
+	stale := hlc.FromTime(time.Now().Add(-time.Hour / 2))
+
+	_ = sendTestCommand(t, conn, "PUT user:1 alice")
+	_ = sendTestCommand(t, conn, fmt.Sprintf("RESTORE user:2 %s bob", stale))
+	_ = sendTestCommand(t, conn, "PUT counter 1")
+
+	written, err := hlc.Parse(strings.Fields(sendTestCommand(t, conn, "GET user:1"))[1])
+	if err != nil {
+		t.Fatalf("Failed to parse version: %v", err)
+	}
+
+	_ = sendTestCommand(t, conn, "DEL user:1")
+	_ = sendTestCommand(t, conn, "DEL counter")
+
+	// Deleted keys report the version of the delete, taken from the clock of the node like the version of a write
+	resp := sendTestCommand(t, conn, "GET user:1")
+	if !strings.HasPrefix(resp, "ERR key deleted ") {
+		t.Fatalf("Expected 'ERR key deleted', got %q", resp)
+	}
+
+	deleted, err := hlc.Parse(strings.TrimSpace(strings.TrimPrefix(resp, "ERR key deleted ")))
+	if err != nil || !deleted.After(written) || deleted.Node != hlc.NodeID("localhost:4001") {
+		t.Fatalf("Expected a delete versioned after %s by the node, got %q", written, resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "INCR counter 1"); !strings.HasPrefix(resp, "ERR key deleted ") {
+		t.Fatalf("Expected 'ERR key deleted', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "GET missing"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	// A stale copy is deleted with the time it was written, its tombstone is older.  A copy written since is kept
+	if resp = sendTestCommand(t, conn, "DEL user:2 "+time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)); resp != fmt.Sprintf("ERR key exists %s\r\n", stale) {
+		t.Fatalf("Expected the newer copy kept, got %q", resp)
+	}
+
+	_ = sendTestCommand(t, conn, fmt.Sprintf("DEL user:2 %s", stale))
+
+	resp = sendTestCommand(t, conn, "TOMBSTONES ^user:")
+	if resp != fmt.Sprintf("OK 2\r\n%s user:1\r\n%s user:2\r\n", deleted, stale) {
+		t.Fatalf("Unexpected TOMBSTONES response %q", resp)
+	}
+
+	// Keys written again have no tombstone
+	_ = sendTestCommand(t, conn, "PUT user:1 carol")
+	if resp = sendTestCommand(t, conn, "TOMBSTONES ^user:"); resp != fmt.Sprintf("OK 1\r\n%s user:2\r\n", stale) {
+		t.Fatalf("Unexpected TOMBSTONES response %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "TOMBSTONES"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %q", resp)
+	}
+
+	// Deletions older than the grace period leave no tombstone
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+	_ = sendTestCommand(t, conn, "RESTORE old "+old+" 1")
+	_ = sendTestCommand(t, conn, "DEL old "+old)
+	if resp = sendTestCommand(t, conn, "GET old"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond) // Wait for journal appends
+	nr.Close()
+
+	// Tombstones are rebuilt from the journal
+	nr = openTestNode(t, logger)
+	defer nr.Close()
+
+	conn = dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if resp = sendTestCommand(t, conn, "TOMBSTONES ^(user|counter)"); !strings.HasPrefix(resp, "OK 2\r\n") {
+		t.Fatalf("Unexpected TOMBSTONES response after recovery %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "GET counter"); !strings.HasPrefix(resp, "ERR key deleted ") {
+		t.Fatalf("Expected 'ERR key deleted' after recovery, got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "TOMBSTONES ^user:2$"); resp != fmt.Sprintf("OK 1\r\n%s user:2\r\n", stale) {
+		t.Fatalf("Unexpected TOMBSTONES response after recovery %q", resp)
+	}
+}
+
+func TestServerHybridLogicalClock(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	config := &Config{
+		HealthCheckInterval: 2,
+		MaxMemoryThreshold:  75,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4001",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+	}
+
+	writeTestConfig(t, config)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+
+	nr := openTestNode(t, logger)
+
+	conn := dialTestNode(t, "localhost:4001")
+
+	// version returns the version in a GET response
+	version := func(resp string) hlc.Timestamp {
+		fields := strings.Fields(resp)
+		if len(fields) < 4 || fields[0] != "OK" {
+			t.Fatalf("Unexpected GET response %q", resp)
+		}
+
+		v, err := hlc.Parse(fields[1])
+		if err != nil {
+			t.Fatalf("Failed to parse version %s: %v", fields[1], err)
+		}
+		return v
+	}
+
+	_ = sendTestCommand(t, conn, "PUT a 1")
+	_ = sendTestCommand(t, conn, "PUT b 2")
+
+	a := version(sendTestCommand(t, conn, "GET a"))
+	b := version(sendTestCommand(t, conn, "GET b"))
+	if !b.After(a) || a.Node != hlc.NodeID("localhost:4001") {
+		t.Fatalf("Expected version %v after %v assigned by the node", b, a)
+	}
+
+	// Increments respond with the version of the value they wrote
+	resp := sendTestCommand(t, conn, "INCR a 2")
+	incremented := version(resp)
+	if !strings.HasSuffix(resp, " a 3\r\n") || !incremented.After(b) {
+		t.Fatalf("Expected INCR to write a version after %v, got %q", b, resp)
+	}
+
+	if v := version(sendTestCommand(t, conn, "GET a")); v != incremented {
+		t.Fatalf("Expected version %v, got %v", incremented, v)
+	}
+
+	resp = sendTestCommand(t, conn, "DECR a 1")
+	if decremented := version(resp); !strings.HasSuffix(resp, " a 2\r\n") || !decremented.After(incremented) {
+		t.Fatalf("Expected DECR to write a version after %v, got %q", incremented, resp)
+	}
+	incremented = version(sendTestCommand(t, conn, "GET a"))
+
+	if resp := sendTestCommand(t, conn, "REGX ^b$"); resp != fmt.Sprintf("OK %s b 2\r\n", b) {
+		t.Fatalf("Unexpected REGX response %q", resp)
+	}
+
+	conn.Close()
+	time.Sleep(100 * time.Millisecond) // Wait for journal appends
+	nr.Close()
+
+	// Versions are journaled
+	nr = openTestNode(t, logger)
+	defer nr.Close()
+
+	conn = dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	if v := version(sendTestCommand(t, conn, "GET a")); v != incremented {
+		t.Fatalf("Expected version %v after recovery, got %v", incremented, v)
+	}
+
+	if v := version(sendTestCommand(t, conn, "GET b")); v != b {
+		t.Fatalf("Expected version %v after recovery, got %v", b, v)
+	}
+
+	// New writes are versioned after the recovered ones
+	_ = sendTestCommand(t, conn, "PUT c 3")
+	if v := version(sendTestCommand(t, conn, "GET c")); !v.After(incremented) {
+		t.Fatalf("Expected version after %v, got %v", incremented, v)
+	}
+}
+
+func TestServerConditionalWrites(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	resp := sendTestCommand(t, conn, "PUTNX user:1 alice smith")
+	if !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected PUTNX to write, got %q", resp)
+	}
+	created := strings.TrimSpace(strings.TrimPrefix(resp, "OK "))
+
+	if resp = sendTestCommand(t, conn, "GET user:1"); resp != fmt.Sprintf("OK %s user:1 alice smith\r\n", created) {
+		t.Fatalf("Expected the written version, got %q", resp)
+	}
+
+	// The key exists, the current version is reported
+	if resp = sendTestCommand(t, conn, "PUTNX user:1 bob"); resp != fmt.Sprintf("ERR key exists %s\r\n", created) {
+		t.Fatalf("Expected 'ERR key exists', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "PUTXX user:2 bob"); resp != "ERR key not found\r\n" {
+		t.Fatalf("Expected 'ERR key not found', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "PUTXX user:1 carol"); !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected PUTXX to write, got %q", resp)
+	}
+	updated := strings.TrimSpace(strings.TrimPrefix(resp, "OK "))
+
+	// A CAS with the version read before the update fails
+	if resp = sendTestCommand(t, conn, fmt.Sprintf("CAS user:1 %s dave", created)); resp != fmt.Sprintf("ERR version mismatch %s\r\n", updated) {
+		t.Fatalf("Expected 'ERR version mismatch', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, fmt.Sprintf("CAS user:1 %s dave", updated)); !strings.HasPrefix(resp, "OK ") {
+		t.Fatalf("Expected CAS to write, got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "GET user:1"); !strings.HasSuffix(resp, " user:1 dave\r\n") {
+		t.Fatalf("Expected dave, got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "CAS user:1 yesterday eve"); resp != "ERR invalid version\r\n" {
+		t.Fatalf("Expected 'ERR invalid version', got %q", resp)
+	}
+
+	// CAS without a version is not a write
+	if resp = sendTestCommand(t, conn, "CAS user:1 eve"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %q", resp)
+	}
+
+	if resp = sendTestCommand(t, conn, "PUTNX user:3"); resp != "ERR invalid command\r\n" {
+		t.Fatalf("Expected 'ERR invalid command', got %q", resp)
+	}
+
+	// A plain PUT still writes
+	if resp = sendTestCommand(t, conn, "PUT user:4 frank"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+}
+
+func TestServerSlotDumpRestore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	nr := openTestNode(t, logger)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".node")
+	defer nr.Close()
+
+	conn := dialTestNode(t, "localhost:4001")
+	defer conn.Close()
+
+	version := "2025-03-01T10:00:00.123456789Z/7/1a2b3c4d"
+
+	// A key moved from another node keeps its version
+	if resp := sendTestCommand(t, conn, fmt.Sprintf("RESTORE moved %s hello world", version)); resp != "OK restored\r\n" {
+		t.Fatalf("Expected 'OK restored', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "GET moved"); resp != fmt.Sprintf("OK %s moved hello world\r\n", version) {
+		t.Fatalf("Expected the restored version, got %q", resp)
+	}
+
+	// An older copy never replaces the current one
+	if resp := sendTestCommand(t, conn, "RESTORE moved 2025-01-01T00:00:00Z old"); resp != fmt.Sprintf("ERR key exists %s\r\n", version) {
+		t.Fatalf("Expected 'ERR key exists', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "DEL moved"); resp != "OK key-value deleted\r\n" {
+		t.Fatalf("Expected 'OK key-value deleted', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, fmt.Sprintf("RESTORE moved %s hello world", version)); !strings.HasPrefix(resp, "ERR key deleted ") {
+		t.Fatalf("Expected 'ERR key deleted', got %q", resp)
+	}
+
+	for _, key := range []string{"b", "a", "c"} {
+		if resp := sendTestCommand(t, conn, fmt.Sprintf("RESTORE %s %s %s", key, version, key)); resp != "OK restored\r\n" {
+			t.Fatalf("Expected 'OK restored', got %q", resp)
+		}
+	}
+
+	if resp := sendTestCommand(t, conn, "SLOTCOUNT 0-16383"); resp != "OK 3\r\n" {
+		t.Fatalf("Expected 'OK 3', got %q", resp)
+	}
+
+	// The deleted key is not counted
+	var memory float64
+	var keys int
+	if _, err := fmt.Sscanf(sendTestCommand(t, conn, "LOAD"), "OK %f %d", &memory, &keys); err != nil || keys != 3 || memory <= 0 {
+		t.Fatalf("Unexpected LOAD response, memory %f keys %d error %v", memory, keys, err)
+	}
+
+	// Keys are dumped in key order
+	if resp := sendTestCommand(t, conn, "SLOTDUMP 0-16383 COUNT 2"); resp != fmt.Sprintf("OK 2\r\n%s a a\r\n%s b b\r\n", version, version) {
+		t.Fatalf("Unexpected SLOTDUMP response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, fmt.Sprintf("SLOTDUMP %d", slots.Slot("c"))); resp != fmt.Sprintf("OK 1\r\n%s c c\r\n", version) {
+		t.Fatalf("Unexpected SLOTDUMP response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SLOTDUMP 0-16384"); resp != "ERR invalid slot range 0-16384\r\n" {
+		t.Fatalf("Expected 'ERR invalid slot range', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "SLOTDUMP 0-100 COUNT none"); resp != "ERR invalid count\r\n" {
+		t.Fatalf("Expected 'ERR invalid count', got %q", resp)
+	}
+
+	// Keys other than strings are dumped as the journal entries rebuilding them
+	_ = sendTestCommand(t, conn, "SETBIT visits 3 1")
+	resp := sendTestCommand(t, conn, fmt.Sprintf("SLOTDUMP %d", slots.Slot("visits")))
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 2 || lines[0] != "OK 1" || !strings.HasPrefix(lines[1], "ENTRIES visits ") {
+		t.Fatalf("Unexpected SLOTDUMP response %q", resp)
+	}
+	entries := strings.TrimPrefix(lines[1], "ENTRIES visits ")
+
+	// A moved key leaves no tombstone
+	if resp := sendTestCommand(t, conn, "DEL visits MOVED"); resp != "OK key-value deleted\r\n" {
+		t.Fatalf("Expected 'OK key-value deleted', got %q", resp)
+	}
+
+	// The moved bitmap is unioned with the copy already there
+	_ = sendTestCommand(t, conn, "SETBIT visits 5 1")
+	if resp := sendTestCommand(t, conn, "RESTOREENTRIES visits "+entries); resp != "OK restored\r\n" {
+		t.Fatalf("Expected 'OK restored', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "BITCOUNT visits"); resp != "OK 2\r\n" {
+		t.Fatalf("Expected 'OK 2', got %q", resp)
+	}
+
+	_ = sendTestCommand(t, conn, "PUT other value")
+	if resp := sendTestCommand(t, conn, "RESTOREENTRIES other "+entries); resp != "ERR invalid entry\r\n" {
+		t.Fatalf("Expected 'ERR invalid entry', got %q", resp)
+	}
+}
+
+func TestServerReplicaSyncSequence(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	replicaDir := t.TempDir()
+	replicaConfig, err := yaml.Marshal(&nodereplica.Config{
+		ServerConfig: &server.Config{
+			Address:     "localhost:4080",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		MaxMemoryThreshold: 75,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(replicaDir, nodereplica.ConfigFile), replicaConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	// openReplica opens the read replica in its directory
+	openReplica := func() *nodereplica.NodeReplica {
+		replica, err := nodereplica.New(logger, "test-key")
+		if err != nil {
+			t.Fatalf("Failed to create node replica: %v", err)
+		}
+
+		go func() {
+			_ = replica.Open(&replicaDir)
+		}()
+
+		time.Sleep(500 * time.Millisecond)
+
+		return replica
+	}
+
+	replica := openReplica()
+
+	primaryDir := t.TempDir()
+	primaryConfig, err := yaml.Marshal(&Config{
+		HealthCheckInterval: 1,
+		MaxMemoryThreshold:  75,
+		ReplicationAck:      AckAll, // The replica is checked right after the writes
+		ServerConfig: &server.Config{
+			Address:     "localhost:4079",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		ReadReplicas: []*client.Config{
+			{
+				ServerAddress:  "localhost:4080",
+				ConnectTimeout: 5,
+				WriteTimeout:   5,
+				ReadTimeout:    5,
+				MaxRetries:     3,
+				RetryWaitTime:  1,
+				BufferSize:     1024,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(primaryDir, ConfigFile), primaryConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	primary, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = primary.Open(&primaryDir)
+	}()
+
+	time.Sleep(3 * time.Second) // Wait for the primary to connect to its replica
+
+	// The replica waits on the connection of the primary when closed, the primary is closed first
+	defer func() {
+		primary.Close()
+		replica.Close()
+	}()
+
+	conn := dialTestNode(t, "localhost:4079")
+	defer conn.Close()
+
+	// The large value takes more pages in the journal than the other entries
+	large := strings.Repeat("x", 5000)
+	if resp := sendTestCommand(t, conn, "PUT large "+large); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PUT counter 0"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := sendTestCommand(t, conn, "INCR counter 1"); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected INCR to write, got %q", resp)
+		}
+	}
+
+	// The replica applied every write of the primary
+	connRep := dialTestNode(t, "localhost:4080")
+	if resp := sendTestCommand(t, connRep, "JOURNALPOS"); resp != "OK 5\r\n" {
+		t.Fatalf("Expected the replica at sequence number 5, got %q", resp)
+	}
+	connRep.Close()
+
+	primary.ReplicaConnections[0].Client.Close()
+	replica.Close()
+
+	for i := 0; i < 2; i++ {
+		if resp := sendTestCommand(t, conn, "INCR counter 1"); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected INCR to write, got %q", resp)
+		}
+	}
+
+	// A queue moved back to the primary is journaled as the entries restoring its jobs
+	_ = sendTestCommand(t, conn, "QPUSH jobs resize image")
+	resp := sendTestCommand(t, conn, fmt.Sprintf("SLOTDUMP %d", slots.Slot("jobs")))
+	lines := strings.Split(strings.TrimSuffix(resp, "\r\n"), "\r\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "ENTRIES jobs ") {
+		t.Fatalf("Unexpected SLOTDUMP response %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "DEL jobs MOVED"); resp != "OK key-value deleted\r\n" {
+		t.Fatalf("Expected 'OK key-value deleted', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "RESTOREENTRIES jobs "+strings.TrimPrefix(lines[1], "ENTRIES jobs ")); resp != "OK restored\r\n" {
+		t.Fatalf("Expected 'OK restored', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PUT after written"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "JOURNALPOS"); resp != "OK 11\r\n" {
+		t.Fatalf("Expected the primary at sequence number 11, got %q", resp)
+	}
+
+	// The reopened replica resumes after the last write it applied, no write is skipped or applied twice
+	replica = openReplica()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		replica.Lock.RLock()
+		_, _, ok := replica.Storage.Get("after")
+		replica.Lock.RUnlock()
+		if ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the replica to be synced")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	replica.Lock.RLock()
+	counter, _, _ := replica.Storage.Get("counter")
+	value, _, _ := replica.Storage.Get("large")
+	jobs, _, _ := replica.Storage.Get("jobs")
+	replica.Lock.RUnlock()
+
+	if q, ok := jobs.(*queue.Queue); !ok || len(q.Ready) != 1 || q.Ready[0].Payload != "resize image" {
+		t.Errorf("Expected the restored job on the replica, got %v", jobs)
+	}
+
+	if fmt.Sprint(counter) != "5" {
+		t.Errorf("Expected counter 5 on the replica, got %v", counter)
+	}
+
+	if fmt.Sprint(value) != large {
+		t.Errorf("Expected the large value on the replica")
+	}
+
+	if replica.Journal.Seq() != 11 {
+		t.Errorf("Expected the replica at sequence number 11, got %d", replica.Journal.Seq())
+	}
+}
+
+func TestServerReplicaSnapshotSync(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	primaryDir := t.TempDir()
+	primaryConfig, err := yaml.Marshal(&Config{
+		HealthCheckInterval: 1,
+		MaxMemoryThreshold:  75,
+		Versions:            []*versions.Rule{{Pattern: "^name$"}},
+		ServerConfig: &server.Config{
+			Address:     "localhost:4081",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		ReadReplicas: []*client.Config{
+			{
+				ServerAddress:  "localhost:4082",
+				ConnectTimeout: 5,
+				WriteTimeout:   5,
+				ReadTimeout:    5,
+				MaxRetries:     3,
+				RetryWaitTime:  1,
+				BufferSize:     1024,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(primaryDir, ConfigFile), primaryConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	primary, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = primary.Open(&primaryDir)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn := dialTestNode(t, "localhost:4081")
+
+	// The primary is written to while its replica is down
+	for _, command := range []string{"PUT name alex", "PUT name sam", "PUT counter 0", "INCR counter 2", "XADD events 1-0 field value", "QPUSH jobs send welcome email", "PUT gone 1", "DEL gone"} {
+		if resp := sendTestCommand(t, conn, command); !strings.HasPrefix(resp, "OK") {
+			t.Fatalf("Expected %s to write, got %q", command, resp)
+		}
+	}
+
+	// The replica journal diverged from the primary, it is ahead of the journal of the primary
+	replicaDir := t.TempDir()
+	replicaConfig, err := yaml.Marshal(&nodereplica.Config{
+		ServerConfig: &server.Config{
+			Address:     "localhost:4082",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		MaxMemoryThreshold: 75,
+		Versions:           []*versions.Rule{{Pattern: "^name$"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(replicaDir, nodereplica.ConfigFile), replicaConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	j, err := journal.Open(filepath.Join(replicaDir, nodereplica.JournalFile))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	j.Follow(50)
+	_, _ = j.Append("stale", "1", journal.PUT)
+	_ = j.Close()
+
+	// openReplica opens the read replica in its directory
+	openReplica := func() *nodereplica.NodeReplica {
+		replica, err := nodereplica.New(logger, "test-key")
+		if err != nil {
+			t.Fatalf("Failed to create node replica: %v", err)
+		}
+
+		errs := make(chan error, 1)
+		go func() {
+			errs <- replica.Open(&replicaDir)
+		}()
+
+		// The storage and journal of the replica are read once it recovered them
+		select {
+		case <-replica.Opened:
+		case err := <-errs:
+			t.Fatalf("Failed to open node replica: %v", err)
+		}
+
+		return replica
+	}
+
+	replica := openReplica()
+
+	// The replica waits on the connection of the primary when closed, the primary is closed first once its client is
+	defer func() {
+		conn.Close()
+		primary.Close()
+		replica.Close()
+	}()
+
+	// waitFor waits for a key on the replica
+	waitFor := func(key string) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			replica.Lock.RLock()
+			_, _, ok := replica.Storage.Get(key)
+			replica.Lock.RUnlock()
+			if ok {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %s on the replica", key)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	waitFor("name")
+
+	// Writes after the snapshot are relayed once
+	if resp := sendTestCommand(t, conn, "INCR counter 1"); !strings.HasPrefix(resp, "OK") {
+		t.Fatalf("Expected INCR to write, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "PUT after written"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	waitFor("after")
+
+	// check checks the replica holds the storage of the primary and none of its own
+	check := func() {
+		replica.Lock.RLock()
+		defer replica.Lock.RUnlock()
+
+		if _, _, ok := replica.Storage.Get("stale"); ok {
+			t.Errorf("Expected the diverged key to be dropped by the snapshot")
+		}
+
+		counter, _, _ := replica.Storage.Get("counter")
+		if fmt.Sprint(counter) != "3" {
+			t.Errorf("Expected counter 3 on the replica, got %v", counter)
+		}
+
+		for _, key := range []string{"name", "events", "jobs"} {
+			if _, _, ok := replica.Storage.Get(key); !ok {
+				t.Errorf("Expected %s on the replica", key)
+			}
+		}
+
+		// Old versions and tombstones are part of the snapshot
+		history := replica.History.Versions("name", time.Now())
+		if len(history) != 2 || history[0].Value != "sam" || history[1].Value != "alex" {
+			t.Errorf("Expected versions sam and alex of name on the replica, got %+v", history)
+		}
+
+		if _, ok := replica.Tombstones.Get("gone", time.Now()); !ok {
+			t.Errorf("Expected the tombstone of gone on the replica")
+		}
+
+		if replica.Journal.Seq() != primary.Journal.Seq() {
+			t.Errorf("Expected the replica at sequence number %d, got %d", primary.Journal.Seq(), replica.Journal.Seq())
+		}
+	}
+
+	check()
+
+	// The replica recovers the snapshot from its journal once reopened
+	primary.ReplicaConnections[0].Client.Close()
+	replica.Close()
+	replica = openReplica()
+
+	check()
+}
+
+func TestServerReplicationAck(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	replicaDir := t.TempDir()
+	replicaConfig, err := yaml.Marshal(&nodereplica.Config{
+		ServerConfig: &server.Config{
+			Address:     "localhost:4084",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		MaxMemoryThreshold: 75,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(replicaDir, nodereplica.ConfigFile), replicaConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	replica, err := nodereplica.New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	go func() {
+		_ = replica.Open(&replicaDir)
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	// The second replica is down for the whole test
+	replicaClientConfig := func(address string) *client.Config {
+		return &client.Config{
+			ServerAddress:  address,
+			ConnectTimeout: 5,
+			WriteTimeout:   5,
+			ReadTimeout:    5,
+			MaxRetries:     3,
+			RetryWaitTime:  1,
+			BufferSize:     1024,
+		}
+	}
+
+	primaryDir := t.TempDir()
+	primaryConfig, err := yaml.Marshal(&Config{
+		HealthCheckInterval: 1,
+		MaxMemoryThreshold:  75,
+		ReplicationAck:      AckNone,
+		AckTimeout:          300,
+		ServerConfig: &server.Config{
+			Address:     "localhost:4083",
+			ReadTimeout: 10,
+			BufferSize:  1024,
+		},
+		ReadReplicas: []*client.Config{replicaClientConfig("localhost:4084"), replicaClientConfig("localhost:4085")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal config: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(primaryDir, ConfigFile), primaryConfig, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	primary, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		_ = primary.Open(&primaryDir)
+	}()
+
+	time.Sleep(3 * time.Second) // Wait for the primary to connect to its replica
+
+	conn := dialTestNode(t, "localhost:4083")
+
+	// The replica waits on the connection of the primary when closed, the primary is closed first once its client is
+	defer func() {
+		conn.Close()
+		primary.Close()
+		replica.Close()
+	}()
+
+	// has returns true if the replica applied the write of a key
+	has := func(key string) bool {
+		replica.Lock.RLock()
+		defer replica.Lock.RUnlock()
+
+		_, _, ok := replica.Storage.Get(key)
+		return ok
+	}
+
+	// A write waiting for one replica is on it once answered
+	if resp := sendTestCommand(t, conn, "ACK one PUT a 1"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if !has("a") {
+		t.Errorf("Expected a on the replica once the write was answered")
+	}
+
+	// A write waiting for every replica waits only for the connected one, the down replica never was
+	start := time.Now()
+	if resp := sendTestCommand(t, conn, "ACK all PUT b 2"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if elapsed := time.Since(start); elapsed >= 300*time.Millisecond {
+		t.Errorf("Expected the write not to wait for the down replica, took %s", elapsed)
+	}
+
+	if !has("b") {
+		t.Errorf("Expected b on the replica once the write was answered")
+	}
+
+	// A write not waiting for replicas is answered at once, WAIT tells how many replicas have it
+	if resp := sendTestCommand(t, conn, "PUT c 3"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT 1 1000"); resp != "OK 1\r\n" {
+		t.Errorf("Expected one replica to acknowledge the writes, got %q", resp)
+	}
+
+	if !has("c") {
+		t.Errorf("Expected c on the replica once WAIT returned")
+	}
+
+	start = time.Now()
+	if resp := sendTestCommand(t, conn, "WAIT 2 200"); resp != "OK 1\r\n" {
+		t.Errorf("Expected only one replica to acknowledge the writes, got %q", resp)
+	}
+
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Expected WAIT to wait for its timeout, took %s", elapsed)
+	}
+
+	// A timeout of 0 waits as long as a write does
+	start = time.Now()
+	if resp := sendTestCommand(t, conn, "WAIT 2 0"); resp != "OK 1\r\n" {
+		t.Errorf("Expected only one replica to acknowledge the writes, got %q", resp)
+	}
+
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond || elapsed > 5*time.Second {
+		t.Errorf("Expected WAIT to wait for the ack timeout, took %s", elapsed)
+	}
+
+	// WAIT covers the writes of its own client, another client's write the replica did not apply yet is not waited for
+	other := dialTestNode(t, "localhost:4083")
+	defer other.Close()
+
+	// The replica cannot apply writes while its lock is held
+	replica.Lock.Lock()
+	if resp := sendTestCommand(t, other, "PUT e 5"); resp != "OK key-value written\r\n" {
+		replica.Lock.Unlock()
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	start = time.Now()
+	resp := sendTestCommand(t, conn, "WAIT 1 1000")
+	elapsed := time.Since(start)
+	unapplied := sendTestCommand(t, other, "WAIT 1 200")
+	replica.Lock.Unlock()
+
+	if resp != "OK 1\r\n" || elapsed >= 500*time.Millisecond {
+		t.Errorf("Expected the writes of the client acknowledged at once, got %q after %s", resp, elapsed)
+	}
+
+	if unapplied != "OK 0\r\n" {
+		t.Errorf("Expected the write of the other client unacknowledged, got %q", unapplied)
+	}
+
+	if resp := sendTestCommand(t, other, "WAIT 1 1000"); resp != "OK 1\r\n" {
+		t.Errorf("Expected the write of the other client acknowledged once applied, got %q", resp)
+	}
+
+	// The live replica applied every write, the down replica is behind by all of them
+	stats := sendTestCommand(t, conn, "STAT")
+	if !strings.Contains(stats, "\tlocalhost:4084 applied 4 lag_entries 0 lag_seconds 0.000\r\n") {
+		t.Errorf("Expected the live replica caught up in the stats, got %q", stats)
+	}
+
+	if !strings.Contains(stats, "\tlocalhost:4085 applied 0 lag_entries 4 lag_seconds ") {
+		t.Errorf("Expected the down replica 4 writes behind in the stats, got %q", stats)
+	}
+
+	if resp := sendTestCommand(t, conn, "ACK most PUT d 4"); resp != "ERR invalid ack mode\r\n" {
+		t.Errorf("Expected 'ERR invalid ack mode', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT 1"); resp != "ERR invalid command\r\n" {
+		t.Errorf("Expected 'ERR invalid command', got %q", resp)
+	}
+
+	// A write the replica fails to apply is not acknowledged, the replica is resynced from a snapshot
+	if resp := sendTestCommand(t, conn, "PUT n 1"); resp != "OK key-value written\r\n" {
+		t.Fatalf("Expected 'OK key-value written', got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT 1 1000"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected one replica to acknowledge the writes, got %q", resp)
+	}
+
+	replica.Lock.Lock()
+	replica.Storage.Put("n", "diverged")
+	replica.Lock.Unlock()
+
+	if resp := sendTestCommand(t, conn, "ACK one INCR n 1"); resp != "ERR write acknowledged by 0 of 1 read replicas\r\n" {
+		t.Fatalf("Expected the write unacknowledged, got %q", resp)
+	}
+
+	if resp := sendTestCommand(t, conn, "WAIT 1 10000"); resp != "OK 1\r\n" {
+		t.Fatalf("Expected the resynced replica to acknowledge the writes, got %q", resp)
+	}
+
+	replica.Lock.RLock()
+	value, _, _ := replica.Storage.Get("n")
+	replica.Lock.RUnlock()
+	if value != "2" {
+		t.Errorf("Expected n resynced to 2 on the replica, got %v", value)
+	}
+
+	// An idle primary sends heartbeats, the replica knows it is up
+	time.Sleep(2 * ReplicationHeartbeat)
+
+	replica.PositionLock.Lock()
+	contact := time.Since(replica.Contact)
+	replica.PositionLock.Unlock()
+	if contact > ReplicationHeartbeat+200*time.Millisecond {
+		t.Errorf("Expected a heartbeat from the idle primary, last contact %s ago", contact)
+	}
+}
+
+// openTestNode creates a node and opens it in the background from the config and journal in the working directory, a
+// default config is created if there is none
+func openTestNode(t *testing.T, logger *slog.Logger) *Node {
+	n, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	go func() {
+		err := n.Open(nil)
+		if err != nil {
+			t.Fatalf("Failed to open node: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	return n
+}
+
+// writeTestConfig writes a node config to the working directory
+func writeTestConfig(t *testing.T, config *Config) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatalf("Failed to marshal config data: %v", err)
+	}
+
+	if err = os.WriteFile(ConfigFile, data, 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+}
+
+// dialTestNode connects to a node and authenticates with the shared key
+func dialTestNode(t *testing.T, address string) *net.TCPConn {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", address)
+	if err != nil {
+		t.Fatalf("Failed to resolve address: %v", err)
+	}
+
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+
+	if resp := sendTestCommand(t, conn, fmt.Sprintf("NAUTH %x", sha256.Sum256([]byte("test-key")))); resp != "OK authenticated\r\n" {
+		t.Fatalf("Expected 'OK authenticated', got %q", resp)
+	}
+
+	return conn
+}
+
+// sendTestCommand writes a command and returns the response
+func sendTestCommand(t *testing.T, conn *net.TCPConn, command string) string {
+	_, err := conn.Write([]byte(command + "\r\n"))
+	if err != nil {
+		t.Fatalf("Failed to write command: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+
+	return string(buf[:n])
+}
@@ -31,17 +31,33 @@ package nodereplica
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"log/slog"
 	"net"
 	"os"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"supermassive/hlc"
+	"supermassive/instance/keyspace"
 	"supermassive/journal"
+	"supermassive/network/client"
 	"supermassive/network/server"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
 	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/tombstone"
+	"supermassive/storage/vector"
+	"supermassive/storage/versions"
 	"supermassive/utility"
 	"sync"
 	"time"
@@ -53,24 +69,56 @@ const ConfigFile = ".nodereplica"
 // JournalFile is the node replica journal file
 const JournalFile = ".journal"
 
+// SnapshotJournalFile is the journal a snapshot of the primary node is written to until it replaces the journal
+const SnapshotJournalFile = ".journal.snapshot"
+
+// NodeConfigFile is the config file a promoted replica leaves for the node it restarts as
+const NodeConfigFile = ".node"
+
+// ContactTimeout is how long the replica goes without a batch from its primary node before it counts itself behind by
+// the time since the last one, the primary node sends a batch at least every second while it is up
+const ContactTimeout = 3 * time.Second
+
 // Config is the node configurations
 type Config struct {
-	MaxMemoryThreshold uint64         `yaml:"max-memory-threshold"` // Max memory threshold for the node replica
-	ServerConfig       *server.Config `yaml:"server-config"`        // Node replica server configs
+	MaxMemoryThreshold uint64           `yaml:"max-memory-threshold"`   // Max memory threshold for the node replica
+	ServerConfig       *server.Config   `yaml:"server-config"`          // Node replica server configs
+	OrderedIndex       bool             `yaml:"ordered-index"`          // Keep keys in lexicographic order for RANGE and PREFIX
+	Versions           []*versions.Rule `yaml:"versions"`               // Keys keeping old versions for point-in-time reads
+	TombstoneGrace     int              `yaml:"tombstone-grace-period"` // Seconds deleted keys keep their tombstone, default 86400
+}
+
+// NodeConfig is the config of the node a replica is promoted to, the replica config with the keys only a node has
+// Queue settings the node config leaves out take their defaults
+type NodeConfig struct {
+	Config              `yaml:",inline"`
+	HealthCheckInterval int              `yaml:"health-check-interval"` // Health check interval of the read replicas
+	ReadReplicas        []*client.Config `yaml:"read-replicas"`         // Read replica configs
 }
 
 // NodeReplica is the main struct for the node replica
 type NodeReplica struct {
-	Config     *Config              // Is the node replica configuration
-	Server     *server.Server       // Is the node replica server
-	Logger     *slog.Logger         // Is the logger for the node replica
-	SharedKey  string               // Is the shared key for the node replica
-	Storage    *hashtable.HashTable // Is the storage for the node replica
-	Journal    *journal.Journal     // Is the journal for the node replica
-	Lock       *sync.RWMutex        // Is the lock for the node replica
-	MaxMemory  uint64               // Is the max memory for the system
-	ConfigLock *sync.RWMutex        // Is the lock for the config
-	Wd         string               // Is the working directory
+	Config        *Config                    // Is the node replica configuration
+	Server        *server.Server             // Is the node replica server
+	Logger        *slog.Logger               // Is the logger for the node replica
+	SharedKey     string                     // Is the shared key for the node replica
+	Storage       *hashtable.HashTable       // Is the storage for the node replica
+	Journal       *journal.Journal           // Is the journal for the node replica
+	Lock          *sync.RWMutex              // Is the lock for the node replica
+	MaxMemory     uint64                     // Is the max memory for the system
+	ConfigLock    *sync.RWMutex              // Is the lock for the config
+	Wd            string                     // Is the working directory
+	VectorIndexes map[string]*vector.Index   // Are the vector indexes by name
+	TextIndexes   map[string]*fulltext.Index // Are the full-text indexes by name
+	History       *versions.History          // Are the old versions of keys
+	Tombstones    *tombstone.Set             // Are the tombstones of deleted keys
+	Clock         *hlc.Clock                 // Assigns the versions of writes
+	Promoted      chan struct{}              // Is closed once the replica was promoted by the cluster and closed
+	Opened        chan struct{}              // Is closed once the replica recovered its journal, before its server starts
+	PositionLock  *sync.Mutex                // Is the lock for the position of the primary node below
+	Head          uint64                     // Is the sequence number of the last write journaled by the primary node as of the last batch relayed
+	Behind        time.Time                  // Is when the primary node relayed the oldest write the replica has not applied, zero when caught up
+	Contact       time.Time                  // Is when the primary node last relayed a batch, when the replica was created until then
 }
 
 // ServerConnectionHandler is the handler for the server connections
@@ -80,6 +128,15 @@ type ServerConnectionHandler struct {
 	ReadTimeout int          // Defined read timeout for the handler
 }
 
+// snapshot is a snapshot of the storage of the primary node being loaded
+type snapshot struct {
+	Seq        uint64               // Is the sequence number of the primary node the snapshot was taken at
+	Storage    *hashtable.HashTable // Is the storage the snapshot is loaded into
+	Journal    *journal.Journal     // Is the journal the snapshot is written to
+	History    *versions.History    // Are the old versions of keys in the snapshot
+	Tombstones *tombstone.Set       // Are the tombstones of deleted keys in the snapshot
+}
+
 // New creates a new node replica instance
 func New(logger *slog.Logger, sharedKey string) (*NodeReplica, error) {
 	if logger == nil {
@@ -95,7 +152,7 @@ func New(logger *slog.Logger, sharedKey string) (*NodeReplica, error) {
 		return nil, err
 	}
 
-	return &NodeReplica{Logger: logger, SharedKey: sharedKey, Storage: hashtable.New(), Lock: &sync.RWMutex{}, MaxMemory: maxMem, ConfigLock: &sync.RWMutex{}}, nil
+	return &NodeReplica{Logger: logger, SharedKey: sharedKey, Storage: hashtable.New(), Lock: &sync.RWMutex{}, MaxMemory: maxMem, ConfigLock: &sync.RWMutex{}, VectorIndexes: make(map[string]*vector.Index), TextIndexes: make(map[string]*fulltext.Index), Promoted: make(chan struct{}), Opened: make(chan struct{}), PositionLock: &sync.Mutex{}, Contact: time.Now()}, nil
 }
 
 // Open opens a new node replica instance
@@ -150,12 +207,36 @@ func (nr *NodeReplica) Open(dir *string) error {
 		return err
 	}
 
+	nr.History, err = versions.New(nr.Config.Versions)
+	if err != nil {
+		return err
+	}
+
+	nr.Tombstones = tombstone.New(tombstone.GracePeriod(nr.Config.TombstoneGrace))
+
+	// Writes are versioned with a hybrid logical clock so copies of a key on different nodes compare deterministically
+	nr.Clock = hlc.NewClock(hlc.NodeID(nr.Config.ServerConfig.Address))
+	nr.Storage.SetClock(nr.Clock)
+
 	// We recover from journal
-	// Populates the in-memory storage with the journal data
-	if err = nr.Journal.Recover(nr.Storage); err != nil {
+	// Populates the in-memory storage with the journal data, old versions and tombstones of keys are rebuilt as their writes are replayed
+	if err = nr.Journal.RecoverWith(nr.Storage, nr.replayEntry); err != nil {
 		return err
 	}
 
+	// Vector index graphs are not journaled, we rebuild them from the recovered vectors
+	nr.VectorIndexes = vector.Rebuild(nr.Storage)
+
+	// Full-text postings are not journaled either, we rebuild them from the recovered values
+	nr.TextIndexes = fulltext.Rebuild(nr.Storage)
+
+	// The ordered index is built once from the recovered keys rather than on every replayed write
+	if nr.Config.OrderedIndex {
+		nr.Storage.EnableOrderedIndex()
+	}
+
+	close(nr.Opened)
+
 	// We start the server
 	err = nr.Server.Start()
 	if err != nil {
@@ -216,6 +297,8 @@ func createDefaultConfigFile(wd string) (*Config, error) {
 
 	config := &Config{
 		MaxMemoryThreshold: 75,
+		OrderedIndex:       true,
+		TombstoneGrace:     tombstone.DefaultGracePeriod,
 		ServerConfig: &server.Config{
 			Address:     "localhost:4002",
 			UseTLS:      false,
@@ -246,36 +329,62 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 	// Create a buffer for receiving data
 	buffer := make([]byte, h.BufferSize)
 	var tempBuffer []byte // Temporary buffer to store data (larger than buffer)
+	var commands [][]byte // Complete commands read but not handled yet, the primary pipelines relayed writes
 
 	authenticated := false // Is the connection authenticated?
 
+	var loading *snapshot // Is the snapshot the primary node is sending, nil if none
+	defer func() {
+		if loading != nil {
+			h.NodeReplica.abortSnapshot(loading)
+		}
+	}()
+
 	for {
 
-		_ = conn.SetReadDeadline(time.Time{}) // Unlimit the read deadline
+		if len(commands) == 0 {
+			_ = conn.SetReadDeadline(time.Time{}) // Unlimit the read deadline
 
-		n, err := conn.Read(buffer)
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				h.NodeReplica.Logger.Warn("connection timeout", "remote_addr", conn.RemoteAddr())
-			} else {
-				h.NodeReplica.Logger.Warn("read error", "error", err, "remote_addr", conn.RemoteAddr())
+			n, err := conn.Read(buffer)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					h.NodeReplica.Logger.Warn("connection timeout", "remote_addr", conn.RemoteAddr())
+				} else {
+					h.NodeReplica.Logger.Warn("read error", "error", err, "remote_addr", conn.RemoteAddr())
+				}
+				return
 			}
-			return
-		}
 
-		// Append the read data to the temporary buffer
-		tempBuffer = append(tempBuffer, buffer[:n]...)
+			// Append the read data to the temporary buffer
+			tempBuffer = append(tempBuffer, buffer[:n]...)
 
-		// Check if the command is complete (ends with \r\n)
-		if !bytes.HasSuffix(tempBuffer, []byte("\r\n")) {
-			continue
+			// Check if the command is complete (ends with \r\n)
+			if !bytes.HasSuffix(tempBuffer, []byte("\r\n")) {
+				continue
+			}
+
+			// Several commands can arrive at once, each is handled in turn
+			commands = bytes.Split(bytes.TrimSuffix(tempBuffer, []byte("\r\n")), []byte("\r\n"))
+			tempBuffer = nil // Reset the temporary buffer for the next command
 		}
 
-		// Process the complete command
-		command := tempBuffer
-		tempBuffer = nil // Reset the temporary buffer for the next command
+		// Process the next complete command
+		command := commands[0]
+		commands = commands[1:]
 
-		command = bytes.TrimSuffix(command, []byte("\r\n"))
+		var err error
+
+		// SEQ <sequence number> <command> is a write relayed by the primary node, it is journaled under the sequence
+		// number of the primary node so the replica resumes syncing after the last write it applied
+		if authenticated && bytes.HasPrefix(command, []byte("SEQ ")) {
+			fields := bytes.SplitN(command, []byte(" "), 3)
+			if len(fields) == 3 {
+				if seq, err := strconv.ParseUint(string(fields[1]), 10, 64); err == nil {
+					h.NodeReplica.follow(seq)
+					command = fields[2]
+				}
+			}
+		}
 
 		switch {
 		// Handle primary to this node replica authentication
@@ -328,20 +437,15 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			h.NodeReplica.Lock.Lock()
-
-			// Because this is a replica we send over SYNCFROM <last journal page number>
+			// Because this is a replica we send over SYNCFROM <sequence number>, the last write of the primary we applied
 			// We know the connected should be a primary node
-			// The primary will now send us missing pages
-			_, err = conn.Write([]byte(fmt.Sprintf("SYNCFROM %d\r\n", h.NodeReplica.Journal.Pager.LastPage())))
+			// The primary will now send us the writes after it
+			_, err = conn.Write([]byte(fmt.Sprintf("SYNCFROM %d\r\n", h.NodeReplica.journalSeq())))
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				h.NodeReplica.Lock.Unlock()
 				return
 			}
 
-			h.NodeReplica.Lock.Unlock()
-
 		case strings.HasPrefix(string(command), "DONESYNC"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
@@ -363,14 +467,7 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				return
 			}
 
-		case strings.HasPrefix(string(command), "PING"):
-			_, err = conn.Write([]byte("OK PONG\r\n"))
-			if err != nil {
-				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-
-		case strings.HasPrefix(string(command), "REGX"):
+		case strings.HasPrefix(string(command), "SNAPSHOTENTRY"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -380,47 +477,37 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// Check for optional offset and limit
-			// Can be REGX <pattern> <offset> <limit>
-			// or REGX <pattern>
-			var offset, limit *int
-			if len(strings.Split(string(command), " ")) > 2 {
-				*offset, _ = strconv.Atoi(strings.Split(string(command), " ")[2])
-				*limit, _ = strconv.Atoi(strings.Split(string(command), " ")[3])
-			}
-
-			pattern := strings.Split(string(command), " ")[1]
-
-			var results [][]byte
-
-			// We acquire read lock
-			h.NodeReplica.Lock.RLock()
-			entries, err := h.NodeReplica.Storage.GetWithRegex(pattern, offset, limit)
+			// SNAPSHOTENTRY <base64 encoded journal entry>
+			err = h.NodeReplica.applySnapshotEntry(loading, strings.TrimPrefix(string(command), "SNAPSHOTENTRY "))
 			if err != nil {
 				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					h.NodeReplica.Lock.RUnlock()
 					return
 				}
-				h.NodeReplica.Lock.RUnlock()
 				continue
 			}
 
-			for i, entry := range entries {
-				if i == 0 {
-					results = append(results, []byte(fmt.Sprintf("OK %s %s %s\r\n", entry.Timestamp.Format(time.RFC3339), entry.Key, entry.Value)))
-				} else {
-					results = append(results, []byte(fmt.Sprintf("%s %s %s\r\n", entry.Timestamp.Format(time.RFC3339), entry.Key, entry.Value)))
-				}
-
+			_, err = conn.Write([]byte("OK\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
 			}
 
-			// We release read lock
-			h.NodeReplica.Lock.RUnlock()
+		case strings.HasPrefix(string(command), "RESTOREENTRY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-			if len(results) == 0 {
-				_, err = conn.Write([]byte("ERR no results found\r\n"))
+			// RESTOREENTRY <base64 encoded journal entry> is a write of the primary node with the version it was written with
+			err = h.NodeReplica.restoreEntry(strings.TrimPrefix(string(command), "RESTOREENTRY "))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -428,14 +515,13 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We join all results into a single byte slice
-			_, err = conn.Write(bytes.Join(results, []byte("")))
+			_, err = conn.Write([]byte("OK\r\n"))
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
 
-		case strings.HasPrefix(string(command), "PUT"):
+		case strings.HasPrefix(string(command), "SNAPSHOTDONE"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -445,9 +531,8 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			if h.NodeReplica.MemoryCheck() == false {
-				// We are out of memory
-				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+			if loading == nil {
+				_, err = conn.Write([]byte("ERR no snapshot in progress\r\n"))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -455,27 +540,27 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We put the data
-			key := strings.Split(string(command), " ")[1]
-			value := strings.Join(strings.Split(string(command), " ")[2:], " ")
-
-			go func() {
-				err := h.NodeReplica.Journal.Append(key, value, journal.PUT)
+			// The loaded snapshot replaces the storage and journal of the replica at once
+			err = h.NodeReplica.loadSnapshot(loading)
+			loading = nil
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
-					h.NodeReplica.Logger.Warn("journal append error", "error", err)
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
 				}
-			}()
+				continue
+			}
 
-			h.NodeReplica.Lock.Lock()
-			h.NodeReplica.Storage.Put(key, value)
-			h.NodeReplica.Lock.Unlock()
+			h.NodeReplica.Logger.Info("snapshot loaded from primary", "remote_addr", conn.RemoteAddr(), "journal_seq", h.NodeReplica.journalSeq())
 
-			_, err = conn.Write([]byte("OK key-value written\r\n"))
+			_, err = conn.Write([]byte("OK snapshot loaded\r\n"))
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-		case strings.HasPrefix(string(command), "GET"):
+
+		case strings.HasPrefix(string(command), "SNAPSHOT"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -485,28 +570,54 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We get the data
-			key := strings.Split(string(command), " ")[1]
-			h.NodeReplica.Lock.RLock()
-			value, ts, ok := h.NodeReplica.Storage.Get(key)
-			h.NodeReplica.Lock.RUnlock()
+			// SNAPSHOT <sequence number>
+			// The primary node cannot resume syncing us from our sequence number, it sends a snapshot of its storage
+			// which is loaded into a new storage while the current one keeps serving reads
+			if loading != nil {
+				h.NodeReplica.abortSnapshot(loading)
+				loading = nil
+			}
 
-			if ok {
-				// Format time in RFC3339
-				// OK 2021-09-01T12:00:00Z key value
-				_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, value)))
+			loading, err = h.NodeReplica.startSnapshot(strings.TrimPrefix(string(command), "SNAPSHOT "))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
-			} else {
-				_, err = conn.Write([]byte("ERR key not found\r\n"))
+				continue
+			}
+
+			_, err = conn.Write([]byte("OK\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "PING"):
+			_, err = conn.Write([]byte("OK PONG\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "ROLE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
-		case strings.HasPrefix(string(command), "DEL"):
+
+			_, err = conn.Write([]byte("OK replica\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "ACKPOS"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -516,35 +627,40 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			// We delete the data
-			key := strings.Split(string(command), " ")[1]
-
-			go func() {
-				err := h.NodeReplica.Journal.Append(key, "", journal.DEL)
-				if err != nil {
-					h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			// The primary ends a batch of relayed writes with ACKPOS <last journaled write> <milliseconds since the first
+			// write after the batch was relayed>, the writes before it are applied once it is answered
+			if fields := strings.Fields(string(command)); len(fields) == 3 {
+				head, headErr := strconv.ParseUint(fields[1], 10, 64)
+				behind, behindErr := strconv.ParseInt(fields[2], 10, 64)
+				if headErr == nil && behindErr == nil {
+					h.NodeReplica.position(head, time.Duration(behind)*time.Millisecond)
 				}
-			}()
-
-			h.NodeReplica.Lock.Lock()
-			ok := h.NodeReplica.Storage.Delete(key)
-			h.NodeReplica.Lock.Unlock()
+			}
 
-			if ok {
+			_, err = conn.Write([]byte(fmt.Sprintf("ACK %d\r\n", h.NodeReplica.journalSeq())))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
 
-				_, err = conn.Write([]byte("OK key-value deleted\r\n"))
-				if err != nil {
-					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					return
-				}
-			} else {
-				_, err = conn.Write([]byte("ERR key-value not found\r\n"))
+		case strings.HasPrefix(string(command), "JOURNALPOS"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
-		case strings.HasPrefix(string(command), "INCR"):
+
+			// The cluster promotes the replica furthest along in the journal of its primary
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %d\r\n", h.NodeReplica.journalSeq())))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "LAG"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -554,11 +670,17 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			key := strings.Split(string(command), " ")[1] // We get incrementing key
+			// OK <applied sequence number> <writes behind> <milliseconds behind>, the cluster skips lagging replicas on reads
+			applied, entries, lag := h.NodeReplica.lag()
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %d %d %d\r\n", applied, entries, lag.Milliseconds())))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
 
-			// We check if we have incrementing value
-			if len(strings.Split(string(command), " ")) < 3 {
-				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+		case strings.HasPrefix(string(command), "PROMOTE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
@@ -566,35 +688,28 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			go func() {
-				err = h.NodeReplica.Journal.Append(key, strings.Split(string(command), " ")[2], journal.PUT)
-				if err != nil {
-					h.NodeReplica.Logger.Warn("journal append error", "error", err)
-				}
-			}()
-
-			h.NodeReplica.Lock.Lock()
-			val, ts, err := h.NodeReplica.Storage.Incr(key, strings.Split(string(command), " ")[2])
+			// PROMOTE <health check interval> <base64 encoded read replica configs>
+			err = h.NodeReplica.promote(strings.Fields(string(command))[1:])
 			if err != nil {
-				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					h.NodeReplica.Lock.Unlock()
 					return
 				}
-				h.NodeReplica.Lock.Unlock()
 				continue
 			}
 
-			h.NodeReplica.Lock.Unlock()
-
-			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, val)))
+			_, err = conn.Write([]byte("OK promoted\r\n"))
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
 			}
 
-		case strings.HasPrefix(string(command), "DECR"):
+			// The replica closes once this connection is done, the process restarts it as a node
+			go h.NodeReplica.stepDown()
+
+			return
+
+		case strings.HasPrefix(string(command), "REGX"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -604,55 +719,62 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			key := strings.Split(string(command), " ")[1] // We get decrementing key
+			// Check for optional offset and limit
+			// Can be REGX <pattern> <offset> <limit>
+			// or REGX <pattern>
+			var offset, limit *int
+			if len(strings.Split(string(command), " ")) > 2 {
+				*offset, _ = strconv.Atoi(strings.Split(string(command), " ")[2])
+				*limit, _ = strconv.Atoi(strings.Split(string(command), " ")[3])
+			}
 
-			// We check if we have a decrementing value
-			if len(strings.Split(string(command), " ")) < 3 {
-				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+			pattern := strings.Split(string(command), " ")[1]
+
+			var results [][]byte
+
+			// We acquire read lock
+			h.NodeReplica.Lock.RLock()
+			entries, err := h.NodeReplica.Storage.GetWithRegex(pattern, offset, limit)
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					h.NodeReplica.Lock.RUnlock()
 					return
 				}
+				h.NodeReplica.Lock.RUnlock()
 				continue
 			}
 
-			go func() {
-				err = h.NodeReplica.Journal.Append(key, strings.Split(string(command), " ")[2], journal.PUT)
-				if err != nil {
-					h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			for i, entry := range entries {
+				if i == 0 {
+					results = append(results, []byte(fmt.Sprintf("OK %s %s %s\r\n", entry.Version, entry.Key, entry.Value)))
+				} else {
+					results = append(results, []byte(fmt.Sprintf("%s %s %s\r\n", entry.Version, entry.Key, entry.Value)))
 				}
-			}()
 
-			h.NodeReplica.Lock.Lock()
+			}
 
-			val, ts, err := h.NodeReplica.Storage.Decr(key, strings.Split(string(command), " ")[2])
-			if err != nil {
-				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+			// We release read lock
+			h.NodeReplica.Lock.RUnlock()
+
+			if len(results) == 0 {
+				_, err = conn.Write([]byte("ERR no results found\r\n"))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-					h.NodeReplica.Lock.Unlock()
 					return
 				}
-				h.NodeReplica.Lock.Unlock()
 				continue
 			}
 
-			h.NodeReplica.Lock.Unlock()
-
-			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", ts.Format(time.RFC3339), key, val)))
-			if err != nil {
-				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
-				return
-			}
-		case strings.HasPrefix(string(command), "QUIT"):
-			_, err = conn.Write([]byte("OK see ya later\r\n"))
+			// We join all results into a single byte slice
+			_, err = conn.Write(bytes.Join(results, []byte("")))
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
 
-			return
-		case strings.HasPrefix(string(command), "STAT"):
+		case strings.HasPrefix(string(command), "PUT"):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -662,20 +784,59 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			storageStats := h.NodeReplica.Journal.Pager.Stats()
-			hashtableStats := h.NodeReplica.Storage.Stats()
-
-			// We create one byte array for response
-			var response []byte
-			response = append(response, []byte("OK\r\n")...)
-			response = append(response, []byte(fmt.Sprintf("DISK\r\n"))...)
-			for k, v := range storageStats {
-				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			if h.NodeReplica.MemoryCheck() == false {
+				// We are out of memory
+				_, err = conn.Write([]byte("ERR out of memory\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
 			}
 
-			response = append(response, []byte(fmt.Sprintf("MEMORY\r\n"))...)
-			for k, v := range hashtableStats {
-				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			// We put the data
+			key := strings.Split(string(command), " ")[1]
+			value := strings.Join(strings.Split(string(command), " ")[2:], " ")
+
+			version := h.NodeReplica.Clock.Now()
+
+			h.NodeReplica.Lock.Lock()
+
+			// The write is journaled under the sequence number it was relayed with before the next write is read
+			_, err = h.NodeReplica.Journal.AppendVersion(key, value, journal.PUT, version)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			}
+
+			h.NodeReplica.Storage.PutVersion(key, value, version)
+			h.NodeReplica.updateTextIndexes(key)
+			h.NodeReplica.recordVersion(key, time.Time{})
+			h.NodeReplica.Lock.Unlock()
+
+			_, err = conn.Write([]byte("OK key-value written\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SETBIT"), strings.HasPrefix(string(command), "GETBIT"), strings.HasPrefix(string(command), "BITCOUNT"), strings.HasPrefix(string(command), "BITDUMP"), strings.HasPrefix(string(command), "BITSTORE"),
+			strings.HasPrefix(string(command), "PFADD"), strings.HasPrefix(string(command), "PFCOUNT"), strings.HasPrefix(string(command), "PFDUMP"), strings.HasPrefix(string(command), "PFSTORE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.NodeReplica.analyticsCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
 			}
 
 			_, err = conn.Write(response)
@@ -683,8 +844,32 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
+		case strings.HasPrefix(string(command), "TS."):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-		case strings.HasPrefix(string(command), "RCNF"):
+			response, err := h.NodeReplica.timeSeriesCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "JSON."):
 			if !authenticated {
 				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
 				if err != nil {
@@ -694,64 +879,1957 @@ func (h *ServerConnectionHandler) HandleConnection(conn net.Conn) {
 				continue
 			}
 
-			err = h.NodeReplica.ReloadConfig()
+			response, err := h.NodeReplica.documentCommand(string(command))
 			if err != nil {
-				_, err = conn.Write([]byte("ERR reload error\r\n"))
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
 				if err != nil {
 					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 					return
 				}
+				continue
 			}
 
-			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
+			_, err = conn.Write(response)
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
+		case strings.HasPrefix(string(command), "VCREATE"), strings.HasPrefix(string(command), "VADD"), strings.HasPrefix(string(command), "VSEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-		default:
-			_, err = conn.Write([]byte("ERR unknown command\r\n"))
+			response, err := h.NodeReplica.vectorCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
 			if err != nil {
 				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
 				return
 			}
-		}
+		case strings.HasPrefix(string(command), "FT.CREATE"), strings.HasPrefix(string(command), "SEARCH"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	}
-}
+			response, err := h.NodeReplica.textCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-// MemoryCheck checks the memory usage of the node replica
-// true for ok (not out of memory), false for out of memory
-func (nr *NodeReplica) MemoryCheck() bool {
-	// Get the current memory usage
-	currentMemoryUsage := utility.GetCurrentMemoryUsage()
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "RANGE"), strings.HasPrefix(string(command), "PREFIX"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	// Calculate the percentage of current memory usage relative to nr.MaxMemory
-	memoryUsagePercentage := (float64(currentMemoryUsage) / float64(nr.MaxMemory)) * 100
+			response, err := h.NodeReplica.orderedCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	// We compare it with the MaxMemoryThreshold set in Config
-	if memoryUsagePercentage > float64(nr.Config.MaxMemoryThreshold) {
-		return false
-	}
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "SCAN"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	return true
-}
+			response, err := h.NodeReplica.scanCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-// ReloadConfig reloads node replica config file
-func (nr *NodeReplica) ReloadConfig() error {
-	nr.ConfigLock.Lock()
-	defer nr.ConfigLock.Unlock()
-	// We open the existing config file
-	config, err := openExistingConfigFile(nr.Wd)
-	if err != nil {
-		return err
-	}
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "AGG"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	// We update the node replica config
-	nr.Config = config
+			response, err := h.NodeReplica.aggCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	// We update the server config
-	nr.Server.Config = config.ServerConfig
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "HISTORY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
 
-	return nil
+			response, err := h.NodeReplica.historyCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "TOMBSTONES"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.NodeReplica.tombstonesCommand(strings.Fields(string(command)))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUERY"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response, err := h.NodeReplica.queryCommand(string(command))
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "GET"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We get the data
+			key := strings.Split(string(command), " ")[1]
+
+			// GET <key> AT <timestamp> reads the version that was current at the time
+			if args := strings.Fields(string(command)); len(args) == 4 && strings.ToUpper(args[2]) == "AT" {
+				response, err := h.NodeReplica.getAtCommand(key, args[3])
+				if err != nil {
+					response = []byte(fmt.Sprintf("ERR %s\r\n", err.Error()))
+				}
+
+				_, err = conn.Write(response)
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+			h.NodeReplica.Lock.RLock()
+			value, version, ok := h.NodeReplica.Storage.GetVersion(key)
+			notFound := h.NodeReplica.deletedError(key, errors.New("key not found"))
+			h.NodeReplica.Lock.RUnlock()
+
+			// Bitmaps, hyperloglogs, time series, vector and full-text indexes exist on several nodes at once
+			switch value.(type) {
+			case *bitmap.Bitmap, *hyperloglog.HyperLogLog, *timeseries.Series, *vector.Index, *fulltext.Index:
+				_, err = conn.Write([]byte("ERR wrong type\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			if ok {
+				// The version is the hybrid logical clock timestamp of the write so copies on different nodes can be ordered
+				// OK 2021-09-01T12:00:00.123456789Z/0/1a2b3c4d key value
+				_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, value)))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			} else {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", notFound.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+		case strings.HasPrefix(string(command), "DEL"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// We delete the data
+			key := strings.Split(string(command), " ")[1]
+
+			// A delete is versioned by the clock like a write, the version is journaled as the value of the entry.
+			// DEL <key> <version> deletes a stale copy, its tombstone is dated with the version of the copy so it does
+			// not win against the newer copy kept on another node.  DEL <key> MOVED deletes a copy moved to another
+			// node without a tombstone
+			deletedAt := h.NodeReplica.Clock.Now()
+			if args := strings.Fields(string(command)); len(args) == 3 {
+				if version, err := hlc.Parse(args[2]); err == nil {
+					deletedAt = version
+				} else if args[2] == journal.Moved {
+					deletedAt = hlc.Timestamp{}
+				}
+			}
+
+			journaled := journal.Moved
+			if !deletedAt.IsZero() {
+				journaled = deletedAt.String()
+			}
+
+			h.NodeReplica.Lock.Lock()
+
+			_, err = h.NodeReplica.Journal.AppendVersion(key, journaled, journal.DEL, deletedAt)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			}
+
+			ok := h.NodeReplica.Storage.Delete(key)
+			if journaled != journal.Moved {
+				h.NodeReplica.Tombstones.Add(key, deletedAt)
+				h.NodeReplica.recordVersion(key, deletedAt.Time())
+			}
+			h.NodeReplica.updateTextIndexes(key)
+			h.NodeReplica.Lock.Unlock()
+
+			if ok {
+
+				_, err = conn.Write([]byte("OK key-value deleted\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			} else {
+				_, err = conn.Write([]byte("ERR key-value not found\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+		case strings.HasPrefix(string(command), "INCR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := strings.Split(string(command), " ")[1] // We get incrementing key
+
+			// We check if we have incrementing value
+			if len(strings.Split(string(command), " ")) < 3 {
+				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			h.NodeReplica.Lock.Lock()
+			_, version, _ := h.NodeReplica.Storage.GetVersion(key) // The version the value is incremented from
+			val, _, err := h.NodeReplica.Storage.Incr(key, strings.Split(string(command), " ")[2])
+			if err != nil {
+				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", h.NodeReplica.deletedError(key, err).Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					h.NodeReplica.Lock.Unlock()
+					return
+				}
+				h.NodeReplica.Lock.Unlock()
+				continue
+			}
+
+			_, written, _ := h.NodeReplica.Storage.GetVersion(key)
+			_, err = h.NodeReplica.Journal.AppendVersion(key, strings.Split(string(command), " ")[2], journal.INCR, written)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			}
+
+			h.NodeReplica.updateTextIndexes(key)
+			h.NodeReplica.recordVersion(key, time.Time{})
+			h.NodeReplica.Lock.Unlock()
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, val)))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "DECR"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			key := strings.Split(string(command), " ")[1] // We get decrementing key
+
+			// We check if we have a decrementing value
+			if len(strings.Split(string(command), " ")) < 3 {
+				_, err := conn.Write([]byte("ERR invalid value\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			h.NodeReplica.Lock.Lock()
+
+			_, version, _ := h.NodeReplica.Storage.GetVersion(key) // The version the value is decremented from
+			val, _, err := h.NodeReplica.Storage.Decr(key, strings.Split(string(command), " ")[2])
+			if err != nil {
+				_, err := conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", h.NodeReplica.deletedError(key, err).Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					h.NodeReplica.Lock.Unlock()
+					return
+				}
+				h.NodeReplica.Lock.Unlock()
+				continue
+			}
+
+			_, written, _ := h.NodeReplica.Storage.GetVersion(key)
+			_, err = h.NodeReplica.Journal.AppendVersion(key, strings.Split(string(command), " ")[2], journal.DECR, written)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("journal append error", "error", err)
+			}
+
+			h.NodeReplica.updateTextIndexes(key)
+			h.NodeReplica.recordVersion(key, time.Time{})
+			h.NodeReplica.Lock.Unlock()
+
+			_, err = conn.Write([]byte(fmt.Sprintf("OK %s %s %s\r\n", version, key, val)))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XADD"), strings.HasPrefix(string(command), "XGROUP"), strings.HasPrefix(string(command), "XDELIVER"), strings.HasPrefix(string(command), "XACK"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// Stream writes come from the primary with resolved ids
+			h.NodeReplica.Lock.Lock()
+			err = h.NodeReplica.applyStream(strings.Fields(string(command)))
+			h.NodeReplica.Lock.Unlock()
+
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte("OK\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XRANGE"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XRANGE <key> <start|-> <end|+> [COUNT <n>]
+			args := strings.Fields(string(command))
+			if len(args) != 4 && (len(args) != 6 || !strings.EqualFold(args[4], "COUNT")) {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			start, end, err := stream.ParseRange(args[2], args[3])
+			count := 0
+			if err == nil && len(args) == 6 {
+				count, err = strconv.Atoi(args[5])
+			}
+
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			h.NodeReplica.Lock.RLock()
+
+			s, err := stream.Load(h.NodeReplica.Storage, args[1], false)
+			if err != nil {
+				h.NodeReplica.Lock.RUnlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response := []byte("OK\r\n")
+			for _, entry := range s.Range(start, end, count) {
+				response = append(response, []byte(fmt.Sprintf("%s\r\n", entry))...)
+			}
+
+			h.NodeReplica.Lock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "XPENDING"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// XPENDING <key> <group>
+			args := strings.Fields(string(command))
+			if len(args) != 3 {
+				_, err = conn.Write([]byte("ERR invalid command\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			h.NodeReplica.Lock.RLock()
+
+			s, err := stream.Load(h.NodeReplica.Storage, args[1], false)
+			var pending []*stream.PendingEntry
+			if err == nil {
+				pending, err = s.Pending(args[2])
+			}
+
+			if err != nil {
+				h.NodeReplica.Lock.RUnlock()
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			response := []byte(fmt.Sprintf("OK %d\r\n", len(pending)))
+			for _, pe := range pending {
+				response = append(response, []byte(fmt.Sprintf("%s %s %d %d\r\n", pe.ID, pe.Consumer, time.Since(pe.DeliveredAt).Milliseconds(), pe.Deliveries))...)
+			}
+
+			h.NodeReplica.Lock.RUnlock()
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QPUSH"), strings.HasPrefix(string(command), "QRESERVE"), strings.HasPrefix(string(command), "QEXPIRE"), strings.HasPrefix(string(command), "QACK"), strings.HasPrefix(string(command), "QNACK"), strings.HasPrefix(string(command), "QDEAD"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// Queue writes come from the primary with resolved ids and times
+			h.NodeReplica.Lock.Lock()
+			err = h.NodeReplica.applyQueue(string(command))
+			h.NodeReplica.Lock.Unlock()
+
+			if err != nil {
+				_, err = conn.Write([]byte(fmt.Sprintf("ERR %s\r\n", err.Error())))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			_, err = conn.Write([]byte("OK\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		case strings.HasPrefix(string(command), "QUIT"):
+			_, err = conn.Write([]byte("OK see ya later\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+			return
+		case strings.HasPrefix(string(command), "STAT"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			// The storage and journal are swapped when a snapshot is loaded
+			h.NodeReplica.Lock.RLock()
+			storageStats := h.NodeReplica.Journal.Pager.Stats()
+			hashtableStats := h.NodeReplica.Storage.Stats()
+			h.NodeReplica.Lock.RUnlock()
+
+			// We create one byte array for response
+			var response []byte
+			response = append(response, []byte("OK\r\n")...)
+			response = append(response, []byte(fmt.Sprintf("DISK\r\n"))...)
+			for k, v := range storageStats {
+				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			}
+
+			response = append(response, []byte(fmt.Sprintf("MEMORY\r\n"))...)
+			for k, v := range hashtableStats {
+				response = append(response, []byte(fmt.Sprintf("\t%s %v\r\n", k, v))...)
+			}
+
+			applied, entries, lag := h.NodeReplica.lag()
+			response = append(response, []byte("REPLICATION\r\n")...)
+			response = append(response, []byte(fmt.Sprintf("\tapplied %d\r\n\tlag_entries %d\r\n\tlag_seconds %.3f\r\n", applied, entries, lag.Seconds()))...)
+
+			_, err = conn.Write(response)
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		case strings.HasPrefix(string(command), "RCNF"):
+			if !authenticated {
+				_, err = conn.Write([]byte("ERR not authenticated\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+				continue
+			}
+
+			err = h.NodeReplica.ReloadConfig()
+			if err != nil {
+				_, err = conn.Write([]byte("ERR reload error\r\n"))
+				if err != nil {
+					h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+					return
+				}
+			}
+
+			_, err = conn.Write([]byte("OK configs reloaded\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+
+		default:
+			_, err = conn.Write([]byte("ERR unknown command\r\n"))
+			if err != nil {
+				h.NodeReplica.Logger.Warn("write error", "error", err, "remote_addr", conn.RemoteAddr())
+				return
+			}
+		}
+
+	}
+}
+
+// MemoryCheck checks the memory usage of the node replica
+// true for ok (not out of memory), false for out of memory
+func (nr *NodeReplica) MemoryCheck() bool {
+	// Get the current memory usage
+	currentMemoryUsage := utility.GetCurrentMemoryUsage()
+
+	// Calculate the percentage of current memory usage relative to nr.MaxMemory
+	memoryUsagePercentage := (float64(currentMemoryUsage) / float64(nr.MaxMemory)) * 100
+
+	// We compare it with the MaxMemoryThreshold set in Config
+	if memoryUsagePercentage > float64(nr.Config.MaxMemoryThreshold) {
+		return false
+	}
+
+	return true
+}
+
+// promote turns the replica into a node writing to the read replicas with the configs sent by the cluster
+// The node config is written from the replica config and the replica config is removed, so the process restarts as a
+// node recovering from the replica's journal
+func (nr *NodeReplica) promote(args []string) error {
+	if len(args) != 2 {
+		return errors.New("invalid command")
+	}
+
+	interval, err := strconv.Atoi(args[0])
+	if err != nil || interval <= 0 {
+		return errors.New("invalid health check interval")
+	}
+
+	// The read replica configs are sent as base64 encoded yaml, with TLS and timeouts as in the cluster config
+	data, err := base64.StdEncoding.DecodeString(args[1])
+	if err != nil {
+		return errors.New("invalid read replica configs")
+	}
+
+	var replicas []*client.Config
+	if err = yaml.Unmarshal(data, &replicas); err != nil {
+		return errors.New("invalid read replica configs")
+	}
+
+	nr.ConfigLock.RLock()
+	config := &NodeConfig{Config: *nr.Config, HealthCheckInterval: interval, ReadReplicas: replicas}
+	nr.ConfigLock.RUnlock()
+
+	data, err = yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), NodeConfigFile), data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), ConfigFile))
+}
+
+// stepDown closes a promoted replica dropping open connections so the node can take over its address and journal
+// Promoted is closed once done
+func (nr *NodeReplica) stepDown() {
+	err := nr.Server.Close()
+	if err != nil {
+		nr.Logger.Warn("error closing server", "error", err)
+	}
+
+	nr.Lock.Lock()
+	err = nr.Journal.Close()
+	if err != nil {
+		nr.Logger.Warn("error closing journal", "error", err)
+	}
+	nr.Lock.Unlock()
+
+	nr.Logger.Info("read replica promoted to node", "node", nr.Config.ServerConfig.Address)
+
+	close(nr.Promoted)
+}
+
+// startSnapshot starts loading a snapshot of the primary node taken at the sequence number
+// The snapshot is written to its own journal so the current journal is kept until the snapshot is loaded
+func (nr *NodeReplica) startSnapshot(rawSeq string) (*snapshot, error) {
+	seq, err := strconv.ParseUint(rawSeq, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid sequence number")
+	}
+
+	path := fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), SnapshotJournalFile)
+
+	// A snapshot left by an interrupted transfer is discarded
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	history, err := versions.New(nr.Config.Versions)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := journal.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Snapshot entries are journaled under the sequence number of the snapshot
+	j.Follow(seq)
+
+	storage := hashtable.New()
+	storage.SetClock(nr.Clock)
+
+	tombstones := tombstone.New(tombstone.GracePeriod(nr.Config.TombstoneGrace))
+
+	return &snapshot{Seq: seq, Storage: storage, Journal: j, History: history, Tombstones: tombstones}, nil
+}
+
+// decodeEntry decodes a base64 encoded journal entry sent by the primary node
+func decodeEntry(encoded string) (*journal.Entry, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return journal.Deserialize(data)
+}
+
+// restoreEntry applies a base64 encoded journal entry of a write the primary node journaled and journals it
+func (nr *NodeReplica) restoreEntry(encoded string) error {
+	e, err := decodeEntry(encoded)
+	if err != nil {
+		return err
+	}
+
+	nr.Lock.Lock()
+	defer nr.Lock.Unlock()
+
+	return nr.applyEntry(e)
+}
+
+// applyEntry applies a journal entry of the primary node with the version it was written with and journals it
+// The indexes, old versions and tombstones of the key are kept up to date like for a write of the replica.  The caller
+// holds the write lock
+func (nr *NodeReplica) applyEntry(e *journal.Entry) error {
+	err := journal.Apply(nr.Storage, e)
+	if err != nil {
+		return err
+	}
+
+	// The clock is kept ahead of the versions of the primary node, writes after a promotion are newer
+	if !e.Version.IsZero() {
+		nr.Clock.Update(e.Version)
+	}
+
+	value, _, _ := nr.Storage.Get(e.Key)
+	switch v := value.(type) {
+	case *vector.Index:
+		if e.Op == journal.VCREATE {
+			for _, entry := range nr.Storage.Traverse(nil) {
+				if vec, ok := entry.Value.(*vector.Vector); ok && v.Covers(entry.Key) && len(vec.Values) == v.Dim {
+					_ = v.Add(entry.Key, vec)
+				}
+			}
+			nr.VectorIndexes[e.Key] = v
+		}
+	case *fulltext.Index:
+		if e.Op == journal.FTCREATE {
+			for _, entry := range nr.Storage.Traverse(nil) {
+				if text, ok := entry.Value.(string); ok && v.Covers(entry.Key) {
+					v.Update(entry.Key, text)
+				}
+			}
+			nr.TextIndexes[e.Key] = v
+		}
+	case *vector.Vector:
+		nr.indexVector(e.Key, v)
+	}
+
+	nr.updateTextIndexes(e.Key)
+	nr.replayEntry(e)
+
+	_, err = nr.Journal.AppendVersion(e.Key, e.Value, e.Op, e.Version)
+	return err
+}
+
+// applySnapshotEntry applies a base64 encoded journal entry of a snapshot to its storage and journals it
+// The old versions and tombstones the primary node sends ahead of the current values are recorded like on recovery
+func (nr *NodeReplica) applySnapshotEntry(s *snapshot, encoded string) error {
+	if s == nil {
+		return errors.New("no snapshot in progress")
+	}
+
+	e, err := decodeEntry(encoded)
+	if err != nil {
+		return err
+	}
+
+	err = journal.Apply(s.Storage, e)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Journal.AppendVersion(e.Key, e.Value, e.Op, e.Version)
+	if err != nil {
+		return err
+	}
+
+	// Current values are sent without the time they were journaled, they are journaled now
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	keyspace.ReplayEntry(s.Storage, s.History, s.Tombstones, e)
+
+	return nil
+}
+
+// loadSnapshot swaps the storage and journal of the replica for the loaded snapshot
+// Indexes are rebuilt from the snapshot, old versions and tombstones of keys were recorded as it was loaded
+func (nr *NodeReplica) loadSnapshot(s *snapshot) error {
+	if nr.Config.OrderedIndex {
+		s.Storage.EnableOrderedIndex()
+	}
+
+	vectorIndexes := vector.Rebuild(s.Storage)
+	textIndexes := fulltext.Rebuild(s.Storage)
+
+	nr.Lock.Lock()
+	defer nr.Lock.Unlock()
+
+	err := s.Journal.Close()
+	if err != nil {
+		nr.abortSnapshot(s)
+		return err
+	}
+
+	err = nr.Journal.Close()
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), JournalFile)
+
+	// The snapshot journal replaces the journal at once, a replica restarting recovers either one in full
+	renameErr := os.Rename(fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), SnapshotJournalFile), path)
+
+	// A journal that cannot be reopened leaves the closed one in place, writes to it fail until the replica restarts
+	j, err := journal.Open(path)
+	if err != nil {
+		return err
+	}
+	nr.Journal = j
+
+	if renameErr != nil {
+		// We keep the storage and journal the replica had
+		return renameErr
+	}
+
+	// An empty snapshot leaves no entry to resume from
+	nr.Journal.Follow(s.Seq)
+
+	nr.Storage = s.Storage
+	nr.VectorIndexes = vectorIndexes
+	nr.TextIndexes = textIndexes
+	nr.History = s.History
+	nr.Tombstones = s.Tombstones
+
+	return nil
+}
+
+// journalSeq returns the sequence number of the last write of the primary node the replica journaled
+// The journal is read under the lock as loading a snapshot replaces it
+func (nr *NodeReplica) journalSeq() uint64 {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return nr.Journal.Seq()
+}
+
+// follow journals the writes relayed by the primary node from now on under its sequence number
+func (nr *NodeReplica) follow(seq uint64) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	nr.Journal.Follow(seq)
+}
+
+// position records the last write journaled by the primary node and how long ago the first write after the relayed
+// batch was relayed
+func (nr *NodeReplica) position(head uint64, behind time.Duration) {
+	applied := nr.journalSeq()
+
+	nr.PositionLock.Lock()
+	defer nr.PositionLock.Unlock()
+
+	nr.Head = head
+	nr.Contact = time.Now()
+	nr.Behind = time.Time{}
+	if head > applied {
+		nr.Behind = time.Now().Add(-behind)
+	}
+}
+
+// lag returns the sequence number of the last write of the primary node the replica applied, the number of writes it
+// is behind and how long ago the oldest of them was relayed, as of the last batch the primary node relayed.  Without a
+// batch for ContactTimeout the primary node may be down with writes the replica never got, the replica is behind by
+// the time since the last batch
+func (nr *NodeReplica) lag() (uint64, uint64, time.Duration) {
+	applied := nr.journalSeq()
+
+	nr.PositionLock.Lock()
+	defer nr.PositionLock.Unlock()
+
+	var entries uint64
+	var lag time.Duration
+	if nr.Head > applied {
+		entries = nr.Head - applied
+		if !nr.Behind.IsZero() {
+			lag = time.Since(nr.Behind)
+		}
+	}
+
+	if since := time.Since(nr.Contact); since > ContactTimeout && since > lag {
+		lag = since
+	}
+
+	return applied, entries, lag
+}
+
+// abortSnapshot discards a snapshot that was not loaded
+func (nr *NodeReplica) abortSnapshot(s *snapshot) {
+	_ = s.Journal.Close()
+
+	err := os.Remove(fmt.Sprintf("%s%s%s", nr.Wd, string(os.PathSeparator), SnapshotJournalFile))
+	if err != nil && !os.IsNotExist(err) {
+		nr.Logger.Warn("error removing snapshot journal", "error", err)
+	}
+}
+
+// ReloadConfig reloads node replica config file
+func (nr *NodeReplica) ReloadConfig() error {
+	nr.ConfigLock.Lock()
+	defer nr.ConfigLock.Unlock()
+	// We open the existing config file
+	config, err := openExistingConfigFile(nr.Wd)
+	if err != nil {
+		return err
+	}
+
+	// We update the node replica config
+	nr.Config = config
+
+	// We update the server config
+	nr.Server.Config = config.ServerConfig
+
+	return nil
+}
+
+// applyStream applies a stream write relayed from the primary, the caller must hold the write lock
+// Writes that were already applied are skipped as the primary may resend them when syncing
+func (nr *NodeReplica) applyStream(args []string) error {
+	if len(args) < 3 {
+		return errors.New("invalid command")
+	}
+
+	switch args[0] {
+	case "XADD":
+		// XADD <key> <id> <field> <value>...
+		if len(args) < 5 {
+			return errors.New("invalid command")
+		}
+
+		id, err := stream.ParseID(args[2], 0)
+		if err != nil {
+			return err
+		}
+
+		s, err := stream.Load(nr.Storage, args[1], true)
+		if err != nil {
+			return err
+		}
+
+		if !s.LastID.Less(id) {
+			return nil
+		}
+
+		err = s.Add(id, args[3:])
+		if err != nil {
+			return err
+		}
+
+		_, err = nr.Journal.Append(args[1], strings.Join(args[2:], " "), journal.XADD)
+		return err
+	case "XGROUP":
+		// XGROUP CREATE <key> <group> <id>
+		// XGROUP DESTROY <key> <group>
+		if len(args) < 4 {
+			return errors.New("invalid command")
+		}
+
+		switch args[1] {
+		case "CREATE":
+			if len(args) != 5 {
+				return errors.New("invalid command")
+			}
+
+			id, err := stream.ParseID(args[4], 0)
+			if err != nil {
+				return err
+			}
+
+			s, err := stream.Load(nr.Storage, args[2], true)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := s.Groups[args[3]]; ok {
+				return nil
+			}
+
+			err = s.CreateGroup(args[3], id)
+			if err != nil {
+				return err
+			}
+
+			_, err = nr.Journal.Append(args[2], strings.Join(args[3:], " "), journal.XGROUPCREATE)
+			return err
+		case "DESTROY":
+			s, err := stream.Load(nr.Storage, args[2], false)
+			if err != nil || !s.DestroyGroup(args[3]) {
+				return nil
+			}
+
+			_, err = nr.Journal.Append(args[2], args[3], journal.XGROUPDESTROY)
+			return err
+		}
+	case "XDELIVER":
+		// XDELIVER <key> <group> <consumer> <unix ms> <id>...
+		if len(args) < 6 {
+			return errors.New("invalid command")
+		}
+
+		ms, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			return errors.New("invalid delivery time")
+		}
+
+		ids, err := stream.ParseIDs(args[5:])
+		if err != nil {
+			return err
+		}
+
+		s, err := stream.Load(nr.Storage, args[1], false)
+		if err != nil {
+			return err
+		}
+
+		g, ok := s.Groups[args[2]]
+		if !ok {
+			return errors.New("group not found")
+		}
+
+		// We skip deliveries we already have
+		at := time.UnixMilli(ms)
+		var deliver []stream.ID
+		for _, id := range ids {
+			if pe, ok := g.Pending[id.String()]; ok && !pe.DeliveredAt.Before(at) {
+				continue
+			}
+			deliver = append(deliver, id)
+		}
+
+		if len(deliver) == 0 {
+			return nil
+		}
+
+		err = s.Deliver(args[2], args[3], deliver, at)
+		if err != nil {
+			return err
+		}
+
+		// Only the deliveries applied are journaled, replaying the others would count them twice
+		value := strings.Join(args[2:5], " ")
+		for _, id := range deliver {
+			value += " " + id.String()
+		}
+
+		_, err = nr.Journal.Append(args[1], value, journal.XDELIVER)
+		return err
+	case "XACK":
+		// XACK <key> <group> <id>...
+		if len(args) < 4 {
+			return errors.New("invalid command")
+		}
+
+		ids, err := stream.ParseIDs(args[3:])
+		if err != nil {
+			return err
+		}
+
+		s, err := stream.Load(nr.Storage, args[1], false)
+		if err != nil {
+			return nil
+		}
+
+		acked, err := s.Ack(args[2], ids)
+		if err != nil || acked == 0 {
+			return nil
+		}
+
+		_, err = nr.Journal.Append(args[1], strings.Join(args[2:], " "), journal.XACK)
+		return err
+	}
+
+	return errors.New("invalid command")
+}
+
+// applyQueue applies a queue write relayed from the primary, the caller must hold the write lock
+// Writes that were already applied are skipped as the primary may resend them when syncing
+func (nr *NodeReplica) applyQueue(command string) error {
+	// <op> <key> <value>, the value of a push may contain spaces
+	args := strings.SplitN(command, " ", 3)
+	if len(args) != 3 {
+		return errors.New("invalid command")
+	}
+
+	op, key, value := args[0], args[1], args[2]
+
+	q, err := queue.Load(nr.Storage, key, true)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case "QPUSH":
+		id, payload, _ := strings.Cut(value, " ")
+		if q.Has(id) {
+			return nil
+		}
+
+		err = q.Push(id, payload)
+		if err != nil {
+			return err
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QPUSH)
+		return err
+	case "QRESERVE":
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return errors.New("invalid command")
+		}
+
+		ms, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return errors.New("invalid visibility time")
+		}
+
+		// A job that is not ready was already reserved or removed
+		if _, err = q.Reserve(fields[0], time.UnixMilli(ms)); err != nil {
+			return nil
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QRESERVE)
+		return err
+	case "QEXPIRE":
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("invalid expire time")
+		}
+
+		if q.Expire(time.UnixMilli(ms)) == 0 {
+			return nil
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QEXPIRE)
+		return err
+	case "QACK":
+		if !q.Ack(value) {
+			return nil
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QACK)
+		return err
+	case "QNACK":
+		if !q.Nack(value) {
+			return nil
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QNACK)
+		return err
+	case "QDEAD":
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return errors.New("invalid command")
+		}
+
+		dead, err := queue.Load(nr.Storage, fields[0], true)
+		if err != nil {
+			return err
+		}
+
+		job, ok := q.Remove(fields[1])
+		if !ok {
+			return nil
+		}
+
+		err = dead.Push(job.ID, job.Payload)
+		if err != nil {
+			return err
+		}
+
+		_, err = nr.Journal.Append(key, value, journal.QDEAD)
+		return err
+	}
+
+	return errors.New("invalid command")
+}
+
+// vectorCommand runs a vector command
+// Writes are validated by the primary, an index that already exists is kept so a resync can replay its creation
+func (nr *NodeReplica) vectorCommand(args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	switch args[0] {
+	case "VCREATE":
+		// VCREATE <index> DIM <dimension> METRIC <metric> PATTERN <pattern>
+		ix, err := vector.ParseCreateArgs(key, args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		if _, err = vector.LoadIndex(nr.Storage, key); err == nil {
+			return []byte("OK index created\r\n"), nil
+		}
+
+		for _, entry := range nr.Storage.Traverse(nil) {
+			if v, ok := entry.Value.(*vector.Vector); ok && ix.Covers(entry.Key) && len(v.Values) == ix.Dim {
+				_ = ix.Add(entry.Key, v)
+			}
+		}
+
+		nr.Storage.Put(key, ix)
+		nr.VectorIndexes[key] = ix
+
+		_, err = nr.Journal.Append(key, fmt.Sprintf("%d %s %s", ix.Dim, ix.Metric, ix.Pattern), journal.VCREATE)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK index created\r\n"), nil
+	case "VADD":
+		// VADD <key> <component>...
+		v, err := vector.Parse(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		nr.Storage.Put(key, v)
+		nr.indexVector(key, v)
+
+		_, err = nr.Journal.Append(key, v.String(), journal.VADD)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK vector added\r\n"), nil
+	case "VSEARCH":
+		// VSEARCH <index> <k> <component>... [EXACT] [EF <candidates>]
+		k, q, exact, ef, err := vector.ParseSearchArgs(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		ix, err := vector.LoadIndex(nr.Storage, key)
+		if err != nil {
+			return nil, err
+		}
+
+		var results []vector.Result
+		if exact {
+			results, err = ix.Exact(nr.Storage, q.Values, k)
+		} else {
+			results, err = ix.Search(nr.Storage, q.Values, k, ef)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(float64(r.Distance), 'f', -1, 32))...)
+		}
+
+		return response, nil
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// indexVector adds a vector to the indexes covering its key while the caller holds the write lock
+// Indexes deleted or overwritten in storage are forgotten
+func (nr *NodeReplica) indexVector(key string, v *vector.Vector) {
+	for name, ix := range nr.VectorIndexes {
+		if value, _, ok := nr.Storage.Get(name); !ok || value != ix {
+			delete(nr.VectorIndexes, name)
+			continue
+		}
+
+		if ix.Covers(key) {
+			_ = ix.Add(key, v)
+		}
+	}
+}
+
+// documentCommand runs a JSON document command
+// The primary relays every update as a set of a concrete path
+func (nr *NodeReplica) documentCommand(command string) ([]byte, error) {
+	args := strings.SplitN(command, " ", 4)
+	if len(args) < 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	path := document.Path{}
+	if len(args) > 2 {
+		var err error
+		path, err = document.ParsePath(args[2])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch args[0] {
+	case "JSON.SET":
+		// JSON.SET <key> <path> <json>
+		if len(args) != 4 {
+			return nil, errors.New("invalid command")
+		}
+
+		value, err := document.Parse(args[3])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		if path.IsRoot() {
+			nr.Storage.Put(key, document.New(value))
+		} else {
+			d, err := document.Load(nr.Storage, key)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, err = d.Set(path, value); err != nil {
+				return nil, err
+			}
+		}
+
+		_, err = nr.Journal.Append(key, fmt.Sprintf("%s %s", args[2], args[3]), journal.JSONSET)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK\r\n"), nil
+	case "JSON.GET":
+		// JSON.GET <key> [<path>]
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		d, err := document.Load(nr.Storage, key)
+		if err != nil {
+			return nil, err
+		}
+
+		return []byte(fmt.Sprintf("OK %s\r\n", document.Encode(d.Get(path)))), nil
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// timeSeriesCommand runs a time series command
+// Writes are relayed from the primary with resolved timestamps and applied idempotently so a resync can replay them
+func (nr *NodeReplica) timeSeriesCommand(args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	switch args[0] {
+	case "TS.CREATE":
+		// TS.CREATE <key> RETENTION <ms>
+		if len(args) != 4 {
+			return nil, errors.New("invalid command")
+		}
+
+		retention, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid retention")
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		s, err := timeseries.Load(nr.Storage, key, true)
+		if err != nil {
+			return nil, err
+		}
+		s.Retention = retention
+
+		_, err = nr.Journal.Append(key, args[3], journal.TSCREATE)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK series created\r\n"), nil
+	case "TS.ADD":
+		// TS.ADD <key> <timestamp ms> <value>
+		if len(args) != 4 {
+			return nil, errors.New("invalid command")
+		}
+
+		timestamp, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid timestamp")
+		}
+
+		value, err := strconv.ParseFloat(args[3], 64)
+		if err != nil {
+			return nil, errors.New("invalid value")
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		s, err := timeseries.Load(nr.Storage, key, true)
+		if err != nil {
+			return nil, err
+		}
+
+		// A sample we already have is skipped
+		if last, ok := s.Last(); ok && timestamp <= last.Timestamp {
+			return []byte(fmt.Sprintf("OK %d\r\n", timestamp)), nil
+		}
+
+		err = s.Add(timestamp, value)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = nr.Journal.Append(key, strings.Join(args[2:], " "), journal.TSADD)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n", timestamp)), nil
+	case "TS.RANGE":
+		// TS.RANGE <key> <from> <to> [AGGREGATION <type> <bucket ms>]
+		from, to, agg, err := timeseries.ParseRangeArgs(args[2:])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		s, err := timeseries.Load(nr.Storage, key, false)
+		if err != nil {
+			return nil, err
+		}
+
+		samples := s.Range(from, to)
+		if agg != nil {
+			samples = agg.Apply(samples)
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(samples)))
+		for _, sample := range samples {
+			response = append(response, fmt.Sprintf("%d %s\r\n", sample.Timestamp, timeseries.FormatValue(sample.Value))...)
+		}
+
+		return response, nil
+	case "TS.MRANGE":
+		// TS.MRANGE <from> <to> <pattern> [AGGREGATION <type> <bucket ms>]
+		if len(args) < 4 {
+			return nil, errors.New("invalid command")
+		}
+
+		from, to, agg, err := timeseries.ParseRangeArgs(append([]string{args[1], args[2]}, args[4:]...))
+		if err != nil {
+			return nil, err
+		}
+
+		re, err := regexp.Compile(args[3])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		entries := nr.Storage.Traverse(func(entry hashtable.Entry) bool {
+			_, ok := entry.Value.(*timeseries.Series)
+			return ok && re.MatchString(entry.Key)
+		})
+
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+		var lines []string
+		for _, entry := range entries {
+			samples := entry.Value.(*timeseries.Series).Range(from, to)
+			if agg != nil {
+				samples = agg.Apply(samples)
+			}
+
+			for _, sample := range samples {
+				lines = append(lines, fmt.Sprintf("%s %d %s\r\n", entry.Key, sample.Timestamp, timeseries.FormatValue(sample.Value)))
+			}
+		}
+
+		return []byte(fmt.Sprintf("OK %d\r\n%s", len(lines), strings.Join(lines, ""))), nil
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// analyticsCommand runs a bitmap or hyperloglog command
+// Writes are relayed from the primary, BITOP and PFMERGE arrive as a store of their result
+func (nr *NodeReplica) analyticsCommand(args []string) ([]byte, error) {
+	if len(args) < 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+
+	switch args[0] {
+	case "SETBIT":
+		// SETBIT <key> <offset> <0|1>
+		if len(args) != 4 {
+			return nil, errors.New("invalid command")
+		}
+
+		offset, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid bit offset")
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		b, err := bitmap.Load(nr.Storage, key, true)
+		if err != nil {
+			return nil, err
+		}
+
+		old, err := b.SetBit(offset, args[3] == "1")
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = nr.Journal.Append(key, strings.Join(args[2:], " "), journal.SETBIT)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		if old {
+			return []byte("OK 1\r\n"), nil
+		}
+		return []byte("OK 0\r\n"), nil
+	case "GETBIT", "BITCOUNT", "BITDUMP":
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		b, err := bitmap.Load(nr.Storage, key, false)
+		if err != nil {
+			if err.Error() == "key not found" && args[0] != "BITDUMP" {
+				return []byte("OK 0\r\n"), nil
+			}
+			return nil, err
+		}
+
+		switch {
+		case args[0] == "BITDUMP":
+			return []byte(fmt.Sprintf("OK %s\r\n", b.Encode())), nil
+		case args[0] == "GETBIT" && len(args) == 3:
+			offset, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil {
+				return nil, errors.New("invalid bit offset")
+			}
+
+			if b.GetBit(offset) {
+				return []byte("OK 1\r\n"), nil
+			}
+			return []byte("OK 0\r\n"), nil
+		case args[0] == "BITCOUNT" && len(args) == 2:
+			return []byte(fmt.Sprintf("OK %d\r\n", b.Count(0, -1))), nil
+		case args[0] == "BITCOUNT" && len(args) == 4:
+			start, end, err := bitmap.ParseRange(args[2], args[3])
+			if err != nil {
+				return nil, err
+			}
+			return []byte(fmt.Sprintf("OK %d\r\n", b.Count(start, end))), nil
+		}
+	case "BITSTORE", "PFSTORE":
+		// BITSTORE <key> <base64 bitmap>
+		// PFSTORE <key> <base64 registers>
+		if len(args) != 3 {
+			return nil, errors.New("invalid command")
+		}
+
+		var value interface{}
+		var err error
+		op := journal.BITSTORE
+		if args[0] == "BITSTORE" {
+			value, err = bitmap.Decode(args[2])
+		} else {
+			value, err = hyperloglog.Decode(args[2])
+			op = journal.PFSTORE
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		nr.Storage.Put(key, value)
+
+		_, err = nr.Journal.Append(key, args[2], op)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK\r\n"), nil
+	case "PFADD":
+		// PFADD <key> <element>...
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		h, err := hyperloglog.Load(nr.Storage, key, true)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, element := range args[2:] {
+			h.Add([]byte(element))
+		}
+
+		_, err = nr.Journal.Append(key, strings.Join(args[2:], " "), journal.PFADD)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK\r\n"), nil
+	case "PFCOUNT", "PFDUMP":
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		union := hyperloglog.New()
+		for _, k := range args[1:] {
+			h, err := hyperloglog.Load(nr.Storage, k, false)
+			if err != nil {
+				if err.Error() == "key not found" {
+					continue
+				}
+				return nil, err
+			}
+			union.Merge(h)
+		}
+
+		if args[0] == "PFDUMP" {
+			return []byte(fmt.Sprintf("OK %s\r\n", union.Encode())), nil
+		}
+		return []byte(fmt.Sprintf("OK %d\r\n", union.Count())), nil
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// queryCommand runs QUERY, see keyspace.Query
+func (nr *NodeReplica) queryCommand(command string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.Query(nr.Storage, command)
+}
+
+// aggCommand runs AGG, see keyspace.Aggregate
+func (nr *NodeReplica) aggCommand(args []string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.Aggregate(nr.Storage, args)
+}
+
+// recordVersion adds the value of a key after a write to its history while the caller holds the write lock, see
+// keyspace.RecordVersion
+func (nr *NodeReplica) recordVersion(key string, at time.Time) {
+	keyspace.RecordVersion(nr.Storage, nr.History, key, at)
+}
+
+// replayEntry records the versions and tombstones of a key as its writes are replayed from the journal, see
+// keyspace.ReplayEntry
+func (nr *NodeReplica) replayEntry(e *journal.Entry) {
+	keyspace.ReplayEntry(nr.Storage, nr.History, nr.Tombstones, e)
+}
+
+// deletedError reports a key not found that has a tombstone as deleted, see keyspace.DeletedError
+// The caller holds the lock
+func (nr *NodeReplica) deletedError(key string, err error) error {
+	return keyspace.DeletedError(nr.Tombstones, key, err)
+}
+
+// tombstonesCommand runs TOMBSTONES, see keyspace.Tombstones
+func (nr *NodeReplica) tombstonesCommand(args []string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.Tombstones(nr.Storage, nr.Tombstones, args)
+}
+
+// getAtCommand runs GET <key> AT <timestamp>, see keyspace.GetAt
+func (nr *NodeReplica) getAtCommand(key, at string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.GetAt(nr.Storage, nr.History, key, at)
+}
+
+// historyCommand runs HISTORY, see keyspace.History
+func (nr *NodeReplica) historyCommand(args []string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.History(nr.Storage, nr.History, args)
+}
+
+// scanCommand runs SCAN, see keyspace.Scan
+func (nr *NodeReplica) scanCommand(args []string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.Scan(nr.Storage, args)
+}
+
+// orderedCommand runs an ordered key command, see keyspace.Ordered
+func (nr *NodeReplica) orderedCommand(args []string) ([]byte, error) {
+	nr.Lock.RLock()
+	defer nr.Lock.RUnlock()
+
+	return keyspace.Ordered(nr.Storage, args)
+}
+
+// textCommand runs a full-text command
+// An index that already exists is kept so a resync can replay its creation
+func (nr *NodeReplica) textCommand(command string) ([]byte, error) {
+	args := strings.SplitN(command, " ", 3)
+	if len(args) < 2 {
+		return nil, errors.New("invalid command")
+	}
+
+	key := args[1]
+	if len(args) == 2 {
+		args = append(args, "")
+	}
+
+	switch args[0] {
+	case "FT.CREATE":
+		// FT.CREATE <index> PATTERN <pattern>
+		ix, err := fulltext.ParseCreateArgs(key, strings.Fields(args[2]))
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.Lock()
+		defer nr.Lock.Unlock()
+
+		if _, err = fulltext.LoadIndex(nr.Storage, key); err == nil {
+			return []byte("OK index created\r\n"), nil
+		}
+
+		for _, entry := range nr.Storage.Traverse(nil) {
+			if value, ok := entry.Value.(string); ok && ix.Covers(entry.Key) {
+				ix.Update(entry.Key, value)
+			}
+		}
+
+		nr.Storage.Put(key, ix)
+		nr.TextIndexes[key] = ix
+
+		_, err = nr.Journal.Append(key, ix.Pattern, journal.FTCREATE)
+		if err != nil {
+			nr.Logger.Warn("journal append error", "error", err)
+		}
+
+		return []byte("OK index created\r\n"), nil
+	case "SEARCH":
+		// SEARCH <index> "<query>" [LIMIT <n>]
+		terms, limit, err := fulltext.ParseSearchArgs(args[2])
+		if err != nil {
+			return nil, err
+		}
+
+		nr.Lock.RLock()
+		defer nr.Lock.RUnlock()
+
+		ix, err := fulltext.LoadIndex(nr.Storage, key)
+		if err != nil {
+			return nil, err
+		}
+
+		results, err := ix.Search(nr.Storage, terms, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		response := []byte(fmt.Sprintf("OK %d\r\n", len(results)))
+		for _, r := range results {
+			response = append(response, fmt.Sprintf("%s %s\r\n", r.Key, strconv.FormatFloat(r.Score, 'f', -1, 64))...)
+		}
+
+		return response, nil
+	}
+
+	return nil, errors.New("invalid command")
+}
+
+// updateTextIndexes updates the full-text indexes covering a key after a write while the caller holds the write lock
+// Indexes deleted or overwritten in storage are forgotten
+func (nr *NodeReplica) updateTextIndexes(key string) {
+	value, _, ok := nr.Storage.Get(key)
+	text, isText := value.(string)
+
+	for name, ix := range nr.TextIndexes {
+		if stored, _, found := nr.Storage.Get(name); !found || stored != ix {
+			delete(nr.TextIndexes, name)
+			continue
+		}
+
+		if !ix.Covers(key) {
+			continue
+		}
+
+		if ok && isText {
+			ix.Update(key, text)
+		} else {
+			ix.Remove(key)
+		}
+	}
 }
@@ -40,7 +40,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"supermassive/journal"
 	"supermassive/network/server"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/stream"
 	"testing"
 	"time"
 )
@@ -1059,3 +1062,210 @@ func TestServerConfigRefresh(t *testing.T) {
 
 	nr.Close()
 }
+
+func TestServerPipelined(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// We create a new node replica
+	nr, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	// We open in background
+	go func() {
+		err := nr.Open(nil)
+		if err != nil {
+			t.Fatalf("Failed to open node replica: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".nodereplica")
+	defer nr.Close()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", "localhost:4002")
+	if err != nil {
+		t.Fatalf("Failed to resolve address: %v", err)
+	}
+
+	// Connect to the address with tcp
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// The primary pipelines a batch of relayed writes followed by ACKPOS in a single write
+	_, err = conn.Write([]byte(fmt.Sprintf("NAUTH %x\r\nSEQ 1 PUT a 1\r\nSEQ 2 PUT b 2\r\nSEQ 3 INCR a 5\r\nACKPOS\r\n", sha256.Sum256([]byte("test-key")))))
+	if err != nil {
+		t.Fatalf("Failed to write commands: %v", err)
+	}
+
+	var responses string
+	buf := make([]byte, 1024)
+	for !strings.HasSuffix(responses, "ACK 3\r\n") {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read responses, got %q: %v", responses, err)
+		}
+		responses += string(buf[:n])
+	}
+
+	if strings.Count(responses, "\r\n") != 5 {
+		t.Errorf("Expected a response per command, got %q", responses)
+	}
+
+	nr.Lock.RLock()
+	a, _, _ := nr.Storage.Get("a")
+	b, _, _ := nr.Storage.Get("b")
+	nr.Lock.RUnlock()
+
+	if fmt.Sprint(a) != "6" || fmt.Sprint(b) != "2" {
+		t.Errorf("Expected a 6 and b 2, got %v and %v", a, b)
+	}
+}
+
+func TestServerLag(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	// We create a new node replica
+	nr, err := New(logger, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	// We open in background
+	go func() {
+		err := nr.Open(nil)
+		if err != nil {
+			t.Fatalf("Failed to open node replica: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	defer os.Remove(".journal")
+	defer os.Remove(".nodereplica")
+	defer nr.Close()
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", "localhost:4002")
+	if err != nil {
+		t.Fatalf("Failed to resolve address: %v", err)
+	}
+
+	// Connect to the address with tcp
+	conn, err := net.DialTCP("tcp", nil, tcpAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	// send writes commands and reads until the response has the marker and ends with a full line
+	send := func(commands, marker string) string {
+		_, err := conn.Write([]byte(commands))
+		if err != nil {
+			t.Fatalf("Failed to write commands: %v", err)
+		}
+
+		var responses string
+		buf := make([]byte, 1024)
+		for !strings.Contains(responses, marker) || !strings.HasSuffix(responses, "\r\n") {
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("Failed to read responses, got %q: %v", responses, err)
+			}
+			responses += string(buf[:n])
+		}
+
+		return responses
+	}
+
+	send(fmt.Sprintf("NAUTH %x\r\n", sha256.Sum256([]byte("test-key"))), "OK authenticated\r\n")
+
+	// The primary journaled 3 writes, the first write after the batch was relayed 2 seconds ago
+	send("SEQ 1 PUT a 1\r\nACKPOS 3 2000\r\n", "ACK 1\r\n")
+
+	var applied, entries, lag int64
+	if _, err := fmt.Sscanf(send("LAG\r\n", "\r\n"), "OK %d %d %d", &applied, &entries, &lag); err != nil {
+		t.Fatalf("Failed to parse lag: %v", err)
+	}
+
+	if applied != 1 || entries != 2 || lag < 2000 || lag > 3000 {
+		t.Errorf("Expected the replica 2 writes and about 2 seconds behind, got %d %d %d", applied, entries, lag)
+	}
+
+	if stats := send("STAT\r\n", "lag_seconds"); !strings.Contains(stats, "\tapplied 1\r\n\tlag_entries 2\r\n") {
+		t.Errorf("Expected the lag in the stats, got %q", stats)
+	}
+
+	// Once the replica applied every write journaled by the primary it is caught up
+	send("SEQ 2 PUT b 2\r\nSEQ 3 PUT c 3\r\nACKPOS 3 0\r\n", "ACK 3\r\n")
+
+	if resp := send("LAG\r\n", "\r\n"); resp != "OK 3 0 0\r\n" {
+		t.Errorf("Expected 'OK 3 0 0', got %q", resp)
+	}
+
+	// A replica not hearing from its primary node falls behind by the time since the last batch
+	nr.PositionLock.Lock()
+	nr.Contact = time.Now().Add(-5 * time.Second)
+	nr.PositionLock.Unlock()
+
+	if _, err := fmt.Sscanf(send("LAG\r\n", "\r\n"), "OK %d %d %d", &applied, &entries, &lag); err != nil {
+		t.Fatalf("Failed to parse lag: %v", err)
+	}
+
+	if applied != 3 || entries != 0 || lag < 5000 || lag > 6000 {
+		t.Errorf("Expected the replica about 5 seconds behind its primary node, got %d %d %d", applied, entries, lag)
+	}
+
+	// The next batch is contact again
+	send("ACKPOS 3 0\r\n", "ACK 3\r\n")
+
+	if resp := send("LAG\r\n", "\r\n"); resp != "OK 3 0 0\r\n" {
+		t.Errorf("Expected 'OK 3 0 0', got %q", resp)
+	}
+}
+
+func TestApplyStreamRedelivery(t *testing.T) {
+	nr, err := New(slog.New(slog.NewTextHandler(os.Stdout, nil)), "test-key")
+	if err != nil {
+		t.Fatalf("Failed to create node replica: %v", err)
+	}
+
+	nr.Journal, err = journal.Open(filepath.Join(t.TempDir(), JournalFile))
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer nr.Journal.Close()
+
+	// The second delivery is relayed again along with a new one, as after a resync
+	for _, command := range []string{"XADD s 1-0 f a", "XADD s 2-0 f b", "XGROUP CREATE s g 0", "XDELIVER s g c 1000 1-0", "XDELIVER s g c 1000 1-0 2-0"} {
+		if err := nr.applyStream(strings.Fields(command)); err != nil {
+			t.Fatalf("Failed to apply %q: %v", command, err)
+		}
+	}
+
+	// Replaying the journal leaves the same deliveries as applying the writes
+	ht := hashtable.New()
+	if err := nr.Journal.Recover(ht); err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	for _, storage := range []*hashtable.HashTable{nr.Storage, ht} {
+		s, err := stream.Load(storage, "s", false)
+		if err != nil {
+			t.Fatalf("Failed to load stream: %v", err)
+		}
+
+		for id, pe := range s.Groups["g"].Pending {
+			if pe.Deliveries != 1 {
+				t.Errorf("Expected %s delivered once, got %d", id, pe.Deliveries)
+			}
+		}
+	}
+}
@@ -31,9 +31,21 @@ package journal
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
 	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
 	"supermassive/storage/pager"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/vector"
 	"sync"
 	"time"
 )
@@ -42,37 +54,157 @@ import (
 type Operation int
 
 // We define the operations that can be stored in the journal
-// We only care about PUT, DEL, INCR, DECR
+// We only care about operations that change state
 // These operations are used to recover the state of a node's hashtable on startup
 const (
 	PUT Operation = iota
 	DEL
 	INCR
 	DECR
+	XADD          // Value is <id> <field> <value>...
+	XGROUPCREATE  // Value is <group> <id>
+	XGROUPDESTROY // Value is <group>
+	XDELIVER      // Value is <group> <consumer> <unix ms> <id>...
+	XACK          // Value is <group> <id>...
+	QPUSH         // Value is <id> <payload>
+	QRESERVE      // Value is <id> <visible at unix ms>
+	QEXPIRE       // Value is <now unix ms>
+	QACK          // Value is <id>
+	QNACK         // Value is <id>
+	QDEAD         // Value is <dead letter key> <id>
+	SETBIT        // Value is <offset> <0|1>
+	BITSTORE      // Value is the base64 encoded bitmap
+	PFADD         // Value is <element>...
+	PFSTORE       // Value is the base64 encoded registers
+	TSCREATE      // Value is <retention ms>
+	TSADD         // Value is <timestamp ms> <value>
+	JSONSET       // Value is <concrete path> <json>
+	VCREATE       // Value is <dimension> <metric> <pattern>
+	VADD          // Value is <component>...
+	FTCREATE      // Value is <pattern>
+	QRESTORE      // Value is <deliveries> <visible at unix ms> <id> <payload>, a visible at of 0 restores a ready job and an empty value an empty queue
 )
 
+// Moved is the value of a DEL entry removing a copy of a key moved to another node, the key lives on so no tombstone is
+// kept for it
+const Moved = "MOVED"
+
 // Entry is a journal entry
 type Entry struct {
-	Key   string    // The key for the entry
-	Value string    // The value for the entry
-	Op    Operation // The operation for the entry
+	Key       string        // The key for the entry
+	Value     string        // The value for the entry
+	Op        Operation     // The operation for the entry
+	Timestamp time.Time     // When the entry was appended, zero for entries written before timestamps were journaled
+	Version   hlc.Timestamp // The version of the value written by PUT, INCR and DECR, zero if not journaled
+	Seq       uint64        // The sequence number of the entry, zero for entries written before sequence numbers were journaled
 }
 
 // Journal is a journal for node and node-replica instances
-// Used to store PUT, DEL, INCR, DECR operations, and recover the state of the hashtable on startup if configured
+// Used to store write operations, and recover the state of the hashtable on startup if configured
 type Journal struct {
-	Pager *pager.Pager // The journals underlying pager
-	Lock  *sync.Mutex  // The journals lock
+	Pager  *pager.Pager // The journals underlying pager
+	Lock   *sync.Mutex  // The journals lock
+	first  uint64       // The sequence number of the first entry
+	seq    uint64       // The sequence number of the last entry
+	follow bool         // Entries are appended with the sequence number set by Follow
 }
 
 // Open opens a journal file
+// Entries appended continue from the sequence number of the last entry in the file
 func Open(filePath string) (*Journal, error) {
 	p, err := pager.Open(filePath, os.O_CREATE|os.O_RDWR, 0777, 1024, true, time.Millisecond*128)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Journal{Pager: p, Lock: &sync.Mutex{}}, nil
+	j := &Journal{Pager: p, Lock: &sync.Mutex{}}
+
+	err = j.Since(0, func(e *Entry) error {
+		if j.first == 0 {
+			j.first = e.Seq
+		}
+		j.seq = e.Seq
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// Seq returns the sequence number of the last entry, 0 if the journal is empty
+func (j *Journal) Seq() uint64 {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+
+	return j.seq
+}
+
+// First returns the sequence number of the first entry, 0 if the journal is empty
+// A journal can be resumed from any sequence number between the one before its first entry and its last
+func (j *Journal) First() uint64 {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+
+	return j.first
+}
+
+// Follow sets the sequence number of the entries appended from then on, rather than numbering them one after another
+// A read replica journals the writes relayed by its primary node under the sequence number of the primary node, so the
+// last sequence number of its journal is the last write of the primary node it applied
+func (j *Journal) Follow(seq uint64) {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+
+	j.seq = seq
+	j.follow = true
+}
+
+// Since calls fn with every entry after a sequence number in journal order, stopping at the first error
+// Entries written before sequence numbers were journaled are numbered by their position.  Each entry is read under the
+// journal lock and fn is called without it, so entries keep being appended while the journal is read.  Entries appended
+// after Since is called are not read
+func (j *Journal) Since(seq uint64, fn func(e *Entry) error) error {
+	var last uint64
+
+	j.Lock.Lock()
+	it := pager.NewIterator(j.Pager)
+	j.Lock.Unlock()
+
+	for {
+		j.Lock.Lock()
+		ok := it.Next()
+		j.Lock.Unlock()
+		if !ok {
+			break
+		}
+
+		data, err := it.Read()
+		if err != nil {
+			break
+		}
+
+		e, err := Deserialize(data)
+		if err != nil {
+			continue
+		}
+
+		if e.Seq == 0 {
+			e.Seq = last + 1
+		}
+		last = e.Seq
+
+		if e.Seq <= seq {
+			continue
+		}
+
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Close closes the journal file
@@ -81,27 +213,49 @@ func (j *Journal) Close() error {
 }
 
 // Append appends an entry to the journal file
-func (j *Journal) Append(key, value string, op Operation) error {
-	e := Entry{Key: key, Value: value, Op: op}
+// Returns the sequence number assigned to the entry
+func (j *Journal) Append(key, value string, op Operation) (uint64, error) {
+	return j.AppendVersion(key, value, op, hlc.Timestamp{})
+}
+
+// AppendVersion appends an entry with the version of the value it writes, the version is restored on recovery
+// Returns the sequence number assigned to the entry, taken under the journal lock so concurrent appends each get their own
+func (j *Journal) AppendVersion(key, value string, op Operation, version hlc.Timestamp) (uint64, error) {
+	j.Lock.Lock()
+	defer j.Lock.Unlock()
+
+	seq := j.seq
+	if !j.follow {
+		seq++
+	}
+
+	e := Entry{Key: key, Value: value, Op: op, Timestamp: time.Now(), Version: version, Seq: seq}
 
 	b, err := Serialize(e)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	j.Lock.Lock()
-	defer j.Lock.Unlock()
-
 	_, err = j.Pager.Write(b)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	if j.first == 0 {
+		j.first = seq
+	}
+	j.seq = seq
+
+	return seq, nil
 }
 
 // Recover reads the journal file and replays the operations to an in-memory hash table
 func (j *Journal) Recover(ht *hashtable.HashTable) error {
+	return j.RecoverWith(ht, nil)
+}
+
+// RecoverWith replays the operations like Recover and calls replayed, if not nil, after each operation is applied
+func (j *Journal) RecoverWith(ht *hashtable.HashTable, replayed func(e *Entry)) error {
 	it := pager.NewIterator(j.Pager)
 	for it.Next() {
 		data, err := it.Read()
@@ -114,27 +268,361 @@ func (j *Journal) Recover(ht *hashtable.HashTable) error {
 			continue
 		}
 
-		switch e.Op {
-		case PUT:
+		if err := Apply(ht, e); err != nil {
+			return err
+		}
+
+		if replayed != nil {
+			replayed(e)
+		}
+	}
+	return nil
+}
+
+// Apply applies a journal entry to a hash table
+func Apply(ht *hashtable.HashTable, e *Entry) error {
+	switch e.Op {
+	case PUT:
+		if e.Version.IsZero() {
 			ht.Put(e.Key, e.Value)
-		case DEL:
-			ht.Delete(e.Key)
-		case INCR:
-			_, _, err := ht.Incr(e.Key, e.Value)
-			if err != nil {
-				return err
-			}
-		case DECR:
-			_, _, err := ht.Decr(e.Key, e.Value)
-			if err != nil {
-				return err
-			}
+		} else {
+			ht.PutVersion(e.Key, e.Value, e.Version)
+		}
+	case DEL:
+		ht.Delete(e.Key)
+	case INCR:
+		value, _, err := ht.Incr(e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		restoreVersion(ht, e, value)
+	case DECR:
+		value, _, err := ht.Decr(e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		restoreVersion(ht, e, value)
+	case XADD, XGROUPCREATE, XGROUPDESTROY, XDELIVER, XACK:
+		if err := recoverStream(ht, e); err != nil {
+			return err
+		}
+	case QPUSH, QRESERVE, QEXPIRE, QACK, QNACK, QDEAD, QRESTORE:
+		if err := recoverQueue(ht, e); err != nil {
+			return err
+		}
+	case SETBIT:
+		if err := recoverSetBit(ht, e); err != nil {
+			return err
+		}
+	case BITSTORE:
+		b, err := bitmap.Decode(e.Value)
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, b)
+	case PFADD:
+		h, err := hyperloglog.Load(ht, e.Key, true)
+		if err != nil {
+			return err
+		}
+
+		for _, element := range strings.Fields(e.Value) {
+			h.Add([]byte(element))
+		}
+	case PFSTORE:
+		h, err := hyperloglog.Decode(e.Value)
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, h)
+	case TSCREATE:
+		retention, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, timeseries.New(retention))
+	case TSADD:
+		if err := recoverTimeSeries(ht, e); err != nil {
+			return err
+		}
+	case JSONSET:
+		if err := recoverDocument(ht, e); err != nil {
+			return err
+		}
+	case VCREATE:
+		// Index graphs are rebuilt from the stored vectors once the journal is replayed, see vector.Rebuild
+		args := strings.Fields(e.Value)
+		if len(args) != 3 {
+			return errors.New("invalid vector index entry")
+		}
+
+		dim, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+
+		ix, err := vector.NewIndex(e.Key, dim, args[1], args[2])
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, ix)
+	case VADD:
+		v, err := vector.Parse(strings.Fields(e.Value))
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, v)
+	case FTCREATE:
+		// Postings are rebuilt from the stored values once the journal is replayed, see fulltext.Rebuild
+		ix, err := fulltext.NewIndex(e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		ht.Put(e.Key, ix)
+	}
+
+	return nil
+}
+
+// recoverStream replays a stream operation to the stream stored under the entry key
+func recoverStream(ht *hashtable.HashTable, e *Entry) error {
+	s, err := stream.Load(ht, e.Key, true)
+	if err != nil {
+		return err
+	}
+
+	args := strings.Fields(e.Value)
+
+	switch e.Op {
+	case XADD:
+		if len(args) < 1 {
+			return errors.New("invalid stream entry")
+		}
+
+		id, err := stream.ParseID(args[0], 0)
+		if err != nil {
+			return err
+		}
+
+		return s.Add(id, args[1:])
+	case XGROUPCREATE:
+		if len(args) != 2 {
+			return errors.New("invalid stream entry")
 		}
 
+		id, err := stream.ParseID(args[1], 0)
+		if err != nil {
+			return err
+		}
+
+		return s.CreateGroup(args[0], id)
+	case XGROUPDESTROY:
+		if len(args) != 1 {
+			return errors.New("invalid stream entry")
+		}
+
+		s.DestroyGroup(args[0])
+	case XDELIVER:
+		if len(args) < 4 {
+			return errors.New("invalid stream entry")
+		}
+
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		ids, err := stream.ParseIDs(args[3:])
+		if err != nil {
+			return err
+		}
+
+		return s.Deliver(args[0], args[1], ids, time.UnixMilli(ms))
+	case XACK:
+		if len(args) < 2 {
+			return errors.New("invalid stream entry")
+		}
+
+		ids, err := stream.ParseIDs(args[1:])
+		if err != nil {
+			return err
+		}
+
+		_, err = s.Ack(args[0], ids)
+		return err
 	}
+
 	return nil
 }
 
+// recoverSetBit replays a set bit operation to the bitmap stored under the entry key
+func recoverSetBit(ht *hashtable.HashTable, e *Entry) error {
+	args := strings.Fields(e.Value)
+	if len(args) != 2 {
+		return errors.New("invalid bitmap entry")
+	}
+
+	offset, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	b, err := bitmap.Load(ht, e.Key, true)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.SetBit(offset, args[1] == "1")
+	return err
+}
+
+// recoverTimeSeries replays a sample to the series stored under the entry key
+func recoverTimeSeries(ht *hashtable.HashTable, e *Entry) error {
+	args := strings.Fields(e.Value)
+	if len(args) != 2 {
+		return errors.New("invalid time series entry")
+	}
+
+	timestamp, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	value, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return err
+	}
+
+	s, err := timeseries.Load(ht, e.Key, true)
+	if err != nil {
+		return err
+	}
+
+	return s.Add(timestamp, value)
+}
+
+// recoverDocument replays a set of a concrete path to the document stored under the entry key
+func recoverDocument(ht *hashtable.HashTable, e *Entry) error {
+	p, data, _ := strings.Cut(e.Value, " ")
+
+	path, err := document.ParsePath(p)
+	if err != nil {
+		return err
+	}
+
+	value, err := document.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	if path.IsRoot() {
+		ht.Put(e.Key, document.New(value))
+		return nil
+	}
+
+	d, err := document.Load(ht, e.Key)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.Set(path, value)
+	return err
+}
+
+// recoverQueue replays a queue operation to the queue stored under the entry key
+func recoverQueue(ht *hashtable.HashTable, e *Entry) error {
+	q, err := queue.Load(ht, e.Key, true)
+	if err != nil {
+		return err
+	}
+
+	switch e.Op {
+	case QPUSH:
+		// The payload may contain spaces
+		id, payload, _ := strings.Cut(e.Value, " ")
+		return q.Push(id, payload)
+	case QRESERVE:
+		args := strings.Fields(e.Value)
+		if len(args) != 2 {
+			return errors.New("invalid queue entry")
+		}
+
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Reserve(args[0], time.UnixMilli(ms))
+		return err
+	case QEXPIRE:
+		ms, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		q.Expire(time.UnixMilli(ms))
+	case QACK:
+		q.Ack(e.Value)
+	case QNACK:
+		q.Nack(e.Value)
+	case QRESTORE:
+		if e.Value == "" {
+			return nil
+		}
+
+		// The payload may contain spaces
+		args := strings.SplitN(e.Value, " ", 4)
+		if len(args) != 4 {
+			return errors.New("invalid queue entry")
+		}
+
+		deliveries, err := strconv.Atoi(args[0])
+		if err != nil {
+			return err
+		}
+
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		job := &queue.Job{ID: args[2], Payload: args[3], Deliveries: deliveries}
+		if ms != 0 {
+			job.VisibleAt = time.UnixMilli(ms)
+		}
+
+		if err := q.Restore(job); err != nil {
+			return err
+		}
+	case QDEAD:
+		args := strings.Fields(e.Value)
+		if len(args) != 2 {
+			return errors.New("invalid queue entry")
+		}
+
+		job, ok := q.Remove(args[1])
+		if !ok {
+			return nil
+		}
+
+		dead, err := queue.Load(ht, args[0], true)
+		if err != nil {
+			return err
+		}
+
+		return dead.Push(job.ID, job.Payload)
+	}
+
+	return nil
+}
+
+// restoreVersion restores the journaled version of the value an entry wrote
+func restoreVersion(ht *hashtable.HashTable, e *Entry, value string) {
+	if !e.Version.IsZero() {
+		ht.PutVersion(e.Key, value, e.Version)
+	}
+}
+
 // Serialize serializes an Entry into a byte slice
 func Serialize(e Entry) ([]byte, error) {
 	var buf bytes.Buffer
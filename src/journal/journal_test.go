@@ -32,9 +32,20 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
 	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/vector"
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestJournal(t *testing.T) {
@@ -48,27 +59,27 @@ func TestJournal(t *testing.T) {
 	defer j.Close()
 
 	// Test Append
-	err = j.Append("key1", "value1", PUT)
+	_, err = j.Append("key1", "value1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
-	err = j.Append("key2", "", DEL)
+	_, err = j.Append("key2", "", DEL)
 	if err != nil {
 		t.Errorf("Failed to append DEL operation: %v", err)
 	}
-	err = j.Append("key3", "0", PUT)
+	_, err = j.Append("key3", "0", PUT)
 	if err != nil {
 		t.Errorf("Failed to append INCR operation: %v", err)
 	}
-	err = j.Append("key4", "1", PUT)
+	_, err = j.Append("key4", "1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append INCR operation: %v", err)
 	}
-	err = j.Append("key3", "1", INCR)
+	_, err = j.Append("key3", "1", INCR)
 	if err != nil {
 		t.Errorf("Failed to append INCR operation: %v", err)
 	}
-	err = j.Append("key4", "1", DECR)
+	_, err = j.Append("key4", "1", DECR)
 	if err != nil {
 		t.Errorf("Failed to append DECR operation: %v", err)
 	}
@@ -110,27 +121,27 @@ func TestJournalBasicOperations(t *testing.T) {
 	defer j.Close()
 
 	// Test Append
-	err = j.Append("key1", "value1", PUT)
+	_, err = j.Append("key1", "value1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
-	err = j.Append("key2", "", DEL)
+	_, err = j.Append("key2", "", DEL)
 	if err != nil {
 		t.Errorf("Failed to append DEL operation: %v", err)
 	}
-	err = j.Append("key3", "0", PUT)
+	_, err = j.Append("key3", "0", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
-	err = j.Append("key4", "1", PUT)
+	_, err = j.Append("key4", "1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
-	err = j.Append("key3", "1", INCR)
+	_, err = j.Append("key3", "1", INCR)
 	if err != nil {
 		t.Errorf("Failed to append INCR operation: %v", err)
 	}
-	err = j.Append("key4", "1", DECR)
+	_, err = j.Append("key4", "1", DECR)
 	if err != nil {
 		t.Errorf("Failed to append DECR operation: %v", err)
 	}
@@ -172,19 +183,19 @@ func TestJournalOverwriteOperations(t *testing.T) {
 	defer j.Close()
 
 	// Test operations that overwrite values
-	err = j.Append("key1", "value1", PUT)
+	_, err = j.Append("key1", "value1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append first PUT operation: %v", err)
 	}
-	err = j.Append("key1", "value2", PUT)
+	_, err = j.Append("key1", "value2", PUT)
 	if err != nil {
 		t.Errorf("Failed to append second PUT operation: %v", err)
 	}
-	err = j.Append("key1", "", DEL)
+	_, err = j.Append("key1", "", DEL)
 	if err != nil {
 		t.Errorf("Failed to append DEL operation: %v", err)
 	}
-	err = j.Append("key1", "value3", PUT)
+	_, err = j.Append("key1", "value3", PUT)
 	if err != nil {
 		t.Errorf("Failed to append third PUT operation: %v", err)
 	}
@@ -214,21 +225,21 @@ func TestJournalIncrDecrOperations(t *testing.T) {
 	defer j.Close()
 
 	// Test INCR/DECR operations
-	err = j.Append("counter", "10", PUT)
+	_, err = j.Append("counter", "10", PUT)
 	if err != nil {
 		t.Errorf("Failed to append initial PUT operation: %v", err)
 	}
 
 	// Series of INCR/DECR operations
 	for i := 0; i < 5; i++ {
-		err = j.Append("counter", "2", INCR)
+		_, err = j.Append("counter", "2", INCR)
 		if err != nil {
 			t.Errorf("Failed to append INCR operation: %v", err)
 		}
 	}
 
 	for i := 0; i < 3; i++ {
-		err = j.Append("counter", "1", DECR)
+		_, err = j.Append("counter", "1", DECR)
 		if err != nil {
 			t.Errorf("Failed to append DECR operation: %v", err)
 		}
@@ -290,7 +301,7 @@ func TestJournalLargeData(t *testing.T) {
 	largeValStr := string(largeValue)
 
 	// Test appending large data
-	err = j.Append(largeKey, largeValStr, PUT)
+	_, err = j.Append(largeKey, largeValStr, PUT)
 	if err != nil {
 		t.Errorf("Failed to append large data: %v", err)
 	}
@@ -318,11 +329,11 @@ func TestJournalReopenAndRecover(t *testing.T) {
 	}
 
 	// Write some data
-	err = j.Append("key1", "value1", PUT)
+	_, err = j.Append("key1", "value1", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
-	err = j.Append("key2", "value2", PUT)
+	_, err = j.Append("key2", "value2", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation: %v", err)
 	}
@@ -342,7 +353,7 @@ func TestJournalReopenAndRecover(t *testing.T) {
 	defer j2.Close()
 
 	// Append more data
-	err = j2.Append("key3", "value3", PUT)
+	_, err = j2.Append("key3", "value3", PUT)
 	if err != nil {
 		t.Errorf("Failed to append PUT operation after reopen: %v", err)
 	}
@@ -518,12 +529,12 @@ func TestJournalConcurrentAppend(t *testing.T) {
 				case 1:
 					// For DEL operations, we don't need a value
 					// First PUT the key, then DEL it
-					err := journal.Append(key, value, PUT)
+					_, err := journal.Append(key, value, PUT)
 					if err != nil {
 						errorChan <- fmt.Errorf("goroutine %d failed to append PUT before DEL: %v", routineID, err)
 						continue
 					}
-					err = journal.Append(key, "", DEL)
+					_, err = journal.Append(key, "", DEL)
 					if err != nil {
 						errorChan <- fmt.Errorf("goroutine %d failed to append DEL operation: %v", routineID, err)
 					}
@@ -538,7 +549,7 @@ func TestJournalConcurrentAppend(t *testing.T) {
 					op = DECR
 				}
 
-				err := journal.Append(key, value, op)
+				_, err := journal.Append(key, value, op)
 				if err != nil {
 					errorChan <- fmt.Errorf("goroutine %d failed to append operation %d: %v", routineID, j, err)
 				}
@@ -574,6 +585,196 @@ func TestJournalConcurrentAppend(t *testing.T) {
 	t.Logf("Recovered %d entries from the journal after concurrent operations", ht.Size())
 }
 
+func TestJournalStreamOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_stream.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		value string
+		op    Operation
+	}{
+		{"1-0 temp 20", XADD},
+		{"2-0 temp 21", XADD},
+		{"3-0 temp 22", XADD},
+		{"workers 0-0", XGROUPCREATE},
+		{"workers alice 1000 1-0 2-0", XDELIVER},
+		{"workers 1-0", XACK},
+		{"audit 0-0", XGROUPCREATE},
+		{"audit", XGROUPDESTROY},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append("events", o.value, o.op); err != nil {
+			t.Fatalf("Failed to append stream operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	s, err := stream.Load(ht, "events", false)
+	if err != nil {
+		t.Fatalf("Expected stream to be recovered: %v", err)
+	}
+
+	if s.Len() != 3 {
+		t.Errorf("Expected 3 stream entries, got %d", s.Len())
+	}
+
+	pending, err := s.Pending("workers")
+	if err != nil {
+		t.Fatalf("Expected group to be recovered: %v", err)
+	}
+
+	if len(pending) != 1 || pending[0].ID.String() != "2-0" || pending[0].Consumer != "alice" {
+		t.Errorf("Expected 2-0 pending for alice, got %+v", pending)
+	}
+
+	entries, _ := s.Undelivered("workers", 0)
+	if len(entries) != 1 || entries[0].ID.String() != "3-0" {
+		t.Errorf("Expected 3-0 to be undelivered, got %v", entries)
+	}
+
+	if _, err = s.Pending("audit"); err == nil {
+		t.Error("Expected destroyed group to stay destroyed")
+	}
+}
+
+func TestJournalQueueOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_queue.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		value string
+		op    Operation
+	}{
+		{"a send welcome email", QPUSH},
+		{"b resize image", QPUSH},
+		{"c charge card", QPUSH},
+		{"a 1000", QRESERVE},
+		{"b 2000", QRESERVE},
+		{"a", QACK},
+		{"5000", QEXPIRE},
+		{"b 6000", QRESERVE},
+		{"b", QNACK},
+		{"jobs_dead b", QDEAD},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append("jobs", o.value, o.op); err != nil {
+			t.Fatalf("Failed to append queue operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	q, err := queue.Load(ht, "jobs", false)
+	if err != nil {
+		t.Fatalf("Expected queue to be recovered: %v", err)
+	}
+
+	if len(q.Ready) != 1 || q.Ready[0].ID != "c" || len(q.Reserved) != 0 {
+		t.Errorf("Expected only c to be ready, got %s", q)
+	}
+
+	dead, err := queue.Load(ht, "jobs_dead", false)
+	if err != nil {
+		t.Fatalf("Expected dead letter queue to be recovered: %v", err)
+	}
+
+	if dead.Next() == nil || dead.Next().Payload != "resize image" {
+		t.Errorf("Expected b in the dead letter queue, got %s", dead)
+	}
+}
+
+func TestJournalBitmapAndHyperLogLogOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_analytics.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	merged := hyperloglog.New()
+	for _, element := range []string{"alice", "bob", "carol"} {
+		merged.Add([]byte(element))
+	}
+
+	ops := []struct {
+		key   string
+		value string
+		op    Operation
+	}{
+		{"flags", "3 1", SETBIT},
+		{"flags", "9 1", SETBIT},
+		{"flags", "3 0", SETBIT},
+		{"copy", (&bitmap.Bitmap{Bits: []byte{0xff}}).Encode(), BITSTORE},
+		{"visitors", "alice bob", PFADD},
+		{"visitors", "bob", PFADD},
+		{"all", merged.Encode(), PFSTORE},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append(o.key, o.value, o.op); err != nil {
+			t.Fatalf("Failed to append operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	b, err := bitmap.Load(ht, "flags", false)
+	if err != nil {
+		t.Fatalf("Expected bitmap to be recovered: %v", err)
+	}
+
+	if b.GetBit(3) || !b.GetBit(9) {
+		t.Errorf("Expected only bit 9 to be set, got %08b", b.Bits)
+	}
+
+	b, err = bitmap.Load(ht, "copy", false)
+	if err != nil || b.Count(0, -1) != 8 {
+		t.Errorf("Expected stored bitmap to be recovered, got %v", err)
+	}
+
+	h, err := hyperloglog.Load(ht, "visitors", false)
+	if err != nil || h.Count() != 2 {
+		t.Errorf("Expected 2 visitors, got %v", err)
+	}
+
+	h, err = hyperloglog.Load(ht, "all", false)
+	if err != nil || h.Count() != 3 {
+		t.Errorf("Expected 3 merged visitors, got %v", err)
+	}
+}
+
 func BenchmarkJournalAppend(b *testing.B) {
 	// Setup
 	filePath := filepath.Join(os.TempDir(), "bench_journal_append.db")
@@ -589,7 +790,7 @@ func BenchmarkJournalAppend(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		key := "key" + string(rune(i%26+65))
 		value := "value" + string(rune(i%26+65))
-		err := j.Append(key, value, PUT)
+		_, err := j.Append(key, value, PUT)
 		if err != nil {
 			b.Fatalf("Failed to append during benchmark: %v", err)
 		}
@@ -611,7 +812,7 @@ func BenchmarkJournalRecover(b *testing.B) {
 	for i := 0; i < numEntries; i++ {
 		key := "key" + string(rune(i%26+65))
 		value := "value" + string(rune(i%26+65))
-		err := j.Append(key, value, PUT)
+		_, err := j.Append(key, value, PUT)
 		if err != nil {
 			b.Fatalf("Failed to append during benchmark setup: %v", err)
 		}
@@ -627,3 +828,447 @@ func BenchmarkJournalRecover(b *testing.B) {
 		}
 	}
 }
+
+func TestJournalTimeSeriesOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_timeseries.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		key   string
+		value string
+		op    Operation
+	}{
+		{"cpu", "100", TSCREATE},
+		{"cpu", "1000 0.5", TSADD},
+		{"cpu", "1050 0.75", TSADD},
+		{"cpu", "1200 1", TSADD},
+		{"mem", "10 2048", TSADD},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append(o.key, o.value, o.op); err != nil {
+			t.Fatalf("Failed to append operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	s, err := timeseries.Load(ht, "cpu", false)
+	if err != nil {
+		t.Fatalf("Expected series to be recovered: %v", err)
+	}
+
+	if s.Retention != 100 {
+		t.Errorf("Expected retention 100, got %d", s.Retention)
+	}
+
+	// The retention window is relative to the last sample
+	samples := s.Range(0, 2000)
+	if len(samples) != 1 || samples[0].Value != 1 {
+		t.Errorf("Expected only the last sample within retention, got %v", samples)
+	}
+
+	s, err = timeseries.Load(ht, "mem", false)
+	if err != nil || s.Len() != 1 {
+		t.Errorf("Expected series created by its first sample, got %v", err)
+	}
+}
+
+func TestJournalDocumentOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_document.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		key   string
+		value string
+		op    Operation
+	}{
+		{"user", `$ {"name":"alice","visits":1,"tags":[]}`, JSONSET},
+		{"user", `$.visits 2`, JSONSET},
+		{"user", `$.tags ["a", "b c"]`, JSONSET},
+		{"user", `$.tags ["a", "b c"]`, JSONSET}, // Replaying a set twice gives the same document
+		{"user", `$["last\u0020seen"] 1740300000`, JSONSET},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append(o.key, o.value, o.op); err != nil {
+			t.Fatalf("Failed to append operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	d, err := document.Load(ht, "user")
+	if err != nil {
+		t.Fatalf("Expected document to be recovered: %v", err)
+	}
+
+	expected := `{"last seen":1740300000,"name":"alice","tags":["a","b c"],"visits":2}`
+	if d.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, d)
+	}
+}
+
+func TestJournalVectorOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_vector.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		key   string
+		value string
+		op    Operation
+	}{
+		{"images", "2 cosine ^img_", VCREATE},
+		{"img_1", "1 0", VADD},
+		{"img_2", "0 1", VADD},
+		{"img_1", "0.5 0.5", VADD},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append(o.key, o.value, o.op); err != nil {
+			t.Fatalf("Failed to append operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	ix, err := vector.LoadIndex(ht, "images")
+	if err != nil {
+		t.Fatalf("Expected index to be recovered: %v", err)
+	}
+
+	if ix.Dim != 2 || ix.Metric != "cosine" || ix.Pattern != "^img_" {
+		t.Errorf("Unexpected index %s", ix)
+	}
+
+	vector.Rebuild(ht)
+
+	results, err := ix.Exact(ht, []float32{1, 1}, 10)
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+
+	if len(results) != 2 || results[0].Key != "img_1" {
+		t.Errorf("Expected the latest img_1 vector first, got %+v", results)
+	}
+}
+
+func TestJournalFullTextOperations(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_fulltext.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	ops := []struct {
+		key   string
+		value string
+		op    Operation
+	}{
+		{"docs:1", "the quick brown fox", PUT},
+		{"articles", "^docs:", FTCREATE},
+		{"docs:2", "a lazy dog", PUT},
+		{"docs:1", "", DEL},
+	}
+
+	for _, o := range ops {
+		if _, err := j.Append(o.key, o.value, o.op); err != nil {
+			t.Fatalf("Failed to append operation: %v", err)
+		}
+	}
+
+	// Test Recover
+	ht := hashtable.New()
+	err = j.Recover(ht)
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	ix, err := fulltext.LoadIndex(ht, "articles")
+	if err != nil {
+		t.Fatalf("Expected index to be recovered: %v", err)
+	}
+
+	fulltext.Rebuild(ht)
+
+	if ix.Len() != 1 {
+		t.Errorf("Expected 1 indexed value, got %d", ix.Len())
+	}
+
+	results, err := ix.Search(ht, "dog OR fox", 10)
+	if err != nil {
+		t.Fatalf("Failed to search: %v", err)
+	}
+
+	if len(results) != 1 || results[0].Key != "docs:2" {
+		t.Errorf("Expected docs:2 only, got %+v", results)
+	}
+}
+
+func TestJournalRecoverWith(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_recover_with.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	before := time.Now()
+
+	_, _ = j.Append("counter", "1", PUT)
+	_, _ = j.Append("counter", "4", INCR)
+	_, _ = j.Append("counter", "", DEL)
+
+	// The hook sees every entry after it is applied, with the time it was appended
+	ht := hashtable.New()
+	var values []string
+	err = j.RecoverWith(ht, func(e *Entry) {
+		if e.Timestamp.Before(before) {
+			t.Errorf("Expected entry timestamp after %v, got %v", before, e.Timestamp)
+		}
+
+		value, _, _ := ht.Get(e.Key)
+		values = append(values, fmt.Sprint(value))
+	})
+	if err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	if strings.Join(values, ",") != "1,5,<nil>" {
+		t.Errorf("Expected values 1,5,<nil> after each entry, got %v", values)
+	}
+}
+
+func TestJournalVersions(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_versions.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	put := hlc.Timestamp{Wall: time.Now().UnixNano(), Logical: 2, Node: 7}
+	incr := hlc.Timestamp{Wall: put.Wall, Logical: 3, Node: 7}
+
+	_, _ = j.AppendVersion("a", "1", PUT, put)
+	_, _ = j.AppendVersion("a", "2", INCR, incr)
+	_, _ = j.Append("b", "old", PUT)
+
+	ht := hashtable.New()
+	clock := hlc.NewClock(1)
+	ht.SetClock(clock)
+
+	if err = j.Recover(ht); err != nil {
+		t.Fatalf("Failed to recover journal: %v", err)
+	}
+
+	// Journaled versions are restored
+	value, v, ok := ht.GetVersion("a")
+	if !ok || value != "3" || v != incr {
+		t.Errorf("Expected 3 at version %v, got %v at %v", incr, value, v)
+	}
+
+	// Entries without a version get a new one after the journaled ones
+	if _, v, _ = ht.GetVersion("b"); !v.After(incr) {
+		t.Errorf("Expected version after %v, got %v", incr, v)
+	}
+}
+
+func TestJournalSequenceNumbers(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_sequence_numbers.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+
+	if j.Seq() != 0 {
+		t.Errorf("Expected sequence number 0 for an empty journal, got %d", j.Seq())
+	}
+
+	_, _ = j.Append("a", "1", PUT)
+	_, _ = j.Append("b", strings.Repeat("x", 4096), PUT) // Overflows a page
+	_, _ = j.Append("a", "", DEL)
+
+	if j.Seq() != 3 {
+		t.Errorf("Expected sequence number 3, got %d", j.Seq())
+	}
+
+	if j.First() != 1 {
+		t.Errorf("Expected first sequence number 1, got %d", j.First())
+	}
+
+	_ = j.Close()
+
+	// The sequence continues after the last entry once reopened
+	j, err = Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to reopen journal: %v", err)
+	}
+	defer j.Close()
+
+	// Appends return the sequence number of their entry
+	seq, err := j.Append("c", "1", PUT)
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	if seq != 4 {
+		t.Errorf("Expected sequence number 4 for the appended entry, got %d", seq)
+	}
+
+	var keys []string
+	err = j.Since(1, func(e *Entry) error {
+		keys = append(keys, fmt.Sprintf("%d:%s", e.Seq, e.Key))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+
+	if strings.Join(keys, ",") != "2:b,3:a,4:c" {
+		t.Errorf("Expected entries 2:b,3:a,4:c after 1, got %v", keys)
+	}
+}
+
+func TestJournalSinceWhileAppending(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_since_appending.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	_, _ = j.Append("a", "1", PUT)
+	_, _ = j.Append("b", "1", PUT)
+
+	// Entries are appended while the journal is read, the ones appended after Since was called are not read
+	var keys []string
+	err = j.Since(0, func(e *Entry) error {
+		keys = append(keys, fmt.Sprintf("%d:%s", e.Seq, e.Key))
+		_, err := j.Append("c", strings.Repeat("x", 4096), PUT)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+
+	if strings.Join(keys, ",") != "1:a,2:b" {
+		t.Errorf("Expected entries 1:a,2:b, got %v", keys)
+	}
+
+	if j.Seq() != 4 {
+		t.Errorf("Expected sequence number 4, got %d", j.Seq())
+	}
+}
+
+func TestJournalFollow(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_follow.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	// Entries of one relayed write share the sequence number of the primary node
+	j.Follow(7)
+	_, _ = j.Append("a", "1", PUT)
+	_, _ = j.Append("a", "2", PUT)
+	j.Follow(9)
+	_, _ = j.Append("b", "1", PUT)
+
+	if j.Seq() != 9 {
+		t.Errorf("Expected sequence number 9, got %d", j.Seq())
+	}
+
+	if j.First() != 7 {
+		t.Errorf("Expected first sequence number 7, got %d", j.First())
+	}
+
+	var seqs []string
+	_ = j.Since(0, func(e *Entry) error {
+		seqs = append(seqs, fmt.Sprint(e.Seq))
+		return nil
+	})
+
+	if strings.Join(seqs, ",") != "7,7,9" {
+		t.Errorf("Expected sequence numbers 7,7,9, got %v", seqs)
+	}
+}
+
+func TestJournalSinceUnnumbered(t *testing.T) {
+	// Setup
+	filePath := filepath.Join(os.TempDir(), "test_journal_since_unnumbered.db")
+	j, err := Open(filePath)
+	if err != nil {
+		t.Fatalf("Failed to open journal: %v", err)
+	}
+	defer os.Remove(filePath)
+	defer j.Close()
+
+	// Entries written before sequence numbers were journaled
+	for _, key := range []string{"a", "b"} {
+		b, err := Serialize(Entry{Key: key, Value: "1", Op: PUT})
+		if err != nil {
+			t.Fatalf("Failed to serialize entry: %v", err)
+		}
+		if _, err = j.Pager.Write(b); err != nil {
+			t.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+
+	var keys []string
+	_ = j.Since(1, func(e *Entry) error {
+		keys = append(keys, fmt.Sprintf("%d:%s", e.Seq, e.Key))
+		return nil
+	})
+
+	if strings.Join(keys, ",") != "2:b" {
+		t.Errorf("Expected entry 2:b numbered by its position, got %v", keys)
+	}
+}
@@ -0,0 +1,128 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package journal
+
+import (
+	"fmt"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/vector"
+)
+
+// Snapshot returns the entries that rebuild a value when applied to an empty hash table in order
+// Index graphs and postings are not part of the entries, they are rebuilt from the stored values like on recovery
+func Snapshot(key string, value interface{}, version hlc.Timestamp) []Entry {
+	switch v := value.(type) {
+	case string:
+		return []Entry{{Key: key, Value: v, Op: PUT, Version: version}}
+	case *bitmap.Bitmap:
+		return []Entry{{Key: key, Value: v.Encode(), Op: BITSTORE}}
+	case *hyperloglog.HyperLogLog:
+		return []Entry{{Key: key, Value: v.Encode(), Op: PFSTORE}}
+	case *document.Document:
+		return []Entry{{Key: key, Value: "$ " + v.String(), Op: JSONSET}}
+	case *vector.Index:
+		return []Entry{{Key: key, Value: fmt.Sprintf("%d %s %s", v.Dim, v.Metric, v.Pattern), Op: VCREATE}}
+	case *vector.Vector:
+		return []Entry{{Key: key, Value: v.String(), Op: VADD}}
+	case *fulltext.Index:
+		return []Entry{{Key: key, Value: v.Pattern, Op: FTCREATE}}
+	case *timeseries.Series:
+		return snapshotTimeSeries(key, v)
+	case *stream.Stream:
+		return snapshotStream(key, v)
+	case *queue.Queue:
+		return snapshotQueue(key, v)
+	}
+
+	return nil
+}
+
+// snapshotTimeSeries returns the entries that create a series and add its samples
+func snapshotTimeSeries(key string, s *timeseries.Series) []Entry {
+	entries := []Entry{{Key: key, Value: fmt.Sprintf("%d", s.Retention), Op: TSCREATE}}
+
+	for _, c := range s.Chunks {
+		for _, sample := range c.Samples() {
+			entries = append(entries, Entry{Key: key, Value: fmt.Sprintf("%d %s", sample.Timestamp, timeseries.FormatValue(sample.Value)), Op: TSADD})
+		}
+	}
+
+	return entries
+}
+
+// snapshotStream returns the entries that add the entries of a stream, create its groups and deliver their pending entries
+// A pending entry is delivered as many times as it was so its delivery count is kept
+func snapshotStream(key string, s *stream.Stream) []Entry {
+	var entries []Entry
+
+	for _, e := range s.Entries {
+		entries = append(entries, Entry{Key: key, Value: strings.TrimSpace(fmt.Sprintf("%s %s", e.ID, strings.Join(e.Fields, " "))), Op: XADD})
+	}
+
+	for name, g := range s.Groups {
+		entries = append(entries, Entry{Key: key, Value: fmt.Sprintf("%s %s", name, g.LastDelivered), Op: XGROUPCREATE})
+
+		pending, _ := s.Pending(name)
+		for _, pe := range pending {
+			for i := 0; i < pe.Deliveries; i++ {
+				entries = append(entries, Entry{Key: key, Value: fmt.Sprintf("%s %s %d %s", name, pe.Consumer, pe.DeliveredAt.UnixMilli(), pe.ID), Op: XDELIVER})
+			}
+		}
+	}
+
+	return entries
+}
+
+// snapshotQueue returns the entries that restore the ready jobs of a queue in delivery order and then its reserved jobs
+// An empty queue is restored by an entry without a job
+func snapshotQueue(key string, q *queue.Queue) []Entry {
+	if len(q.Ready) == 0 && len(q.Reserved) == 0 {
+		return []Entry{{Key: key, Op: QRESTORE}}
+	}
+
+	var entries []Entry
+
+	for _, job := range q.Ready {
+		entries = append(entries, Entry{Key: key, Value: fmt.Sprintf("%d 0 %s %s", job.Deliveries, job.ID, job.Payload), Op: QRESTORE})
+	}
+
+	for _, job := range q.Reserved {
+		entries = append(entries, Entry{Key: key, Value: fmt.Sprintf("%d %d %s %s", job.Deliveries, job.VisibleAt.UnixMilli(), job.ID, job.Payload), Op: QRESTORE})
+	}
+
+	return entries
+}
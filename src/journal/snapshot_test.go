@@ -0,0 +1,165 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package journal
+
+import (
+	"strings"
+	"supermassive/hlc"
+	"supermassive/storage/bitmap"
+	"supermassive/storage/document"
+	"supermassive/storage/fulltext"
+	"supermassive/storage/hashtable"
+	"supermassive/storage/hyperloglog"
+	"supermassive/storage/queue"
+	"supermassive/storage/stream"
+	"supermassive/storage/timeseries"
+	"supermassive/storage/vector"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	ht := hashtable.New()
+
+	version := hlc.Timestamp{Wall: 1000, Logical: 2, Node: 3}
+	ht.PutVersion("name", "supermassive", version)
+
+	b := bitmap.New()
+	_, _ = b.SetBit(7, true)
+	ht.Put("bits", b)
+
+	h := hyperloglog.New()
+	h.Add([]byte("a"))
+	h.Add([]byte("b"))
+	ht.Put("visitors", h)
+
+	root, _ := document.Parse(`{"name":"alex","tags":["a","b"]}`)
+	ht.Put("doc", document.New(root))
+
+	series := timeseries.New(60000)
+	_ = series.Add(1000, 1.5)
+	_ = series.Add(2000, 2.5)
+	ht.Put("temp", series)
+
+	ix, _ := vector.NewIndex("vecs", 2, "cosine", "vecs:.*")
+	ht.Put("vecs", ix)
+	ht.Put("vecs:1", vector.New([]float32{0.5, 1}))
+
+	text, _ := fulltext.NewIndex("docs", "docs:.*")
+	ht.Put("docs", text)
+
+	s := stream.New()
+	_ = s.Add(stream.ID{Ms: 1, Seq: 0}, []string{"field", "value"})
+	_ = s.Add(stream.ID{Ms: 2, Seq: 0}, []string{"field", "other"})
+	_ = s.CreateGroup("workers", stream.ID{})
+	_ = s.Deliver("workers", "alice", []stream.ID{{Ms: 1, Seq: 0}}, time.UnixMilli(5000))
+	_ = s.Deliver("workers", "bob", []stream.ID{{Ms: 1, Seq: 0}}, time.UnixMilli(6000))
+	ht.Put("events", s)
+
+	q := queue.New()
+	_ = q.Push("a", "send welcome email")
+	_ = q.Push("b", "resize image")
+	_, _ = q.Reserve("a", time.UnixMilli(9000))
+	ht.Put("jobs", q)
+
+	ht.Put("empty", queue.New())
+
+	// Apply the snapshot of every value to an empty hash table
+	restored := hashtable.New()
+	for _, entry := range ht.Traverse(nil) {
+		for _, e := range Snapshot(entry.Key, entry.Value, entry.Version) {
+			if err := Apply(restored, &e); err != nil {
+				t.Fatalf("Failed to apply snapshot entry of %s: %v", entry.Key, err)
+			}
+		}
+	}
+
+	if restored.Size() != ht.Size() {
+		t.Fatalf("Expected %d keys, got %d", ht.Size(), restored.Size())
+	}
+
+	value, v, ok := restored.GetVersion("name")
+	if !ok || value != "supermassive" || v != version {
+		t.Errorf("Expected name with its version, got %v %v", value, v)
+	}
+
+	// Values with a String method are compared by their description
+	for _, key := range []string{"bits", "doc", "temp", "vecs:1", "events", "jobs"} {
+		want, _, _ := ht.Get(key)
+		got, _, _ := restored.Get(key)
+		if got.(interface{ String() string }).String() != want.(interface{ String() string }).String() {
+			t.Errorf("Expected %s to be %v, got %v", key, want, got)
+		}
+	}
+
+	rh, _ := hyperloglog.Load(restored, "visitors", false)
+	if rh == nil || rh.Encode() != h.Encode() {
+		t.Errorf("Expected visitors registers to be restored")
+	}
+
+	rix, err := vector.LoadIndex(restored, "vecs")
+	if err != nil || rix.Dim != 2 || rix.Metric != "cosine" || rix.Pattern != "vecs:.*" {
+		t.Errorf("Expected vector index to be restored, got %v %v", rix, err)
+	}
+
+	rtext, err := fulltext.LoadIndex(restored, "docs")
+	if err != nil || rtext.Pattern != "docs:.*" {
+		t.Errorf("Expected text index to be restored, got %v %v", rtext, err)
+	}
+
+	rs, _ := stream.Load(restored, "events", false)
+	pending, err := rs.Pending("workers")
+	if err != nil || len(pending) != 1 || pending[0].Consumer != "bob" || pending[0].Deliveries != 2 || pending[0].DeliveredAt.UnixMilli() != 6000 {
+		t.Errorf("Expected the pending entry of bob delivered twice, got %v %v", pending, err)
+	}
+
+	rq, _ := queue.Load(restored, "jobs", false)
+	job := rq.Reserved["a"]
+	if job == nil || job.Deliveries != 1 || job.VisibleAt.UnixMilli() != 9000 || job.Payload != "send welcome email" {
+		t.Errorf("Expected job a to be reserved until 9000, got %v", job)
+	}
+
+	if rq.Next() == nil || rq.Next().ID != "b" {
+		t.Errorf("Expected job b to be ready, got %s", rq)
+	}
+
+	if _, err := queue.Load(restored, "empty", false); err != nil {
+		t.Errorf("Expected the empty queue to be restored: %v", err)
+	}
+
+	rts, _ := timeseries.Load(restored, "temp", false)
+	samples := rts.Range(0, 3000)
+	var got []string
+	for _, sample := range samples {
+		got = append(got, timeseries.FormatValue(sample.Value))
+	}
+	if strings.Join(got, ",") != "1.5,2.5" {
+		t.Errorf("Expected samples 1.5,2.5, got %v", got)
+	}
+}
@@ -115,65 +115,118 @@ func main() {
 			return
 		}
 
-	case "node":
-		logger.Info("Starting node instance")
-
-		// We create a node instance
-		n, err := node.New(logger, *sharedKeyFlag)
-		if err != nil {
-			logger.Error("Error creating node instance", err)
-			os.Exit(1)
+	case "node", "node-replica":
+		// A node demoted by the cluster restarts as a read replica and a read replica promoted by the cluster as a node
+		instanceType := instanceRole(*instanceTypeFlag)
+		for instanceType != "" {
+			switch instanceType {
+			case "node":
+				instanceType = runNode(logger, *sharedKeyFlag, sig)
+			case "node-replica":
+				instanceType = runNodeReplica(logger, *sharedKeyFlag, sig)
+			}
 		}
+	default:
+		logger.Error("Invalid instance type")
+		os.Exit(1)
+	}
 
-		// We use Open method in background as it blocks
-		go func() {
-			err := n.Open(nil)
-			if err != nil {
-				logger.Error("Error starting node instance", err)
-				os.Exit(1)
-			}
-		}()
+}
 
-		<-sig // We wait for the signal to shutdown
-		logger.Info("Shutting down node instance")
+// instanceRole returns the instance type to start as
+// A node demoted or a read replica promoted by the cluster leaves only the config file of its new role in the working directory
+func instanceRole(instanceType string) string {
+	exists := func(name string) bool {
+		_, err := os.Stat(name)
+		return err == nil
+	}
 
-		// We close the node instance
-		err = n.Close()
-		if err != nil {
-			logger.Error("Error shutting down node instance", err)
-			return
-		}
-	case "node-replica":
-		logger.Info("Starting node replica instance")
+	switch {
+	case instanceType == "node" && !exists(node.ConfigFile) && exists(nodereplica.ConfigFile):
+		return "node-replica"
+	case instanceType == "node-replica" && !exists(nodereplica.ConfigFile) && exists(node.ConfigFile):
+		return "node"
+	}
+
+	return instanceType
+}
+
+// runNode runs a node instance until a shutdown signal or until the cluster demotes it
+// Returns node-replica if the node was demoted, otherwise an empty string
+func runNode(logger *slog.Logger, sharedKey string, sig chan os.Signal) string {
+	logger.Info("Starting node instance")
+
+	// We create a node instance
+	n, err := node.New(logger, sharedKey)
+	if err != nil {
+		logger.Error("Error creating node instance", "error", err)
+		os.Exit(1)
+	}
 
-		// We create a node replica instance
-		nr, err := nodereplica.New(logger, *sharedKeyFlag)
+	// We use Open method in background as it blocks
+	go func() {
+		err := n.Open(nil)
 		if err != nil {
-			logger.Error("Error creating node replica instance", err)
+			logger.Error("Error starting node instance", "error", err)
 			os.Exit(1)
 		}
+	}()
+
+	select {
+	case <-n.Demoted:
+		// The node is already closed, it restarts as a read replica of the new primary
+		logger.Info("Node instance demoted to node replica")
+		return "node-replica"
+	case <-sig: // We wait for the signal to shutdown
+	}
 
-		// We use Open method in background as it blocks
-		go func() {
-			err := nr.Open(nil)
-			if err != nil {
-				logger.Error("Error starting node replica instance", err)
-				os.Exit(1)
-			}
-		}()
+	logger.Info("Shutting down node instance")
 
-		<-sig // We wait for the signal to shutdown
-		logger.Info("Shutting down node replica instance")
+	// We close the node instance
+	err = n.Close()
+	if err != nil {
+		logger.Error("Error shutting down node instance", "error", err)
+	}
+
+	return ""
+}
 
-		// We close the node replica instance
-		err = nr.Close()
+// runNodeReplica runs a node replica instance until a shutdown signal or until the cluster promotes it
+// Returns node if the replica was promoted, otherwise an empty string
+func runNodeReplica(logger *slog.Logger, sharedKey string, sig chan os.Signal) string {
+	logger.Info("Starting node replica instance")
+
+	// We create a node replica instance
+	nr, err := nodereplica.New(logger, sharedKey)
+	if err != nil {
+		logger.Error("Error creating node replica instance", "error", err)
+		os.Exit(1)
+	}
+
+	// We use Open method in background as it blocks
+	go func() {
+		err := nr.Open(nil)
 		if err != nil {
-			logger.Error("Error shutting down node replica instance", err)
-			return
+			logger.Error("Error starting node replica instance", "error", err)
+			os.Exit(1)
 		}
-	default:
-		logger.Error("Invalid instance type")
-		os.Exit(1)
+	}()
+
+	select {
+	case <-nr.Promoted:
+		// The replica is already closed, it restarts as a node recovering from its journal
+		logger.Info("Node replica instance promoted to node")
+		return "node"
+	case <-sig: // We wait for the signal to shutdown
+	}
+
+	logger.Info("Shutting down node replica instance")
+
+	// We close the node replica instance
+	err = nr.Close()
+	if err != nil {
+		logger.Error("Error shutting down node replica instance", "error", err)
 	}
 
+	return ""
 }
@@ -29,12 +29,14 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"log/slog"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
@@ -159,6 +161,53 @@ func (c *Client) Receive(ctx context.Context) ([]byte, error) {
 	return buffer[:n], nil
 }
 
+// ReceiveLine receives a single line response from the server, reading until it ends with CRLF
+// Used for responses that can be larger than the buffer size
+func (c *Client) ReceiveLine(ctx context.Context) ([]byte, error) {
+	var data []byte
+	for {
+		rec, err := c.Receive(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, rec...)
+		if bytes.HasSuffix(data, []byte("\r\n")) {
+			return data, nil
+		}
+	}
+}
+
+// ReceiveLines receives a response of the form OK <n> followed by n lines, reading until all lines arrived
+// The header may carry more fields after the count, such as a cursor.  Any other response is returned after its first line
+func (c *Client) ReceiveLines(ctx context.Context) ([]byte, error) {
+	data, err := c.ReceiveLine(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	header, _, _ := bytes.Cut(data, []byte("\r\n"))
+	if !bytes.HasPrefix(header, []byte("OK ")) {
+		return data, nil
+	}
+
+	count, _, _ := bytes.Cut(header[3:], []byte(" "))
+	n, err := strconv.Atoi(string(count))
+	if err != nil {
+		return data, nil
+	}
+
+	for bytes.Count(data, []byte("\r\n")) < n+1 {
+		rec, err := c.ReceiveLine(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, rec...)
+	}
+
+	return data, nil
+}
+
 // Close closes the connection
 func (c *Client) Close() error {
 	if c.Conn != nil {
@@ -181,6 +181,137 @@ func TestClient_Receive(t *testing.T) {
 	}
 }
 
+func TestClient_ReceiveLine(t *testing.T) {
+	config := &Config{
+		ServerAddress:  "localhost:8081",
+		UseTLS:         false,
+		ConnectTimeout: 5,
+		WriteTimeout:   5,
+		ReadTimeout:    5,
+		MaxRetries:     3,
+		RetryWaitTime:  1,
+		BufferSize:     16,
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	client := New(config, logger)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Mock server
+	ln, err := net.Listen("tcp", config.ServerAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	line := "OK a line much longer than the sixteen byte buffer\r\n"
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// We write the line in two parts
+		conn.Write([]byte(line[:20]))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(line[20:]))
+	}()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	data, err := client.ReceiveLine(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(data) != line {
+		t.Fatalf("expected %q, got %q", line, data)
+	}
+}
+
+func TestClient_ReceiveLines(t *testing.T) {
+	config := &Config{
+		ServerAddress:  "localhost:8082",
+		UseTLS:         false,
+		ConnectTimeout: 5,
+		WriteTimeout:   5,
+		ReadTimeout:    5,
+		MaxRetries:     3,
+		RetryWaitTime:  1,
+		BufferSize:     16,
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	client := New(config, logger)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Mock server
+	ln, err := net.Listen("tcp", config.ServerAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	response := "OK 3\r\ncpu 1000 0.5\r\ncpu 2000 0.75\r\ncpu 3000 1\r\n"
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// We write the response in parts ending on line boundaries
+		conn.Write([]byte(response[:20]))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(response[20:36]))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte(response[36:]))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("ERR key not found\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("OK 1 42\r\n"))
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("user:1\r\n"))
+	}()
+
+	err = client.Connect(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	data, err := client.ReceiveLines(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(data) != response {
+		t.Fatalf("expected %q, got %q", response, data)
+	}
+
+	data, err = client.ReceiveLines(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(data) != "ERR key not found\r\n" {
+		t.Fatalf("expected error response, got %q", data)
+	}
+
+	// Fields after the count are part of the header
+	data, err = client.ReceiveLines(ctx)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if string(data) != "OK 1 42\r\nuser:1\r\n" {
+		t.Fatalf("expected cursor response, got %q", data)
+	}
+}
+
 func TestClient_Close(t *testing.T) {
 	config := &Config{
 		ServerAddress:  "localhost:8080",
@@ -61,6 +61,8 @@ type Server struct {
 	ConnCount  int64             // Connection count
 	ConnMutex  sync.Mutex        // Mutex for connection count
 	Handler    ConnectionHandler // The assigned connection handler
+	Conns      map[net.Conn]bool // Open connections, guarded by the connection count mutex
+	stopOnce   sync.Once         // Stops accepting connections once
 }
 
 // New creates a new server
@@ -70,6 +72,7 @@ func New(config *Config, logger *slog.Logger, handler ConnectionHandler) *Server
 		ShutdownCh: make(chan struct{}),
 		Logger:     logger,
 		Handler:    handler,
+		Conns:      make(map[net.Conn]bool),
 	}
 }
 
@@ -123,11 +126,11 @@ func (s *Server) acceptConnections() {
 		}
 
 		s.Wg.Add(1)
-		s.incrementConnCount()
+		s.incrementConnCount(conn)
 
 		go func() {
 			defer s.Wg.Done()
-			defer s.decrementConnCount()
+			defer s.decrementConnCount(conn)
 			s.handleConnection(conn)
 		}()
 	}
@@ -148,11 +151,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 
 // Shutdown shuts down the server
 func (s *Server) Shutdown() error {
-	close(s.ShutdownCh)
-
-	if s.Listener != nil {
-		_ = s.Listener.Close()
-	}
+	s.stop()
 
 	// Wait for all connections to finish with timeout
 	done := make(chan struct{})
@@ -167,10 +166,38 @@ func (s *Server) Shutdown() error {
 	}
 }
 
+// Close shuts down the server closing the open connections rather than waiting for clients to close them
+// Used when an instance hands its address over to another instance, such as a read replica promoted to a node
+func (s *Server) Close() error {
+	s.stop()
+
+	s.ConnMutex.Lock()
+	for conn := range s.Conns {
+		_ = conn.Close()
+	}
+	s.ConnMutex.Unlock()
+
+	s.Wg.Wait()
+
+	return nil
+}
+
+// stop stops accepting connections, the server can be shut down or closed more than once
+func (s *Server) stop() {
+	s.stopOnce.Do(func() {
+		close(s.ShutdownCh)
+
+		if s.Listener != nil {
+			_ = s.Listener.Close()
+		}
+	})
+}
+
 // incrementConnCount increments the connection count
-func (s *Server) incrementConnCount() {
+func (s *Server) incrementConnCount(conn net.Conn) {
 	s.ConnMutex.Lock()
 	s.ConnCount++
+	s.Conns[conn] = true
 	s.ConnMutex.Unlock()
 }
 
@@ -182,8 +209,9 @@ func (s *Server) GetConnCount() int64 {
 }
 
 // decrementConnCount decrements the connection count
-func (s *Server) decrementConnCount() {
+func (s *Server) decrementConnCount(conn net.Conn) {
 	s.ConnMutex.Lock()
 	s.ConnCount--
+	delete(s.Conns, conn)
 	s.ConnMutex.Unlock()
 }
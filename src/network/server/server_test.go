@@ -120,6 +120,66 @@ func TestServerShutdown(t *testing.T) {
 	}
 }
 
+// BlockingConnectionHandler is a mock handler reading until the connection is closed
+type BlockingConnectionHandler struct{}
+
+func (b *BlockingConnectionHandler) HandleConnection(conn net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// TestServerClose tests the Close method closes open connections
+func TestServerClose(t *testing.T) {
+	config := &Config{
+		Address:     "localhost:0",
+		UseTLS:      false,
+		ReadTimeout: 5,
+		BufferSize:  1024,
+	}
+
+	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	server := New(config, logger, &BlockingConnectionHandler{})
+
+	go func() {
+		if err := server.Start(); err != nil {
+			t.Errorf("Failed to start server: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// The client never closes its connection
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect to server: %v", err)
+	}
+	defer conn.Close()
+
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan error)
+	go func() {
+		done <- server.Close()
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Failed to close server: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close waited on an open connection")
+	}
+
+	if server.GetConnCount() != 0 {
+		t.Errorf("Expected no connections, got %d", server.GetConnCount())
+	}
+}
+
 // TestServerMultipleConnections tests the server's ability to handle multiple connections
 func TestServerMultipleConnections(t *testing.T) {
 	config := &Config{
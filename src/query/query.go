@@ -0,0 +1,471 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package query
+
+// A small predicate language over stored entries
+// [WHERE <condition>] [LIMIT <n>] where a condition compares key, value, type, ts, num(value) or len(value) with a
+// literal, for example key ~ '^user_' AND ts > 2025-01-01 AND num(value) > 10.  Conditions combine with AND, OR, NOT
+// and parentheses.  A query is validated where it is received and passed on in its canonical form, see Query.String.
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+	"time"
+)
+
+// Query is a parsed query
+type Query struct {
+	Where Condition // The condition entries must match, nil matches every entry
+	Limit int       // Maximum number of entries returned, 0 returns every match
+}
+
+// Condition is a predicate over an entry
+type Condition interface {
+	match(e hashtable.Entry, typeOf func(value interface{}) string) bool // Returns true if the entry matches
+	String() string                                                      // Returns the condition in canonical form
+}
+
+// comparison compares a field of an entry with a literal
+type comparison struct {
+	field  string         // key, value, type, ts, num(value) or len(value)
+	op     string         // =, !=, <, <=, >, >=, ~ or !~
+	text   string         // String literal
+	re     *regexp.Regexp // Compiled pattern for ~ and !~
+	number float64        // Number literal for num(value) and len(value)
+	ts     time.Time      // Time literal for ts
+}
+
+// and matches entries matching both sides
+type and struct {
+	left, right Condition
+}
+
+// or matches entries matching either side
+type or struct {
+	left, right Condition
+}
+
+// not matches entries not matching its condition
+type not struct {
+	c Condition
+}
+
+// Token kinds
+const (
+	tokenWord = iota
+	tokenString
+	tokenOp
+	tokenOpen
+	tokenClose
+)
+
+// token is a lexed query token
+type token struct {
+	kind int
+	text string
+}
+
+// parser is a recursive descent query parser
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// timeLayouts are the accepted ts literal layouts, an integer is a unix timestamp in seconds
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"}
+
+// Parse parses a query
+func Parse(s string) (*Query, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	q := &Query{}
+
+	if p.keyword("WHERE") {
+		p.pos++
+	}
+
+	if p.pos < len(p.tokens) && !p.keyword("LIMIT") {
+		if q.Where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.keyword("LIMIT") {
+		p.pos++
+		if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenWord {
+			return nil, errors.New("invalid limit")
+		}
+
+		if q.Limit, err = strconv.Atoi(p.tokens[p.pos].text); err != nil || q.Limit <= 0 {
+			return nil, errors.New("invalid limit")
+		}
+		p.pos++
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos].text)
+	}
+
+	return q, nil
+}
+
+// String returns the query in canonical form
+func (q *Query) String() string {
+	var parts []string
+	if q.Where != nil {
+		parts = append(parts, "WHERE "+q.Where.String())
+	}
+	if q.Limit > 0 {
+		parts = append(parts, fmt.Sprintf("LIMIT %d", q.Limit))
+	}
+	return strings.Join(parts, " ")
+}
+
+// Filter returns a filter matching the entries of the query for hashtable.HashTable.Traverse
+// typeOf returns the type name of a stored value for type comparisons
+func (q *Query) Filter(typeOf func(value interface{}) string) hashtable.FilterFunc {
+	return func(e hashtable.Entry) bool {
+		return q.Where == nil || q.Where.match(e, typeOf)
+	}
+}
+
+// lex splits a query into tokens
+func lex(s string) ([]token, error) {
+	var tokens []token
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenOpen, text: "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenClose, text: ")"})
+			i++
+		case c == '\'' || c == '"':
+			// Quoted strings escape the quote and backslash with a backslash
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && s[j] != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+
+			if j >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+
+			tokens = append(tokens, token{kind: tokenString, text: b.String()})
+			i = j + 1
+		case strings.IndexByte("=!<>~", c) >= 0:
+			op := string(c)
+			if i+1 < len(s) {
+				if two := s[i : i+2]; two == "!=" || two == "<=" || two == ">=" || two == "!~" {
+					op = two
+				}
+			}
+
+			if op == "!" {
+				return nil, errors.New("unexpected !")
+			}
+
+			tokens = append(tokens, token{kind: tokenOp, text: op})
+			i += len(op)
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t()'\"=!<>~", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: s[i:j]})
+			i = j
+		}
+	}
+
+	return tokens, nil
+}
+
+// keyword returns true if the next token is the keyword
+func (p *parser) keyword(word string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenWord && strings.EqualFold(p.tokens[p.pos].text, word)
+}
+
+// next returns the next token, an empty word at the end
+func (p *parser) next() token {
+	if p.pos >= len(p.tokens) {
+		return token{kind: tokenWord}
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+// or parses <and> [OR <and>]...
+func (p *parser) or() (Condition, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &or{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// and parses <unary> [AND <unary>]...
+func (p *parser) and() (Condition, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		p.pos++
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &and{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+// unary parses NOT <unary>, ( <or> ) or a comparison
+func (p *parser) unary() (Condition, error) {
+	if p.keyword("NOT") {
+		p.pos++
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &not{c: c}, nil
+	}
+
+	if p.pos < len(p.tokens) && p.tokens[p.pos].kind == tokenOpen {
+		p.pos++
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.next().kind != tokenClose {
+			return nil, errors.New("expected )")
+		}
+		return c, nil
+	}
+
+	return p.comparison()
+}
+
+// comparison parses <field> <op> <literal>
+func (p *parser) comparison() (Condition, error) {
+	t := p.next()
+	if t.kind != tokenWord || t.text == "" {
+		return nil, errors.New("expected field")
+	}
+
+	field := strings.ToLower(t.text)
+	switch field {
+	case "key", "value", "type", "ts":
+	case "num", "len":
+		// Functions take the value as their only argument
+		if p.next().kind != tokenOpen || !strings.EqualFold(p.next().text, "value") || p.next().kind != tokenClose {
+			return nil, fmt.Errorf("expected %s(value)", field)
+		}
+		field += "(value)"
+	default:
+		return nil, fmt.Errorf("unknown field %s", t.text)
+	}
+
+	op := p.next()
+	if op.kind != tokenOp {
+		return nil, errors.New("expected operator")
+	}
+
+	literal := p.next()
+	if literal.kind != tokenWord && literal.kind != tokenString || literal.kind == tokenWord && literal.text == "" {
+		return nil, errors.New("expected literal")
+	}
+
+	c := &comparison{field: field, op: op.text, text: literal.text}
+
+	var err error
+	switch field {
+	case "key", "value", "type":
+		if c.op == "~" || c.op == "!~" {
+			if c.re, err = regexp.Compile(c.text); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	case "ts":
+		if c.ts, err = ParseTime(c.text); err != nil {
+			return nil, err
+		}
+	case "num(value)", "len(value)":
+		if c.number, err = strconv.ParseFloat(c.text, 64); err != nil {
+			return nil, fmt.Errorf("invalid number %s", c.text)
+		}
+	}
+
+	if c.op == "~" || c.op == "!~" {
+		return nil, fmt.Errorf("%s cannot be matched with %s", field, c.op)
+	}
+
+	return c, nil
+}
+
+// ParseTime parses a ts literal, also used for point-in-time reads
+func ParseTime(s string) (time.Time, error) {
+	if unix, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(unix, 0).UTC(), nil
+	}
+
+	for _, layout := range timeLayouts {
+		if ts, err := time.Parse(layout, s); err == nil {
+			return ts, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid timestamp %s", s)
+}
+
+// holds returns true if a comparison result satisfies the operator
+func holds(op string, result int) bool {
+	switch op {
+	case "=":
+		return result == 0
+	case "!=":
+		return result != 0
+	case "<":
+		return result < 0
+	case "<=":
+		return result <= 0
+	case ">":
+		return result > 0
+	case ">=":
+		return result >= 0
+	}
+	return false
+}
+
+// match returns true if the field of the entry compares to the literal
+// Values that are not numbers never match num(value) comparisons
+func (c *comparison) match(e hashtable.Entry, typeOf func(value interface{}) string) bool {
+	var s string
+	switch c.field {
+	case "key":
+		s = e.Key
+	case "value":
+		s = fmt.Sprint(e.Value)
+	case "type":
+		s = typeOf(e.Value)
+	case "ts":
+		return holds(c.op, e.Timestamp.Compare(c.ts))
+	case "num(value)":
+		f, err := strconv.ParseFloat(fmt.Sprint(e.Value), 64)
+		if err != nil {
+			return false
+		}
+		return holds(c.op, cmp.Compare(f, c.number))
+	case "len(value)":
+		return holds(c.op, cmp.Compare(float64(len(fmt.Sprint(e.Value))), c.number))
+	}
+
+	switch c.op {
+	case "~":
+		return c.re.MatchString(s)
+	case "!~":
+		return !c.re.MatchString(s)
+	}
+	return holds(c.op, strings.Compare(s, c.text))
+}
+
+// String returns the comparison in canonical form
+func (c *comparison) String() string {
+	switch c.field {
+	case "ts":
+		return fmt.Sprintf("ts %s %s", c.op, c.ts.Format(time.RFC3339Nano))
+	case "num(value)", "len(value)":
+		return fmt.Sprintf("%s %s %s", c.field, c.op, strconv.FormatFloat(c.number, 'g', -1, 64))
+	}
+
+	quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(c.text)
+	return fmt.Sprintf("%s %s '%s'", c.field, c.op, quoted)
+}
+
+// match returns true if both sides match
+func (c *and) match(e hashtable.Entry, typeOf func(value interface{}) string) bool {
+	return c.left.match(e, typeOf) && c.right.match(e, typeOf)
+}
+
+// String returns the condition in canonical form
+func (c *and) String() string {
+	return fmt.Sprintf("(%s AND %s)", c.left, c.right)
+}
+
+// match returns true if either side matches
+func (c *or) match(e hashtable.Entry, typeOf func(value interface{}) string) bool {
+	return c.left.match(e, typeOf) || c.right.match(e, typeOf)
+}
+
+// String returns the condition in canonical form
+func (c *or) String() string {
+	return fmt.Sprintf("(%s OR %s)", c.left, c.right)
+}
+
+// match returns true if the condition does not match
+func (c *not) match(e hashtable.Entry, typeOf func(value interface{}) string) bool {
+	return !c.c.match(e, typeOf)
+}
+
+// String returns the condition in canonical form
+func (c *not) String() string {
+	return "NOT " + c.c.String()
+}
@@ -0,0 +1,147 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package query
+
+import (
+	"supermassive/storage/hashtable"
+	"testing"
+	"time"
+)
+
+// typeOf names plain values string and everything else other
+func typeOf(value interface{}) string {
+	if _, ok := value.(string); ok {
+		return "string"
+	}
+	return "other"
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query     string
+		canonical string
+	}{
+		{"WHERE key ~ '^user_' AND ts > 2025-01-01 AND num(value) > 10 LIMIT 100",
+			"WHERE ((key ~ '^user_' AND ts > 2025-01-01T00:00:00Z) AND num(value) > 10) LIMIT 100"},
+		{"key = a OR NOT (value != 'b c' AND len(value) <= 3)",
+			"WHERE (key = 'a' OR NOT (value != 'b c' AND len(value) <= 3))"},
+		{`where TYPE != "it's"`, `WHERE type != 'it\'s'`},
+		{"LIMIT 5", "LIMIT 5"},
+		{"", ""},
+		{"ts >= 1735689600", "WHERE ts >= 2025-01-01T00:00:00Z"},
+	}
+
+	for _, test := range tests {
+		q, err := Parse(test.query)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", test.query, err)
+		}
+
+		if q.String() != test.canonical {
+			t.Errorf("Expected %q, got %q", test.canonical, q.String())
+		}
+
+		// The canonical form parses to itself
+		again, err := Parse(q.String())
+		if err != nil || again.String() != q.String() {
+			t.Errorf("Canonical form %q did not round trip: %v", q.String(), err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, query := range []string{
+		"key",
+		"key =",
+		"name = a",
+		"key ~ '('",
+		"ts > yesterday",
+		"num(value) > ten",
+		"num(key) > 1",
+		"ts ~ 2025",
+		"key = 'open",
+		"(key = a",
+		"key = a LIMIT 0",
+		"key = a b",
+		"key ! a",
+	} {
+		if _, err := Parse(query); err == nil {
+			t.Errorf("Expected error parsing %q", query)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	ht := hashtable.New()
+	ht.Put("user_1", "5")
+	ht.Put("user_2", "20")
+	ht.Put("user_3", "hello world")
+	ht.Put("item_1", "50")
+	ht.Put("other", 7)
+
+	count := func(query string) int {
+		q, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Failed to parse %q: %v", query, err)
+		}
+		return len(ht.Traverse(q.Filter(typeOf)))
+	}
+
+	tests := []struct {
+		query    string
+		expected int
+	}{
+		{"", 5},
+		{"key ~ '^user_'", 3},
+		{"key ~ '^user_' AND num(value) > 10", 1},
+		{"num(value) >= 5", 4},
+		{"NOT num(value) >= 5", 1},
+		{"key !~ '^user_' OR value = 'hello world'", 3},
+		{"len(value) > 2", 1},
+		{"type = other", 1},
+		{"key < user_2", 3},
+		{"ts > 2000-01-01", 5},
+		{"ts < 2000-01-01", 0},
+	}
+
+	for _, test := range tests {
+		if got := count(test.query); got != test.expected {
+			t.Errorf("Query %q expected %d entries, got %d", test.query, test.expected, got)
+		}
+	}
+
+	// Only entries written after a point in time
+	since := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	ht.Put("user_1", "6")
+
+	if got := count("ts > " + since.Format(time.RFC3339Nano)); got != 1 {
+		t.Errorf("Expected 1 entry changed since %v, got %d", since, got)
+	}
+}
@@ -0,0 +1,342 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package slots
+
+// Hash slots
+// Keys are hashed into a fixed number of slots and every slot is owned by exactly one primary node, so a key always
+// lives on the same node.  Moving slots between nodes moves the keys hashed to them.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+)
+
+// Count is the number of hash slots
+const Count = 16384
+
+// Slot returns the hash slot of a key
+func Slot(key string) int {
+	return int(hashtable.MurmurHash3([]byte(key), 0) % Count)
+}
+
+// Range is an inclusive range of slots
+type Range struct {
+	Start int // First slot of the range
+	End   int // Last slot of the range
+}
+
+// Ranges is a list of slot ranges, formatted like 0-8191,10000
+type Ranges []Range
+
+// ParseRanges parses comma separated slots and slot ranges, an empty string is no slots
+func ParseRanges(s string) (Ranges, error) {
+	var ranges Ranges
+	if strings.TrimSpace(s) == "" {
+		return ranges, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		start, end, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			end = start
+		}
+
+		first, err := strconv.Atoi(start)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot range %s", part)
+		}
+
+		last, err := strconv.Atoi(end)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slot range %s", part)
+		}
+
+		if first < 0 || last >= Count || first > last {
+			return nil, fmt.Errorf("invalid slot range %s", part)
+		}
+
+		ranges = append(ranges, Range{Start: first, End: last})
+	}
+
+	return ranges, nil
+}
+
+// String formats the ranges like 0-8191,10000
+func (r Ranges) String() string {
+	parts := make([]string, 0, len(r))
+	for _, rng := range r {
+		if rng.Start == rng.End {
+			parts = append(parts, strconv.Itoa(rng.Start))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", rng.Start, rng.End))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Contains returns true if the slot is in one of the ranges
+func (r Ranges) Contains(slot int) bool {
+	for _, rng := range r {
+		if slot >= rng.Start && slot <= rng.End {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of slots in the ranges
+func (r Ranges) Len() int {
+	n := 0
+	for _, rng := range r {
+		n += rng.End - rng.Start + 1
+	}
+	return n
+}
+
+// Complement returns the slots not in the ranges
+func (r Ranges) Complement() Ranges {
+	var in [Count]bool
+	for _, rng := range r {
+		for slot := rng.Start; slot <= rng.End; slot++ {
+			in[slot] = true
+		}
+	}
+
+	return collect(func(slot int) bool { return !in[slot] })
+}
+
+// collect returns the ranges of the slots for which member returns true
+func collect(member func(slot int) bool) Ranges {
+	var ranges Ranges
+	for slot := 0; slot < Count; slot++ {
+		if !member(slot) {
+			continue
+		}
+
+		if len(ranges) > 0 && ranges[len(ranges)-1].End == slot-1 {
+			ranges[len(ranges)-1].End = slot
+		} else {
+			ranges = append(ranges, Range{Start: slot, End: slot})
+		}
+	}
+	return ranges
+}
+
+// Even splits all slots into n contiguous ranges of nearly equal size
+func Even(n int) []Ranges {
+	split := make([]Ranges, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		size := Count / n
+		if i < Count%n {
+			size++
+		}
+
+		if size > 0 {
+			split[i] = Ranges{{Start: start, End: start + size - 1}}
+		}
+		start += size
+	}
+	return split
+}
+
+// Table maps every slot to the node owning it
+type Table struct {
+	owners [Count]string // Address of the node owning each slot
+}
+
+// NewTable creates a table from the slots assigned to each node by address
+// Every slot must be assigned to exactly one node
+func NewTable(assigned map[string]Ranges) (*Table, error) {
+	t := &Table{}
+	for node, ranges := range assigned {
+		for _, rng := range ranges {
+			for slot := rng.Start; slot <= rng.End; slot++ {
+				if t.owners[slot] != "" {
+					return nil, fmt.Errorf("slot %d is assigned to %s and %s", slot, t.owners[slot], node)
+				}
+				t.owners[slot] = node
+			}
+		}
+	}
+
+	for slot, owner := range t.owners {
+		if owner == "" {
+			return nil, fmt.Errorf("slot %d is not assigned", slot)
+		}
+	}
+
+	return t, nil
+}
+
+// Owner returns the address of the node owning the slot of a key
+func (t *Table) Owner(key string) string {
+	return t.owners[Slot(key)]
+}
+
+// Ranges returns the slots owned by a node
+func (t *Table) Ranges(node string) Ranges {
+	return collect(func(slot int) bool { return t.owners[slot] == node })
+}
+
+// Balance spreads all slots evenly between the nodes, in the order of the split of Even
+// A node keeps the slots it owns up to its share so few keys move, slots over a share and slots owned by nodes
+// that are not listed are handed to the nodes under their share.  Returns the slots of each node
+func Balance(owned map[string]Ranges, nodes []string) (map[string]Ranges, error) {
+	return BalanceWeighted(owned, nodes, nil)
+}
+
+// BalanceWeighted spreads all slots between the nodes in proportion to their weights, like Balance
+// Without weights or when they add up to 0 the slots are spread evenly
+func BalanceWeighted(owned map[string]Ranges, nodes []string, weights []float64) (map[string]Ranges, error) {
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes")
+	}
+
+	if weights != nil && len(weights) != len(nodes) {
+		return nil, fmt.Errorf("expected %d weights", len(nodes))
+	}
+
+	// The index of the owning node plus one, 0 for a free slot
+	var owners [Count]int
+	for i, node := range nodes {
+		for _, rng := range owned[node] {
+			for slot := rng.Start; slot <= rng.End; slot++ {
+				if owners[slot] != 0 {
+					return nil, fmt.Errorf("slot %d is assigned to %s and %s", slot, nodes[owners[slot]-1], node)
+				}
+				owners[slot] = i + 1
+			}
+		}
+	}
+
+	shares := Shares(weights, len(nodes))
+
+	// Slots over a share are freed from the end of the node's ranges
+	counts := make([]int, len(nodes))
+	for slot := range owners {
+		if owners[slot] == 0 {
+			continue
+		}
+
+		i := owners[slot] - 1
+		if counts[i] == shares[i] {
+			owners[slot] = 0
+			continue
+		}
+		counts[i]++
+	}
+
+	// Free slots go to the first node under its share
+	i := 0
+	for slot := range owners {
+		if owners[slot] != 0 {
+			continue
+		}
+
+		for counts[i] == shares[i] {
+			i++
+		}
+		owners[slot] = i + 1
+		counts[i]++
+	}
+
+	balanced := make(map[string]Ranges, len(nodes))
+	for i, node := range nodes {
+		balanced[node] = collect(func(slot int) bool { return owners[slot] == i+1 })
+	}
+
+	return balanced, nil
+}
+
+// Shares splits the slots between n nodes in proportion to their weights, the slots left by rounding go to the first
+// nodes.  Without weights or when they add up to 0 the shares are those of Even
+func Shares(weights []float64, n int) []int {
+	total := 0.0
+	for _, weight := range weights {
+		total += max(weight, 0)
+	}
+
+	shares := make([]int, n)
+	if total == 0 {
+		for i, ranges := range Even(n) {
+			shares[i] = ranges.Len()
+		}
+		return shares
+	}
+
+	left := Count
+	for i, weight := range weights {
+		shares[i] = int(float64(Count) * max(weight, 0) / total)
+		left -= shares[i]
+	}
+
+	for i := 0; left > 0; i = (i + 1) % n {
+		if weights[i] > 0 {
+			shares[i]++
+			left--
+		}
+	}
+
+	return shares
+}
+
+// Move is a set of slots changing owner
+type Move struct {
+	Source string // Address of the node owning the slots
+	Target string // Address of the node the slots move to
+	Ranges Ranges // Slots moving
+}
+
+// Moves returns the slots owned by another node in next, by source and target
+func (t *Table) Moves(next *Table) []Move {
+	if t == nil || next == nil {
+		return nil
+	}
+
+	var moves []Move
+	seen := make(map[[2]string]bool)
+	for slot := range t.owners {
+		pair := [2]string{t.owners[slot], next.owners[slot]}
+		if pair[0] == pair[1] || seen[pair] {
+			continue
+		}
+		seen[pair] = true
+
+		moves = append(moves, Move{
+			Source: pair[0],
+			Target: pair[1],
+			Ranges: collect(func(slot int) bool { return t.owners[slot] == pair[0] && next.owners[slot] == pair[1] }),
+		})
+	}
+
+	return moves
+}
@@ -0,0 +1,208 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package slots
+
+import (
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	if Slot("user:1") != Slot("user:1") {
+		t.Fatal("Expected the slot of a key to be stable")
+	}
+
+	seen := make(map[int]bool)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		slot := Slot(key)
+		if slot < 0 || slot >= Count {
+			t.Fatalf("Slot %d out of range", slot)
+		}
+		seen[slot] = true
+	}
+
+	if len(seen) < 2 {
+		t.Error("Expected keys to hash to different slots")
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	ranges, err := ParseRanges("0-99, 200,300-300")
+	if err != nil {
+		t.Fatalf("Failed to parse ranges: %v", err)
+	}
+
+	if ranges.String() != "0-99,200,300" || ranges.Len() != 102 {
+		t.Errorf("Unexpected ranges %s with %d slots", ranges, ranges.Len())
+	}
+
+	if !ranges.Contains(99) || !ranges.Contains(200) || ranges.Contains(100) {
+		t.Error("Unexpected Contains")
+	}
+
+	if ranges, err = ParseRanges(""); err != nil || len(ranges) != 0 {
+		t.Errorf("Expected no slots, got %v %v", ranges, err)
+	}
+
+	for _, invalid := range []string{"a", "5-2", "-1", "16384", "0-x"} {
+		if _, err := ParseRanges(invalid); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestComplementEven(t *testing.T) {
+	ranges, _ := ParseRanges("0-99,200")
+	if c := ranges.Complement(); c.String() != "100-199,201-16383" {
+		t.Errorf("Unexpected complement %s", c)
+	}
+
+	split := Even(3)
+	if split[0].String() != "0-5461" || split[1].String() != "5462-10922" || split[2].String() != "10923-16383" {
+		t.Errorf("Unexpected split %v", split)
+	}
+}
+
+func TestTable(t *testing.T) {
+	split := Even(2)
+	table, err := NewTable(map[string]Ranges{"a": split[0], "b": split[1]})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	owner := "a"
+	if Slot("key") > split[0][0].End {
+		owner = "b"
+	}
+
+	if table.Owner("key") != owner {
+		t.Errorf("Expected owner %s, got %s", owner, table.Owner("key"))
+	}
+
+	if table.Ranges("b").String() != split[1].String() {
+		t.Errorf("Unexpected ranges %s", table.Ranges("b"))
+	}
+
+	if _, err = NewTable(map[string]Ranges{"a": split[0]}); err == nil || err.Error() != "slot 8192 is not assigned" {
+		t.Errorf("Expected unassigned slot error, got %v", err)
+	}
+
+	if _, err = NewTable(map[string]Ranges{"a": Even(1)[0], "b": {{Start: 5, End: 5}}}); err == nil {
+		t.Error("Expected error for a slot assigned twice")
+	}
+}
+
+func TestBalance(t *testing.T) {
+	// No slots owned is the even split
+	balanced, err := Balance(nil, []string{"a", "b"})
+	if err != nil {
+		t.Fatalf("Failed to balance: %v", err)
+	}
+
+	if balanced["a"].String() != "0-8191" || balanced["b"].String() != "8192-16383" {
+		t.Errorf("Unexpected split %s %s", balanced["a"], balanced["b"])
+	}
+
+	// A new node takes the slots over the share of the others
+	balanced, err = Balance(balanced, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("Failed to balance: %v", err)
+	}
+
+	if balanced["a"].String() != "0-5461" || balanced["b"].String() != "8192-13652" || balanced["c"].String() != "5462-8191,13653-16383" {
+		t.Errorf("Unexpected split %s %s %s", balanced["a"], balanced["b"], balanced["c"])
+	}
+
+	// The slots of a removed node are handed out
+	balanced, err = Balance(balanced, []string{"a", "c"})
+	if err != nil {
+		t.Fatalf("Failed to balance: %v", err)
+	}
+
+	if balanced["a"].Len() != 8192 || balanced["c"].Len() != 8192 || !balanced["a"].Contains(0) || !balanced["c"].Contains(16383) {
+		t.Errorf("Unexpected split %s %s", balanced["a"], balanced["c"])
+	}
+
+	if _, err = Balance(map[string]Ranges{"a": {{Start: 0, End: 10}}, "b": {{Start: 10, End: 10}}}, []string{"a", "b"}); err == nil || err.Error() != "slot 10 is assigned to a and b" {
+		t.Errorf("Expected slot assigned twice error, got %v", err)
+	}
+
+	if _, err = Balance(nil, nil); err == nil {
+		t.Error("Expected error without nodes")
+	}
+}
+
+func TestMoves(t *testing.T) {
+	before, err := NewTable(map[string]Ranges{"a": Even(2)[0], "b": Even(2)[1]})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	after, err := NewTable(map[string]Ranges{"a": {{Start: 0, End: 99}}, "b": {{Start: 100, End: 16383}}})
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	moves := before.Moves(after)
+	if len(moves) != 1 || moves[0].Source != "a" || moves[0].Target != "b" || moves[0].Ranges.String() != "100-8191" {
+		t.Errorf("Unexpected moves %v", moves)
+	}
+
+	if moves = before.Moves(before); len(moves) != 0 {
+		t.Errorf("Expected no moves, got %v", moves)
+	}
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	balanced, err := BalanceWeighted(nil, []string{"a", "b"}, []float64{3, 1})
+	if err != nil {
+		t.Fatalf("Failed to balance: %v", err)
+	}
+
+	if balanced["a"].String() != "0-12287" || balanced["b"].String() != "12288-16383" {
+		t.Errorf("Unexpected split %s %s", balanced["a"], balanced["b"])
+	}
+
+	// A node with no weight gives up its slots
+	balanced, err = BalanceWeighted(balanced, []string{"a", "b"}, []float64{0, 1})
+	if err != nil {
+		t.Fatalf("Failed to balance: %v", err)
+	}
+
+	if len(balanced["a"]) != 0 || balanced["b"].Len() != Count {
+		t.Errorf("Unexpected split %s %s", balanced["a"], balanced["b"])
+	}
+
+	if shares := Shares([]float64{0, 0, 0}, 3); shares[0] != 5462 || shares[2] != 5461 {
+		t.Errorf("Expected even shares, got %v", shares)
+	}
+
+	if _, err = BalanceWeighted(nil, []string{"a"}, []float64{1, 2}); err == nil {
+		t.Error("Expected error for a weight count mismatch")
+	}
+}
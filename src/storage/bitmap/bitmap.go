@@ -0,0 +1,241 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package bitmap
+
+// A bitmap value addressed by bit offset
+// Bits are ordered from the most significant bit of the first byte, offset 0 is the highest bit of byte 0.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+)
+
+// MaxOffset is the largest bit offset a bitmap can address, 512MB of bits
+const MaxOffset = 1<<32 - 1
+
+// Bitmap is a growable array of bits
+type Bitmap struct {
+	Bits []byte // The bitmap bytes
+}
+
+// New creates a new empty bitmap
+func New() *Bitmap {
+	return &Bitmap{}
+}
+
+// Load gets the bitmap stored under key in the hash table
+// If create is true and the key does not exist a new bitmap is stored
+func Load(ht *hashtable.HashTable, key string, create bool) (*Bitmap, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		if !create {
+			return nil, errors.New("key not found")
+		}
+
+		b := New()
+		ht.Put(key, b)
+		return b, nil
+	}
+
+	b, ok := value.(*Bitmap)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return b, nil
+}
+
+// Decode decodes a bitmap from its base64 encoding
+func Decode(s string) (*Bitmap, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("invalid bitmap encoding")
+	}
+	return &Bitmap{Bits: data}, nil
+}
+
+// Encode encodes the bitmap as base64
+func (b *Bitmap) Encode() string {
+	return base64.StdEncoding.EncodeToString(b.Bits)
+}
+
+// String returns a short description of the bitmap
+func (b *Bitmap) String() string {
+	return fmt.Sprintf("bitmap %d", len(b.Bits))
+}
+
+// SetBit sets or clears the bit at offset and returns its previous value
+func (b *Bitmap) SetBit(offset uint64, value bool) (bool, error) {
+	if offset > MaxOffset {
+		return false, errors.New("bit offset out of range")
+	}
+
+	i := offset / 8
+	if i >= uint64(len(b.Bits)) {
+		grown := make([]byte, i+1)
+		copy(grown, b.Bits)
+		b.Bits = grown
+	}
+
+	mask := byte(0x80 >> (offset % 8))
+	old := b.Bits[i]&mask != 0
+
+	if value {
+		b.Bits[i] |= mask
+	} else {
+		b.Bits[i] &^= mask
+	}
+
+	return old, nil
+}
+
+// GetBit returns the bit at offset, bits past the end are 0
+func (b *Bitmap) GetBit(offset uint64) bool {
+	i := offset / 8
+	if i >= uint64(len(b.Bits)) {
+		return false
+	}
+	return b.Bits[i]&(0x80>>(offset%8)) != 0
+}
+
+// Count returns the number of set bits between the start and end bytes inclusive
+// Negative positions count back from the last byte, -1 is the last byte
+func (b *Bitmap) Count(start, end int64) int {
+	n := int64(len(b.Bits))
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+
+	count := 0
+	for i := start; i <= end; i++ {
+		count += bits.OnesCount8(b.Bits[i])
+	}
+	return count
+}
+
+// ParseRange parses the start and end byte positions of a count
+func ParseRange(start, end string) (int64, int64, error) {
+	s, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	e, err := strconv.ParseInt(end, 10, 64)
+	if err != nil {
+		return 0, 0, errors.New("invalid range")
+	}
+
+	return s, e, nil
+}
+
+// Merge sets every bit that is set in other
+func (b *Bitmap) Merge(other *Bitmap) {
+	if len(other.Bits) > len(b.Bits) {
+		grown := make([]byte, len(other.Bits))
+		copy(grown, b.Bits)
+		b.Bits = grown
+	}
+
+	for i, v := range other.Bits {
+		b.Bits[i] |= v
+	}
+}
+
+// Op performs a bitwise AND, OR, XOR or NOT over the sources and returns the result
+// Shorter sources are treated as zero padded, a nil source is an empty bitmap
+// NOT takes exactly one source
+func Op(op string, sources []*Bitmap) (*Bitmap, error) {
+	op = strings.ToUpper(op)
+
+	switch op {
+	case "AND", "OR", "XOR", "NOT":
+	default:
+		return nil, errors.New("invalid bitwise operation")
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no source bitmaps")
+	}
+
+	if op == "NOT" && len(sources) != 1 {
+		return nil, errors.New("NOT takes a single source bitmap")
+	}
+
+	length := 0
+	for _, src := range sources {
+		if src != nil && len(src.Bits) > length {
+			length = len(src.Bits)
+		}
+	}
+
+	// byteAt returns a source byte, zero past the end
+	byteAt := func(src *Bitmap, i int) byte {
+		if src == nil || i >= len(src.Bits) {
+			return 0
+		}
+		return src.Bits[i]
+	}
+
+	result := &Bitmap{Bits: make([]byte, length)}
+	for i := 0; i < length; i++ {
+		v := byteAt(sources[0], i)
+		for _, src := range sources[1:] {
+			switch op {
+			case "AND":
+				v &= byteAt(src, i)
+			case "OR":
+				v |= byteAt(src, i)
+			case "XOR":
+				v ^= byteAt(src, i)
+			}
+		}
+
+		if op == "NOT" {
+			v = ^v
+		}
+
+		result.Bits[i] = v
+	}
+
+	return result, nil
+}
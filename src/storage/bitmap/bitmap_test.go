@@ -0,0 +1,168 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package bitmap
+
+import (
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+func TestSetGetBit(t *testing.T) {
+	b := New()
+
+	old, err := b.SetBit(7, true)
+	if err != nil || old {
+		t.Fatalf("Expected unset bit, got %v (%v)", old, err)
+	}
+
+	old, _ = b.SetBit(7, true)
+	if !old {
+		t.Error("Expected bit to be set")
+	}
+
+	if len(b.Bits) != 1 || b.Bits[0] != 0x01 {
+		t.Errorf("Expected offset 7 to be the lowest bit of byte 0, got %08b", b.Bits)
+	}
+
+	b.SetBit(100, true)
+	if !b.GetBit(100) || b.GetBit(99) || b.GetBit(1000) {
+		t.Error("Unexpected bit values")
+	}
+
+	b.SetBit(100, false)
+	if b.GetBit(100) {
+		t.Error("Expected bit to be cleared")
+	}
+
+	if _, err = b.SetBit(MaxOffset+1, true); err == nil {
+		t.Error("Expected error for offset out of range")
+	}
+}
+
+func TestCount(t *testing.T) {
+	b := &Bitmap{Bits: []byte{0xff, 0x0f, 0x01}}
+
+	if n := b.Count(0, -1); n != 13 {
+		t.Errorf("Expected 13 bits, got %d", n)
+	}
+
+	if n := b.Count(1, 1); n != 4 {
+		t.Errorf("Expected 4 bits, got %d", n)
+	}
+
+	if n := b.Count(-2, -1); n != 5 {
+		t.Errorf("Expected 5 bits, got %d", n)
+	}
+
+	if n := b.Count(2, 1); n != 0 {
+		t.Errorf("Expected 0 bits for an empty range, got %d", n)
+	}
+
+	if n := New().Count(0, -1); n != 0 {
+		t.Errorf("Expected 0 bits for an empty bitmap, got %d", n)
+	}
+}
+
+func TestOp(t *testing.T) {
+	a := &Bitmap{Bits: []byte{0xf0, 0xff}}
+	b := &Bitmap{Bits: []byte{0x3c}}
+
+	tests := []struct {
+		op       string
+		sources  []*Bitmap
+		expected []byte
+	}{
+		{"AND", []*Bitmap{a, b}, []byte{0x30, 0x00}},
+		{"OR", []*Bitmap{a, b}, []byte{0xfc, 0xff}},
+		{"XOR", []*Bitmap{a, b}, []byte{0xcc, 0xff}},
+		{"NOT", []*Bitmap{b}, []byte{0xc3}},
+		{"OR", []*Bitmap{nil, b}, []byte{0x3c}},
+	}
+
+	for _, tc := range tests {
+		result, err := Op(tc.op, tc.sources)
+		if err != nil {
+			t.Fatalf("%s failed: %v", tc.op, err)
+		}
+
+		if string(result.Bits) != string(tc.expected) {
+			t.Errorf("%s: expected %08b, got %08b", tc.op, tc.expected, result.Bits)
+		}
+	}
+
+	if _, err := Op("NOT", []*Bitmap{a, b}); err == nil {
+		t.Error("Expected error for NOT with two sources")
+	}
+
+	if _, err := Op("NAND", []*Bitmap{a}); err == nil {
+		t.Error("Expected error for invalid operation")
+	}
+}
+
+func TestMergeAndEncoding(t *testing.T) {
+	a := &Bitmap{Bits: []byte{0x80}}
+	a.Merge(&Bitmap{Bits: []byte{0x01, 0x02}})
+
+	decoded, err := Decode(a.Encode())
+	if err != nil {
+		t.Fatalf("Failed to decode bitmap: %v", err)
+	}
+
+	if string(decoded.Bits) != string([]byte{0x81, 0x02}) {
+		t.Errorf("Unexpected merged bitmap %08b", decoded.Bits)
+	}
+
+	if _, err = Decode("not base64!"); err == nil {
+		t.Error("Expected error for invalid encoding")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "flags", false); err == nil {
+		t.Error("Expected error loading missing bitmap")
+	}
+
+	b, err := Load(ht, "flags", true)
+	if err != nil {
+		t.Fatalf("Failed to create bitmap: %v", err)
+	}
+	b.SetBit(3, true)
+
+	b, err = Load(ht, "flags", false)
+	if err != nil || !b.GetBit(3) {
+		t.Fatalf("Expected to load stored bitmap, got %v", err)
+	}
+
+	ht.Put("plain", "value")
+	if _, err = Load(ht, "plain", false); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
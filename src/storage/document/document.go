@@ -0,0 +1,517 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package document
+
+// JSON documents addressed with a subset of JSONPath
+// Paths start at the root $ and select members with .name or ["name"], array elements with [index]
+// where negative indexes count from the end, and every child with .* or [*].
+// Updates report the concrete paths they changed so they can be journaled and replayed as plain sets.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+)
+
+// Document is a JSON document
+type Document struct {
+	Root interface{} // The decoded document, numbers are kept as json.Number
+}
+
+// Change is a value written to a concrete path by an update
+type Change struct {
+	Path  string      // Concrete path without wildcards
+	Value interface{} // The new value at the path
+}
+
+// Path is a parsed path
+type Path []segment
+
+// segmentKind is the kind of a path segment
+type segmentKind int
+
+const (
+	member segmentKind = iota
+	index
+	wildcard
+)
+
+// segment is a single step of a path
+type segment struct {
+	kind  segmentKind
+	name  string // Member name
+	index int    // Array index
+}
+
+// match is a value selected by a path
+type match struct {
+	path  string            // Concrete path of the value
+	value interface{}       // The value
+	set   func(interface{}) // Replaces the value in its parent
+	name  string            // Member name within the parent object
+	index int               // Index within the parent array
+}
+
+// New creates a document from a decoded value
+func New(root interface{}) *Document {
+	return &Document{Root: root}
+}
+
+// Load gets the document stored under key in the hash table
+func Load(ht *hashtable.HashTable, key string) (*Document, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		return nil, errors.New("key not found")
+	}
+
+	d, ok := value.(*Document)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return d, nil
+}
+
+// Parse decodes a JSON value keeping numbers as json.Number
+func Parse(data string) (interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, errors.New("invalid json")
+	}
+
+	if dec.More() {
+		return nil, errors.New("invalid json")
+	}
+
+	return v, nil
+}
+
+// ParseAll decodes a sequence of whitespace separated JSON values
+func ParseAll(data string) ([]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+
+	var values []interface{}
+	for dec.More() {
+		var v interface{}
+		if err := dec.Decode(&v); err != nil {
+			return nil, errors.New("invalid json")
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// Encode encodes a value as compact JSON
+func Encode(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// String returns the document as compact JSON
+func (d *Document) String() string {
+	return Encode(d.Root)
+}
+
+// ParsePath parses a path such as $.users[0].name
+func ParsePath(s string) (Path, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, errors.New("invalid path")
+	}
+
+	var path Path
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case '.':
+			i++
+			if i < len(s) && s[i] == '*' {
+				path = append(path, segment{kind: wildcard})
+				i++
+				continue
+			}
+
+			j := i
+			for j < len(s) && s[j] != '.' && s[j] != '[' {
+				j++
+			}
+
+			if j == i {
+				return nil, errors.New("invalid path")
+			}
+
+			path = append(path, segment{kind: member, name: s[i:j]})
+			i = j
+		case '[':
+			seg, n, err := parseBracket(s[i:])
+			if err != nil {
+				return nil, err
+			}
+
+			path = append(path, seg)
+			i += n
+		default:
+			return nil, errors.New("invalid path")
+		}
+	}
+
+	return path, nil
+}
+
+// parseBracket parses a bracketed segment at the start of s and returns it with its length
+func parseBracket(s string) (segment, int, error) {
+	if len(s) > 1 && (s[1] == '"' || s[1] == '\'') {
+		// A quoted member name, the closing quote is the first one not escaped
+		quote := s[1]
+		j := 2
+		for j < len(s) && s[j] != quote {
+			if s[j] == '\\' {
+				j++
+			}
+			j++
+		}
+
+		if j+1 >= len(s) || s[j+1] != ']' {
+			return segment{}, 0, errors.New("invalid path")
+		}
+
+		name := s[2:j]
+		if quote == '"' {
+			if err := json.Unmarshal([]byte(s[1:j+1]), &name); err != nil {
+				return segment{}, 0, errors.New("invalid path")
+			}
+		}
+
+		return segment{kind: member, name: name}, j + 2, nil
+	}
+
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return segment{}, 0, errors.New("invalid path")
+	}
+
+	if s[1:end] == "*" {
+		return segment{kind: wildcard}, end + 1, nil
+	}
+
+	i, err := strconv.Atoi(s[1:end])
+	if err != nil {
+		return segment{}, 0, errors.New("invalid path")
+	}
+
+	return segment{kind: index, index: i}, end + 1, nil
+}
+
+// IsRoot returns true if the path selects the whole document
+func (p Path) IsRoot() bool {
+	return len(p) == 0
+}
+
+// memberPath returns the concrete path step for a member name
+// Names that are not plain identifiers are quoted with whitespace escaped so paths never contain spaces
+func memberPath(name string) string {
+	plain := name != ""
+	for i, r := range name {
+		if !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || i > 0 && r >= '0' && r <= '9') {
+			plain = false
+			break
+		}
+	}
+
+	if plain {
+		return "." + name
+	}
+
+	quoted, _ := json.Marshal(name)
+	return "[" + strings.ReplaceAll(string(quoted), " ", "\\u0020") + "]"
+}
+
+// children returns the children of m selected by a segment
+func children(m match, seg segment) []match {
+	var results []match
+
+	switch v := m.value.(type) {
+	case map[string]interface{}:
+		names := []string{seg.name}
+		if seg.kind == wildcard {
+			names = make([]string, 0, len(v))
+			for name := range v {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		} else if seg.kind != member {
+			return nil
+		}
+
+		for _, name := range names {
+			child, ok := v[name]
+			if !ok {
+				continue
+			}
+
+			name := name
+			results = append(results, match{path: m.path + memberPath(name), value: child, set: func(nv interface{}) { v[name] = nv }, name: name})
+		}
+	case []interface{}:
+		var indexes []int
+		switch seg.kind {
+		case wildcard:
+			for i := range v {
+				indexes = append(indexes, i)
+			}
+		case index:
+			i := seg.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				indexes = append(indexes, i)
+			}
+		}
+
+		for _, i := range indexes {
+			i := i
+			results = append(results, match{path: m.path + "[" + strconv.Itoa(i) + "]", value: v[i], set: func(nv interface{}) { v[i] = nv }, index: i})
+		}
+	}
+
+	return results
+}
+
+// walk returns every value selected by a path
+func (d *Document) walk(path Path) []match {
+	matches := []match{{path: "$", value: d.Root, set: func(nv interface{}) { d.Root = nv }}}
+
+	for _, seg := range path {
+		var next []match
+		for _, m := range matches {
+			next = append(next, children(m, seg)...)
+		}
+		matches = next
+	}
+
+	return matches
+}
+
+// Get returns every value selected by a path
+func (d *Document) Get(path Path) []interface{} {
+	values := make([]interface{}, 0)
+	for _, m := range d.walk(path) {
+		values = append(values, m.value)
+	}
+	return values
+}
+
+// Set writes a value at a path
+// The parent of the last segment must exist, a missing member is added to an object but arrays are not extended
+func (d *Document) Set(path Path, value interface{}) ([]Change, error) {
+	if path.IsRoot() {
+		d.Root = value
+		return []Change{{Path: "$", Value: value}}, nil
+	}
+
+	last := path[len(path)-1]
+
+	var changes []Change
+	for _, parent := range d.walk(path[:len(path)-1]) {
+		targets := children(parent, last)
+
+		// A new member of an object
+		if obj, ok := parent.value.(map[string]interface{}); ok && last.kind == member && len(targets) == 0 {
+			name := last.name
+			targets = append(targets, match{path: parent.path + memberPath(name), set: func(nv interface{}) { obj[name] = nv }})
+		}
+
+		for _, t := range targets {
+			v := clone(value) // Every target gets its own copy
+			t.set(v)
+			changes = append(changes, Change{Path: t.path, Value: v})
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil, errors.New("path not found")
+	}
+
+	return changes, nil
+}
+
+// Delete removes the values selected by a path and returns how many were removed
+// The changes are the new values of the parents, the root can not be deleted from a document
+func (d *Document) Delete(path Path) (int, []Change) {
+	if path.IsRoot() {
+		return 0, nil
+	}
+
+	last := path[len(path)-1]
+
+	deleted := 0
+	var changes []Change
+	for _, parent := range d.walk(path[:len(path)-1]) {
+		targets := children(parent, last)
+		if len(targets) == 0 {
+			continue
+		}
+
+		switch v := parent.value.(type) {
+		case map[string]interface{}:
+			for _, t := range targets {
+				delete(v, t.name)
+			}
+		case []interface{}:
+			removed := make(map[int]bool, len(targets))
+			for _, t := range targets {
+				removed[t.index] = true
+			}
+
+			remaining := make([]interface{}, 0, len(v))
+			for i, element := range v {
+				if !removed[i] {
+					remaining = append(remaining, element)
+				}
+			}
+			parent.set(remaining)
+			parent.value = remaining
+		}
+
+		deleted += len(targets)
+		changes = append(changes, Change{Path: parent.path, Value: parent.value})
+	}
+
+	return deleted, changes
+}
+
+// NumIncrBy adds a number to every number selected by a path and returns the new values
+func (d *Document) NumIncrBy(path Path, by string) ([]interface{}, []Change, error) {
+	matches := d.walk(path)
+	if len(matches) == 0 {
+		return nil, nil, errors.New("path not found")
+	}
+
+	// We check every value before changing any so the update is all or nothing
+	for _, m := range matches {
+		if _, ok := m.value.(json.Number); !ok {
+			return nil, nil, errors.New("value is not a number")
+		}
+	}
+
+	var results []interface{}
+	var changes []Change
+	for _, m := range matches {
+		sum, err := addNumbers(m.value.(json.Number), by)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m.set(sum)
+		results = append(results, sum)
+		changes = append(changes, Change{Path: m.path, Value: sum})
+	}
+
+	return results, changes, nil
+}
+
+// addNumbers adds two JSON numbers, integers stay integers
+func addNumbers(a json.Number, b string) (json.Number, error) {
+	x, errX := strconv.ParseInt(string(a), 10, 64)
+	y, errY := strconv.ParseInt(b, 10, 64)
+	if errX == nil && errY == nil {
+		return json.Number(strconv.FormatInt(x+y, 10)), nil
+	}
+
+	fx, err := strconv.ParseFloat(string(a), 64)
+	if err != nil {
+		return "", errors.New("value is not a number")
+	}
+
+	fy, err := strconv.ParseFloat(b, 64)
+	if err != nil {
+		return "", errors.New("invalid number")
+	}
+
+	return json.Number(strconv.FormatFloat(fx+fy, 'f', -1, 64)), nil
+}
+
+// ArrAppend appends values to every array selected by a path and returns the new lengths
+func (d *Document) ArrAppend(path Path, values []interface{}) ([]interface{}, []Change, error) {
+	matches := d.walk(path)
+	if len(matches) == 0 {
+		return nil, nil, errors.New("path not found")
+	}
+
+	for _, m := range matches {
+		if _, ok := m.value.([]interface{}); !ok {
+			return nil, nil, errors.New("value is not an array")
+		}
+	}
+
+	var results []interface{}
+	var changes []Change
+	for _, m := range matches {
+		arr := m.value.([]interface{})
+		for _, v := range values {
+			arr = append(arr, clone(v))
+		}
+
+		m.set(arr)
+		results = append(results, len(arr))
+		changes = append(changes, Change{Path: m.path, Value: arr})
+	}
+
+	return results, changes, nil
+}
+
+// clone deep copies a decoded value
+func clone(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			c[k] = clone(child)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, child := range v {
+			c[i] = clone(child)
+		}
+		return c
+	}
+	return v
+}
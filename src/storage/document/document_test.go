@@ -0,0 +1,240 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package document
+
+import (
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+// mustDocument parses a document or fails the test
+func mustDocument(t *testing.T, data string) *Document {
+	root, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+	return New(root)
+}
+
+// mustPath parses a path or fails the test
+func mustPath(t *testing.T, s string) Path {
+	p, err := ParsePath(s)
+	if err != nil {
+		t.Fatalf("Failed to parse path %s: %v", s, err)
+	}
+	return p
+}
+
+func TestParsePath(t *testing.T) {
+	p := mustPath(t, `$.users[0]["first name"]['x'].*[*][-1]`)
+	if len(p) != 7 {
+		t.Fatalf("Expected 7 segments, got %d", len(p))
+	}
+
+	if p[0].name != "users" || p[1].index != 0 || p[2].name != "first name" || p[3].name != "x" {
+		t.Errorf("Unexpected segments %+v", p)
+	}
+
+	if p[4].kind != wildcard || p[5].kind != wildcard || p[6].index != -1 {
+		t.Errorf("Unexpected segments %+v", p)
+	}
+
+	if !mustPath(t, "$").IsRoot() {
+		t.Error("Expected $ to be the root")
+	}
+
+	for _, invalid := range []string{"users", "$.", "$[abc]", "$[0", `$["a]`, "$x"} {
+		if _, err := ParsePath(invalid); err == nil {
+			t.Errorf("Expected error for path %s", invalid)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	d := mustDocument(t, `{"users":[{"name":"alice","age":30},{"name":"bob","age":25}],"count":2}`)
+
+	if got := Encode(d.Get(mustPath(t, "$.users[*].name"))); got != `["alice","bob"]` {
+		t.Errorf("Unexpected names %s", got)
+	}
+
+	if got := Encode(d.Get(mustPath(t, "$.users[-1].age"))); got != `[25]` {
+		t.Errorf("Unexpected age %s", got)
+	}
+
+	if got := Encode(d.Get(mustPath(t, "$.missing"))); got != `[]` {
+		t.Errorf("Expected no matches, got %s", got)
+	}
+
+	if d.String() != `{"count":2,"users":[{"age":30,"name":"alice"},{"age":25,"name":"bob"}]}` {
+		t.Errorf("Unexpected document %s", d)
+	}
+}
+
+func TestSet(t *testing.T) {
+	d := mustDocument(t, `{"a":{"b":1},"list":[1,2]}`)
+
+	value, _ := Parse(`{"c":true}`)
+	changes, err := d.Set(mustPath(t, "$.a.new"), value)
+	if err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	if len(changes) != 1 || changes[0].Path != "$.a.new" {
+		t.Errorf("Unexpected changes %+v", changes)
+	}
+
+	value, _ = Parse(`3`)
+	if _, err = d.Set(mustPath(t, "$.list[1]"), value); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	// Arrays are not extended and missing parents are not created
+	if _, err = d.Set(mustPath(t, "$.list[5]"), value); err == nil {
+		t.Error("Expected error setting past the end of an array")
+	}
+
+	if _, err = d.Set(mustPath(t, "$.x.y"), value); err == nil {
+		t.Error("Expected error setting under a missing member")
+	}
+
+	value, _ = Parse(`"v"`)
+	changes, err = d.Set(mustPath(t, `$["odd key"]`), value)
+	if err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+
+	// Concrete paths never contain spaces and parse back to the same member
+	if changes[0].Path != `$["odd\u0020key"]` {
+		t.Errorf("Unexpected concrete path %s", changes[0].Path)
+	}
+
+	if got := Encode(d.Get(mustPath(t, changes[0].Path))); got != `["v"]` {
+		t.Errorf("Expected the concrete path to select the value, got %s", got)
+	}
+
+	if d.String() != `{"a":{"b":1,"new":{"c":true}},"list":[1,3],"odd key":"v"}` {
+		t.Errorf("Unexpected document %s", d)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	d := mustDocument(t, `{"a":1,"b":2,"list":[1,2,3],"nested":[{"x":1},{"x":2}]}`)
+
+	deleted, changes := d.Delete(mustPath(t, "$.a"))
+	if deleted != 1 || len(changes) != 1 || changes[0].Path != "$" {
+		t.Errorf("Unexpected delete %d %+v", deleted, changes)
+	}
+
+	deleted, changes = d.Delete(mustPath(t, "$.list[1]"))
+	if deleted != 1 || changes[0].Path != "$.list" || Encode(changes[0].Value) != "[1,3]" {
+		t.Errorf("Unexpected delete %d %+v", deleted, changes)
+	}
+
+	deleted, _ = d.Delete(mustPath(t, "$.nested[*].x"))
+	if deleted != 2 {
+		t.Errorf("Expected 2 deleted, got %d", deleted)
+	}
+
+	deleted, _ = d.Delete(mustPath(t, "$.missing"))
+	if deleted != 0 {
+		t.Errorf("Expected nothing deleted, got %d", deleted)
+	}
+
+	if d.String() != `{"b":2,"list":[1,3],"nested":[{},{}]}` {
+		t.Errorf("Unexpected document %s", d)
+	}
+}
+
+func TestNumIncrBy(t *testing.T) {
+	d := mustDocument(t, `{"counts":[1,2.5],"name":"x"}`)
+
+	results, changes, err := d.NumIncrBy(mustPath(t, "$.counts[*]"), "2")
+	if err != nil {
+		t.Fatalf("Failed to increment: %v", err)
+	}
+
+	if Encode(results) != "[3,4.5]" || len(changes) != 2 || changes[1].Path != "$.counts[1]" {
+		t.Errorf("Unexpected increment %v %+v", results, changes)
+	}
+
+	// Nothing changes when any value is not a number
+	if _, _, err = d.NumIncrBy(mustPath(t, "$.*"), "1"); err == nil {
+		t.Error("Expected error incrementing a string")
+	}
+
+	if d.String() != `{"counts":[3,4.5],"name":"x"}` {
+		t.Errorf("Unexpected document %s", d)
+	}
+}
+
+func TestArrAppend(t *testing.T) {
+	d := mustDocument(t, `{"tags":["a"],"n":1}`)
+
+	b, _ := Parse(`"b"`)
+	c, _ := Parse(`{"c":1}`)
+	results, changes, err := d.ArrAppend(mustPath(t, "$.tags"), []interface{}{b, c})
+	if err != nil {
+		t.Fatalf("Failed to append: %v", err)
+	}
+
+	if Encode(results) != "[3]" || Encode(changes[0].Value) != `["a","b",{"c":1}]` {
+		t.Errorf("Unexpected append %v %+v", results, changes)
+	}
+
+	if _, _, err = d.ArrAppend(mustPath(t, "$.n"), []interface{}{b}); err == nil {
+		t.Error("Expected error appending to a number")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "doc"); err == nil {
+		t.Error("Expected error loading missing document")
+	}
+
+	ht.Put("doc", mustDocument(t, `{}`))
+	if _, err := Load(ht, "doc"); err != nil {
+		t.Errorf("Expected stored document, got %v", err)
+	}
+
+	ht.Put("plain", "value")
+	if _, err := Load(ht, "plain"); err == nil {
+		t.Error("Expected wrong type error")
+	}
+
+	if _, err := Parse(`{"a":1} {"b":2}`); err == nil {
+		t.Error("Expected error parsing trailing data")
+	}
+
+	values, err := ParseAll(`{"a":1} "b c" 3`)
+	if err != nil || len(values) != 3 {
+		t.Errorf("Expected 3 values, got %v %v", values, err)
+	}
+}
@@ -0,0 +1,307 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package fulltext
+
+// Full-text indexes over string values
+// An index covers the values stored under keys matching its pattern.  Values are split into lower case terms and kept
+// in an inverted index, queries combine terms with AND, OR and NOT and results are ranked by TF-IDF.
+// The postings are not journaled, they are rebuilt from the stored values on recovery.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+	"unicode"
+)
+
+const DefaultLimit = 10 // Results returned by a search without a limit
+
+// Result is a search result
+type Result struct {
+	Key   string  // The key of the matching value
+	Score float64 // TF-IDF score of the value for the query
+}
+
+// Index is an inverted index
+type Index struct {
+	Name     string                    // Index name
+	Pattern  string                    // Pattern of the keys covered by the index
+	pattern  *regexp.Regexp            // Compiled pattern
+	postings map[string]map[string]int // Keys containing each term and how many times
+	docs     map[string]*doc           // Indexed values by key
+}
+
+// doc is an indexed value
+type doc struct {
+	value  string         // The value as indexed, used to skip values replaced behind the index
+	terms  map[string]int // Occurrences of each term
+	length int            // Number of terms
+}
+
+// Tokenize splits text into lower case terms of letters and digits
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// ParseCreateArgs parses [PATTERN <pattern>] index options
+// The pattern defaults to keys prefixed with the index name and a colon
+func ParseCreateArgs(name string, args []string) (*Index, error) {
+	pattern := "^" + regexp.QuoteMeta(name) + ":"
+
+	if len(args)%2 != 0 {
+		return nil, errors.New("invalid command")
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "PATTERN":
+			pattern = args[i+1]
+		default:
+			return nil, errors.New("invalid command")
+		}
+	}
+
+	return NewIndex(name, pattern)
+}
+
+// ParseSearchArgs parses "<query>" [LIMIT <n>] search arguments
+// A query without quotes is a single word
+func ParseSearchArgs(args string) (string, int, error) {
+	args = strings.TrimSpace(args)
+
+	var query string
+	if strings.HasPrefix(args, `"`) {
+		end := strings.Index(args[1:], `"`)
+		if end < 0 {
+			return "", 0, errors.New("unterminated query")
+		}
+		query, args = args[1:end+1], args[end+2:]
+	} else {
+		query, args, _ = strings.Cut(args, " ")
+	}
+
+	if strings.TrimSpace(query) == "" {
+		return "", 0, errors.New("invalid query")
+	}
+
+	limit := DefaultLimit
+	opts := strings.Fields(args)
+	switch {
+	case len(opts) == 0:
+	case len(opts) == 2 && strings.ToUpper(opts[0]) == "LIMIT":
+		var err error
+		if limit, err = strconv.Atoi(opts[1]); err != nil || limit <= 0 {
+			return "", 0, errors.New("invalid limit")
+		}
+	default:
+		return "", 0, errors.New("invalid command")
+	}
+
+	return query, limit, nil
+}
+
+// NewIndex creates an empty index
+func NewIndex(name, pattern string) (*Index, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &Index{Name: name, Pattern: pattern, pattern: re}
+	ix.reset()
+	return ix, nil
+}
+
+// reset empties the index
+func (ix *Index) reset() {
+	ix.postings = make(map[string]map[string]int)
+	ix.docs = make(map[string]*doc)
+}
+
+// LoadIndex gets the index stored under name in the hash table
+func LoadIndex(ht *hashtable.HashTable, name string) (*Index, error) {
+	value, _, ok := ht.Get(name)
+	if !ok {
+		return nil, errors.New("index not found")
+	}
+
+	ix, ok := value.(*Index)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return ix, nil
+}
+
+// Rebuild rebuilds the postings of every index in the hash table from the stored values
+// Returns the indexes by name
+func Rebuild(ht *hashtable.HashTable) map[string]*Index {
+	indexes := make(map[string]*Index)
+
+	entries := ht.Traverse(nil)
+	for _, entry := range entries {
+		if ix, ok := entry.Value.(*Index); ok {
+			ix.reset()
+			indexes[entry.Key] = ix
+		}
+	}
+
+	for _, entry := range entries {
+		value, ok := entry.Value.(string)
+		if !ok {
+			continue
+		}
+
+		for _, ix := range indexes {
+			if ix.Covers(entry.Key) {
+				ix.Update(entry.Key, value)
+			}
+		}
+	}
+
+	return indexes
+}
+
+// String returns a short description of the index
+func (ix *Index) String() string {
+	return fmt.Sprintf("textindex %d %s", len(ix.docs), ix.Pattern)
+}
+
+// Covers returns true if the index covers values stored under key
+func (ix *Index) Covers(key string) bool {
+	return ix.pattern.MatchString(key)
+}
+
+// Len returns the number of indexed values
+func (ix *Index) Len() int {
+	return len(ix.docs)
+}
+
+// Update indexes the value stored under key replacing what was indexed before
+func (ix *Index) Update(key, value string) {
+	ix.Remove(key)
+
+	d := &doc{value: value, terms: make(map[string]int)}
+	for _, term := range Tokenize(value) {
+		d.terms[term]++
+		d.length++
+	}
+
+	for term, count := range d.terms {
+		keys, ok := ix.postings[term]
+		if !ok {
+			keys = make(map[string]int)
+			ix.postings[term] = keys
+		}
+		keys[key] = count
+	}
+
+	ix.docs[key] = d
+}
+
+// Remove removes the value stored under key from the index
+func (ix *Index) Remove(key string) {
+	d, ok := ix.docs[key]
+	if !ok {
+		return
+	}
+
+	for term := range d.terms {
+		delete(ix.postings[term], key)
+		if len(ix.postings[term]) == 0 {
+			delete(ix.postings, term)
+		}
+	}
+
+	delete(ix.docs, key)
+}
+
+// Search returns up to limit values matching the query ranked by score
+// Terms under a NOT do not contribute to the score
+func (ix *Index) Search(ht *hashtable.HashTable, query string, limit int) ([]Result, error) {
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []string
+	q.positive(false, &terms)
+
+	var results []Result
+	for key := range q.match(ix) {
+		d := ix.docs[key]
+
+		// Values replaced by a write the index did not see are skipped
+		if value, _, ok := ht.Get(key); !ok || value != d.value {
+			continue
+		}
+
+		results = append(results, Result{Key: key, Score: ix.score(d, terms)})
+	}
+
+	SortResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// score returns the TF-IDF score of an indexed value for the terms
+func (ix *Index) score(d *doc, terms []string) float64 {
+	score := 0.0
+	for _, term := range terms {
+		count := d.terms[term]
+		if count == 0 {
+			continue
+		}
+
+		tf := float64(count) / float64(d.length)
+		idf := math.Log(1 + float64(len(ix.docs))/float64(len(ix.postings[term])))
+		score += tf * idf
+	}
+	return score
+}
+
+// SortResults sorts results by descending score then key
+func SortResults(results []Result) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Key < results[j].Key
+	})
+}
@@ -0,0 +1,219 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package fulltext
+
+import (
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	terms := Tokenize("Hello, World! It's 2025 -- café")
+	expected := []string{"hello", "world", "it", "s", "2025", "café"}
+	if len(terms) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, terms)
+	}
+	for i := range expected {
+		if terms[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, terms)
+			break
+		}
+	}
+}
+
+func TestParseSearchArgs(t *testing.T) {
+	query, limit, err := ParseSearchArgs(`"quick fox" LIMIT 5`)
+	if err != nil {
+		t.Fatalf("Failed to parse search args: %v", err)
+	}
+	if query != "quick fox" || limit != 5 {
+		t.Errorf("Expected quick fox with limit 5, got %q %d", query, limit)
+	}
+
+	query, limit, err = ParseSearchArgs("fox")
+	if err != nil || query != "fox" || limit != DefaultLimit {
+		t.Errorf("Expected fox with default limit, got %q %d %v", query, limit, err)
+	}
+
+	if _, _, err = ParseSearchArgs(`"quick fox`); err == nil {
+		t.Error("Expected error for unterminated query")
+	}
+
+	if _, _, err = ParseSearchArgs(`"fox" LIMIT 0`); err == nil {
+		t.Error("Expected error for invalid limit")
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	for _, query := range []string{"fox", "quick AND fox", "quick OR (lazy -dog)", "NOT cat", "e-mail"} {
+		if _, err := ParseQuery(query); err != nil {
+			t.Errorf("Failed to parse %q: %v", query, err)
+		}
+	}
+
+	for _, query := range []string{"", "AND", "fox OR", "(fox", "fox)", "!!!"} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("Expected error parsing %q", query)
+		}
+	}
+}
+
+func newTestIndex(t *testing.T) (*hashtable.HashTable, *Index) {
+	ht := hashtable.New()
+	ix, err := ParseCreateArgs("docs", nil)
+	if err != nil {
+		t.Fatalf("Failed to create index: %v", err)
+	}
+	ht.Put("docs", ix)
+
+	values := map[string]string{
+		"docs:1": "The quick brown fox jumps over the lazy dog",
+		"docs:2": "A quick brown dog",
+		"docs:3": "Foxes and hounds, fox fox fox",
+		"docs:4": "Nothing to see here",
+		"other":  "quick fox outside the index",
+	}
+	for key, value := range values {
+		ht.Put(key, value)
+		if ix.Covers(key) {
+			ix.Update(key, value)
+		}
+	}
+
+	return ht, ix
+}
+
+func keys(results []Result) []string {
+	var keys []string
+	for _, r := range results {
+		keys = append(keys, r.Key)
+	}
+	return keys
+}
+
+func TestSearch(t *testing.T) {
+	ht, ix := newTestIndex(t)
+
+	if ix.Len() != 4 {
+		t.Errorf("Expected 4 indexed values, got %d", ix.Len())
+	}
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"fox", []string{"docs:3", "docs:1"}}, // docs:3 mentions fox more often
+		{"quick fox", []string{"docs:1"}},
+		{"quick AND fox", []string{"docs:1"}},
+		{"fox OR dog", []string{"docs:3", "docs:2", "docs:1"}},
+		{"quick -fox", []string{"docs:2"}},
+		{"NOT (fox OR dog)", []string{"docs:4"}},
+		{"QUICK", []string{"docs:2", "docs:1"}},
+		{"cat", nil},
+	}
+
+	for _, test := range tests {
+		results, err := ix.Search(ht, test.query, DefaultLimit)
+		if err != nil {
+			t.Fatalf("Failed to search %q: %v", test.query, err)
+		}
+
+		got := keys(results)
+		if len(got) != len(test.expected) {
+			t.Errorf("Search %q expected %v, got %v", test.query, test.expected, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("Search %q expected %v, got %v", test.query, test.expected, got)
+				break
+			}
+		}
+	}
+
+	results, _ := ix.Search(ht, "fox OR dog", 2)
+	if len(results) != 2 {
+		t.Errorf("Expected 2 results with limit, got %d", len(results))
+	}
+}
+
+func TestUpdateAndRemove(t *testing.T) {
+	ht, ix := newTestIndex(t)
+
+	ht.Put("docs:4", "a fox appears")
+	ix.Update("docs:4", "a fox appears")
+
+	results, _ := ix.Search(ht, "fox", DefaultLimit)
+	if len(results) != 3 {
+		t.Errorf("Expected 3 results after update, got %v", keys(results))
+	}
+
+	results, _ = ix.Search(ht, "nothing", DefaultLimit)
+	if len(results) != 0 {
+		t.Errorf("Expected old terms to be removed, got %v", keys(results))
+	}
+
+	ht.Delete("docs:3")
+	ix.Remove("docs:3")
+
+	results, _ = ix.Search(ht, "foxes", DefaultLimit)
+	if len(results) != 0 {
+		t.Errorf("Expected removed value to be gone, got %v", keys(results))
+	}
+
+	// A value replaced without updating the index is skipped
+	ht.Put("docs:1", "replaced")
+	results, _ = ix.Search(ht, "lazy", DefaultLimit)
+	if len(results) != 0 {
+		t.Errorf("Expected stale value to be skipped, got %v", keys(results))
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ht, _ := newTestIndex(t)
+
+	indexes := Rebuild(ht)
+	ix, ok := indexes["docs"]
+	if !ok {
+		t.Fatal("Expected docs index to be rebuilt")
+	}
+
+	if ix.Len() != 4 {
+		t.Errorf("Expected 4 indexed values, got %d", ix.Len())
+	}
+
+	results, _ := ix.Search(ht, "quick", DefaultLimit)
+	if len(results) != 2 {
+		t.Errorf("Expected 2 results after rebuild, got %v", keys(results))
+	}
+
+	if _, err := LoadIndex(ht, "docs:1"); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
@@ -0,0 +1,275 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package fulltext
+
+import (
+	"errors"
+	"strings"
+)
+
+// Query is a parsed search query
+// Words next to each other must all match, OR matches either side and NOT or a leading - excludes matches.
+// Parentheses group, NOT binds tighter than AND which binds tighter than OR.
+type Query interface {
+	match(ix *Index) map[string]bool        // Returns the keys matching the query
+	positive(negated bool, terms *[]string) // Collects the terms not excluded by a NOT
+}
+
+// termQuery matches values containing a term
+type termQuery struct {
+	term string
+}
+
+// andQuery matches values matching every child
+type andQuery struct {
+	children []Query
+}
+
+// orQuery matches values matching any child
+type orQuery struct {
+	children []Query
+}
+
+// notQuery matches values not matching its child
+type notQuery struct {
+	child Query
+}
+
+// queryParser is a recursive descent query parser
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+// ParseQuery parses a search query
+func ParseQuery(query string) (Query, error) {
+	p := &queryParser{tokens: lexQuery(query)}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("invalid query")
+	}
+
+	q, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("invalid query")
+	}
+
+	return q, nil
+}
+
+// lexQuery splits a query into words, operators and parentheses
+// A leading - is turned into a NOT
+func lexQuery(query string) []string {
+	query = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(query)
+
+	var tokens []string
+	for _, field := range strings.Fields(query) {
+		for len(field) > 1 && strings.HasPrefix(field, "-") {
+			tokens = append(tokens, "NOT")
+			field = field[1:]
+		}
+		tokens = append(tokens, field)
+	}
+	return tokens
+}
+
+// peek returns the next token or an empty string at the end
+func (p *queryParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// or parses <and> [OR <and>]...
+func (p *queryParser) or() (Query, error) {
+	var children []Query
+	for {
+		q, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, q)
+
+		if p.peek() != "OR" {
+			break
+		}
+		p.pos++
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &orQuery{children: children}, nil
+}
+
+// and parses <unary> [[AND] <unary>]...
+func (p *queryParser) and() (Query, error) {
+	var children []Query
+	for {
+		q, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, q)
+
+		if p.peek() == "AND" {
+			p.pos++
+			continue
+		}
+
+		if next := p.peek(); next == "" || next == "OR" || next == ")" {
+			break
+		}
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+	return &andQuery{children: children}, nil
+}
+
+// unary parses NOT <unary>, ( <or> ) or a word
+func (p *queryParser) unary() (Query, error) {
+	token := p.peek()
+	p.pos++
+
+	switch token {
+	case "", "AND", "OR", ")":
+		return nil, errors.New("invalid query")
+	case "NOT":
+		child, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &notQuery{child: child}, nil
+	case "(":
+		q, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, errors.New("invalid query")
+		}
+		p.pos++
+		return q, nil
+	}
+
+	// A word tokenized into several terms, such as e-mail, must match all of them
+	terms := Tokenize(token)
+	if len(terms) == 0 {
+		return nil, errors.New("invalid query")
+	}
+
+	if len(terms) == 1 {
+		return &termQuery{term: terms[0]}, nil
+	}
+
+	and := &andQuery{}
+	for _, term := range terms {
+		and.children = append(and.children, &termQuery{term: term})
+	}
+	return and, nil
+}
+
+// match returns the keys containing the term
+func (q *termQuery) match(ix *Index) map[string]bool {
+	keys := make(map[string]bool, len(ix.postings[q.term]))
+	for key := range ix.postings[q.term] {
+		keys[key] = true
+	}
+	return keys
+}
+
+// positive collects the term unless it is excluded
+func (q *termQuery) positive(negated bool, terms *[]string) {
+	if !negated {
+		*terms = append(*terms, q.term)
+	}
+}
+
+// match returns the keys matching every child
+func (q *andQuery) match(ix *Index) map[string]bool {
+	keys := q.children[0].match(ix)
+	for _, child := range q.children[1:] {
+		other := child.match(ix)
+		for key := range keys {
+			if !other[key] {
+				delete(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// positive collects the terms of every child
+func (q *andQuery) positive(negated bool, terms *[]string) {
+	for _, child := range q.children {
+		child.positive(negated, terms)
+	}
+}
+
+// match returns the keys matching any child
+func (q *orQuery) match(ix *Index) map[string]bool {
+	keys := make(map[string]bool)
+	for _, child := range q.children {
+		for key := range child.match(ix) {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// positive collects the terms of every child
+func (q *orQuery) positive(negated bool, terms *[]string) {
+	for _, child := range q.children {
+		child.positive(negated, terms)
+	}
+}
+
+// match returns the indexed keys not matching the child
+func (q *notQuery) match(ix *Index) map[string]bool {
+	excluded := q.child.match(ix)
+	keys := make(map[string]bool)
+	for key := range ix.docs {
+		if !excluded[key] {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// positive collects the terms of the child, flipping whether they are excluded
+func (q *notQuery) positive(negated bool, terms *[]string) {
+	q.child.positive(!negated, terms)
+}
@@ -0,0 +1,257 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package hashtable
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Number is a numeric value, an integer or a float
+type Number struct {
+	Int   int64   // The value when it is an integer
+	Float float64 // The value when it is a float
+	IsInt bool    // Whether the value is an integer
+}
+
+// Aggregate is a partial aggregate of numeric values
+// Partial aggregates of different nodes are merged before the result is taken
+type Aggregate struct {
+	Count    int64   // Number of values
+	IntSum   int64   // Sum of the integer values
+	FloatSum float64 // Sum of the float values
+	Floats   bool    // Whether any value was a float
+	Min      Number  // Smallest value
+	Max      Number  // Largest value
+}
+
+// AggregateOps are the aggregations that can be taken of an Aggregate
+var AggregateOps = []string{"COUNT", "SUM", "AVG", "MIN", "MAX"}
+
+// ParseNumeric parses a stored value as an integer, or as a float when it is not one, like Incr does
+// Returns false if the value is not numeric
+func ParseNumeric(value interface{}) (Number, bool) {
+	s := fmt.Sprint(value)
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Number{Int: i, IsInt: true}, true
+	}
+
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return Number{Float: f}, true
+	}
+
+	return Number{}, false
+}
+
+// Value returns the number as a float
+func (n Number) Value() float64 {
+	if n.IsInt {
+		return float64(n.Int)
+	}
+	return n.Float
+}
+
+// Less returns true if n is lower than other
+func (n Number) Less(other Number) bool {
+	if n.IsInt && other.IsInt {
+		return n.Int < other.Int
+	}
+	return n.Value() < other.Value()
+}
+
+// String formats the number with the original precision, like Incr does
+func (n Number) String() string {
+	if n.IsInt {
+		return strconv.FormatInt(n.Int, 10)
+	}
+	return strconv.FormatFloat(n.Float, 'f', -1, 64)
+}
+
+// Add adds a value to the aggregate
+func (a *Aggregate) Add(n Number) {
+	if n.IsInt {
+		a.IntSum += n.Int
+	} else {
+		a.FloatSum += n.Float
+		a.Floats = true
+	}
+
+	if a.Count == 0 || n.Less(a.Min) {
+		a.Min = n
+	}
+	if a.Count == 0 || a.Max.Less(n) {
+		a.Max = n
+	}
+
+	a.Count++
+}
+
+// Merge merges another partial aggregate into the aggregate
+func (a *Aggregate) Merge(other Aggregate) {
+	if other.Count == 0 {
+		return
+	}
+
+	if a.Count == 0 || other.Min.Less(a.Min) {
+		a.Min = other.Min
+	}
+	if a.Count == 0 || a.Max.Less(other.Max) {
+		a.Max = other.Max
+	}
+
+	a.Count += other.Count
+	a.IntSum += other.IntSum
+	a.FloatSum += other.FloatSum
+	a.Floats = a.Floats || other.Floats
+}
+
+// Sum returns the sum of the values, an integer unless a value was a float
+func (a *Aggregate) Sum() Number {
+	if !a.Floats {
+		return Number{Int: a.IntSum, IsInt: true}
+	}
+	return Number{Float: float64(a.IntSum) + a.FloatSum}
+}
+
+// Result returns the COUNT, SUM, AVG, MIN or MAX of the values
+func (a *Aggregate) Result(op string) (string, error) {
+	switch strings.ToUpper(op) {
+	case "COUNT":
+		return strconv.FormatInt(a.Count, 10), nil
+	case "SUM":
+		return a.Sum().String(), nil
+	}
+
+	if a.Count == 0 {
+		return "", fmt.Errorf("no numeric values")
+	}
+
+	switch strings.ToUpper(op) {
+	case "AVG":
+		return strconv.FormatFloat(a.Sum().Value()/float64(a.Count), 'f', -1, 64), nil
+	case "MIN":
+		return a.Min.String(), nil
+	case "MAX":
+		return a.Max.String(), nil
+	}
+
+	return "", fmt.Errorf("invalid aggregation")
+}
+
+// String encodes the partial aggregate as <count> <integer sum> <float sum> <min> <max>, floats are prefixed with f
+func (a *Aggregate) String() string {
+	floatSum := Number{IsInt: true}
+	if a.Floats {
+		floatSum = Number{Float: a.FloatSum}
+	}
+
+	return fmt.Sprintf("%d %d %s %s %s", a.Count, a.IntSum, encodeNumber(floatSum), encodeNumber(a.Min), encodeNumber(a.Max))
+}
+
+// ParseAggregate decodes a partial aggregate encoded by String
+func ParseAggregate(s string) (Aggregate, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return Aggregate{}, fmt.Errorf("invalid aggregate")
+	}
+
+	var a Aggregate
+	var err error
+	if a.Count, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return Aggregate{}, fmt.Errorf("invalid aggregate")
+	}
+	if a.IntSum, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return Aggregate{}, fmt.Errorf("invalid aggregate")
+	}
+	floatSum, err := decodeNumber(fields[2])
+	if err != nil {
+		return Aggregate{}, err
+	}
+	a.FloatSum, a.Floats = floatSum.Float, !floatSum.IsInt
+	if a.Min, err = decodeNumber(fields[3]); err != nil {
+		return Aggregate{}, err
+	}
+	if a.Max, err = decodeNumber(fields[4]); err != nil {
+		return Aggregate{}, err
+	}
+
+	return a, nil
+}
+
+// encodeNumber encodes a number keeping whether it is an integer, floats are prefixed with f
+func encodeNumber(n Number) string {
+	if n.IsInt {
+		return strconv.FormatInt(n.Int, 10)
+	}
+	return "f" + strconv.FormatFloat(n.Float, 'g', -1, 64)
+}
+
+// decodeNumber decodes a number encoded by encodeNumber
+func decodeNumber(s string) (Number, error) {
+	if f, ok := strings.CutPrefix(s, "f"); ok {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return Number{}, fmt.Errorf("invalid aggregate")
+		}
+		return Number{Float: v}, nil
+	}
+
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return Number{}, fmt.Errorf("invalid aggregate")
+	}
+	return Number{Int: i, IsInt: true}, nil
+}
+
+// ParseAggregateArgs parses <op> <pattern> [EXCLUDE <key>...] aggregation arguments
+// Besides the AggregateOps, KEYS and PARTIAL are accepted for the cluster to collect keys and partial aggregates
+// Returns the upper cased op, the key pattern and the excluded keys
+func ParseAggregateArgs(args []string) (string, string, []string, error) {
+	if len(args) < 2 {
+		return "", "", nil, fmt.Errorf("invalid command")
+	}
+
+	op := strings.ToUpper(args[0])
+	if !slices.Contains(AggregateOps, op) && op != "KEYS" && op != "PARTIAL" {
+		return "", "", nil, fmt.Errorf("invalid aggregation")
+	}
+
+	if len(args) == 2 {
+		return op, args[1], nil, nil
+	}
+
+	if strings.ToUpper(args[2]) != "EXCLUDE" || len(args) == 3 {
+		return "", "", nil, fmt.Errorf("invalid command")
+	}
+
+	return op, args[1], args[3:], nil
+}
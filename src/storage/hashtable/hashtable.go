@@ -30,17 +30,22 @@ package hashtable
 
 import (
 	"fmt"
+	"math/bits"
 	"regexp"
 	"strconv"
+	"strings"
+	"supermassive/hlc"
+	"supermassive/storage/skiplist"
 	"time"
 )
 
 // Entry is a key-value pair in the hash table
 type Entry struct {
-	Key       string      // The key witin the entry
-	Value     interface{} // The value within the entry
-	Timestamp time.Time   // The timestamp of the entry
-	PSL       uint32      // Probe sequence length
+	Key       string        // The key witin the entry
+	Value     interface{}   // The value within the entry
+	Timestamp time.Time     // The timestamp of the entry, the physical time of its version
+	Version   hlc.Timestamp // The hybrid logical clock timestamp of the write
+	PSL       uint32        // Probe sequence length
 }
 
 // FilterFunc is a function type for filtering entries
@@ -54,6 +59,10 @@ type HashTable struct {
 	// Growth and shrink thresholds
 	growThreshold   float64 // Threshold to grow the table
 	shrinkThreshold float64 // Threshold to shrink the table
+	// Ordered index of the keys for range scans, nil unless enabled
+	ordered *skiplist.SkipList
+	// Clock assigning the versions of writes, nil stamps writes with the physical time
+	clock *hlc.Clock
 }
 
 // Hashtable is not thread-safe**
@@ -90,7 +99,7 @@ func (ht *HashTable) resize(newSize uint32) {
 	// Reinsert all existing entries
 	for _, entry := range oldBuckets {
 		if entry.Key != "" { // Skip empty buckets
-			ht.Put(entry.Key, entry.Value)
+			ht.put(entry.Key, entry.Value, entry.Version)
 		}
 	}
 }
@@ -107,6 +116,42 @@ func (ht *HashTable) shouldShrink() bool {
 
 // Put inserts or updates a key-value pair in the hash table
 func (ht *HashTable) Put(key string, value interface{}) bool {
+	if ht.ordered != nil {
+		ht.ordered.Insert(key)
+	}
+
+	return ht.put(key, value, ht.now())
+}
+
+// PutVersion inserts or updates a key-value pair written with the given version, like a write replayed from a journal
+// The clock is moved past the version so later writes are newer
+func (ht *HashTable) PutVersion(key string, value interface{}, version hlc.Timestamp) bool {
+	if ht.ordered != nil {
+		ht.ordered.Insert(key)
+	}
+
+	if ht.clock != nil {
+		ht.clock.Update(version)
+	}
+
+	return ht.put(key, value, version)
+}
+
+// now returns the version of a write
+func (ht *HashTable) now() hlc.Timestamp {
+	if ht.clock == nil {
+		return hlc.FromTime(time.Now())
+	}
+	return ht.clock.Now()
+}
+
+// SetClock sets the clock assigning the versions of writes
+func (ht *HashTable) SetClock(clock *hlc.Clock) {
+	ht.clock = clock
+}
+
+// put inserts or updates a key-value pair in the buckets with the version it was written with
+func (ht *HashTable) put(key string, value interface{}, version hlc.Timestamp) bool {
 	// Check if we need to grow the table
 	if ht.shouldGrow() {
 		ht.resize(ht.size * 2) // Double the size
@@ -116,7 +161,8 @@ func (ht *HashTable) Put(key string, value interface{}) bool {
 	entry := Entry{
 		Key:       key,
 		Value:     value,
-		Timestamp: time.Now(),
+		Timestamp: version.Time(),
+		Version:   version,
 		PSL:       0,
 	}
 
@@ -132,6 +178,8 @@ func (ht *HashTable) Put(key string, value interface{}) bool {
 		// If key already exists, update value
 		if ht.buckets[index].Key == key {
 			ht.buckets[index].Value = value
+			ht.buckets[index].Timestamp = entry.Timestamp
+			ht.buckets[index].Version = version
 			return true
 		}
 
@@ -168,6 +216,28 @@ func (ht *HashTable) Get(key string) (interface{}, time.Time, bool) {
 	}
 }
 
+// GetVersion retrieves a value from the hash table with the version it was written with
+func (ht *HashTable) GetVersion(key string) (interface{}, hlc.Timestamp, bool) {
+	index := ht.hash(key)
+	probeLength := uint32(0)
+
+	for {
+		// If bucket is empty or we've probed too far
+		if ht.buckets[index].Key == "" || probeLength > ht.buckets[index].PSL {
+			return nil, hlc.Timestamp{}, false
+		}
+
+		// If we found the key
+		if ht.buckets[index].Key == key {
+			return ht.buckets[index].Value, ht.buckets[index].Version, true
+		}
+
+		// Move to next bucket
+		probeLength++
+		index = (index + 1) % ht.size
+	}
+}
+
 // Delete removes a key-value pair from the hash table
 func (ht *HashTable) Delete(key string) bool {
 	index := ht.hash(key)
@@ -192,6 +262,10 @@ func (ht *HashTable) Delete(key string) bool {
 			ht.buckets[index] = Entry{} // Clear the last bucket
 			ht.used--
 
+			if ht.ordered != nil {
+				ht.ordered.Delete(key)
+			}
+
 			// Check if we need to shrink the table
 			if ht.shouldShrink() {
 				ht.resize(ht.size / 2)
@@ -255,7 +329,7 @@ func (ht *HashTable) Incr(key string, incrValue interface{}) (string, time.Time,
 		}
 
 		// We convert the original value to float
-		floatValOriginal, err := strconv.ParseFloat(value.(string), 64)
+		floatValOriginal, err := strconv.ParseFloat(fmt.Sprint(value), 64)
 		if err != nil {
 			return "", time.Now(), fmt.Errorf("invalid value")
 		}
@@ -274,7 +348,7 @@ func (ht *HashTable) Incr(key string, incrValue interface{}) (string, time.Time,
 		}
 
 		// We convert the original value to integer
-		intValOriginal, intErr := strconv.ParseInt(value.(string), 10, 64)
+		intValOriginal, intErr := strconv.ParseInt(fmt.Sprint(value), 10, 64)
 		if intErr != nil {
 			return "", time.Now(), fmt.Errorf("invalid value")
 		}
@@ -305,7 +379,7 @@ func (ht *HashTable) Decr(key string, incrValue interface{}) (string, time.Time,
 		}
 
 		// We convert the original value to float
-		floatValOriginal, err := strconv.ParseFloat(value.(string), 64)
+		floatValOriginal, err := strconv.ParseFloat(fmt.Sprint(value), 64)
 		if err != nil {
 			return "", time.Now(), fmt.Errorf("invalid value")
 		}
@@ -328,7 +402,7 @@ func (ht *HashTable) Decr(key string, incrValue interface{}) (string, time.Time,
 		}
 
 		// We convert the original value to integer
-		intValOriginal, intErr := strconv.ParseInt(value.(string), 10, 64)
+		intValOriginal, intErr := strconv.ParseInt(fmt.Sprint(value), 10, 64)
 		if intErr != nil {
 			return "", time.Now(), fmt.Errorf("invalid value")
 		}
@@ -394,6 +468,188 @@ func (ht *HashTable) GetWithRegex(pattern string, limit, offset *int) ([]Entry,
 	return results, nil
 }
 
+// Scan visits count home buckets starting at cursor and returns the entries whose keys hash to them with the next cursor
+// A scan starts with cursor 0 and ends when the returned cursor is 0.  The cursor walks the buckets in reverse binary
+// order, the high bits of the bucket index are incremented first, so buckets already visited before a resize map to
+// buckets the cursor has passed after it and every key present for the whole scan is returned at least once.
+// Keys may be returned more than once when the table shrinks.  The guarantee needs a power of two size, which New
+// and resizing keep.
+func (ht *HashTable) Scan(cursor uint64, count int, filter FilterFunc) ([]Entry, uint64) {
+	var results []Entry
+	mask := uint64(ht.size - 1)
+
+	if count <= 0 {
+		count = 1
+	}
+
+	for visited := 0; visited < count; visited++ {
+		home := uint32(cursor & mask)
+
+		// Keys hashing to a bucket are stored in the run of used buckets starting at it
+		for i, steps := home, uint32(0); ht.buckets[i].Key != "" && steps < ht.size; i, steps = (i+1)%ht.size, steps+1 {
+			entry := ht.buckets[i]
+			if ht.hash(entry.Key) == home && (filter == nil || filter(entry)) {
+				results = append(results, entry)
+			}
+		}
+
+		// We increment the reversed cursor
+		cursor |= ^mask
+		cursor = bits.Reverse64(cursor)
+		cursor++
+		cursor = bits.Reverse64(cursor)
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	return results, cursor
+}
+
+// ParseScanArgs parses <cursor> [MATCH <pattern>] [COUNT <n>] [TYPE <type>] scan arguments
+// Returns the cursor, the key pattern, the count and the type, the count defaults to 10
+func ParseScanArgs(args []string) (uint64, string, int, string, error) {
+	if len(args) < 1 || len(args)%2 != 1 {
+		return 0, "", 0, "", fmt.Errorf("invalid command")
+	}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return 0, "", 0, "", fmt.Errorf("invalid cursor")
+	}
+
+	pattern, count, typ := "", 10, ""
+	for i := 1; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count <= 0 {
+				return 0, "", 0, "", fmt.Errorf("invalid count")
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return 0, "", 0, "", fmt.Errorf("invalid command")
+		}
+	}
+
+	return cursor, pattern, count, typ, nil
+}
+
+// EnableOrderedIndex keeps the keys in lexicographic order alongside the buckets for Range and Prefix
+// Existing keys are indexed, enabling an enabled index does nothing
+func (ht *HashTable) EnableOrderedIndex() {
+	if ht.ordered != nil {
+		return
+	}
+
+	ht.ordered = skiplist.New()
+	for _, entry := range ht.buckets {
+		if entry.Key != "" {
+			ht.ordered.Insert(entry.Key)
+		}
+	}
+}
+
+// OrderedIndexEnabled returns true if the ordered index is enabled
+func (ht *HashTable) OrderedIndexEnabled() bool {
+	return ht.ordered != nil
+}
+
+// Range returns up to limit entries with keys between start and end inclusive in lexicographic order
+// An empty start or end leaves that side of the range open, a limit of 0 returns every entry in the range
+func (ht *HashTable) Range(start, end string, limit int) ([]Entry, error) {
+	return ht.ascend(start, limit, func(key string) bool {
+		return end == "" || key <= end
+	})
+}
+
+// Prefix returns up to limit entries with keys starting with prefix in lexicographic order
+// A limit of 0 returns every entry with the prefix
+func (ht *HashTable) Prefix(prefix string, limit int) ([]Entry, error) {
+	return ht.ascend(prefix, limit, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// ascend collects entries in key order starting at from while within returns true
+func (ht *HashTable) ascend(from string, limit int, within func(key string) bool) ([]Entry, error) {
+	if ht.ordered == nil {
+		return nil, fmt.Errorf("ordered index not enabled")
+	}
+
+	var results []Entry
+	ht.ordered.Ascend(from, func(key string) bool {
+		if !within(key) {
+			return false
+		}
+
+		value, ts, ok := ht.Get(key)
+		if ok {
+			results = append(results, Entry{Key: key, Value: value, Timestamp: ts})
+		}
+
+		return limit <= 0 || len(results) < limit
+	})
+
+	return results, nil
+}
+
+// ParseRangeArgs parses <start> <end> [LIMIT <n>] range arguments
+// - and + are open bounds returned as empty strings
+func ParseRangeArgs(args []string) (string, string, int, error) {
+	if len(args) < 2 {
+		return "", "", 0, fmt.Errorf("invalid command")
+	}
+
+	start, end := args[0], args[1]
+	if start == "-" {
+		start = ""
+	}
+	if end == "+" {
+		end = ""
+	}
+
+	limit, err := parseLimit(args[2:])
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return start, end, limit, nil
+}
+
+// ParsePrefixArgs parses <prefix> [LIMIT <n>] prefix arguments
+func ParsePrefixArgs(args []string) (string, int, error) {
+	if len(args) < 1 {
+		return "", 0, fmt.Errorf("invalid command")
+	}
+
+	limit, err := parseLimit(args[1:])
+	if err != nil {
+		return "", 0, err
+	}
+
+	return args[0], limit, nil
+}
+
+// parseLimit parses optional LIMIT <n> arguments, no limit is 0
+func parseLimit(args []string) (int, error) {
+	switch {
+	case len(args) == 0:
+		return 0, nil
+	case len(args) == 2 && strings.ToUpper(args[0]) == "LIMIT":
+		limit, err := strconv.Atoi(args[1])
+		if err != nil || limit <= 0 {
+			return 0, fmt.Errorf("invalid limit")
+		}
+		return limit, nil
+	}
+
+	return 0, fmt.Errorf("invalid command")
+}
+
 // Stats returns detailed statistics about the hash table
 func (ht *HashTable) Stats() map[string]string {
 	stats := make(map[string]string)
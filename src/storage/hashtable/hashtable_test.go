@@ -33,6 +33,7 @@ import (
 	"math/rand"
 	"regexp"
 	"strconv"
+	"supermassive/hlc"
 	"testing"
 	"time"
 )
@@ -585,3 +586,296 @@ func BenchmarkHashTable_Delete(b *testing.B) {
 		ht.Delete(string(rune('a' + (i % 26))))
 	}
 }
+
+func TestOrderedIndex(t *testing.T) {
+	ht := New()
+
+	// Keys stored before the index is enabled are indexed too
+	ht.Put("user:3", "c")
+	ht.Put("user:1", "a")
+
+	if _, err := ht.Range("", "", 0); err == nil {
+		t.Error("Expected error before the ordered index is enabled")
+	}
+
+	ht.EnableOrderedIndex()
+
+	// Enough keys to resize the table a few times
+	for i := 0; i < 100; i++ {
+		ht.Put(fmt.Sprintf("item:%03d", i), i)
+	}
+	ht.Put("user:2", "b")
+	ht.Put("user:2", "bb")
+	ht.Delete("item:050")
+
+	keys := func(entries []Entry) []string {
+		var keys []string
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		return keys
+	}
+
+	entries, err := ht.Prefix("user:", 0)
+	if err != nil {
+		t.Fatalf("Failed to get prefix: %v", err)
+	}
+	if got := fmt.Sprint(keys(entries)); got != "[user:1 user:2 user:3]" {
+		t.Errorf("Expected users in order, got %s", got)
+	}
+	if entries[1].Value != "bb" {
+		t.Errorf("Expected the latest value, got %v", entries[1].Value)
+	}
+
+	entries, _ = ht.Range("item:048", "item:052", 0)
+	if got := fmt.Sprint(keys(entries)); got != "[item:048 item:049 item:051 item:052]" {
+		t.Errorf("Expected inclusive range without the deleted key, got %s", got)
+	}
+
+	entries, _ = ht.Range("item:098", "", 3)
+	if got := fmt.Sprint(keys(entries)); got != "[item:098 item:099 user:1]" {
+		t.Errorf("Expected open ended range with limit, got %s", got)
+	}
+
+	// Shrinking keeps the index
+	for i := 0; i < 100; i++ {
+		ht.Delete(fmt.Sprintf("item:%03d", i))
+	}
+	entries, _ = ht.Range("", "", 0)
+	if len(entries) != 3 {
+		t.Errorf("Expected 3 keys after deletes, got %v", keys(entries))
+	}
+}
+
+func TestParseRangeArgs(t *testing.T) {
+	start, end, limit, err := ParseRangeArgs([]string{"-", "+", "LIMIT", "5"})
+	if err != nil {
+		t.Fatalf("Failed to parse range: %v", err)
+	}
+	if start != "" || end != "" || limit != 5 {
+		t.Errorf("Expected open range with limit 5, got %q %q %d", start, end, limit)
+	}
+
+	if _, _, _, err = ParseRangeArgs([]string{"a"}); err == nil {
+		t.Error("Expected error for missing end")
+	}
+
+	if _, _, err = ParsePrefixArgs([]string{"user:", "LIMIT", "x"}); err == nil {
+		t.Error("Expected error for invalid limit")
+	}
+}
+
+func TestScan(t *testing.T) {
+	ht := New()
+	for i := 0; i < 200; i++ {
+		ht.Put(fmt.Sprintf("key:%d", i), i)
+	}
+
+	seen := make(map[string]int)
+	cursor := uint64(0)
+	calls := 0
+	for {
+		var entries []Entry
+		entries, cursor = ht.Scan(cursor, 4, nil)
+		for _, e := range entries {
+			seen[e.Key]++
+		}
+		calls++
+
+		// The table grows while the scan is running
+		if calls == 5 {
+			for i := 200; i < 2000; i++ {
+				ht.Put(fmt.Sprintf("key:%d", i), i)
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		if seen[fmt.Sprintf("key:%d", i)] == 0 {
+			t.Fatalf("Expected key:%d to be returned after the table grew", i)
+		}
+	}
+
+	// The table shrinks while the scan is running
+	seen = make(map[string]int)
+	cursor = 0
+	calls = 0
+	for {
+		var entries []Entry
+		entries, cursor = ht.Scan(cursor, 8, nil)
+		for _, e := range entries {
+			seen[e.Key]++
+		}
+		calls++
+
+		if calls == 10 {
+			for i := 100; i < 2000; i++ {
+				ht.Delete(fmt.Sprintf("key:%d", i))
+			}
+		}
+
+		if cursor == 0 {
+			break
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if seen[fmt.Sprintf("key:%d", i)] == 0 {
+			t.Fatalf("Expected key:%d to be returned after the table shrank", i)
+		}
+	}
+
+	// Filters are applied to the visited entries
+	count := 0
+	cursor = 0
+	for {
+		var entries []Entry
+		entries, cursor = ht.Scan(cursor, 16, func(e Entry) bool { return e.Value.(int)%2 == 0 })
+		count += len(entries)
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if count != 50 {
+		t.Errorf("Expected 50 even values, got %d", count)
+	}
+}
+
+func TestParseScanArgs(t *testing.T) {
+	cursor, pattern, count, typ, err := ParseScanArgs([]string{"12", "MATCH", "^user:", "COUNT", "100", "TYPE", "Stream"})
+	if err != nil {
+		t.Fatalf("Failed to parse scan args: %v", err)
+	}
+	if cursor != 12 || pattern != "^user:" || count != 100 || typ != "stream" {
+		t.Errorf("Unexpected scan args %d %q %d %q", cursor, pattern, count, typ)
+	}
+
+	if _, _, count, _, _ = ParseScanArgs([]string{"0"}); count != 10 {
+		t.Errorf("Expected default count 10, got %d", count)
+	}
+
+	if _, _, _, _, err = ParseScanArgs([]string{"x"}); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+
+	if _, _, _, _, err = ParseScanArgs([]string{"0", "COUNT"}); err == nil {
+		t.Error("Expected error for missing count")
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	ht := New()
+	ht.Put("first", "a")
+	_, written, _ := ht.Get("first")
+
+	time.Sleep(10 * time.Millisecond)
+
+	// Resizing keeps the time a key was written
+	for i := 0; i < 100; i++ {
+		ht.Put(strconv.Itoa(i), i)
+	}
+
+	_, ts, _ := ht.Get("first")
+	if !ts.Equal(written) {
+		t.Errorf("Expected timestamp %v to survive resizing, got %v", written, ts)
+	}
+
+	// Overwriting a key updates it
+	ht.Put("first", "b")
+	_, ts, _ = ht.Get("first")
+	if !ts.After(written) {
+		t.Errorf("Expected timestamp after %v on overwrite, got %v", written, ts)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ht := New()
+	clock := hlc.NewClock(1)
+	ht.SetClock(clock)
+
+	ht.Put("a", "1")
+	ht.Put("b", "2")
+
+	_, a, _ := ht.GetVersion("a")
+	_, b, ok := ht.GetVersion("b")
+	if !ok || !b.After(a) || a.Node != 1 {
+		t.Fatalf("Expected b %v after a %v from node 1", b, a)
+	}
+
+	_, ts, _ := ht.Get("a")
+	if !ts.Equal(a.Time()) {
+		t.Errorf("Expected timestamp %v, got %v", a.Time(), ts)
+	}
+
+	// A version from a clock ahead is kept and moves the clock
+	ahead := hlc.Timestamp{Wall: time.Now().Add(time.Hour).UnixNano(), Logical: 3, Node: 2}
+	ht.PutVersion("c", "3", ahead)
+	if _, v, _ := ht.GetVersion("c"); v != ahead {
+		t.Errorf("Expected version %v, got %v", ahead, v)
+	}
+
+	ht.Put("a", "4")
+	if _, v, _ := ht.GetVersion("a"); !v.After(ahead) {
+		t.Errorf("Expected version after %v, got %v", ahead, v)
+	}
+
+	if _, _, ok := ht.GetVersion("missing"); ok {
+		t.Error("Expected missing key")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	var agg Aggregate
+	for _, value := range []interface{}{"5", 20, "2.5", "hello"} {
+		if num, ok := ParseNumeric(value); ok {
+			agg.Add(num)
+		}
+	}
+
+	expected := map[string]string{"COUNT": "3", "SUM": "27.5", "MIN": "2.5", "MAX": "20"}
+	for op, want := range expected {
+		if result, err := agg.Result(op); err != nil || result != want {
+			t.Errorf("Expected %s for %s, got %s (%v)", want, op, result, err)
+		}
+	}
+
+	// Partial aggregates survive encoding and merge
+	partial, err := ParseAggregate(agg.String())
+	if err != nil {
+		t.Fatalf("Failed to parse aggregate: %v", err)
+	}
+
+	var ints Aggregate
+	ints.Add(Number{Int: -4, IsInt: true})
+	ints.Add(Number{Int: 8, IsInt: true})
+	if result, _ := ints.Result("SUM"); result != "4" {
+		t.Errorf("Expected integer sum 4, got %s", result)
+	}
+
+	ints.Merge(partial)
+	if result, _ := ints.Result("AVG"); result != "6.3" {
+		t.Errorf("Expected average 6.3, got %s", result)
+	}
+	if result, _ := ints.Result("MIN"); result != "-4" {
+		t.Errorf("Expected min -4, got %s", result)
+	}
+
+	var empty Aggregate
+	if _, err = empty.Result("AVG"); err == nil {
+		t.Error("Expected error for average of no values")
+	}
+
+	if _, _, _, err = ParseAggregateArgs([]string{"SUM", "^a", "EXCLUDE"}); err == nil {
+		t.Error("Expected error for missing excluded keys")
+	}
+
+	op, pattern, exclude, err := ParseAggregateArgs([]string{"sum", "^a", "EXCLUDE", "a1", "a2"})
+	if err != nil || op != "SUM" || pattern != "^a" || len(exclude) != 2 {
+		t.Errorf("Unexpected aggregate arguments %s %s %v (%v)", op, pattern, exclude, err)
+	}
+}
@@ -0,0 +1,151 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package hyperloglog
+
+// A HyperLogLog estimates the number of unique elements added to it using a fixed 16KB of registers
+// The standard error is about 0.81%.  Two HyperLogLogs are merged by taking the max of each register,
+// which is how copies of the same key on different shards are combined.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"supermassive/storage/hashtable"
+)
+
+// Precision is the number of hash bits used to pick a register
+const Precision = 14
+
+// Registers is the number of registers
+const Registers = 1 << Precision
+
+// HyperLogLog is a cardinality estimator
+type HyperLogLog struct {
+	Registers []uint8 // Max rank seen per register
+}
+
+// New creates a new empty HyperLogLog
+func New() *HyperLogLog {
+	return &HyperLogLog{Registers: make([]uint8, Registers)}
+}
+
+// Load gets the HyperLogLog stored under key in the hash table
+// If create is true and the key does not exist a new HyperLogLog is stored
+func Load(ht *hashtable.HashTable, key string, create bool) (*HyperLogLog, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		if !create {
+			return nil, errors.New("key not found")
+		}
+
+		h := New()
+		ht.Put(key, h)
+		return h, nil
+	}
+
+	h, ok := value.(*HyperLogLog)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return h, nil
+}
+
+// Decode decodes a HyperLogLog from its base64 encoded registers
+func Decode(s string) (*HyperLogLog, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(data) != Registers {
+		return nil, errors.New("invalid hyperloglog encoding")
+	}
+	return &HyperLogLog{Registers: data}, nil
+}
+
+// Encode encodes the registers as base64
+func (h *HyperLogLog) Encode() string {
+	return base64.StdEncoding.EncodeToString(h.Registers)
+}
+
+// String returns a short description of the HyperLogLog
+func (h *HyperLogLog) String() string {
+	return fmt.Sprintf("hyperloglog %d", h.Count())
+}
+
+// Hash returns a 64-bit hash of an element made from two 32-bit MurmurHash3 hashes with different seeds
+func Hash(element []byte) uint64 {
+	return uint64(hashtable.MurmurHash3(element, 0x9747b28c))<<32 | uint64(hashtable.MurmurHash3(element, 0x5bd1e995))
+}
+
+// Add adds an element and returns true if a register changed
+func (h *HyperLogLog) Add(element []byte) bool {
+	x := Hash(element)
+
+	// The first Precision bits pick the register, the rank is the position of the first set bit in the rest
+	i := x >> (64 - Precision)
+	rank := uint8(bits.LeadingZeros64(x<<Precision|1<<(Precision-1))) + 1
+
+	if rank > h.Registers[i] {
+		h.Registers[i] = rank
+		return true
+	}
+	return false
+}
+
+// Merge merges the registers of other into h
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, rank := range other.Registers {
+		if rank > h.Registers[i] {
+			h.Registers[i] = rank
+		}
+	}
+}
+
+// Count returns the estimated number of unique elements
+func (h *HyperLogLog) Count() uint64 {
+	m := float64(Registers)
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.Registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+
+	// Small cardinalities are estimated more accurately with linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
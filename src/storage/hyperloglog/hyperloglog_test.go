@@ -0,0 +1,137 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package hyperloglog
+
+import (
+	"fmt"
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+// withinError checks an estimate is within 2% of the actual count
+func withinError(estimate, actual uint64) bool {
+	diff := float64(estimate) - float64(actual)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= float64(actual)*0.02
+}
+
+func TestAddCount(t *testing.T) {
+	h := New()
+
+	if h.Count() != 0 {
+		t.Errorf("Expected empty count 0, got %d", h.Count())
+	}
+
+	if !h.Add([]byte("alice")) {
+		t.Error("Expected first add to change a register")
+	}
+
+	if h.Add([]byte("alice")) {
+		t.Error("Expected duplicate add not to change a register")
+	}
+
+	for _, n := range []int{100, 10000, 200000} {
+		h := New()
+		for i := 0; i < n; i++ {
+			h.Add([]byte(fmt.Sprintf("user_%d", i)))
+		}
+
+		// Adding the same elements again doesn't change the count
+		for i := 0; i < n; i++ {
+			h.Add([]byte(fmt.Sprintf("user_%d", i)))
+		}
+
+		if count := h.Count(); !withinError(count, uint64(n)) {
+			t.Errorf("Expected about %d, got %d", n, count)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+
+	// Two overlapping halves of 20000 elements
+	for i := 0; i < 12000; i++ {
+		a.Add([]byte(fmt.Sprintf("user_%d", i)))
+	}
+	for i := 8000; i < 20000; i++ {
+		b.Add([]byte(fmt.Sprintf("user_%d", i)))
+	}
+
+	a.Merge(b)
+
+	if count := a.Count(); !withinError(count, 20000) {
+		t.Errorf("Expected about 20000, got %d", count)
+	}
+}
+
+func TestEncoding(t *testing.T) {
+	h := New()
+	h.Add([]byte("alice"))
+	h.Add([]byte("bob"))
+
+	decoded, err := Decode(h.Encode())
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if decoded.Count() != 2 {
+		t.Errorf("Expected 2, got %d", decoded.Count())
+	}
+
+	if _, err = Decode("AAAA"); err == nil {
+		t.Error("Expected error for wrong register count")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "visitors", false); err == nil {
+		t.Error("Expected error loading missing hyperloglog")
+	}
+
+	h, err := Load(ht, "visitors", true)
+	if err != nil {
+		t.Fatalf("Failed to create hyperloglog: %v", err)
+	}
+	h.Add([]byte("alice"))
+
+	h, err = Load(ht, "visitors", false)
+	if err != nil || h.Count() != 1 {
+		t.Fatalf("Expected to load stored hyperloglog, got %v", err)
+	}
+
+	ht.Put("plain", "value")
+	if _, err = Load(ht, "plain", false); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
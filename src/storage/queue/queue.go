@@ -0,0 +1,286 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package queue
+
+// A reliable job queue with at least once delivery
+// A reserved job is hidden from other consumers until its visibility timeout passes, if it is not acknowledged by then it becomes ready again.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"supermassive/storage/hashtable"
+	"time"
+)
+
+// Job is a job in a queue
+type Job struct {
+	ID         string    // The job ID
+	Payload    string    // The job payload
+	Deliveries int       // How many times the job was reserved
+	VisibleAt  time.Time // When a reserved job becomes visible again
+}
+
+// Queue is a job queue
+type Queue struct {
+	Ready    []*Job          // Jobs ready to be reserved, in delivery order
+	Reserved map[string]*Job // Reserved jobs by ID
+	ready    map[string]*Job // Ready jobs by ID, kept with Ready so looking up a job does not scan the queue
+}
+
+// New creates a new empty queue
+func New() *Queue {
+	return &Queue{Reserved: make(map[string]*Job), ready: make(map[string]*Job)}
+}
+
+// Load gets the queue stored under key in the hash table
+// If create is true and the key does not exist a new queue is stored
+func Load(ht *hashtable.HashTable, key string, create bool) (*Queue, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		if !create {
+			return nil, errors.New("key not found")
+		}
+
+		q := New()
+		ht.Put(key, q)
+		return q, nil
+	}
+
+	q, ok := value.(*Queue)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return q, nil
+}
+
+// NewID generates a random job ID
+func NewID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// String returns a short description of the queue
+func (q *Queue) String() string {
+	return fmt.Sprintf("queue %d %d", len(q.Ready), len(q.Reserved))
+}
+
+// Has returns true if a job with the ID is ready or reserved
+func (q *Queue) Has(id string) bool {
+	if _, ok := q.Reserved[id]; ok {
+		return true
+	}
+	_, ok := q.ready[id]
+	return ok
+}
+
+// readyIndex returns the index of a ready job or -1
+func (q *Queue) readyIndex(id string) int {
+	if _, ok := q.ready[id]; !ok {
+		return -1
+	}
+
+	for i, job := range q.Ready {
+		if job.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Push adds a job to the end of the queue
+func (q *Queue) Push(id, payload string) error {
+	if q.Has(id) {
+		return errors.New("job already exists")
+	}
+
+	job := &Job{ID: id, Payload: payload}
+	q.Ready = append(q.Ready, job)
+	q.ready[id] = job
+	return nil
+}
+
+// Restore adds a job as it was, reserved until its visible time or at the end of the queue if it has none
+func (q *Queue) Restore(job *Job) error {
+	if q.Has(job.ID) {
+		return errors.New("job already exists")
+	}
+
+	if job.VisibleAt.IsZero() {
+		q.Ready = append(q.Ready, job)
+		q.ready[job.ID] = job
+	} else {
+		q.Reserved[job.ID] = job
+	}
+
+	return nil
+}
+
+// Next returns the next ready job without reserving it
+func (q *Queue) Next() *Job {
+	if len(q.Ready) == 0 {
+		return nil
+	}
+	return q.Ready[0]
+}
+
+// Reserve reserves a ready job until the given time
+func (q *Queue) Reserve(id string, until time.Time) (*Job, error) {
+	i := q.readyIndex(id)
+	if i == -1 {
+		return nil, errors.New("job not ready")
+	}
+
+	job := q.Ready[i]
+	q.Ready = append(q.Ready[:i], q.Ready[i+1:]...)
+	delete(q.ready, id)
+
+	job.Deliveries++
+	job.VisibleAt = until
+	q.Reserved[id] = job
+
+	return job, nil
+}
+
+// Expire moves reserved jobs whose visibility timeout passed back to the front of the queue
+// Returns the number of jobs that expired
+func (q *Queue) Expire(now time.Time) int {
+	var expired []*Job
+	for _, job := range q.Reserved {
+		if !job.VisibleAt.After(now) {
+			expired = append(expired, job)
+		}
+	}
+
+	// Map iteration order is random, we sort so replaying the journal restores the same order
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].VisibleAt.Equal(expired[j].VisibleAt) {
+			return expired[i].ID < expired[j].ID
+		}
+		return expired[i].VisibleAt.Before(expired[j].VisibleAt)
+	})
+
+	for _, job := range expired {
+		delete(q.Reserved, job.ID)
+		job.VisibleAt = time.Time{}
+		q.ready[job.ID] = job
+	}
+
+	q.Ready = append(expired, q.Ready...)
+	return len(expired)
+}
+
+// NextVisible returns when the next reserved job becomes visible again
+func (q *Queue) NextVisible() (time.Time, bool) {
+	var next time.Time
+	for _, job := range q.Reserved {
+		if next.IsZero() || job.VisibleAt.Before(next) {
+			next = job.VisibleAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Ack acknowledges a reserved job removing it from the queue
+func (q *Queue) Ack(id string) bool {
+	if _, ok := q.Reserved[id]; !ok {
+		return false
+	}
+
+	delete(q.Reserved, id)
+	return true
+}
+
+// Nack releases a reserved job back to the front of the queue
+func (q *Queue) Nack(id string) bool {
+	job, ok := q.Reserved[id]
+	if !ok {
+		return false
+	}
+
+	delete(q.Reserved, id)
+	job.VisibleAt = time.Time{}
+	q.Ready = append([]*Job{job}, q.Ready...)
+	q.ready[id] = job
+	return true
+}
+
+// Exhausted returns the IDs of ready jobs that were delivered at least max times
+func (q *Queue) Exhausted(max int) []string {
+	var ids []string
+	if max <= 0 {
+		return ids
+	}
+
+	for _, job := range q.Ready {
+		if job.Deliveries >= max {
+			ids = append(ids, job.ID)
+		}
+	}
+	return ids
+}
+
+// Remove removes a ready or reserved job from the queue
+func (q *Queue) Remove(id string) (*Job, bool) {
+	if job, ok := q.Reserved[id]; ok {
+		delete(q.Reserved, id)
+		return job, true
+	}
+
+	i := q.readyIndex(id)
+	if i == -1 {
+		return nil, false
+	}
+
+	job := q.Ready[i]
+	q.Ready = append(q.Ready[:i], q.Ready[i+1:]...)
+	delete(q.ready, id)
+	return job, true
+}
+
+// Stats returns the number of ready and reserved jobs at the given time
+// Reserved jobs whose visibility timeout passed are counted as ready
+func (q *Queue) Stats(now time.Time) (int, int) {
+	ready, reserved := len(q.Ready), 0
+	for _, job := range q.Reserved {
+		if job.VisibleAt.After(now) {
+			reserved++
+		} else {
+			ready++
+		}
+	}
+	return ready, reserved
+}
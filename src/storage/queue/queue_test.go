@@ -0,0 +1,234 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package queue
+
+import (
+	"fmt"
+	"supermassive/storage/hashtable"
+	"testing"
+	"time"
+)
+
+func TestPushReserveAck(t *testing.T) {
+	q := New()
+
+	if err := q.Push("a", "job a"); err != nil {
+		t.Fatalf("Failed to push job: %v", err)
+	}
+
+	if err := q.Push("a", "job a"); err == nil {
+		t.Error("Expected error for duplicate job id")
+	}
+
+	if err := q.Push("b", "job b"); err != nil {
+		t.Fatalf("Failed to push job: %v", err)
+	}
+
+	next := q.Next()
+	if next == nil || next.ID != "a" {
+		t.Fatalf("Expected job a to be next, got %v", next)
+	}
+
+	now := time.Now()
+	job, err := q.Reserve("a", now.Add(time.Second))
+	if err != nil {
+		t.Fatalf("Failed to reserve job: %v", err)
+	}
+
+	if job.Deliveries != 1 {
+		t.Errorf("Expected 1 delivery, got %d", job.Deliveries)
+	}
+
+	if _, err = q.Reserve("a", now.Add(time.Second)); err == nil {
+		t.Error("Expected error reserving a reserved job")
+	}
+
+	ready, reserved := q.Stats(now)
+	if ready != 1 || reserved != 1 {
+		t.Errorf("Expected 1 ready and 1 reserved, got %d and %d", ready, reserved)
+	}
+
+	if !q.Ack("a") {
+		t.Error("Expected ack to succeed")
+	}
+
+	if q.Ack("a") {
+		t.Error("Expected second ack to fail")
+	}
+
+	if q.Has("a") {
+		t.Error("Expected job a to be removed")
+	}
+}
+
+func TestExpire(t *testing.T) {
+	q := New()
+	q.Push("a", "job a")
+	q.Push("b", "job b")
+	q.Push("c", "job c")
+
+	now := time.Now()
+	q.Reserve("b", now.Add(2*time.Second))
+	q.Reserve("a", now.Add(time.Second))
+
+	if next, ok := q.NextVisible(); !ok || !next.Equal(now.Add(time.Second)) {
+		t.Errorf("Expected next visible at %v, got %v", now.Add(time.Second), next)
+	}
+
+	if n := q.Expire(now); n != 0 {
+		t.Errorf("Expected no expired jobs, got %d", n)
+	}
+
+	// Both expire, a became visible first so it is delivered first
+	if n := q.Expire(now.Add(3 * time.Second)); n != 2 {
+		t.Fatalf("Expected 2 expired jobs, got %d", n)
+	}
+
+	expected := []string{"a", "b", "c"}
+	for i, job := range q.Ready {
+		if job.ID != expected[i] {
+			t.Errorf("Expected %s at %d, got %s", expected[i], i, job.ID)
+		}
+	}
+
+	if len(q.Reserved) != 0 {
+		t.Errorf("Expected no reserved jobs, got %d", len(q.Reserved))
+	}
+}
+
+func TestNackAndExhausted(t *testing.T) {
+	q := New()
+	q.Push("a", "job a")
+	q.Push("b", "job b")
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := q.Reserve("b", now.Add(time.Minute)); err != nil {
+			t.Fatalf("Failed to reserve job: %v", err)
+		}
+
+		if !q.Nack("b") {
+			t.Fatal("Expected nack to succeed")
+		}
+	}
+
+	if q.Next().ID != "b" {
+		t.Errorf("Expected nacked job at the front, got %s", q.Next().ID)
+	}
+
+	ids := q.Exhausted(3)
+	if len(ids) != 1 || ids[0] != "b" {
+		t.Fatalf("Expected b to be exhausted, got %v", ids)
+	}
+
+	job, ok := q.Remove("b")
+	if !ok || job.Payload != "job b" {
+		t.Fatalf("Expected to remove job b, got %v", job)
+	}
+
+	if len(q.Exhausted(0)) != 0 {
+		t.Error("Expected no exhausted jobs when max deliveries is disabled")
+	}
+}
+
+func TestReadyIndex(t *testing.T) {
+	q := New()
+	for i := 0; i < 1000; i++ {
+		if err := q.Push(fmt.Sprintf("job%d", i), "payload"); err != nil {
+			t.Fatalf("Failed to push job: %v", err)
+		}
+	}
+
+	now := time.Now()
+	if _, err := q.Reserve("job500", now.Add(time.Second)); err != nil {
+		t.Fatalf("Failed to reserve job: %v", err)
+	}
+
+	if _, ok := q.Remove("job10"); !ok {
+		t.Fatal("Expected job10 to be removed")
+	}
+
+	// Jobs released by a nack or an expired reservation are ready again
+	q.Nack("job500")
+	if _, err := q.Reserve("job500", now); err != nil {
+		t.Fatalf("Failed to reserve a released job: %v", err)
+	}
+	q.Expire(now)
+
+	if err := q.Restore(&Job{ID: "job10", Deliveries: 2, VisibleAt: now.Add(time.Second)}); err != nil {
+		t.Fatalf("Failed to restore job: %v", err)
+	}
+
+	if err := q.Restore(&Job{ID: "job999"}); err == nil {
+		t.Error("Expected error restoring a job already in the queue")
+	}
+
+	if len(q.ready) != len(q.Ready) {
+		t.Fatalf("Expected %d ready jobs indexed, got %d", len(q.Ready), len(q.ready))
+	}
+
+	for _, job := range q.Ready {
+		if q.ready[job.ID] != job {
+			t.Errorf("Expected %s indexed", job.ID)
+		}
+	}
+
+	if !q.Has("job500") || !q.Has("job10") || q.Has("job1000") {
+		t.Error("Unexpected jobs in the queue")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "jobs", false); err == nil {
+		t.Error("Expected error loading missing queue")
+	}
+
+	q, err := Load(ht, "jobs", true)
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	q.Push("a", "job a")
+
+	q, err = Load(ht, "jobs", false)
+	if err != nil || !q.Has("a") {
+		t.Fatalf("Expected to load stored queue, got %v", err)
+	}
+
+	ht.Put("plain", "value")
+	if _, err = Load(ht, "plain", false); err == nil {
+		t.Error("Expected wrong type error")
+	}
+
+	id, err := NewID()
+	if err != nil || len(id) != 16 {
+		t.Errorf("Expected 16 character id, got %q (%v)", id, err)
+	}
+}
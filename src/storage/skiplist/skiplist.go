@@ -0,0 +1,155 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package skiplist
+
+// A skip list of keys kept in lexicographic order
+// Each key is on the bottom level and on every level above with probability P, searches start at the highest level
+// and drop down a level whenever the next key would overshoot.
+
+import (
+	"math/rand"
+)
+
+const (
+	MaxLevel = 32   // Maximum number of levels
+	P        = 0.25 // Probability of a key being on the next level up
+)
+
+// SkipList is an ordered set of keys
+type SkipList struct {
+	head   *node      // Sentinel node before the first key
+	level  int        // Number of levels in use
+	length int        // Number of keys
+	rng    *rand.Rand // Level generator
+}
+
+// node is a key in the list
+type node struct {
+	key  string
+	next []*node // Next node on each level the key is on
+}
+
+// New creates an empty skip list
+func New() *SkipList {
+	return &SkipList{head: &node{next: make([]*node, MaxLevel)}, level: 1, rng: rand.New(rand.NewSource(1))}
+}
+
+// Len returns the number of keys in the list
+func (sl *SkipList) Len() int {
+	return sl.length
+}
+
+// randomLevel returns the number of levels for a new key
+func (sl *SkipList) randomLevel() int {
+	level := 1
+	for level < MaxLevel && sl.rng.Float64() < P {
+		level++
+	}
+	return level
+}
+
+// findPrevious returns the last node before key on every level
+func (sl *SkipList) findPrevious(key string) []*node {
+	previous := make([]*node, MaxLevel)
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		previous[i] = x
+	}
+	return previous
+}
+
+// Insert adds a key to the list, returns false if the key is already in the list
+func (sl *SkipList) Insert(key string) bool {
+	previous := sl.findPrevious(key)
+	if next := previous[0].next[0]; next != nil && next.key == key {
+		return false
+	}
+
+	level := sl.randomLevel()
+	if level > sl.level {
+		for i := sl.level; i < level; i++ {
+			previous[i] = sl.head
+		}
+		sl.level = level
+	}
+
+	n := &node{key: key, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		n.next[i] = previous[i].next[i]
+		previous[i].next[i] = n
+	}
+
+	sl.length++
+	return true
+}
+
+// Delete removes a key from the list, returns false if the key is not in the list
+func (sl *SkipList) Delete(key string) bool {
+	previous := sl.findPrevious(key)
+	n := previous[0].next[0]
+	if n == nil || n.key != key {
+		return false
+	}
+
+	for i := 0; i < len(n.next); i++ {
+		previous[i].next[i] = n.next[i]
+	}
+
+	for sl.level > 1 && sl.head.next[sl.level-1] == nil {
+		sl.level--
+	}
+
+	sl.length--
+	return true
+}
+
+// Has returns true if the key is in the list
+func (sl *SkipList) Has(key string) bool {
+	n := sl.findPrevious(key)[0].next[0]
+	return n != nil && n.key == key
+}
+
+// Ascend calls fn for every key greater than or equal to from in order until fn returns false
+func (sl *SkipList) Ascend(from string, fn func(key string) bool) {
+	x := sl.head
+	for i := sl.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < from {
+			x = x.next[i]
+		}
+	}
+
+	for x = x.next[0]; x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
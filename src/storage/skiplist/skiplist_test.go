@@ -0,0 +1,133 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package skiplist
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// keys returns every key greater than or equal to from
+func keys(sl *SkipList, from string) []string {
+	var keys []string
+	sl.Ascend(from, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestInsertDelete(t *testing.T) {
+	sl := New()
+
+	for _, key := range []string{"banana", "apple", "cherry", "apple"} {
+		sl.Insert(key)
+	}
+
+	if sl.Len() != 3 {
+		t.Errorf("Expected 3 keys, got %d", sl.Len())
+	}
+
+	if sl.Insert("banana") {
+		t.Error("Expected insert of existing key to return false")
+	}
+
+	if got := fmt.Sprint(keys(sl, "")); got != "[apple banana cherry]" {
+		t.Errorf("Expected keys in order, got %s", got)
+	}
+
+	if !sl.Delete("banana") || sl.Delete("banana") {
+		t.Error("Expected banana to be deleted once")
+	}
+
+	if sl.Has("banana") || !sl.Has("cherry") {
+		t.Error("Unexpected membership after delete")
+	}
+
+	if got := fmt.Sprint(keys(sl, "b")); got != "[cherry]" {
+		t.Errorf("Expected keys from b, got %s", got)
+	}
+}
+
+func TestAscendStops(t *testing.T) {
+	sl := New()
+	for i := 0; i < 10; i++ {
+		sl.Insert(fmt.Sprintf("key%d", i))
+	}
+
+	var visited []string
+	sl.Ascend("key3", func(key string) bool {
+		visited = append(visited, key)
+		return len(visited) < 2
+	})
+
+	if got := fmt.Sprint(visited); got != "[key3 key4]" {
+		t.Errorf("Expected to stop after 2 keys, got %s", got)
+	}
+}
+
+func TestRandomized(t *testing.T) {
+	sl := New()
+	set := make(map[string]bool)
+	rng := rand.New(rand.NewSource(42))
+
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%04d", rng.Intn(2000))
+		if rng.Intn(3) == 0 {
+			if sl.Delete(key) != set[key] {
+				t.Fatalf("Delete of %s disagreed with the reference set", key)
+			}
+			delete(set, key)
+		} else {
+			if sl.Insert(key) == set[key] {
+				t.Fatalf("Insert of %s disagreed with the reference set", key)
+			}
+			set[key] = true
+		}
+	}
+
+	expected := make([]string, 0, len(set))
+	for key := range set {
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+
+	got := keys(sl, "")
+	if sl.Len() != len(expected) || len(got) != len(expected) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), len(got))
+	}
+
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("Expected %s at %d, got %s", expected[i], i, got[i])
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package stream
+
+// An append-only stream of entries addressed by monotonic IDs
+// Consumer groups track which entries were delivered to which consumer and which are still pending acknowledgement.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+	"time"
+)
+
+// ID is a stream entry ID made up of a millisecond timestamp and a sequence number
+type ID struct {
+	Ms  uint64 // Milliseconds part of the ID
+	Seq uint64 // Sequence within the same millisecond
+}
+
+// Entry is a stream entry
+type Entry struct {
+	ID     ID       // The entry ID
+	Fields []string // Field value pairs
+}
+
+// PendingEntry is an entry delivered to a consumer but not yet acknowledged
+type PendingEntry struct {
+	ID          ID        // The entry ID
+	Consumer    string    // The consumer the entry was last delivered to
+	DeliveredAt time.Time // When the entry was last delivered
+	Deliveries  int       // How many times the entry was delivered
+}
+
+// Group is a consumer group
+type Group struct {
+	Name          string                   // The group name
+	LastDelivered ID                       // The last ID delivered to the group
+	Pending       map[string]*PendingEntry // Pending entries list keyed by entry ID
+}
+
+// Stream is an append-only log of entries with consumer groups
+type Stream struct {
+	Entries []Entry           // Entries ordered by ID
+	LastID  ID                // The last ID added to the stream
+	Groups  map[string]*Group // Consumer groups by name
+}
+
+// MaxID is the largest possible stream ID
+var MaxID = ID{Ms: math.MaxUint64, Seq: math.MaxUint64}
+
+// New creates a new empty stream
+func New() *Stream {
+	return &Stream{Groups: make(map[string]*Group)}
+}
+
+// Load gets the stream stored under key in the hash table
+// If create is true and the key does not exist a new stream is stored
+func Load(ht *hashtable.HashTable, key string, create bool) (*Stream, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		if !create {
+			return nil, errors.New("key not found")
+		}
+
+		s := New()
+		ht.Put(key, s)
+		return s, nil
+	}
+
+	s, ok := value.(*Stream)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return s, nil
+}
+
+// String returns the ID in <ms>-<seq> format
+func (id ID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+// Less returns true if id is lower than other
+func (id ID) Less(other ID) bool {
+	if id.Ms != other.Ms {
+		return id.Ms < other.Ms
+	}
+	return id.Seq < other.Seq
+}
+
+// ParseID parses an ID in <ms>-<seq> or <ms> format
+// When the sequence is omitted, seq is used
+func ParseID(s string, seq uint64) (ID, error) {
+	msPart, seqPart, found := strings.Cut(s, "-")
+
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return ID{}, errors.New("invalid stream id")
+	}
+
+	if found {
+		seq, err = strconv.ParseUint(seqPart, 10, 64)
+		if err != nil {
+			return ID{}, errors.New("invalid stream id")
+		}
+	}
+
+	return ID{Ms: ms, Seq: seq}, nil
+}
+
+// ParseIDs parses a list of IDs in <ms>-<seq> or <ms> format
+func ParseIDs(args []string) ([]ID, error) {
+	ids := make([]ID, 0, len(args))
+	for _, arg := range args {
+		id, err := ParseID(arg, 0)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// ParseRange parses a start and end ID for a range, - and + are the lowest and highest possible IDs
+func ParseRange(start, end string) (ID, ID, error) {
+	var startID, endID ID
+	var err error
+
+	if start == "-" {
+		startID = ID{}
+	} else if startID, err = ParseID(start, 0); err != nil {
+		return ID{}, ID{}, err
+	}
+
+	if end == "+" {
+		endID = MaxID
+	} else if endID, err = ParseID(end, math.MaxUint64); err != nil {
+		return ID{}, ID{}, err
+	}
+
+	return startID, endID, nil
+}
+
+// String returns the entry in <id> <field> <value>... format
+func (e Entry) String() string {
+	if len(e.Fields) == 0 {
+		return e.ID.String()
+	}
+	return fmt.Sprintf("%s %s", e.ID.String(), strings.Join(e.Fields, " "))
+}
+
+// String returns a short description of the stream
+func (s *Stream) String() string {
+	return fmt.Sprintf("stream %d %s", len(s.Entries), s.LastID.String())
+}
+
+// Len returns the number of entries in the stream
+func (s *Stream) Len() int {
+	return len(s.Entries)
+}
+
+// NextID returns the next automatically generated ID for the given time
+func (s *Stream) NextID(now time.Time) ID {
+	ms := uint64(now.UnixMilli())
+	if ms <= s.LastID.Ms {
+		return ID{Ms: s.LastID.Ms, Seq: s.LastID.Seq + 1}
+	}
+	return ID{Ms: ms}
+}
+
+// Add appends an entry to the stream, the ID must be greater than the last ID
+func (s *Stream) Add(id ID, fields []string) error {
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return errors.New("invalid field value pairs")
+	}
+
+	if id == (ID{}) {
+		return errors.New("id must be greater than 0-0")
+	}
+
+	if !s.LastID.Less(id) {
+		return errors.New("id must be greater than last id")
+	}
+
+	s.Entries = append(s.Entries, Entry{ID: id, Fields: fields})
+	s.LastID = id
+	return nil
+}
+
+// Has returns true if an entry with the ID exists
+func (s *Stream) Has(id ID) bool {
+	_, ok := s.find(id)
+	return ok
+}
+
+// find returns the entry with the given ID using a binary search
+func (s *Stream) find(id ID) (Entry, bool) {
+	i := sort.Search(len(s.Entries), func(i int) bool { return !s.Entries[i].ID.Less(id) })
+	if i < len(s.Entries) && s.Entries[i].ID == id {
+		return s.Entries[i], true
+	}
+	return Entry{}, false
+}
+
+// Range returns entries with IDs between start and end inclusive
+// A count of 0 returns all entries in the range
+func (s *Stream) Range(start, end ID, count int) []Entry {
+	var results []Entry
+
+	i := sort.Search(len(s.Entries), func(i int) bool { return !s.Entries[i].ID.Less(start) })
+	for ; i < len(s.Entries); i++ {
+		if end.Less(s.Entries[i].ID) {
+			break
+		}
+
+		results = append(results, s.Entries[i])
+		if count > 0 && len(results) == count {
+			break
+		}
+	}
+
+	return results
+}
+
+// After returns entries with IDs greater than id
+func (s *Stream) After(id ID, count int) []Entry {
+	if id == MaxID {
+		return nil
+	}
+
+	if id.Seq == math.MaxUint64 {
+		return s.Range(ID{Ms: id.Ms + 1}, MaxID, count)
+	}
+
+	return s.Range(ID{Ms: id.Ms, Seq: id.Seq + 1}, MaxID, count)
+}
+
+// CreateGroup creates a consumer group that will deliver entries after id
+func (s *Stream) CreateGroup(name string, id ID) error {
+	if _, ok := s.Groups[name]; ok {
+		return errors.New("group already exists")
+	}
+
+	s.Groups[name] = &Group{Name: name, LastDelivered: id, Pending: make(map[string]*PendingEntry)}
+	return nil
+}
+
+// DestroyGroup removes a consumer group, returns false if the group does not exist
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.Groups[name]; !ok {
+		return false
+	}
+
+	delete(s.Groups, name)
+	return true
+}
+
+// group returns a consumer group by name
+func (s *Stream) group(name string) (*Group, error) {
+	g, ok := s.Groups[name]
+	if !ok {
+		return nil, errors.New("group not found")
+	}
+	return g, nil
+}
+
+// Undelivered returns entries that were not yet delivered to the group
+// The entries are not marked delivered, see Deliver
+func (s *Stream) Undelivered(group string, count int) ([]Entry, error) {
+	g, err := s.group(group)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.After(g.LastDelivered, count), nil
+}
+
+// Deliver marks entries as delivered to a consumer of the group
+// Delivered entries are added to the pending entries list until acknowledged
+func (s *Stream) Deliver(group, consumer string, ids []ID, at time.Time) error {
+	g, err := s.group(group)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if g.LastDelivered.Less(id) {
+			g.LastDelivered = id
+		}
+
+		pe, ok := g.Pending[id.String()]
+		if !ok {
+			pe = &PendingEntry{ID: id}
+			g.Pending[id.String()] = pe
+		}
+
+		pe.Consumer = consumer
+		pe.DeliveredAt = at
+		pe.Deliveries++
+	}
+
+	return nil
+}
+
+// PendingFor returns the pending entries of a consumer with IDs greater than after
+func (s *Stream) PendingFor(group, consumer string, after ID, count int) ([]Entry, error) {
+	pending, err := s.Pending(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Entry
+	for _, pe := range pending {
+		if pe.Consumer != consumer || !after.Less(pe.ID) {
+			continue
+		}
+
+		if e, ok := s.find(pe.ID); ok {
+			results = append(results, e)
+		}
+
+		if count > 0 && len(results) == count {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// Ack acknowledges entries for a group removing them from the pending entries list
+// Returns the number of entries acknowledged
+func (s *Stream) Ack(group string, ids []ID) (int, error) {
+	g, err := s.group(group)
+	if err != nil {
+		return 0, err
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if _, ok := g.Pending[id.String()]; ok {
+			delete(g.Pending, id.String())
+			acked++
+		}
+	}
+
+	return acked, nil
+}
+
+// Pending returns the pending entries list of a group ordered by ID
+func (s *Stream) Pending(group string) ([]*PendingEntry, error) {
+	g, err := s.group(group)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]*PendingEntry, 0, len(g.Pending))
+	for _, pe := range g.Pending {
+		pending = append(pending, pe)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID.Less(pending[j].ID) })
+
+	return pending, nil
+}
@@ -0,0 +1,241 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package stream
+
+import (
+	"supermassive/storage/hashtable"
+	"testing"
+	"time"
+)
+
+func TestParseID(t *testing.T) {
+	id, err := ParseID("1526919030474-55", 0)
+	if err != nil {
+		t.Fatalf("Failed to parse id: %v", err)
+	}
+	if id.Ms != 1526919030474 || id.Seq != 55 {
+		t.Errorf("Expected 1526919030474-55, got %s", id)
+	}
+
+	id, err = ParseID("1526919030474", 7)
+	if err != nil {
+		t.Fatalf("Failed to parse id: %v", err)
+	}
+	if id.Seq != 7 {
+		t.Errorf("Expected default sequence 7, got %d", id.Seq)
+	}
+
+	if _, err = ParseID("abc-1", 0); err == nil {
+		t.Error("Expected error for invalid id")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	s := New()
+
+	if err := s.Add(ID{Ms: 1}, []string{"field", "value"}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	// IDs must increase
+	if err := s.Add(ID{Ms: 1}, []string{"field", "value"}); err == nil {
+		t.Error("Expected error for duplicate id")
+	}
+
+	// Fields must be pairs
+	if err := s.Add(ID{Ms: 2}, []string{"field"}); err == nil {
+		t.Error("Expected error for odd field count")
+	}
+
+	if err := s.Add(ID{}, []string{"field", "value"}); err == nil {
+		t.Error("Expected error for 0-0 id")
+	}
+
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 entry, got %d", s.Len())
+	}
+}
+
+func TestNextID(t *testing.T) {
+	s := New()
+	now := time.UnixMilli(1000)
+
+	id := s.NextID(now)
+	if id != (ID{Ms: 1000}) {
+		t.Errorf("Expected 1000-0, got %s", id)
+	}
+	_ = s.Add(id, []string{"a", "1"})
+
+	// Same millisecond increments the sequence
+	id = s.NextID(now)
+	if id != (ID{Ms: 1000, Seq: 1}) {
+		t.Errorf("Expected 1000-1, got %s", id)
+	}
+	_ = s.Add(id, []string{"a", "2"})
+
+	// Clock going backwards still produces increasing ids
+	id = s.NextID(time.UnixMilli(500))
+	if id != (ID{Ms: 1000, Seq: 2}) {
+		t.Errorf("Expected 1000-2, got %s", id)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := New()
+	for i := uint64(1); i <= 10; i++ {
+		if err := s.Add(ID{Ms: i}, []string{"n", "v"}); err != nil {
+			t.Fatalf("Failed to add entry: %v", err)
+		}
+	}
+
+	start, end, err := ParseRange("-", "+")
+	if err != nil {
+		t.Fatalf("Failed to parse range: %v", err)
+	}
+
+	if len(s.Range(start, end, 0)) != 10 {
+		t.Errorf("Expected 10 entries")
+	}
+
+	start, end, err = ParseRange("3", "5")
+	if err != nil {
+		t.Fatalf("Failed to parse range: %v", err)
+	}
+
+	entries := s.Range(start, end, 0)
+	if len(entries) != 3 || entries[0].ID.Ms != 3 || entries[2].ID.Ms != 5 {
+		t.Errorf("Expected entries 3 to 5, got %v", entries)
+	}
+
+	entries = s.Range(start, end, 2)
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries with count, got %d", len(entries))
+	}
+
+	entries = s.After(ID{Ms: 8}, 0)
+	if len(entries) != 2 || entries[0].ID.Ms != 9 {
+		t.Errorf("Expected entries after 8, got %v", entries)
+	}
+}
+
+func TestConsumerGroups(t *testing.T) {
+	s := New()
+	for i := uint64(1); i <= 5; i++ {
+		_ = s.Add(ID{Ms: i}, []string{"n", "v"})
+	}
+
+	if err := s.CreateGroup("workers", ID{}); err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+
+	if err := s.CreateGroup("workers", ID{}); err == nil {
+		t.Error("Expected error creating existing group")
+	}
+
+	entries, err := s.Undelivered("workers", 3)
+	if err != nil {
+		t.Fatalf("Failed to read group: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+
+	ids := []ID{entries[0].ID, entries[1].ID, entries[2].ID}
+	if err = s.Deliver("workers", "alice", ids, time.Now()); err != nil {
+		t.Fatalf("Failed to deliver: %v", err)
+	}
+
+	// The next read continues after the delivered entries
+	entries, _ = s.Undelivered("workers", 0)
+	if len(entries) != 2 || entries[0].ID.Ms != 4 {
+		t.Errorf("Expected entries 4 and 5, got %v", entries)
+	}
+
+	pending, _ := s.Pending("workers")
+	if len(pending) != 3 {
+		t.Errorf("Expected 3 pending entries, got %d", len(pending))
+	}
+
+	history, _ := s.PendingFor("workers", "alice", ID{}, 0)
+	if len(history) != 3 {
+		t.Errorf("Expected 3 pending entries for alice, got %d", len(history))
+	}
+
+	history, _ = s.PendingFor("workers", "bob", ID{}, 0)
+	if len(history) != 0 {
+		t.Errorf("Expected no pending entries for bob, got %d", len(history))
+	}
+
+	acked, err := s.Ack("workers", []ID{{Ms: 1}, {Ms: 2}, {Ms: 9}})
+	if err != nil {
+		t.Fatalf("Failed to ack: %v", err)
+	}
+	if acked != 2 {
+		t.Errorf("Expected 2 acknowledged, got %d", acked)
+	}
+
+	// Redelivery increments the delivery count
+	_ = s.Deliver("workers", "bob", []ID{{Ms: 3}}, time.Now())
+	pending, _ = s.Pending("workers")
+	if len(pending) != 1 || pending[0].Consumer != "bob" || pending[0].Deliveries != 2 {
+		t.Errorf("Expected entry 3 pending for bob with 2 deliveries, got %+v", pending)
+	}
+
+	if !s.DestroyGroup("workers") {
+		t.Error("Expected group to be destroyed")
+	}
+
+	if _, err = s.Undelivered("workers", 0); err == nil {
+		t.Error("Expected error reading destroyed group")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "events", false); err == nil {
+		t.Error("Expected error loading missing stream")
+	}
+
+	s, err := Load(ht, "events", true)
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	_ = s.Add(ID{Ms: 1}, []string{"a", "b"})
+
+	s, err = Load(ht, "events", false)
+	if err != nil || s.Len() != 1 {
+		t.Errorf("Expected stored stream with 1 entry")
+	}
+
+	ht.Put("plain", "value")
+	if _, err = Load(ht, "plain", true); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
@@ -0,0 +1,357 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package timeseries
+
+// A series of timestamped samples with a retention window
+// Samples are stored in chunks, timestamps as varint delta of deltas and values xor'd with the previous value
+// so regular intervals and slowly changing values take a couple of bytes per sample.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+)
+
+// ChunkSize is the maximum number of samples in a chunk
+const ChunkSize = 256
+
+// Sample is a single timestamped value
+type Sample struct {
+	Timestamp int64   // Unix milliseconds
+	Value     float64 // The sample value
+}
+
+// Chunk is a run of encoded samples
+type Chunk struct {
+	Start     int64  // Timestamp of the first sample
+	End       int64  // Timestamp of the last sample
+	Count     int    // Number of samples in the chunk
+	LastDelta int64  // Delta between the last two timestamps, used to encode the next sample
+	LastValue uint64 // Bits of the last value, used to encode the next sample
+	Data      []byte // Encoded samples
+}
+
+// Series is a time series
+type Series struct {
+	Retention int64    // Retention window in milliseconds relative to the last sample, 0 keeps samples forever
+	Chunks    []*Chunk // Chunks ordered by time
+}
+
+// Aggregation downsamples samples into time buckets
+type Aggregation struct {
+	Type   string // min, max, avg, sum or count
+	Bucket int64  // Bucket size in milliseconds
+}
+
+// New creates a new empty series
+func New(retention int64) *Series {
+	return &Series{Retention: retention}
+}
+
+// Load gets the series stored under key in the hash table
+// If create is true and the key does not exist a new series without retention is stored
+func Load(ht *hashtable.HashTable, key string, create bool) (*Series, error) {
+	value, _, ok := ht.Get(key)
+	if !ok {
+		if !create {
+			return nil, errors.New("key not found")
+		}
+
+		s := New(0)
+		ht.Put(key, s)
+		return s, nil
+	}
+
+	s, ok := value.(*Series)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return s, nil
+}
+
+// FormatValue formats a sample value without losing precision
+func FormatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// ParseRange parses a from and to timestamp, - and + are the lowest and highest possible timestamps
+func ParseRange(from, to string) (int64, int64, error) {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	var err error
+
+	if from != "-" {
+		if start, err = strconv.ParseInt(from, 10, 64); err != nil {
+			return 0, 0, errors.New("invalid timestamp")
+		}
+	}
+
+	if to != "+" {
+		if end, err = strconv.ParseInt(to, 10, 64); err != nil {
+			return 0, 0, errors.New("invalid timestamp")
+		}
+	}
+
+	return start, end, nil
+}
+
+// ParseRangeArgs parses <from> <to> [AGGREGATION <type> <bucket ms>] command arguments
+// The aggregation is nil when not given
+func ParseRangeArgs(args []string) (int64, int64, *Aggregation, error) {
+	if len(args) != 2 && (len(args) != 5 || strings.ToUpper(args[2]) != "AGGREGATION") {
+		return 0, 0, nil, errors.New("invalid command")
+	}
+
+	from, to, err := ParseRange(args[0], args[1])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	if len(args) == 2 {
+		return from, to, nil, nil
+	}
+
+	agg, err := ParseAggregation(strings.ToLower(args[3]), args[4])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return from, to, agg, nil
+}
+
+// ParseAggregation parses an aggregation type and bucket size in milliseconds
+func ParseAggregation(typ, bucket string) (*Aggregation, error) {
+	switch typ {
+	case "min", "max", "avg", "sum", "count":
+	default:
+		return nil, errors.New("invalid aggregation")
+	}
+
+	size, err := strconv.ParseInt(bucket, 10, 64)
+	if err != nil || size <= 0 {
+		return nil, errors.New("invalid bucket size")
+	}
+
+	return &Aggregation{Type: typ, Bucket: size}, nil
+}
+
+// String returns a short description of the series
+func (s *Series) String() string {
+	return fmt.Sprintf("timeseries %d %d", s.Len(), s.Retention)
+}
+
+// Len returns the number of samples stored
+func (s *Series) Len() int {
+	n := 0
+	for _, c := range s.Chunks {
+		n += c.Count
+	}
+	return n
+}
+
+// Last returns the last sample of the series
+func (s *Series) Last() (Sample, bool) {
+	if len(s.Chunks) == 0 {
+		return Sample{}, false
+	}
+
+	c := s.Chunks[len(s.Chunks)-1]
+	return Sample{Timestamp: c.End, Value: math.Float64frombits(c.LastValue)}, true
+}
+
+// Add appends a sample, the timestamp must be greater than the last sample's
+// Chunks that fall entirely outside the retention window are dropped
+func (s *Series) Add(timestamp int64, value float64) error {
+	if last, ok := s.Last(); ok && timestamp <= last.Timestamp {
+		return errors.New("timestamp must be greater than the last sample")
+	}
+
+	if len(s.Chunks) == 0 || s.Chunks[len(s.Chunks)-1].Count == ChunkSize {
+		s.Chunks = append(s.Chunks, &Chunk{Start: timestamp})
+	}
+
+	s.Chunks[len(s.Chunks)-1].append(timestamp, value)
+
+	if s.Retention > 0 {
+		cutoff := timestamp - s.Retention
+		i := 0
+		for i < len(s.Chunks)-1 && s.Chunks[i].End < cutoff {
+			i++
+		}
+		s.Chunks = s.Chunks[i:]
+	}
+
+	return nil
+}
+
+// Range returns the samples with timestamps between from and to inclusive
+// Samples outside the retention window are not returned
+func (s *Series) Range(from, to int64) []Sample {
+	if last, ok := s.Last(); ok && s.Retention > 0 && from < last.Timestamp-s.Retention {
+		from = last.Timestamp - s.Retention
+	}
+
+	var samples []Sample
+
+	// Skip chunks that end before the range
+	i := sort.Search(len(s.Chunks), func(i int) bool { return s.Chunks[i].End >= from })
+	for ; i < len(s.Chunks) && s.Chunks[i].Start <= to; i++ {
+		for _, sample := range s.Chunks[i].Samples() {
+			if sample.Timestamp >= from && sample.Timestamp <= to {
+				samples = append(samples, sample)
+			}
+		}
+	}
+
+	return samples
+}
+
+// Merge returns a series with the samples of both series in time order and the retention of this series
+// A sample of this series wins over a sample of the other series at the same timestamp
+func (s *Series) Merge(other *Series) *Series {
+	var samples []Sample
+	for _, c := range s.Chunks {
+		samples = append(samples, c.Samples()...)
+	}
+
+	seen := make(map[int64]bool, len(samples))
+	for _, sample := range samples {
+		seen[sample.Timestamp] = true
+	}
+
+	for _, c := range other.Chunks {
+		for _, sample := range c.Samples() {
+			if !seen[sample.Timestamp] {
+				samples = append(samples, sample)
+			}
+		}
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+
+	merged := New(s.Retention)
+	for _, sample := range samples {
+		_ = merged.Add(sample.Timestamp, sample.Value)
+	}
+
+	return merged
+}
+
+// append encodes a sample at the end of the chunk
+func (c *Chunk) append(timestamp int64, value float64) {
+	prev := c.Start
+	if c.Count > 0 {
+		prev = c.End
+	}
+
+	// The xor of close values has its set bits at the top, reversing the bytes keeps the varint short
+	delta := timestamp - prev
+	v := math.Float64bits(value)
+	c.Data = binary.AppendVarint(c.Data, delta-c.LastDelta)
+	c.Data = binary.AppendUvarint(c.Data, bits.ReverseBytes64(v^c.LastValue))
+
+	c.End = timestamp
+	c.LastDelta = delta
+	c.LastValue = v
+	c.Count++
+}
+
+// Samples decodes the samples of the chunk
+func (c *Chunk) Samples() []Sample {
+	samples := make([]Sample, 0, c.Count)
+
+	timestamp, delta, value := c.Start, int64(0), uint64(0)
+	data := c.Data
+	for len(samples) < c.Count {
+		dod, n := binary.Varint(data)
+		data = data[n:]
+		x, n := binary.Uvarint(data)
+		data = data[n:]
+
+		delta += dod
+		timestamp += delta
+		value ^= bits.ReverseBytes64(x)
+		samples = append(samples, Sample{Timestamp: timestamp, Value: math.Float64frombits(value)})
+	}
+
+	return samples
+}
+
+// Apply downsamples ordered samples into buckets aligned to multiples of the bucket size
+// Each bucket is returned as a sample at the bucket start
+func (a *Aggregation) Apply(samples []Sample) []Sample {
+	var results []Sample
+
+	for i := 0; i < len(samples); {
+		start := samples[i].Timestamp - mod(samples[i].Timestamp, a.Bucket)
+
+		agg := samples[i].Value
+		sum, count := 0.0, 0
+		for ; i < len(samples) && samples[i].Timestamp < start+a.Bucket; i++ {
+			v := samples[i].Value
+			sum += v
+			count++
+
+			switch {
+			case a.Type == "min" && v < agg:
+				agg = v
+			case a.Type == "max" && v > agg:
+				agg = v
+			}
+		}
+
+		switch a.Type {
+		case "avg":
+			agg = sum / float64(count)
+		case "sum":
+			agg = sum
+		case "count":
+			agg = float64(count)
+		}
+
+		results = append(results, Sample{Timestamp: start, Value: agg})
+	}
+
+	return results
+}
+
+// mod returns the non negative remainder of a divided by b
+func mod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
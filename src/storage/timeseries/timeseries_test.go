@@ -0,0 +1,233 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package timeseries
+
+import (
+	"math"
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+func TestAddAndRange(t *testing.T) {
+	s := New(0)
+
+	for i := int64(0); i < 1000; i++ {
+		if err := s.Add(1000+i*10, float64(i)/4); err != nil {
+			t.Fatalf("Failed to add sample: %v", err)
+		}
+	}
+
+	if s.Len() != 1000 {
+		t.Errorf("Expected 1000 samples, got %d", s.Len())
+	}
+
+	if len(s.Chunks) != 4 {
+		t.Errorf("Expected 4 chunks, got %d", len(s.Chunks))
+	}
+
+	// Timestamps must increase
+	if err := s.Add(1000, 1); err == nil {
+		t.Error("Expected error adding an older sample")
+	}
+
+	samples := s.Range(math.MinInt64, math.MaxInt64)
+	if len(samples) != 1000 {
+		t.Fatalf("Expected 1000 samples, got %d", len(samples))
+	}
+
+	for i, sample := range samples {
+		if sample.Timestamp != 1000+int64(i)*10 || sample.Value != float64(i)/4 {
+			t.Fatalf("Unexpected sample %d: %+v", i, sample)
+		}
+	}
+
+	samples = s.Range(3550, 3600)
+	if len(samples) != 6 || samples[0].Timestamp != 3550 || samples[5].Timestamp != 3600 {
+		t.Errorf("Unexpected range %+v", samples)
+	}
+
+	last, ok := s.Last()
+	if !ok || last.Timestamp != 10990 || last.Value != 249.75 {
+		t.Errorf("Unexpected last sample %+v", last)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := New(0)
+
+	for i := int64(0); i < ChunkSize; i++ {
+		_ = s.Add(1700000000000+i*1000, 42)
+	}
+
+	// Regular intervals and repeated values take two bytes per sample after the first
+	size := len(s.Chunks[0].Data)
+	if size > 2*ChunkSize+16 {
+		t.Errorf("Expected compact encoding, got %d bytes for %d samples", size, ChunkSize)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	s := New(1000)
+
+	for i := int64(0); i < 2000; i++ {
+		_ = s.Add(i, float64(i))
+	}
+
+	samples := s.Range(math.MinInt64, math.MaxInt64)
+	if len(samples) != 1001 || samples[0].Timestamp != 999 {
+		t.Errorf("Expected samples from 999, got %d starting at %d", len(samples), samples[0].Timestamp)
+	}
+
+	// Chunks entirely outside the window are dropped
+	if s.Chunks[0].End < 999 {
+		t.Errorf("Expected expired chunks to be dropped, first chunk ends at %d", s.Chunks[0].End)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(0), New(0)
+	for _, ts := range []int64{1000, 3000, 5000} {
+		_ = a.Add(ts, 1)
+	}
+	for _, ts := range []int64{2000, 3000, 6000} {
+		_ = b.Add(ts, 2)
+	}
+
+	samples := a.Merge(b).Range(math.MinInt64, math.MaxInt64)
+
+	expected := []Sample{{1000, 1}, {2000, 2}, {3000, 1}, {5000, 1}, {6000, 2}}
+	if len(samples) != len(expected) {
+		t.Fatalf("Expected %d samples, got %d", len(expected), len(samples))
+	}
+
+	for i, sample := range samples {
+		if sample != expected[i] {
+			t.Errorf("Expected %v at %d, got %v", expected[i], i, sample)
+		}
+	}
+}
+
+func TestAggregation(t *testing.T) {
+	samples := []Sample{{0, 1}, {5, 3}, {9, 2}, {10, 10}, {25, -1}, {29, 4}}
+
+	expected := map[string][]Sample{
+		"min":   {{0, 1}, {10, 10}, {20, -1}},
+		"max":   {{0, 3}, {10, 10}, {20, 4}},
+		"avg":   {{0, 2}, {10, 10}, {20, 1.5}},
+		"sum":   {{0, 6}, {10, 10}, {20, 3}},
+		"count": {{0, 3}, {10, 1}, {20, 2}},
+	}
+
+	for typ, want := range expected {
+		agg, err := ParseAggregation(typ, "10")
+		if err != nil {
+			t.Fatalf("Failed to parse aggregation: %v", err)
+		}
+
+		got := agg.Apply(samples)
+		if len(got) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", typ, want, got)
+		}
+
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", typ, want, got)
+				break
+			}
+		}
+	}
+
+	if _, err := ParseAggregation("median", "10"); err == nil {
+		t.Error("Expected error for unknown aggregation")
+	}
+
+	if _, err := ParseAggregation("avg", "0"); err == nil {
+		t.Error("Expected error for empty bucket")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	from, to, err := ParseRange("-", "+")
+	if err != nil || from != math.MinInt64 || to != math.MaxInt64 {
+		t.Errorf("Unexpected open range %d %d %v", from, to, err)
+	}
+
+	from, to, err = ParseRange("10", "20")
+	if err != nil || from != 10 || to != 20 {
+		t.Errorf("Unexpected range %d %d %v", from, to, err)
+	}
+
+	if _, _, err = ParseRange("abc", "+"); err == nil {
+		t.Error("Expected error for invalid timestamp")
+	}
+}
+
+func TestParseRangeArgs(t *testing.T) {
+	from, to, agg, err := ParseRangeArgs([]string{"0", "+", "AGGREGATION", "AVG", "60000"})
+	if err != nil {
+		t.Fatalf("Failed to parse range: %v", err)
+	}
+
+	if from != 0 || to != math.MaxInt64 || agg.Type != "avg" || agg.Bucket != 60000 {
+		t.Errorf("Unexpected range %d %d %+v", from, to, agg)
+	}
+
+	_, _, agg, err = ParseRangeArgs([]string{"-", "+"})
+	if err != nil || agg != nil {
+		t.Errorf("Expected no aggregation, got %+v %v", agg, err)
+	}
+
+	if _, _, _, err = ParseRangeArgs([]string{"-", "+", "COUNT", "10"}); err == nil {
+		t.Error("Expected error for unknown option")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	ht := hashtable.New()
+
+	if _, err := Load(ht, "cpu", false); err == nil {
+		t.Error("Expected error loading missing series")
+	}
+
+	s, err := Load(ht, "cpu", true)
+	if err != nil {
+		t.Fatalf("Failed to create series: %v", err)
+	}
+	_ = s.Add(1, 0.5)
+
+	s, err = Load(ht, "cpu", false)
+	if err != nil || s.Len() != 1 {
+		t.Errorf("Expected stored series with 1 sample")
+	}
+
+	ht.Put("plain", "value")
+	if _, err = Load(ht, "plain", true); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
@@ -0,0 +1,148 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package tombstone
+
+// Deletion versions of deleted keys
+// A tombstone lets a delete win against an older copy of the key on another node, it is dropped after a grace period
+// once every node is expected to have seen the delete.  Deletes are versioned by the hybrid logical clock like writes,
+// so a delete and a copy are ordered the same way on every node.
+
+import (
+	"regexp"
+	"sort"
+	"supermassive/hlc"
+	"time"
+)
+
+// DefaultGracePeriod is the default number of seconds a tombstone is kept
+const DefaultGracePeriod = 86400
+
+// GracePeriod returns the grace period for a configured number of seconds, DefaultGracePeriod if not configured
+func GracePeriod(seconds int) time.Duration {
+	if seconds <= 0 {
+		seconds = DefaultGracePeriod
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Tombstone is the deletion version of a key
+type Tombstone struct {
+	Key     string        // The deleted key
+	Version hlc.Timestamp // The version of the delete
+}
+
+// Set holds the tombstones of deleted keys until their grace period ends
+type Set struct {
+	Grace     time.Duration            // How long a tombstone is kept
+	deleted   map[string]hlc.Timestamp // Deletion versions by key
+	collected time.Time                // When expired tombstones were last collected
+}
+
+// New creates an empty set keeping tombstones for the grace period
+func New(grace time.Duration) *Set {
+	return &Set{Grace: grace, deleted: make(map[string]hlc.Timestamp), collected: time.Now()}
+}
+
+// Len returns the number of tombstones, expired ones included until collected
+func (s *Set) Len() int {
+	return len(s.deleted)
+}
+
+// Add records the deletion of a key, a later deletion replaces an earlier one
+// Expired tombstones are collected at most ten times per grace period as keys are deleted
+func (s *Set) Add(key string, at hlc.Timestamp) {
+	now := time.Now()
+
+	if s.expired(at, now) {
+		return
+	}
+
+	if existing, ok := s.deleted[key]; !ok || at.After(existing) {
+		s.deleted[key] = at
+	}
+
+	if now.Sub(s.collected) >= s.Grace/10 {
+		s.Collect(now)
+	}
+}
+
+// Get returns the version a key was deleted at, false if it has no tombstone or the tombstone expired
+func (s *Set) Get(key string, now time.Time) (hlc.Timestamp, bool) {
+	at, ok := s.deleted[key]
+	if !ok || s.expired(at, now) {
+		return hlc.Timestamp{}, false
+	}
+	return at, true
+}
+
+// Match returns the tombstones of keys matching the pattern for which exists returns false, ordered by key
+func (s *Set) Match(re *regexp.Regexp, exists func(key string) bool, now time.Time) []Tombstone {
+	var tombstones []Tombstone
+	for key, at := range s.deleted {
+		if s.expired(at, now) || !re.MatchString(key) || exists(key) {
+			continue
+		}
+		tombstones = append(tombstones, Tombstone{Key: key, Version: at})
+	}
+
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].Key < tombstones[j].Key })
+	return tombstones
+}
+
+// All returns the tombstones that did not expire, ordered by key
+func (s *Set) All(now time.Time) []Tombstone {
+	var tombstones []Tombstone
+	for key, at := range s.deleted {
+		if !s.expired(at, now) {
+			tombstones = append(tombstones, Tombstone{Key: key, Version: at})
+		}
+	}
+
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].Key < tombstones[j].Key })
+	return tombstones
+}
+
+// Collect drops the tombstones past their grace period and returns how many were dropped
+func (s *Set) Collect(now time.Time) int {
+	collected := 0
+	for key, at := range s.deleted {
+		if s.expired(at, now) {
+			delete(s.deleted, key)
+			collected++
+		}
+	}
+
+	s.collected = now
+	return collected
+}
+
+// expired returns true if a tombstone of the given version is past the grace period
+func (s *Set) expired(at hlc.Timestamp, now time.Time) bool {
+	return now.Sub(at.Time()) > s.Grace
+}
@@ -0,0 +1,116 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package tombstone
+
+import (
+	"regexp"
+	"supermassive/hlc"
+	"testing"
+	"time"
+)
+
+func TestAddGet(t *testing.T) {
+	s := New(time.Hour)
+	now := time.Now()
+
+	s.Add("a", hlc.FromTime(now.Add(-time.Minute)))
+	s.Add("a", hlc.FromTime(now.Add(-2*time.Minute)))
+
+	// The later deletion is kept
+	at, ok := s.Get("a", now)
+	if !ok || at != hlc.FromTime(now.Add(-time.Minute)) {
+		t.Errorf("Expected tombstone a minute ago, got %v %v", at, ok)
+	}
+
+	if _, ok = s.Get("b", now); ok {
+		t.Error("Expected no tombstone for b")
+	}
+
+	// Past the grace period the tombstone is ignored
+	if _, ok = s.Get("a", now.Add(2*time.Hour)); ok {
+		t.Error("Expected expired tombstone to be ignored")
+	}
+
+	// Deletions older than the grace period are not recorded
+	s.Add("old", hlc.FromTime(now.Add(-2*time.Hour)))
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 tombstone, got %d", s.Len())
+	}
+
+	// Deletes at the same physical time are ordered by their logical counter
+	s.Add("c", hlc.Timestamp{Wall: now.UnixNano(), Logical: 2})
+	s.Add("c", hlc.Timestamp{Wall: now.UnixNano(), Logical: 1})
+	if at, ok := s.Get("c", now); !ok || at.Logical != 2 {
+		t.Errorf("Expected the delete with the higher logical counter, got %v %v", at, ok)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	s := New(time.Hour)
+	now := time.Now()
+
+	s.Add("user:2", hlc.FromTime(now))
+	s.Add("user:1", hlc.FromTime(now))
+	s.Add("order:1", hlc.FromTime(now))
+
+	tombstones := s.Match(regexp.MustCompile("^user:"), func(key string) bool { return key == "user:2" }, now)
+	if len(tombstones) != 1 || tombstones[0].Key != "user:1" {
+		t.Errorf("Expected tombstone of user:1 only, got %+v", tombstones)
+	}
+}
+
+func TestAll(t *testing.T) {
+	s := New(time.Hour)
+	now := time.Now()
+
+	s.Add("b", hlc.FromTime(now))
+	s.Add("a", hlc.FromTime(now.Add(-30*time.Minute)))
+	s.Add("c", hlc.FromTime(now.Add(-50*time.Minute)))
+
+	tombstones := s.All(now.Add(15 * time.Minute))
+	if len(tombstones) != 2 || tombstones[0].Key != "a" || tombstones[1].Key != "b" {
+		t.Errorf("Expected tombstones of a and b, got %+v", tombstones)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	s := New(time.Hour)
+	now := time.Now()
+
+	s.Add("a", hlc.FromTime(now.Add(-50*time.Minute)))
+	s.Add("b", hlc.FromTime(now))
+
+	if collected := s.Collect(now.Add(20 * time.Minute)); collected != 1 {
+		t.Errorf("Expected 1 tombstone collected, got %d", collected)
+	}
+
+	if _, ok := s.Get("b", now); !ok || s.Len() != 1 {
+		t.Errorf("Expected tombstone of b to remain")
+	}
+}
@@ -0,0 +1,483 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package vector
+
+// Fixed dimension float32 vectors and nearest neighbour indexes
+// An index covers the vectors stored under keys matching its pattern.  It keeps a hierarchical navigable small world
+// graph for approximate search, exact search scans every vector in the index.
+// The graph is not journaled, it is rebuilt from the stored vectors on recovery.
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"supermassive/storage/hashtable"
+)
+
+const (
+	M              = 16  // Links per node on the upper layers, twice as many on the bottom layer
+	EfConstruction = 200 // Candidates considered when linking a new node
+	DefaultEf      = 64  // Candidates considered when searching
+)
+
+// Vector is a fixed dimension vector value
+type Vector struct {
+	Values []float32 // The vector components
+}
+
+// Result is a search result
+type Result struct {
+	Key      string  // The key of the vector
+	Distance float32 // Distance from the query vector
+}
+
+// Index is a nearest neighbour index
+type Index struct {
+	Name     string         // Index name
+	Dim      int            // Dimension of the indexed vectors
+	Metric   string         // cosine or l2
+	Pattern  string         // Pattern of the keys covered by the index
+	pattern  *regexp.Regexp // Compiled pattern
+	nodes    []*graphNode   // Graph nodes, a key that is set again gets a new node
+	keys     map[string]int // Latest node of each key
+	entry    int            // Entry point of the graph, -1 when empty
+	maxLevel int            // Level of the entry point
+	rng      *rand.Rand     // Level generator, seeded from the name so rebuilds are reproducible
+}
+
+// graphNode is a vector in the graph
+type graphNode struct {
+	key    string
+	vector *Vector
+	links  [][]int // Neighbours on each level the node is on
+}
+
+// candidate is a node and its distance from a query
+type candidate struct {
+	id       int
+	distance float32
+}
+
+// New creates a vector value
+func New(values []float32) *Vector {
+	return &Vector{Values: values}
+}
+
+// Parse parses vector components separated by spaces or commas
+func Parse(args []string) (*Vector, error) {
+	fields := strings.FieldsFunc(strings.Join(args, " "), func(r rune) bool { return r == ' ' || r == ',' })
+	if len(fields) == 0 {
+		return nil, errors.New("invalid vector")
+	}
+
+	values := make([]float32, len(fields))
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 32)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, errors.New("invalid vector")
+		}
+		values[i] = float32(f)
+	}
+
+	return New(values), nil
+}
+
+// ParseCreateArgs parses DIM <dimension> [METRIC <cosine|l2>] [PATTERN <pattern>] index options
+// The metric defaults to cosine and the pattern to keys prefixed with the index name and a colon
+func ParseCreateArgs(name string, args []string) (*Index, error) {
+	dim, metric, pattern := 0, "cosine", "^"+regexp.QuoteMeta(name)+":"
+
+	if len(args)%2 != 0 {
+		return nil, errors.New("invalid command")
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "DIM":
+			var err error
+			if dim, err = strconv.Atoi(args[i+1]); err != nil {
+				return nil, errors.New("invalid dimension")
+			}
+		case "METRIC":
+			metric = strings.ToLower(args[i+1])
+		case "PATTERN":
+			pattern = args[i+1]
+		default:
+			return nil, errors.New("invalid command")
+		}
+	}
+
+	return NewIndex(name, dim, metric, pattern)
+}
+
+// ParseSearchArgs parses <k> <component>... [EXACT] [EF <candidates>] search arguments
+func ParseSearchArgs(args []string) (int, *Vector, bool, int, error) {
+	if len(args) < 2 {
+		return 0, nil, false, 0, errors.New("invalid command")
+	}
+
+	k, err := strconv.Atoi(args[0])
+	if err != nil || k <= 0 {
+		return 0, nil, false, 0, errors.New("invalid k")
+	}
+
+	exact, ef := false, DefaultEf
+	var components []string
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "EXACT":
+			exact = true
+		case "EF":
+			if i+1 == len(args) {
+				return 0, nil, false, 0, errors.New("invalid command")
+			}
+
+			i++
+			if ef, err = strconv.Atoi(args[i]); err != nil || ef <= 0 {
+				return 0, nil, false, 0, errors.New("invalid ef")
+			}
+		default:
+			components = append(components, args[i])
+		}
+	}
+
+	q, err := Parse(components)
+	if err != nil {
+		return 0, nil, false, 0, err
+	}
+
+	return k, q, exact, ef, nil
+}
+
+// String returns the vector components separated by spaces
+func (v *Vector) String() string {
+	parts := make([]string, len(v.Values))
+	for i, f := range v.Values {
+		parts[i] = strconv.FormatFloat(float64(f), 'f', -1, 32)
+	}
+	return strings.Join(parts, " ")
+}
+
+// NewIndex creates an empty index
+func NewIndex(name string, dim int, metric, pattern string) (*Index, error) {
+	if dim <= 0 {
+		return nil, errors.New("invalid dimension")
+	}
+
+	if metric != "cosine" && metric != "l2" {
+		return nil, errors.New("invalid metric")
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	ix := &Index{Name: name, Dim: dim, Metric: metric, Pattern: pattern, pattern: re}
+	ix.reset()
+	return ix, nil
+}
+
+// reset empties the graph
+func (ix *Index) reset() {
+	h := fnv.New64a()
+	h.Write([]byte(ix.Name))
+
+	ix.nodes = nil
+	ix.keys = make(map[string]int)
+	ix.entry = -1
+	ix.maxLevel = 0
+	ix.rng = rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// LoadIndex gets the index stored under name in the hash table
+func LoadIndex(ht *hashtable.HashTable, name string) (*Index, error) {
+	value, _, ok := ht.Get(name)
+	if !ok {
+		return nil, errors.New("index not found")
+	}
+
+	ix, ok := value.(*Index)
+	if !ok {
+		return nil, errors.New("wrong type")
+	}
+
+	return ix, nil
+}
+
+// Rebuild rebuilds the graphs of every index in the hash table from the stored vectors
+// Returns the indexes by name
+func Rebuild(ht *hashtable.HashTable) map[string]*Index {
+	indexes := make(map[string]*Index)
+
+	entries := ht.Traverse(nil)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+
+	for _, entry := range entries {
+		if ix, ok := entry.Value.(*Index); ok {
+			ix.reset()
+			indexes[entry.Key] = ix
+		}
+	}
+
+	for _, entry := range entries {
+		v, ok := entry.Value.(*Vector)
+		if !ok {
+			continue
+		}
+
+		for _, ix := range indexes {
+			if ix.Covers(entry.Key) && len(v.Values) == ix.Dim {
+				_ = ix.Add(entry.Key, v)
+			}
+		}
+	}
+
+	return indexes
+}
+
+// String returns a short description of the index
+func (ix *Index) String() string {
+	return fmt.Sprintf("vectorindex %d %s %s", ix.Dim, ix.Metric, ix.Pattern)
+}
+
+// Covers returns true if the index covers vectors stored under key
+func (ix *Index) Covers(key string) bool {
+	return ix.pattern.MatchString(key)
+}
+
+// Distance returns the distance between two vectors with the index metric
+// Cosine distance is 1 minus the cosine similarity
+func (ix *Index) Distance(a, b []float32) float32 {
+	if ix.Metric == "l2" {
+		var sum float64
+		for i := range a {
+			d := float64(a[i] - b[i])
+			sum += d * d
+		}
+		return float32(math.Sqrt(sum))
+	}
+
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+
+	if na == 0 || nb == 0 {
+		return 1
+	}
+
+	return float32(1 - dot/(math.Sqrt(na)*math.Sqrt(nb)))
+}
+
+// Add inserts a vector stored under key into the graph
+// A key added again gets a new node, the old one is only kept to navigate the graph
+func (ix *Index) Add(key string, v *Vector) error {
+	if len(v.Values) != ix.Dim {
+		return errors.New("dimension mismatch")
+	}
+
+	id := len(ix.nodes)
+	level := int(-math.Log(1-ix.rng.Float64()) / math.Log(M))
+	n := &graphNode{key: key, vector: v, links: make([][]int, level+1)}
+	ix.nodes = append(ix.nodes, n)
+	ix.keys[key] = id
+
+	if ix.entry < 0 {
+		ix.entry, ix.maxLevel = id, level
+		return nil
+	}
+
+	// We descend greedily to the level of the new node
+	ep := ix.entry
+	for l := ix.maxLevel; l > level; l-- {
+		ep = ix.searchLayer(v.Values, ep, 1, l)[0].id
+	}
+
+	for l := min(level, ix.maxLevel); l >= 0; l-- {
+		candidates := ix.searchLayer(v.Values, ep, EfConstruction, l)
+
+		maxLinks := M
+		if l == 0 {
+			maxLinks = 2 * M
+		}
+
+		for _, c := range candidates[:min(M, len(candidates))] {
+			n.links[l] = append(n.links[l], c.id)
+
+			other := ix.nodes[c.id]
+			other.links[l] = append(other.links[l], id)
+			if len(other.links[l]) > maxLinks {
+				ix.prune(other, l, maxLinks)
+			}
+		}
+
+		ep = candidates[0].id
+	}
+
+	if level > ix.maxLevel {
+		ix.entry, ix.maxLevel = id, level
+	}
+
+	return nil
+}
+
+// prune keeps the closest neighbours of a node on a level
+func (ix *Index) prune(n *graphNode, level, maxLinks int) {
+	links := n.links[level]
+	sort.Slice(links, func(i, j int) bool {
+		return ix.Distance(n.vector.Values, ix.nodes[links[i]].vector.Values) < ix.Distance(n.vector.Values, ix.nodes[links[j]].vector.Values)
+	})
+	n.links[level] = links[:maxLinks]
+}
+
+// searchLayer returns up to ef nodes closest to q on a level, closest first
+func (ix *Index) searchLayer(q []float32, ep, ef, level int) []candidate {
+	visited := map[int]bool{ep: true}
+	start := candidate{id: ep, distance: ix.Distance(q, ix.nodes[ep].vector.Values)}
+
+	candidates := []candidate{start} // Nodes to explore
+	results := []candidate{start}    // Closest nodes found
+
+	for len(candidates) > 0 {
+		c := candidates[0]
+		candidates = candidates[1:]
+
+		if len(results) >= ef && c.distance > results[len(results)-1].distance {
+			break
+		}
+
+		for _, id := range ix.nodes[c.id].links[level] {
+			if visited[id] {
+				continue
+			}
+			visited[id] = true
+
+			next := candidate{id: id, distance: ix.Distance(q, ix.nodes[id].vector.Values)}
+			if len(results) < ef || next.distance < results[len(results)-1].distance {
+				candidates = insertCandidate(candidates, next)
+				results = insertCandidate(results, next)
+				if len(results) > ef {
+					results = results[:ef]
+				}
+			}
+		}
+	}
+
+	return results
+}
+
+// insertCandidate inserts a candidate keeping the slice ordered by distance
+func insertCandidate(list []candidate, c candidate) []candidate {
+	i := sort.Search(len(list), func(i int) bool { return list[i].distance > c.distance })
+	list = append(list, candidate{})
+	copy(list[i+1:], list[i:])
+	list[i] = c
+	return list
+}
+
+// live returns true if a node holds the current vector of its key in the hash table
+func (ix *Index) live(ht *hashtable.HashTable, id int) bool {
+	n := ix.nodes[id]
+	if ix.keys[n.key] != id {
+		return false
+	}
+
+	value, _, ok := ht.Get(n.key)
+	return ok && value == n.vector
+}
+
+// Search returns the approximate k nearest vectors to q
+// ef is the number of candidates considered, higher is more accurate and slower
+func (ix *Index) Search(ht *hashtable.HashTable, q []float32, k, ef int) ([]Result, error) {
+	if len(q) != ix.Dim {
+		return nil, errors.New("dimension mismatch")
+	}
+
+	if ix.entry < 0 {
+		return nil, nil
+	}
+
+	ep := ix.entry
+	for l := ix.maxLevel; l > 0; l-- {
+		ep = ix.searchLayer(q, ep, 1, l)[0].id
+	}
+
+	var results []Result
+	for _, c := range ix.searchLayer(q, ep, max(ef, k), 0) {
+		if len(results) == k {
+			break
+		}
+
+		if ix.live(ht, c.id) {
+			results = append(results, Result{Key: ix.nodes[c.id].key, Distance: c.distance})
+		}
+	}
+
+	return results, nil
+}
+
+// Exact returns the k nearest vectors to q comparing q with every vector in the index
+func (ix *Index) Exact(ht *hashtable.HashTable, q []float32, k int) ([]Result, error) {
+	if len(q) != ix.Dim {
+		return nil, errors.New("dimension mismatch")
+	}
+
+	var results []Result
+	for id, n := range ix.nodes {
+		if ix.live(ht, id) {
+			results = append(results, Result{Key: n.key, Distance: ix.Distance(q, n.vector.Values)})
+		}
+	}
+
+	SortResults(results)
+	if len(results) > k {
+		results = results[:k]
+	}
+
+	return results, nil
+}
+
+// SortResults orders results by distance then key
+func SortResults(results []Result) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Distance != results[j].Distance {
+			return results[i].Distance < results[j].Distance
+		}
+		return results[i].Key < results[j].Key
+	})
+}
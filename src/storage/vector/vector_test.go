@@ -0,0 +1,219 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package vector
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"supermassive/storage/hashtable"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	v, err := Parse([]string{"0.5,1", "-2"})
+	if err != nil {
+		t.Fatalf("Failed to parse vector: %v", err)
+	}
+
+	if len(v.Values) != 3 || v.Values[2] != -2 || v.String() != "0.5 1 -2" {
+		t.Errorf("Unexpected vector %s", v)
+	}
+
+	for _, invalid := range [][]string{{}, {"a"}, {"1", "NaN"}} {
+		if _, err = Parse(invalid); err == nil {
+			t.Errorf("Expected error parsing %v", invalid)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	ix, err := ParseCreateArgs("images", []string{"DIM", "3"})
+	if err != nil {
+		t.Fatalf("Failed to parse index: %v", err)
+	}
+
+	if ix.Dim != 3 || ix.Metric != "cosine" || !ix.Covers("images:1") || ix.Covers("other:1") {
+		t.Errorf("Unexpected index %s", ix)
+	}
+
+	ix, err = ParseCreateArgs("images", []string{"DIM", "3", "METRIC", "L2", "PATTERN", "^img_"})
+	if err != nil || ix.Metric != "l2" || !ix.Covers("img_1") {
+		t.Errorf("Unexpected index %v %v", ix, err)
+	}
+
+	if _, err = ParseCreateArgs("images", []string{"METRIC", "l2"}); err == nil {
+		t.Error("Expected error without a dimension")
+	}
+
+	k, q, exact, ef, err := ParseSearchArgs([]string{"5", "1,2", "3", "EXACT", "EF", "100"})
+	if err != nil {
+		t.Fatalf("Failed to parse search: %v", err)
+	}
+
+	if k != 5 || len(q.Values) != 3 || !exact || ef != 100 {
+		t.Errorf("Unexpected search %d %s %v %d", k, q, exact, ef)
+	}
+
+	if _, _, _, _, err = ParseSearchArgs([]string{"0", "1"}); err == nil {
+		t.Error("Expected error for k of 0")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	cosine, _ := NewIndex("c", 2, "cosine", ".*")
+	l2, _ := NewIndex("l", 2, "l2", ".*")
+
+	if d := cosine.Distance([]float32{1, 0}, []float32{2, 0}); d != 0 {
+		t.Errorf("Expected cosine distance 0 for parallel vectors, got %f", d)
+	}
+
+	if d := cosine.Distance([]float32{1, 0}, []float32{0, 1}); d != 1 {
+		t.Errorf("Expected cosine distance 1 for orthogonal vectors, got %f", d)
+	}
+
+	if d := l2.Distance([]float32{0, 0}, []float32{3, 4}); d != 5 {
+		t.Errorf("Expected l2 distance 5, got %f", d)
+	}
+
+	if _, err := NewIndex("x", 2, "dot", ".*"); err == nil {
+		t.Error("Expected error for unknown metric")
+	}
+}
+
+func TestSearchRecall(t *testing.T) {
+	ht := hashtable.New()
+	ix, _ := NewIndex("idx", 16, "l2", "^doc_")
+	rng := rand.New(rand.NewSource(1))
+
+	random := func() *Vector {
+		values := make([]float32, 16)
+		for i := range values {
+			values[i] = rng.Float32()
+		}
+		return New(values)
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("doc_%d", i)
+		v := random()
+		ht.Put(key, v)
+		if err := ix.Add(key, v); err != nil {
+			t.Fatalf("Failed to add vector: %v", err)
+		}
+	}
+
+	// Approximate results should mostly agree with exact ones
+	found, total := 0, 0
+	for q := 0; q < 20; q++ {
+		query := random().Values
+
+		exact, err := ix.Exact(ht, query, 10)
+		if err != nil {
+			t.Fatalf("Failed exact search: %v", err)
+		}
+
+		approx, err := ix.Search(ht, query, 10, DefaultEf)
+		if err != nil {
+			t.Fatalf("Failed search: %v", err)
+		}
+
+		keys := make(map[string]bool)
+		for _, r := range approx {
+			keys[r.Key] = true
+		}
+
+		for _, r := range exact {
+			if keys[r.Key] {
+				found++
+			}
+			total++
+		}
+	}
+
+	if recall := float64(found) / float64(total); recall < 0.9 {
+		t.Errorf("Expected recall of at least 0.9, got %.2f", recall)
+	}
+}
+
+func TestStaleVectors(t *testing.T) {
+	ht := hashtable.New()
+	ix, _ := NewIndex("idx", 2, "l2", ".*")
+
+	for i, key := range []string{"a", "b", "c"} {
+		v := New([]float32{float32(i), 0})
+		ht.Put(key, v)
+		_ = ix.Add(key, v)
+	}
+
+	// Overwriting and deleting keys hides their old vectors
+	moved := New([]float32{100, 0})
+	ht.Put("a", moved)
+	_ = ix.Add("a", moved)
+	ht.Delete("b")
+
+	results, _ := ix.Search(ht, []float32{0, 0}, 3, DefaultEf)
+	if len(results) != 2 || results[0].Key != "c" || results[1].Key != "a" {
+		t.Errorf("Unexpected results %+v", results)
+	}
+
+	results, _ = ix.Exact(ht, []float32{0, 0}, 3)
+	if len(results) != 2 || results[0].Key != "c" || math.Abs(float64(results[1].Distance)-100) > 1e-6 {
+		t.Errorf("Unexpected exact results %+v", results)
+	}
+
+	if _, err := ix.Search(ht, []float32{0}, 1, DefaultEf); err == nil {
+		t.Error("Expected dimension mismatch")
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	ht := hashtable.New()
+
+	ix, _ := NewIndex("idx", 2, "cosine", "^img_")
+	ht.Put("idx", ix)
+	ht.Put("img_1", New([]float32{1, 0}))
+	ht.Put("img_2", New([]float32{0, 1}))
+	ht.Put("img_3", New([]float32{1, 1, 1})) // Wrong dimension, not indexed
+	ht.Put("txt_1", New([]float32{1, 0}))    // Not covered by the pattern
+
+	indexes := Rebuild(ht)
+	if len(indexes) != 1 || indexes["idx"] != ix {
+		t.Fatalf("Expected the stored index, got %v", indexes)
+	}
+
+	results, _ := ix.Exact(ht, []float32{1, 0.1}, 10)
+	if len(results) != 2 || results[0].Key != "img_1" {
+		t.Errorf("Unexpected results %+v", results)
+	}
+
+	if _, err := LoadIndex(ht, "img_1"); err == nil {
+		t.Error("Expected wrong type error")
+	}
+}
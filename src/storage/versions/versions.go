@@ -0,0 +1,208 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package versions
+
+// Old values of keys kept for point-in-time reads
+// Rules select the keys that keep versions by pattern and how many versions or for how long they are kept.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule keeps versions of the keys matching a pattern
+type Rule struct {
+	Pattern   string         `yaml:"pattern"`   // Regular expression keys are matched against
+	Count     int            `yaml:"count"`     // Versions kept including the current value, 0 for no limit
+	Retention time.Duration  `yaml:"retention"` // How long replaced versions are kept, 0 for no limit
+	re        *regexp.Regexp // The compiled pattern
+}
+
+// Version is a value of a key and when it was written
+type Version struct {
+	Value     string    // The value
+	Timestamp time.Time // When the value was written or the key deleted
+	Deleted   bool      // Whether the key was deleted
+}
+
+// History holds the versions of the keys matching its rules
+type History struct {
+	rules    []*Rule
+	versions map[string][]Version // Versions of each key ordered oldest first
+}
+
+// New creates a history for the given rules, the first rule matching a key applies
+func New(rules []*Rule) (*History, error) {
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version pattern %s", rule.Pattern)
+		}
+
+		if rule.Count < 0 || rule.Retention < 0 {
+			return nil, fmt.Errorf("invalid version limits for %s", rule.Pattern)
+		}
+
+		rule.re = re
+	}
+
+	return &History{rules: rules, versions: make(map[string][]Version)}, nil
+}
+
+// Rule returns the rule applying to a key, nil if the key does not keep versions
+func (h *History) Rule(key string) *Rule {
+	for _, rule := range h.rules {
+		if rule.re.MatchString(key) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// Len returns the number of keys with versions
+func (h *History) Len() int {
+	return len(h.versions)
+}
+
+// Keys returns the keys with versions, sorted
+func (h *History) Keys() []string {
+	keys := make([]string, 0, len(h.versions))
+	for key := range h.versions {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Record adds a version of a key if a rule applies to it and drops the versions past the rule limits
+// Returns false if the key does not keep versions
+func (h *History) Record(key string, v Version, now time.Time) bool {
+	rule := h.Rule(key)
+	if rule == nil {
+		return false
+	}
+
+	versions := h.versions[key]
+
+	// Versions replayed from the journal may arrive slightly out of order
+	i := sort.Search(len(versions), func(i int) bool { return v.Timestamp.Before(versions[i].Timestamp) })
+	versions = append(versions, Version{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = v
+
+	versions = rule.keep(versions, now)
+	if len(versions) == 1 && versions[0].Deleted {
+		// Nothing is left to read before the deletion
+		delete(h.versions, key)
+		return true
+	}
+
+	h.versions[key] = versions
+	return true
+}
+
+// Versions returns the versions of a key within the rule limits, newest first
+func (h *History) Versions(key string, now time.Time) []Version {
+	rule := h.Rule(key)
+	if rule == nil {
+		return nil
+	}
+
+	kept := rule.keep(h.versions[key], now)
+
+	versions := make([]Version, len(kept))
+	for i, v := range kept {
+		versions[len(kept)-1-i] = v
+	}
+	return versions
+}
+
+// At returns the version of a key that was current at the given time
+// Returns false if the key keeps no version that old or was deleted at that time
+func (h *History) At(key string, at, now time.Time) (Version, bool) {
+	for _, v := range h.Versions(key, now) {
+		if v.Timestamp.After(at) {
+			continue
+		}
+		return v, !v.Deleted
+	}
+	return Version{}, false
+}
+
+// keep returns the versions within the rule limits, the newest version is always kept
+func (r *Rule) keep(versions []Version, now time.Time) []Version {
+	start := 0
+	if r.Count > 0 && len(versions) > r.Count {
+		start = len(versions) - r.Count
+	}
+
+	if r.Retention > 0 {
+		cutoff := now.Add(-r.Retention)
+		for start < len(versions)-1 && versions[start+1].Timestamp.Before(cutoff) {
+			// A version is kept while it was replaced within the retention window
+			start++
+		}
+	}
+
+	return versions[start:]
+}
+
+// String returns the version in <timestamp> PUT <value> or <timestamp> DEL format
+func (v Version) String() string {
+	if v.Deleted {
+		return fmt.Sprintf("%s DEL", v.Timestamp.Format(time.RFC3339Nano))
+	}
+	return fmt.Sprintf("%s PUT %s", v.Timestamp.Format(time.RFC3339Nano), v.Value)
+}
+
+// Parse parses a version in the format returned by String
+func Parse(s string) (Version, error) {
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) < 2 {
+		return Version{}, fmt.Errorf("invalid version")
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return Version{}, fmt.Errorf("invalid version")
+	}
+
+	switch {
+	case fields[1] == "DEL" && len(fields) == 2:
+		return Version{Timestamp: ts, Deleted: true}, nil
+	case fields[1] == "PUT" && len(fields) == 3:
+		return Version{Value: fields[2], Timestamp: ts}, nil
+	}
+
+	return Version{}, fmt.Errorf("invalid version")
+}
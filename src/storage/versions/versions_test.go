@@ -0,0 +1,151 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package versions
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordCount(t *testing.T) {
+	h, err := New([]*Rule{{Pattern: "^config:", Count: 3}})
+	if err != nil {
+		t.Fatalf("Failed to create history: %v", err)
+	}
+
+	now := time.Unix(1000, 0)
+	for i, value := range []string{"a", "b", "c", "d"} {
+		h.Record("config:x", Version{Value: value, Timestamp: now.Add(time.Duration(i) * time.Second)}, now)
+	}
+
+	if h.Record("other", Version{Value: "a", Timestamp: now}, now) {
+		t.Error("Expected keys without a rule to keep no versions")
+	}
+
+	versions := h.Versions("config:x", now)
+	if len(versions) != 3 || versions[0].Value != "d" || versions[2].Value != "b" {
+		t.Fatalf("Expected versions d, c, b, got %+v", versions)
+	}
+
+	v, ok := h.At("config:x", now.Add(1500*time.Millisecond), now)
+	if !ok || v.Value != "b" {
+		t.Errorf("Expected b at 1.5s, got %+v", v)
+	}
+
+	// Versions older than the kept ones are gone
+	if _, ok = h.At("config:x", now, now); ok {
+		t.Error("Expected no version at 0s")
+	}
+
+	// Reading past a deletion finds nothing, reading before it the last value
+	h.Record("config:x", Version{Timestamp: now.Add(10 * time.Second), Deleted: true}, now)
+	if _, ok = h.At("config:x", now.Add(11*time.Second), now); ok {
+		t.Error("Expected deleted key at 11s")
+	}
+	if v, ok = h.At("config:x", now.Add(9*time.Second), now); !ok || v.Value != "d" {
+		t.Errorf("Expected d at 9s, got %+v", v)
+	}
+}
+
+func TestRecordRetention(t *testing.T) {
+	h, err := New([]*Rule{{Pattern: "^session:", Retention: time.Minute}})
+	if err != nil {
+		t.Fatalf("Failed to create history: %v", err)
+	}
+
+	start := time.Unix(1000, 0)
+	h.Record("session:1", Version{Value: "a", Timestamp: start}, start)
+	h.Record("session:1", Version{Value: "b", Timestamp: start.Add(30 * time.Second)}, start)
+	h.Record("session:1", Version{Value: "c", Timestamp: start.Add(90 * time.Second)}, start)
+
+	// a was replaced more than a minute ago, b was current within the last minute
+	versions := h.Versions("session:1", start.Add(100*time.Second))
+	if len(versions) != 2 || versions[1].Value != "b" {
+		t.Fatalf("Expected versions c, b, got %+v", versions)
+	}
+
+	// The current value is kept however old it is
+	versions = h.Versions("session:1", start.Add(time.Hour))
+	if len(versions) != 1 || versions[0].Value != "c" {
+		t.Fatalf("Expected version c, got %+v", versions)
+	}
+
+	// A deletion with nothing left before it drops the key
+	h.Record("session:2", Version{Timestamp: start, Deleted: true}, start)
+	if h.Len() != 1 {
+		t.Errorf("Expected 1 key with versions, got %d", h.Len())
+	}
+}
+
+func TestRecordOutOfOrder(t *testing.T) {
+	h, _ := New([]*Rule{{Pattern: "."}})
+
+	now := time.Unix(1000, 0)
+	h.Record("k", Version{Value: "new", Timestamp: now.Add(time.Second)}, now)
+	h.Record("k", Version{Value: "old", Timestamp: now}, now)
+
+	versions := h.Versions("k", now)
+	if len(versions) != 2 || versions[0].Value != "new" {
+		t.Errorf("Expected versions ordered newest first, got %+v", versions)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	h, _ := New([]*Rule{{Pattern: "^user:"}})
+
+	now := time.Unix(1000, 0)
+	h.Record("user:2", Version{Value: "b", Timestamp: now}, now)
+	h.Record("user:1", Version{Value: "a", Timestamp: now}, now)
+	h.Record("order:1", Version{Value: "c", Timestamp: now}, now)
+
+	if keys := h.Keys(); strings.Join(keys, ",") != "user:1,user:2" {
+		t.Errorf("Expected keys user:1,user:2, got %v", keys)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, v := range []Version{
+		{Value: "hello world", Timestamp: time.Unix(1000, 5).UTC()},
+		{Timestamp: time.Unix(2000, 0).UTC(), Deleted: true},
+	} {
+		parsed, err := Parse(v.String())
+		if err != nil || parsed != v {
+			t.Errorf("Expected %+v, got %+v (%v)", v, parsed, err)
+		}
+	}
+
+	if _, err := Parse("yesterday PUT x"); err == nil {
+		t.Error("Expected error for invalid timestamp")
+	}
+
+	if _, err := New([]*Rule{{Pattern: "("}}); err == nil {
+		t.Error("Expected error for invalid pattern")
+	}
+}
@@ -0,0 +1,110 @@
+// BSD 3-Clause License
+//
+// (C) Copyright 2025, Alex Gaetano Padula & SuperMassive authors
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+//  1. Redistributions of source code must retain the above copyright notice, this
+//     list of conditions and the following disclaimer.
+//
+//  2. Redistributions in binary form must reproduce the above copyright notice,
+//     this list of conditions and the following disclaimer in the documentation
+//     and/or other materials provided with the distribution.
+//
+//  3. Neither the name of the copyright holder nor the names of its
+//     contributors may be used to endorse or promote products derived from
+//     this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package utility
+
+import (
+	"sync"
+	"time"
+)
+
+// Notifier wakes up goroutines waiting on a key
+// Used by blocking commands that wait for a key to be written to
+type Notifier struct {
+	waiters map[string]chan struct{} // Channels closed on the next notify for a key
+	lock    *sync.Mutex              // Lock for the waiters map
+}
+
+// NewNotifier creates a new notifier
+func NewNotifier() *Notifier {
+	return &Notifier{waiters: make(map[string]chan struct{}), lock: &sync.Mutex{}}
+}
+
+// Wait returns a channel that is closed the next time the key is notified
+func (n *Notifier) Wait(key string) <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	ch, ok := n.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[key] = ch
+	}
+
+	return ch
+}
+
+// Notify wakes up all goroutines waiting on the key
+func (n *Notifier) Notify(key string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if ch, ok := n.waiters[key]; ok {
+		close(ch)
+		delete(n.waiters, key)
+	}
+}
+
+// WaitAny blocks until one of the channels returned by Wait is closed, the timeout passes or done is closed
+// A timeout of 0 waits until woken or done.  Returns false on timeout or once done is closed
+// Channels should be gathered with Wait while the caller still holds its own lock so no notify is missed
+func WaitAny(channels []<-chan struct{}, timeout time.Duration, done <-chan struct{}) bool {
+	// We merge all the channels into one
+	woken := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for _, ch := range channels {
+		go func(ch <-chan struct{}) {
+			select {
+			case <-ch:
+				select {
+				case woken <- struct{}{}:
+				default:
+				}
+			case <-stop:
+			}
+		}(ch)
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case <-woken:
+		return true
+	case <-expired:
+		return false
+	case <-done:
+		return false
+	}
+}
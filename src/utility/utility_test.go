@@ -28,7 +28,10 @@
 // OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package utility
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestGetMaxMemory(t *testing.T) {
 	mem, err := GetMaxMemory()
@@ -40,3 +43,42 @@ func TestGetMaxMemory(t *testing.T) {
 		t.Error("Expected memory greater than 0")
 	}
 }
+
+func TestNotifier(t *testing.T) {
+	n := NewNotifier()
+
+	// Nothing notified, we should time out
+	if WaitAny([]<-chan struct{}{n.Wait("key1")}, 10*time.Millisecond, nil) {
+		t.Error("Expected wait to time out")
+	}
+
+	ch := n.Wait("key1")
+	other := n.Wait("key2")
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		n.Notify("key1")
+	}()
+
+	if !WaitAny([]<-chan struct{}{ch, other}, time.Second, nil) {
+		t.Error("Expected wait to be woken by notify")
+	}
+
+	// A notify before waiting must not be lost once the channel is obtained
+	ch = n.Wait("key2")
+	n.Notify("key2")
+	if !WaitAny([]<-chan struct{}{ch}, 10*time.Millisecond, nil) {
+		t.Error("Expected closed channel to wake the waiter")
+	}
+
+	// Closing done stops a wait without a timeout
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+	}()
+
+	if WaitAny([]<-chan struct{}{n.Wait("key3")}, 0, done) {
+		t.Error("Expected closing done to stop the wait")
+	}
+}